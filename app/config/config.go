@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -12,8 +13,15 @@ const configName = "goblocks"
 const filename = configName + ".yaml"
 
 type Config struct {
-	Http   Http
-	Blocks Blocks
+	Http            Http
+	Blocks          Blocks
+	Webhooks        []Webhook
+	WebhookDelivery WebhookDelivery `mapstructure:"webhook_delivery"`
+	Auth            Auth
+	Acl             []AclRule
+	Tenants         []Tenant
+	// Tenant is the name of the tenant the configuration applies to, empty for the shared one
+	Tenant string `mapstructure:"-"`
 }
 
 func defaultConfig() {
@@ -21,6 +29,21 @@ func defaultConfig() {
 	viper.SetDefault("http.port", 8000)
 	viper.SetDefault("http.max_upload_size", 10*1024*1024) // 10MB default
 	viper.SetDefault("blocks.storage.type", Fs)
+	viper.SetDefault("blocks.storage.gc_interval", time.Hour)
+	viper.SetDefault("blocks.events.history", 1000)
+	viper.SetDefault("blocks.expiry.reap_interval", time.Minute)
+	// Known keys can be set from the environment, such as AUTH_JWT_SECRET
+	viper.SetDefault("auth.anonymous", "")
+	viper.SetDefault("auth.jwt.secret", "")
+	viper.SetDefault("auth.jwt.issuer", "")
+	viper.SetDefault("auth.jwt.audience", "")
+	viper.SetDefault("auth.signed_urls.secret", "")
+	viper.SetDefault("auth.signed_urls.ttl", 15*time.Minute)
+	viper.SetDefault("auth.signed_urls.max_ttl", 24*time.Hour)
+	viper.SetDefault("webhook_delivery.queue", "./webhooks.json")
+	viper.SetDefault("webhook_delivery.max_attempts", 8)
+	viper.SetDefault("webhook_delivery.backoff", time.Second)
+	viper.SetDefault("webhook_delivery.timeout", 10*time.Second)
 }
 
 type Http struct {
@@ -33,7 +56,113 @@ type Blocks struct {
 	Storage struct {
 		Type StorageType
 		Path string
+		S3   S3
+		// GcInterval is the delay between two collections of the unreferenced contents, 0 disables them
+		GcInterval time.Duration `mapstructure:"gc_interval"`
 	}
+	Events struct {
+		// History is the number of recent events kept to resume change feeds
+		History int
+	}
+	Expiry struct {
+		// ReapInterval is the delay between two purges of the expired blocks, 0 disables them
+		ReapInterval time.Duration `mapstructure:"reap_interval"`
+	}
+	Quotas []Quota
+}
+
+// Quota bounds the current contents stored under a path, the whole tree when empty
+type Quota struct {
+	Path string
+	// MaxBytes bounds their total size and MaxBlocks their number, 0 meaning unlimited
+	MaxBytes  int64 `mapstructure:"max_bytes"`
+	MaxBlocks int64 `mapstructure:"max_blocks"`
+}
+
+// S3 locates the bucket of the s3 storage, credentials fall back to the AWS default chain when AccessKey is empty
+type S3 struct {
+	// Endpoint is only needed by S3-compatible services such as MinIO
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	// PathStyle addresses the bucket in the path instead of the host name
+	PathStyle bool `mapstructure:"path_style"`
+}
+
+type Webhook struct {
+	Url string
+	// Prefix restricts the webhook to the blocks under a path
+	Prefix string
+	// Events restricts the webhook to some event types, all of them when empty
+	Events []string
+	// Secret signs the payloads in the X-Goblocks-Signature header
+	Secret string
+}
+
+type WebhookDelivery struct {
+	// Queue is the file keeping pending deliveries across restarts, nothing is kept when empty
+	Queue       string
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// Backoff is the delay before the first retry, doubled after every failed attempt
+	Backoff time.Duration
+	Timeout time.Duration
+}
+
+type Auth struct {
+	// Anonymous is what requests without credentials may do, full access when empty
+	// and no api key nor jwt secret is configured, no access otherwise
+	Anonymous AnonymousAccess
+	ApiKeys   []ApiKey `mapstructure:"api_keys"`
+	Jwt       Jwt
+	// SignedUrls issues urls granting a single request on a block without credentials
+	SignedUrls SignedUrls `mapstructure:"signed_urls"`
+}
+
+type AnonymousAccess string
+
+const AnonymousNone AnonymousAccess = "none"
+const AnonymousRead AnonymousAccess = "read"
+const AnonymousWrite AnonymousAccess = "write"
+
+// ApiKey is a static key sent in the X-Api-Key header
+type ApiKey struct {
+	// Name identifies the principal using the key
+	Name string
+	// Hash is the hex encoded SHA-256 of the key, which is never configured in clear
+	Hash     string
+	Groups   []string
+	ReadOnly bool `mapstructure:"read_only"`
+}
+
+// Jwt verifies the HMAC signed bearer tokens, they are rejected when Secret is empty
+type Jwt struct {
+	Secret string
+	// Issuer and Audience are the required iss and aud claims, not checked when empty
+	Issuer   string
+	Audience string
+}
+
+// SignedUrls signs the urls with Secret, or with a random secret invalidating them at every restart when empty
+type SignedUrls struct {
+	Secret string
+	// Ttl is the lifetime of the urls issued without one, MaxTtl bounds the requested ones
+	Ttl    time.Duration
+	MaxTtl time.Duration `mapstructure:"max_ttl"`
+}
+
+// AclRule grants or denies permissions on a subtree to principals and groups
+type AclRule struct {
+	// Path is the block the rule applies to along with its descendants, empty for the whole tree
+	Path string
+	// Principals are api key names or jwt subjects, "*" matching everyone including anonymous requests
+	Principals []string
+	Groups     []string
+	// Allow and Deny hold "read", "write", "delete" or "admin", which implies the others
+	Allow []string
+	Deny  []string
 }
 
 type StorageType string
@@ -41,6 +170,15 @@ type StorageType string
 const Fs StorageType = "fs"
 const InMemory StorageType = "inMemory"
 
+// Bolt stores every block in the single bbolt file at Storage.Path
+const Bolt StorageType = "bolt"
+
+// Sqlite stores every block in the SQLite database at Storage.Path
+const Sqlite StorageType = "sqlite"
+
+// S3Storage stores every block as objects of the bucket configured in Storage.S3
+const S3Storage StorageType = "s3"
+
 func (h *Config) HttpHostAndPort() string {
 	return fmt.Sprintf("%s:%d", h.Http.Host, h.Http.Port)
 }
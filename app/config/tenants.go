@@ -0,0 +1,66 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+)
+
+var ErrInvalidTenant = errors.New("Invalid Tenant")
+
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Tenant serves its own blocks from its own storage, to the requests under /t/{name}/ or the ones it selects
+type Tenant struct {
+	// Name is made of lowercase letters, digits, - and _
+	Name string
+	// Hosts select the tenant by the Host header of the requests, port excluded
+	Hosts []string
+	// Principals and Groups select the tenant of the requests they send, which may use no other tenant
+	Principals []string
+	Groups     []string
+	// Config overrides keys of the configuration for the tenant, such as blocks.storage, acl or webhooks
+	Config map[string]any
+}
+
+// ForTenant returns the configuration of a tenant, made of this one with the overrides of the tenant.
+// The storage path and the webhook queue of the tenant default to ones of its own next to the shared ones.
+func (c *Config) ForTenant(t Tenant) (*Config, error) {
+	if !tenantName.MatchString(t.Name) {
+		return nil, errors.Join(fmt.Errorf("tenant %q: names are made of lowercase letters, digits, - and _", t.Name), ErrInvalidTenant)
+	}
+
+	overrides := viper.New()
+	if err := overrides.MergeConfigMap(t.Config); err != nil {
+		return nil, errors.Join(fmt.Errorf("tenant %s: %w", t.Name, err), ErrInvalidTenant)
+	}
+	cfg := *c
+	cfg.Tenants = nil
+	// Slices are replaced, instead of overwritten in place where they are shared with this configuration
+	err := overrides.Unmarshal(&cfg, func(dc *mapstructure.DecoderConfig) { dc.ZeroFields = true })
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("tenant %s: %w", t.Name, err), ErrInvalidTenant)
+	}
+	cfg.Tenant = t.Name
+
+	storage := &cfg.Blocks.Storage
+	if storage.Type != InMemory && storage.Type != S3Storage && storage.Path == c.Blocks.Storage.Path {
+		storage.Path = tenantPath(storage.Path, t.Name)
+	}
+	if cfg.WebhookDelivery.Queue != "" && cfg.WebhookDelivery.Queue == c.WebhookDelivery.Queue {
+		cfg.WebhookDelivery.Queue = tenantPath(cfg.WebhookDelivery.Queue, t.Name)
+	}
+	return &cfg, nil
+}
+
+// tenantPath inserts the name of a tenant in a file or directory path, ./data/ giving data.name and blocks.db blocks.name.db
+func tenantPath(path string, name string) string {
+	path = filepath.Clean(path)
+	extension := filepath.Ext(path)
+	return strings.TrimSuffix(path, extension) + "." + name + extension
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"slices"
+	"strings"
+)
+
+type Permission string
+
+const Read Permission = "read"
+const Write Permission = "write"
+const Delete Permission = "delete"
+
+// Admin implies every other permission
+const Admin Permission = "admin"
+
+var Permissions = []Permission{Read, Write, Delete, Admin}
+
+var ErrInvalidAcl = errors.New("Invalid ACL")
+
+// EveryonePrincipal matches every principal of a rule, anonymous ones included
+const EveryonePrincipal = "*"
+
+// Policy decides the permissions of principals from ACL rules. Without rules everything is allowed,
+// otherwise a permission is denied unless a rule grants it.
+type Policy struct {
+	rules []config.AclRule
+}
+
+// Decision tells whether a principal has a permission on a path and which rule decided it
+type Decision struct {
+	Permission Permission `json:"permission"`
+	Allowed    bool       `json:"allowed"`
+	// Rule is the path of the deciding rule, only set when Matched
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	// Inherited tells the rule applies to an ancestor of the path
+	Inherited bool `json:"inherited,omitempty"`
+}
+
+func NewPolicy(c *config.Config) (*Policy, error) {
+	rules := []config.AclRule{}
+	for i, rule := range c.Acl {
+		for _, permission := range slices.Concat(rule.Allow, rule.Deny) {
+			if !slices.Contains(Permissions, Permission(permission)) {
+				return nil, errors.Join(fmt.Errorf("acl rule %d: unknown permission %q", i, permission), ErrInvalidAcl)
+			}
+		}
+		rule.Path = strings.Trim(rule.Path, "/")
+		rules = append(rules, rule)
+	}
+	return &Policy{rules}, nil
+}
+
+// Check returns ErrForbidden unless the principal has the permission on the path
+func (p *Policy) Check(principal Principal, path string, permission Permission) error {
+	if !p.Decide(principal, path, permission).Allowed {
+		return blocks.ErrForbidden
+	}
+	return nil
+}
+
+// CheckTree returns ErrForbidden unless the principal has the permission on the path and on every
+// block below it, as needed by the operations applying to a whole subtree
+func (p *Policy) CheckTree(principal Principal, path string, permission Permission) error {
+	if err := p.Check(principal, path, permission); err != nil {
+		return err
+	}
+	// Decisions can only change below the path where a rule applies
+	for _, rule := range p.rules {
+		if rule.Path != path && isUnder(rule.Path, path) {
+			if err := p.Check(principal, rule.Path, permission); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decide applies the deepest rule of the principal granting or denying the permission on the path
+// or one of its ancestors. At the same depth the rules naming the principal or one of its groups win
+// over the ones for everyone, then a deny wins over an allow.
+func (p *Policy) Decide(principal Principal, path string, permission Permission) Decision {
+	// A signed url only grants the request it signs, which the controllers verify instead
+	if principal.Method == MethodSignedUrl {
+		return Decision{Permission: permission}
+	}
+	decision := Decision{Permission: permission, Allowed: len(p.rules) == 0}
+	precedence := -1
+	for _, rule := range p.rules {
+		if !isUnder(path, rule.Path) {
+			continue
+		}
+		applies, named := appliesTo(rule, principal)
+		if !applies {
+			continue
+		}
+		denies := slices.Contains(rule.Deny, string(permission))
+		allows := slices.Contains(rule.Allow, string(permission)) || slices.Contains(rule.Allow, string(Admin))
+		if !denies && !allows {
+			continue
+		}
+		rulePrecedence := pathDepth(rule.Path) * 2
+		if named {
+			rulePrecedence++
+		}
+		if rulePrecedence > precedence || (rulePrecedence == precedence && denies) {
+			precedence = rulePrecedence
+			decision.Allowed = !denies
+			decision.Rule = rule.Path
+			decision.Matched = true
+			decision.Inherited = rule.Path != path
+		}
+	}
+	return decision
+}
+
+// Explain decides every permission of the principal on the path
+func (p *Policy) Explain(principal Principal, path string) []Decision {
+	decisions := []Decision{}
+	for _, permission := range Permissions {
+		decisions = append(decisions, p.Decide(principal, path, permission))
+	}
+	return decisions
+}
+
+// appliesTo reports whether a rule applies to a principal, and whether it names the principal or one of its groups
+func appliesTo(rule config.AclRule, principal Principal) (bool, bool) {
+	if principal.ID != "" && !principal.Anonymous() && slices.Contains(rule.Principals, principal.ID) {
+		return true, true
+	}
+	for _, group := range principal.Groups {
+		if slices.Contains(rule.Groups, group) {
+			return true, true
+		}
+	}
+	return slices.Contains(rule.Principals, EveryonePrincipal), false
+}
+
+// isUnder reports whether path is ancestor or one of its descendants
+func isUnder(path string, ancestor string) bool {
+	return ancestor == "" || path == ancestor || strings.HasPrefix(path, ancestor+"/")
+}
+
+func pathDepth(path string) int {
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, "/") + 1
+}
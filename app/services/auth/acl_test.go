@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"errors"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := NewPolicy(&config.Config{Acl: []config.AclRule{
+		{Path: "", Principals: []string{"*"}, Allow: []string{"read"}},
+		{Path: "marketing/", Groups: []string{"marketing"}, Allow: []string{"read", "write", "delete"}},
+		{Path: "legal", Groups: []string{"legal"}, Allow: []string{"admin"}},
+		{Path: "legal", Principals: []string{"*"}, Deny: []string{"read"}},
+		{Path: "legal", Groups: []string{"legal"}, Deny: []string{"write"}},
+		{Path: "legal/contracts/signed", Groups: []string{"legal"}, Deny: []string{"delete", "write"}},
+		{Path: "legal/public", Principals: []string{"*"}, Allow: []string{"read"}},
+	}})
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+	anonymous := Principal{Method: MethodAnonymous}
+	marketer := Principal{ID: "ada", Groups: []string{"marketing"}, Method: MethodJwt}
+	lawyer := Principal{ID: "grace", Groups: []string{"legal"}, Method: MethodJwt}
+
+	tests := []struct {
+		name       string
+		principal  Principal
+		path       string
+		permission Permission
+		expected   bool
+	}{
+		{name: "everyone reads", principal: anonymous, path: "docs/guide", permission: Read, expected: true},
+		{name: "nobody writes by default", principal: anonymous, path: "docs/guide", permission: Write},
+		{name: "group writes its subtree", principal: marketer, path: "marketing/launch", permission: Write, expected: true},
+		{name: "group only writes its subtree", principal: marketer, path: "marketingx", permission: Write},
+		{name: "explicit deny wins over an inherited allow", principal: marketer, path: "legal/nda", permission: Read},
+		{name: "named rule wins at the same depth", principal: lawyer, path: "legal/nda", permission: Read, expected: true},
+		{name: "deny wins at the same depth", principal: lawyer, path: "legal/nda", permission: Write},
+		{name: "admin implies delete", principal: lawyer, path: "legal/nda", permission: Delete, expected: true},
+		{name: "deeper deny", principal: lawyer, path: "legal/contracts/signed/2024", permission: Delete},
+		{name: "deeper allow", principal: anonymous, path: "legal/public/terms", permission: Read, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.principal, tt.path, tt.permission)
+			if allowed := err == nil; allowed != tt.expected {
+				t.Errorf("Check(%s, %s) = %v, want allowed %v", tt.path, tt.permission, err, tt.expected)
+			}
+			if err != nil && !errors.Is(err, blocks.ErrForbidden) {
+				t.Errorf("Check() error = %v, want ErrForbidden", err)
+			}
+		})
+	}
+
+	// Deleting legal would delete the signed contracts
+	if err := policy.CheckTree(lawyer, "legal", Delete); !errors.Is(err, blocks.ErrForbidden) {
+		t.Errorf("CheckTree(legal, delete) error = %v, want ErrForbidden", err)
+	}
+	if err := policy.CheckTree(lawyer, "legal/nda", Delete); err != nil {
+		t.Errorf("CheckTree(legal/nda, delete) error = %v", err)
+	}
+
+	decision := policy.Decide(lawyer, "legal/contracts/signed/2024", Delete)
+	if decision.Allowed || !decision.Matched || decision.Rule != "legal/contracts/signed" || !decision.Inherited {
+		t.Errorf("Decide() = %+v, want denied by the inherited legal/contracts/signed rule", decision)
+	}
+}
+
+func TestPolicy_WithoutRules(t *testing.T) {
+	policy, _ := NewPolicy(&config.Config{})
+	if err := policy.CheckTree(Principal{Method: MethodAnonymous}, "", Admin); err != nil {
+		t.Errorf("Check() without rules error = %v, want everything allowed", err)
+	}
+	if _, err := NewPolicy(&config.Config{Acl: []config.AclRule{{Allow: []string{"own"}}}}); !errors.Is(err, ErrInvalidAcl) {
+		t.Errorf("NewPolicy() with an unknown permission error = %v, want ErrInvalidAcl", err)
+	}
+}
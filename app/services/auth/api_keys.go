@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"goblocks/app/config"
+	"net/http"
+	"strings"
+)
+
+// ApiKeyHeader carries the static api key of a request
+const ApiKeyHeader = "X-Api-Key"
+
+type apiKeys struct {
+	keys []config.ApiKey
+}
+
+// NewApiKeys authenticates the requests sending one of the keys in the X-Api-Key header
+func NewApiKeys(keys []config.ApiKey) Authenticator {
+	return &apiKeys{keys}
+}
+
+func (a *apiKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get(ApiKeyHeader)
+	if key == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	hash := HashApiKey(key)
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(k.Hash))) == 1 {
+			return Principal{ID: k.Name, Groups: k.Groups, Method: MethodApiKey, ReadOnly: k.ReadOnly}, nil
+		}
+	}
+	return Principal{}, ErrInvalidCredentials
+}
+
+// HashApiKey returns the hex encoded SHA-256 of a key, as configured in api_keys
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
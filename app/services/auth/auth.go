@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"goblocks/app/config"
+	"net/http"
+)
+
+const MethodApiKey = "api_key"
+const MethodJwt = "jwt"
+const MethodAnonymous = "anonymous"
+
+var ErrNoCredentials = errors.New("No Credentials")
+var ErrInvalidCredentials = errors.New("Invalid Credentials")
+var ErrReadOnly = errors.New("Read Only")
+
+// Principal is who sends a request
+type Principal struct {
+	// ID is the api key name or the jwt subject, empty for anonymous requests
+	ID     string   `json:"id,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Method tells how the principal authenticated
+	Method string `json:"method"`
+	// ReadOnly principals may only send GET, HEAD and OPTIONS requests
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+func (p Principal) Anonymous() bool {
+	return p.Method == MethodAnonymous
+}
+
+// Allows reports whether the principal may send a request with this method
+func (p Principal) Allows(method string) bool {
+	if !p.ReadOnly {
+		return true
+	}
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Authenticator finds the principal of a request. It returns ErrNoCredentials when the request
+// carries none of the credentials it understands, so that the next authenticator is tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+type AuthenticatorFunc func(r *http.Request) (Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+// Chain tries authenticators in order until one finds credentials, invalid ones not falling through
+func Chain(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(r)
+			if !errors.Is(err, ErrNoCredentials) {
+				return principal, err
+			}
+		}
+		return Principal{}, ErrNoCredentials
+	})
+}
+
+// Anonymous authenticates every request as an anonymous principal
+func Anonymous(readOnly bool) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		return Principal{Method: MethodAnonymous, ReadOnly: readOnly}, nil
+	})
+}
+
+// NewAuthenticator chains the signed urls, the api keys, the jwt and the anonymous access of the configuration
+func NewAuthenticator(c *config.Config) Authenticator {
+	authenticators := []Authenticator{}
+	if len(c.Auth.ApiKeys) > 0 {
+		authenticators = append(authenticators, NewApiKeys(c.Auth.ApiKeys))
+	}
+	if c.Auth.Jwt.Secret != "" {
+		authenticators = append(authenticators, NewJwt(c.Auth.Jwt))
+	}
+
+	anonymous := c.Auth.Anonymous
+	if anonymous == "" {
+		anonymous = config.AnonymousNone
+		if len(authenticators) == 0 {
+			anonymous = config.AnonymousWrite
+		}
+	}
+	switch anonymous {
+	case config.AnonymousRead:
+		authenticators = append(authenticators, Anonymous(true))
+	case config.AnonymousWrite:
+		authenticators = append(authenticators, Anonymous(false))
+	}
+	return Chain(append([]Authenticator{SignedUrls()}, authenticators...)...)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal of a request
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal of a request, false when it was not authenticated
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"goblocks/app/config"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiKeys(t *testing.T) {
+	authenticator := NewApiKeys([]config.ApiKey{
+		{Name: "ci", Hash: HashApiKey("secret"), Groups: []string{"builders"}},
+		{Name: "viewer", Hash: HashApiKey("viewer-secret"), ReadOnly: true},
+	})
+
+	tests := []struct {
+		name          string
+		key           string
+		expectedID    string
+		expectedError error
+	}{
+		{name: "no key", expectedError: ErrNoCredentials},
+		{name: "valid key", key: "secret", expectedID: "ci"},
+		{name: "read only key", key: "viewer-secret", expectedID: "viewer"},
+		{name: "unknown key", key: "guess", expectedError: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/", nil)
+			if tt.key != "" {
+				req.Header.Set(ApiKeyHeader, tt.key)
+			}
+			principal, err := authenticator.Authenticate(req)
+			if !errors.Is(err, tt.expectedError) || principal.ID != tt.expectedID {
+				t.Errorf("Authenticate() = %+v, %v, want %q and %v", principal, err, tt.expectedID, tt.expectedError)
+			}
+			if err == nil && principal.Method != MethodApiKey {
+				t.Errorf("Method = %q, want %q", principal.Method, MethodApiKey)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	keys := []config.ApiKey{{Name: "ci", Hash: HashApiKey("secret")}}
+
+	tests := []struct {
+		name             string
+		auth             config.Auth
+		key              string
+		expectedMethod   string
+		expectedReadOnly bool
+		expectedError    error
+	}{
+		{name: "nothing configured", expectedMethod: MethodAnonymous},
+		{name: "anonymous read", auth: config.Auth{Anonymous: config.AnonymousRead}, expectedMethod: MethodAnonymous, expectedReadOnly: true},
+		{name: "credentials required", auth: config.Auth{ApiKeys: keys}, expectedError: ErrNoCredentials},
+		{name: "api key", auth: config.Auth{ApiKeys: keys}, key: "secret", expectedMethod: MethodApiKey},
+		{name: "anonymous read with keys", auth: config.Auth{ApiKeys: keys, Anonymous: config.AnonymousRead}, expectedMethod: MethodAnonymous, expectedReadOnly: true},
+		// Invalid credentials never fall back to the anonymous access
+		{name: "invalid key", auth: config.Auth{ApiKeys: keys, Anonymous: config.AnonymousWrite}, key: "guess", expectedError: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/", nil)
+			if tt.key != "" {
+				req.Header.Set(ApiKeyHeader, tt.key)
+			}
+			principal, err := NewAuthenticator(&config.Config{Auth: tt.auth}).Authenticate(req)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.expectedError)
+			}
+			if principal.Method != tt.expectedMethod || principal.ReadOnly != tt.expectedReadOnly {
+				t.Errorf("Authenticate() = %+v, want %q read only %v", principal, tt.expectedMethod, tt.expectedReadOnly)
+			}
+		})
+	}
+}
+
+func TestPrincipal_Allows(t *testing.T) {
+	readOnly := Principal{Method: MethodAnonymous, ReadOnly: true}
+	if !readOnly.Allows("GET") || !readOnly.Allows("HEAD") || readOnly.Allows("PUT") || readOnly.Allows("DELETE") {
+		t.Error("a read only principal should only be allowed safe methods")
+	}
+	if !(Principal{Method: MethodApiKey}).Allows("DELETE") {
+		t.Error("a principal should be allowed every method")
+	}
+}
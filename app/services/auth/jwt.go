@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"goblocks/app/config"
+	"hash"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JwtLeeway tolerates the clock skew between the issuer and goblocks
+const JwtLeeway = time.Minute
+
+type jwt struct {
+	config config.Jwt
+	now    func() time.Time
+}
+
+// NewJwt authenticates the requests sending an HS256, HS384 or HS512 signed JWT as a bearer token.
+// The token must expire, and its sub claim is the principal with the groups of its groups claim.
+func NewJwt(c config.Jwt) Authenticator {
+	return &jwt{c, time.Now}
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Groups    []string `json:"groups"`
+}
+
+// audience is the aud claim, a single string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (j *jwt) Authenticate(r *http.Request) (Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return Principal{}, ErrNoCredentials
+	}
+	claims, err := j.verify(strings.TrimSpace(token))
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{ID: claims.Subject, Groups: claims.Groups, Method: MethodJwt}, nil
+}
+
+// verify checks the signature and the claims of a token
+func (j *jwt) verify(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	newHash := jwtAlgorithm(header.Algorithm)
+	if newHash == nil {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	mac := hmac.New(newHash, []byte(j.config.Secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+
+	var claims jwtClaims
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	now := j.now()
+	if claims.Subject == "" || claims.ExpiresAt == nil || now.After(numericDate(*claims.ExpiresAt).Add(JwtLeeway)) {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	if claims.NotBefore != nil && now.Add(JwtLeeway).Before(numericDate(*claims.NotBefore)) {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	if j.config.Issuer != "" && claims.Issuer != j.config.Issuer {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	if j.config.Audience != "" && !slices.Contains(claims.Audience, j.config.Audience) {
+		return jwtClaims{}, ErrInvalidCredentials
+	}
+	return claims, nil
+}
+
+// jwtAlgorithm returns the hash of a supported signing algorithm, nil for the others and "none"
+func jwtAlgorithm(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "HS256":
+		return sha256.New
+	case "HS384":
+		return sha512.New384
+	case "HS512":
+		return sha512.New
+	}
+	return nil
+}
+
+func decodeJwtPart(part string, v any) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// numericDate converts the seconds since the epoch of a jwt claim
+func numericDate(seconds float64) time.Time {
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*float64(time.Second)))
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"goblocks/app/config"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// signJwt builds a token signed with HMAC-SHA256, whatever algorithm its header claims
+func signJwt(secret string, algorithm string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJwt(t *testing.T) {
+	now := time.Now()
+	authenticator := &jwt{config.Jwt{Secret: "secret", Issuer: "https://id.internal", Audience: "goblocks"}, func() time.Time { return now }}
+	claims := func(changes map[string]any) map[string]any {
+		claims := map[string]any{
+			"sub":    "ada",
+			"iss":    "https://id.internal",
+			"aud":    []string{"wiki", "goblocks"},
+			"exp":    now.Add(time.Hour).Unix(),
+			"groups": []string{"legal"},
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(claims, key)
+				continue
+			}
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		expectedError error
+	}{
+		{name: "valid", authorization: "Bearer " + signJwt("secret", "HS256", claims(nil))},
+		{name: "single audience", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"aud": "goblocks"}))},
+		{name: "no token", expectedError: ErrNoCredentials},
+		{name: "basic auth", authorization: "Basic YWRhOnNlY3JldA==", expectedError: ErrNoCredentials},
+		{name: "malformed", authorization: "Bearer not-a-jwt", expectedError: ErrInvalidCredentials},
+		{name: "wrong secret", authorization: "Bearer " + signJwt("guess", "HS256", claims(nil)), expectedError: ErrInvalidCredentials},
+		{name: "none algorithm", authorization: "Bearer " + signJwt("secret", "none", claims(nil)), expectedError: ErrInvalidCredentials},
+		{name: "expired", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})), expectedError: ErrInvalidCredentials},
+		{name: "no expiry", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"exp": nil})), expectedError: ErrInvalidCredentials},
+		{name: "not yet valid", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), expectedError: ErrInvalidCredentials},
+		{name: "other issuer", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"iss": "https://evil"})), expectedError: ErrInvalidCredentials},
+		{name: "other audience", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"aud": "wiki"})), expectedError: ErrInvalidCredentials},
+		{name: "no subject", authorization: "Bearer " + signJwt("secret", "HS256", claims(map[string]any{"sub": nil})), expectedError: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			principal, err := authenticator.Authenticate(req)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.expectedError)
+			}
+			if err == nil && (principal.ID != "ada" || principal.Method != MethodJwt || !slices.Equal(principal.Groups, []string{"legal"})) {
+				t.Errorf("Authenticate() = %+v, want ada of the legal group", principal)
+			}
+		})
+	}
+}
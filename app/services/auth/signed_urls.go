@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const MethodSignedUrl = "signed_url"
+
+// SignatureParam is the query parameter carrying the signature of a pre-signed url
+const SignatureParam = "signature"
+
+var ErrInvalidSignature = errors.New("Invalid Signature")
+var ErrSignatureExpired = errors.New("Signature Expired")
+var ErrInvalidSignedUrl = errors.New("Invalid Signed Url")
+
+// SignedUrl grants a single request on a block to whoever holds the url, until it expires
+type SignedUrl struct {
+	// Method is GET for downloading the raw content of the block or PUT for uploading it
+	Method    string
+	Path      string
+	ExpiresAt time.Time
+	// ContentType is the only content type an upload may send, any when empty
+	ContentType string
+	// MaxSize bounds the size of an upload, only the configured maximum applies when 0
+	MaxSize int64
+	// Issuer is the principal who issued the url, recorded as the author of the uploads
+	Issuer string
+}
+
+// Signer issues and verifies the HMAC-SHA256 signed urls of the blocks of a tenant
+type Signer struct {
+	secret []byte
+	tenant string
+	now    func() time.Time
+}
+
+// NewSigner signs the urls with the configured secret, or with a random one when it is empty
+// so that the urls are only valid until the next restart
+func NewSigner(c *config.Config) (*Signer, error) {
+	secret := []byte(c.Auth.SignedUrls.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Signer{secret, c.Tenant, time.Now}, nil
+}
+
+// Signed reports whether a request is sent to a pre-signed url, which must be verified in place of credentials
+func Signed(r *http.Request) bool {
+	return r.URL.Query().Has(SignatureParam)
+}
+
+// SignedUrls authenticates the requests sent to pre-signed urls, whose signature is only verified
+// by the controllers serving them. The policy grants no permission to these principals.
+func SignedUrls() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		if !Signed(r) {
+			return Principal{}, ErrNoCredentials
+		}
+		return Principal{Method: MethodSignedUrl}, nil
+	})
+}
+
+// Sign returns the path and query of a signed url, relative to the root of the server, under /t/{tenant}/
+// for the blocks of a tenant
+func (s *Signer) Sign(u SignedUrl) (string, error) {
+	if u.Method != http.MethodGet && u.Method != http.MethodPut {
+		return "", ErrInvalidSignedUrl
+	}
+	if u.MaxSize < 0 {
+		return "", ErrInvalidSignedUrl
+	}
+	if u.ContentType != "" {
+		if err := blocks.ValidateContentType(u.ContentType); err != nil {
+			return "", err
+		}
+	}
+
+	query := url.Values{}
+	if u.Method == http.MethodGet {
+		query.Set("raw", "")
+	}
+	query.Set("method", u.Method)
+	query.Set("expires", strconv.FormatInt(u.ExpiresAt.Unix(), 10))
+	if u.ContentType != "" {
+		query.Set("content_type", u.ContentType)
+	}
+	if u.MaxSize > 0 {
+		query.Set("max_size", strconv.FormatInt(u.MaxSize, 10))
+	}
+	if u.Issuer != "" {
+		query.Set("issuer", u.Issuer)
+	}
+	query.Set(SignatureParam, s.signature(u.Method, u.Path, query))
+
+	signed := url.URL{Path: "/blocks/" + u.Path, RawQuery: query.Encode()}
+	if s.tenant != "" {
+		signed.Path = "/t/" + s.tenant + signed.Path
+	}
+	return signed.String(), nil
+}
+
+// Verify checks that a request was sent to a signed url of the block at path which has not expired,
+// and returns the constraints the url puts on the request
+func (s *Signer) Verify(r *http.Request, path string) (SignedUrl, error) {
+	query := r.URL.Query()
+	signature := query.Get(SignatureParam)
+	if !hmac.Equal([]byte(signature), []byte(s.signature(r.Method, path, query))) {
+		return SignedUrl{}, ErrInvalidSignature
+	}
+
+	// The parameters can be trusted once the signature matches
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || query.Get("method") != r.Method {
+		return SignedUrl{}, ErrInvalidSignature
+	}
+	u := SignedUrl{
+		Method:      r.Method,
+		Path:        path,
+		ExpiresAt:   time.Unix(expires, 0),
+		ContentType: query.Get("content_type"),
+		Issuer:      query.Get("issuer"),
+	}
+	if !s.now().Before(u.ExpiresAt) {
+		return SignedUrl{}, ErrSignatureExpired
+	}
+	if query.Has("max_size") {
+		if u.MaxSize, err = strconv.ParseInt(query.Get("max_size"), 10, 64); err != nil {
+			return SignedUrl{}, ErrInvalidSignature
+		}
+	}
+	return u, nil
+}
+
+// signature signs the method, the tenant, the path and every query parameter but the signature itself,
+// so that tenants sharing a secret do not share their urls
+func (s *Signer) signature(method string, path string, query url.Values) string {
+	query = maps.Clone(query)
+	delete(query, SignatureParam)
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(method + "\n" + s.tenant + "\n" + path + "\n" + query.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"goblocks/app/config"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	signer, err := NewSigner(&config.Config{Auth: config.Auth{SignedUrls: config.SignedUrls{Secret: "secret"}}})
+	if err != nil {
+		t.Fatalf("NewSigner() error = %v", err)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	signer.now = func() time.Time { return now }
+
+	download, _ := signer.Sign(SignedUrl{Method: "GET", Path: "docs/guide", ExpiresAt: now.Add(time.Hour), Issuer: "ada"})
+	upload, _ := signer.Sign(SignedUrl{Method: "PUT", Path: "uploads/avatar", ExpiresAt: now.Add(time.Hour), ContentType: "image/png", MaxSize: 1024})
+	expired, _ := signer.Sign(SignedUrl{Method: "GET", Path: "docs/guide", ExpiresAt: now.Add(-time.Second)})
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		path          string
+		expectedError error
+	}{
+		{name: "download", method: "GET", target: download, path: "docs/guide"},
+		{name: "upload", method: "PUT", target: upload, path: "uploads/avatar"},
+		{name: "other block", method: "GET", target: download, path: "docs/other", expectedError: ErrInvalidSignature},
+		{name: "other method", method: "PUT", target: download, path: "docs/guide", expectedError: ErrInvalidSignature},
+		{name: "added parameter", method: "GET", target: download + "&rev=1", path: "docs/guide", expectedError: ErrInvalidSignature},
+		{name: "raised limit", method: "PUT", target: upload + "&max_size=2048", path: "uploads/avatar", expectedError: ErrInvalidSignature},
+		{name: "expired", method: "GET", target: expired, path: "docs/guide", expectedError: ErrSignatureExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if !Signed(req) {
+				t.Fatalf("Signed(%s) = false", tt.target)
+			}
+			_, err := signer.Verify(req, tt.path)
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.expectedError)
+			}
+		})
+	}
+
+	signed, err := signer.Verify(httptest.NewRequest("PUT", upload, nil), "uploads/avatar")
+	if err != nil || signed.ContentType != "image/png" || signed.MaxSize != 1024 || !signed.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Verify() = %+v, %v, want the constraints of the url", signed, err)
+	}
+	if signed, _ := signer.Verify(httptest.NewRequest("GET", download, nil), "docs/guide"); signed.Issuer != "ada" {
+		t.Errorf("Issuer = %q, want ada", signed.Issuer)
+	}
+	if _, err := signer.Sign(SignedUrl{Method: "DELETE", Path: "docs/guide"}); !errors.Is(err, ErrInvalidSignedUrl) {
+		t.Errorf("Sign(DELETE) error = %v, want ErrInvalidSignedUrl", err)
+	}
+
+	// Tenants sharing a secret do not share their urls
+	acme, _ := NewSigner(&config.Config{Tenant: "acme", Auth: config.Auth{SignedUrls: config.SignedUrls{Secret: "secret"}}})
+	acmeDownload, _ := acme.Sign(SignedUrl{Method: "GET", Path: "docs/guide", ExpiresAt: time.Now().Add(time.Hour)})
+	if !strings.HasPrefix(acmeDownload, "/t/acme/blocks/docs/guide?") {
+		t.Errorf("Sign() = %q, want a url under /t/acme/", acmeDownload)
+	}
+	req := httptest.NewRequest("GET", strings.TrimPrefix(acmeDownload, "/t/acme"), nil)
+	if _, err := signer.Verify(req, "docs/guide"); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() of another tenant error = %v, want ErrInvalidSignature", err)
+	}
+
+	// Signed requests get no permission from the policy, rules or not
+	policy, _ := NewPolicy(&config.Config{})
+	principal, _ := NewAuthenticator(&config.Config{}).Authenticate(httptest.NewRequest("GET", download, nil))
+	if principal.Method != MethodSignedUrl || policy.Check(principal, "docs/guide", Read) == nil {
+		t.Errorf("Authenticate() = %+v, want a signed url principal without permissions", principal)
+	}
+}
@@ -0,0 +1,235 @@
+package blocks
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+const MaxMetadataSize = 8 * 1024
+const MaxTags = 32
+const MaxTagLength = 64
+const MaxMetadataKeyLength = 64
+const MaxAuthorLength = 256
+
+var ErrInvalidMetadata = errors.New("Invalid Metadata")
+
+// Attributes are the user defined metadata, tags and expiry recorded with every revision of a block
+type Attributes struct {
+	// Metadata keys are lowercase, as sent in X-Block-Meta-{Key} headers
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Tags are sorted and unique
+	Tags []string `json:"tags,omitempty"`
+	// ExpiresAt is when the block is deleted, zero when it never expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// WriteOption sets an optional attribute of the revision written by Set or Link
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	metadata    map[string]string
+	tags        []string
+	author      string
+	expiresAt   time.Time
+	hasMetadata bool
+	hasTags     bool
+}
+
+// WithMetadata replaces the metadata of a block, which is otherwise carried over from its current revision
+func WithMetadata(metadata map[string]string) WriteOption {
+	return func(o *writeOptions) {
+		o.metadata = metadata
+		o.hasMetadata = true
+	}
+}
+
+// WithTags replaces the tags of a block, which are otherwise carried over from its current revision
+func WithTags(tags ...string) WriteOption {
+	return func(o *writeOptions) {
+		o.tags = tags
+		o.hasTags = true
+	}
+}
+
+// WithAttributes replaces both the metadata and the tags of a block
+func WithAttributes(attributes Attributes) WriteOption {
+	return func(o *writeOptions) {
+		WithMetadata(attributes.Metadata)(o)
+		WithTags(attributes.Tags...)(o)
+	}
+}
+
+// WithAuthor records who writes the revision, which is never carried over
+func WithAuthor(author string) WriteOption {
+	return func(o *writeOptions) {
+		o.author = author
+	}
+}
+
+// WithExpiry sets when the block expires, which is never carried over so a write without it keeps the block forever
+func WithExpiry(expiresAt time.Time) WriteOption {
+	return func(o *writeOptions) {
+		o.expiresAt = expiresAt.UTC()
+	}
+}
+
+func newWriteOptions(opts []WriteOption) writeOptions {
+	options := writeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// writeAuthor returns the author given by the options, empty when the revision has none
+func writeAuthor(opts []WriteOption) string {
+	return newWriteOptions(opts).author
+}
+
+// writeAttributes returns the attributes of a new revision, the metadata and tags not given by
+// the options being carried over from the current revision. The author is validated along with them.
+func writeAttributes(current Attributes, opts []WriteOption) (Attributes, error) {
+	options := newWriteOptions(opts)
+	if len(options.author) > MaxAuthorLength || !validHeaderValue(options.author) {
+		return Attributes{}, ErrInvalidMetadata
+	}
+	attributes := current
+	if options.hasMetadata {
+		attributes.Metadata = options.metadata
+	}
+	if options.hasTags {
+		attributes.Tags = options.tags
+	}
+	attributes.ExpiresAt = options.expiresAt
+	return NormalizeAttributes(attributes)
+}
+
+// NormalizeAttributes validates attributes and returns a copy with lowercase metadata keys and sorted unique tags.
+// Keys are made of letters, digits, dashes and underscores, values and tags must fit in a header.
+func NormalizeAttributes(attributes Attributes) (Attributes, error) {
+	normalized := Attributes{ExpiresAt: attributes.ExpiresAt}
+	size := 0
+	for key, value := range attributes.Metadata {
+		key = strings.ToLower(key)
+		if !validMetadataKey(key) || !validHeaderValue(value) {
+			return Attributes{}, ErrInvalidMetadata
+		}
+		if normalized.Metadata == nil {
+			normalized.Metadata = map[string]string{}
+		}
+		normalized.Metadata[key] = value
+		size += len(key) + len(value)
+	}
+	if size > MaxMetadataSize {
+		return Attributes{}, ErrInvalidMetadata
+	}
+
+	for _, tag := range attributes.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || len(tag) > MaxTagLength || strings.Contains(tag, ",") || !validHeaderValue(tag) {
+			return Attributes{}, ErrInvalidMetadata
+		}
+		normalized.Tags = append(normalized.Tags, tag)
+	}
+	slices.Sort(normalized.Tags)
+	normalized.Tags = slices.Compact(normalized.Tags)
+	if len(normalized.Tags) > MaxTags {
+		return Attributes{}, ErrInvalidMetadata
+	}
+	return normalized, nil
+}
+
+// Expired reports whether the block expired at the given time
+func (a Attributes) Expired(now time.Time) bool {
+	return expired(a.ExpiresAt, now)
+}
+
+func expired(expiresAt time.Time, now time.Time) bool {
+	return !expiresAt.IsZero() && !expiresAt.After(now)
+}
+
+// hasTags reports whether every wanted tag is in tags
+func hasTags(tags []string, wanted []string) bool {
+	for _, tag := range wanted {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func validMetadataKey(key string) bool {
+	if key == "" || len(key) > MaxMetadataKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func validHeaderValue(value string) bool {
+	for _, c := range value {
+		if c < ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// AttributesPatch changes the attributes of a block: metadata set to nil are removed, the
+// others are added or replaced, and Tags replaces the tags when it is not nil
+type AttributesPatch struct {
+	Metadata map[string]*string `json:"metadata"`
+	Tags     []string           `json:"tags"`
+}
+
+func (p AttributesPatch) apply(current Attributes) Attributes {
+	patched := Attributes{Metadata: maps.Clone(current.Metadata), Tags: current.Tags, ExpiresAt: current.ExpiresAt}
+	for key, value := range p.Metadata {
+		key = strings.ToLower(key)
+		if value == nil {
+			delete(patched.Metadata, key)
+			continue
+		}
+		if patched.Metadata == nil {
+			patched.Metadata = map[string]string{}
+		}
+		patched.Metadata[key] = *value
+	}
+	if p.Tags != nil {
+		patched.Tags = p.Tags
+	}
+	return patched
+}
+
+// PatchAttributes records a new revision of a block holding the same content with patched attributes,
+// the options applying on top of them. The block keeps its expiry, the content is linked when the
+// storage holds it under its checksum and copied otherwise.
+func PatchAttributes(m BlockManager, path string, patch AttributesPatch, opts ...WriteOption) error {
+	current, err := m.Get(path, false)
+	if err != nil {
+		return err
+	}
+	attributes, err := NormalizeAttributes(patch.apply(current.Attributes))
+	if err != nil {
+		return err
+	}
+
+	opts = append([]WriteOption{WithAttributes(attributes), WithExpiry(attributes.ExpiresAt)}, opts...)
+	err = m.Link(path, current.Checksum, current.Type, opts...)
+	if !errors.Is(err, ErrUnknownBlob) {
+		return err
+	}
+	block, content, err := m.Open(path, current.Revision)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return m.Set(path, content, block.Type, opts...)
+}
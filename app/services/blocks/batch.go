@@ -0,0 +1,180 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+)
+
+type OperationType string
+
+const OpSet OperationType = "set"
+const OpDelete OperationType = "delete"
+const OpMove OperationType = "move"
+
+type OperationStatus string
+
+const OperationApplied OperationStatus = "applied"
+const OperationFailed OperationStatus = "failed"
+const OperationRolledBack OperationStatus = "rolled_back"
+const OperationSkipped OperationStatus = "skipped"
+
+var ErrInvalidOperation = errors.New("Invalid Operation")
+var ErrUnsupported = errors.New("Unsupported Operation")
+
+// Operation is a change applied by Batch
+type Operation struct {
+	Type OperationType
+	Path string
+	// Content, ContentType and Options are the new content of a set
+	Content     []byte
+	ContentType string
+	Options     []WriteOption
+	// To is the destination of a move, only replaced when Overwrite is set
+	To        string
+	Overwrite bool
+	// IfMatch is the entity tag the block must have when the operation runs, "*" matching any block with content
+	IfMatch string
+}
+
+// OperationResult reports what became of an operation of a batch
+type OperationResult struct {
+	Type   OperationType   `json:"op"`
+	Path   string          `json:"path"`
+	Status OperationStatus `json:"status"`
+	// Block is the block written by an applied set or move, without content
+	Block *Block `json:"block,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BatchError tells which operation aborted a batch
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+func validateOperation(op Operation) error {
+	switch op.Type {
+	case OpSet:
+		if err := validateBlockPath(op.Path); err != nil {
+			return err
+		}
+		return ValidateContentType(op.ContentType)
+	case OpDelete:
+		return validateBlockPath(op.Path)
+	case OpMove:
+		return validateTransfer(op.Path, op.To)
+	}
+	return ErrInvalidOperation
+}
+
+// checkMatch evaluates the If-Match precondition of an operation against the current entity tag of its block
+func checkMatch(ifMatch string, tag string, exists bool) error {
+	if ifMatch == "" {
+		return nil
+	}
+	if !exists || (ifMatch != "*" && ifMatch != tag) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// applyBatch validates every operation before applying them in order through apply,
+// it stops at the first failure, which the caller must roll back
+func applyBatch(ops []Operation, apply func(op Operation) (*Block, error)) ([]*Block, error) {
+	written := make([]*Block, len(ops))
+	for i, op := range ops {
+		if err := validateOperation(op); err != nil {
+			return written, &BatchError{i, err}
+		}
+	}
+	for i, op := range ops {
+		block, err := apply(op)
+		if err != nil {
+			return written, &BatchError{i, err}
+		}
+		written[i] = block
+	}
+	return written, nil
+}
+
+// batchResults describes the operations of a committed or rolled back batch
+func batchResults(ops []Operation, written []*Block, err error) ([]OperationResult, error) {
+	failed := len(ops)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		failed = batchErr.Index
+	}
+
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		results[i] = OperationResult{Type: op.Type, Path: op.Path}
+		switch {
+		case err == nil:
+			results[i].Status = OperationApplied
+			results[i].Block = written[i]
+		case i < failed:
+			results[i].Status = OperationRolledBack
+		case i == failed:
+			results[i].Status = OperationFailed
+			results[i].Error = batchErr.Err.Error()
+		default:
+			results[i].Status = OperationSkipped
+		}
+	}
+	return results, err
+}
+
+// batchJournal records how to undo the operations of a batch applied in place,
+// and what to clean up once it is committed
+type batchJournal struct {
+	undo    []func() error
+	cleanup []func()
+}
+
+func (j *batchJournal) onRollback(fn func() error) {
+	j.undo = append(j.undo, fn)
+}
+
+func (j *batchJournal) onCommit(fn func()) {
+	j.cleanup = append(j.cleanup, fn)
+}
+
+// rollback undoes the recorded changes, most recent first
+func (j *batchJournal) rollback() error {
+	var errs []error
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		if err := j.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(append(errs, ErrUnknown)...)
+	}
+	return nil
+}
+
+func (j *batchJournal) commit() {
+	for _, fn := range j.cleanup {
+		fn()
+	}
+}
+
+// finishBatch commits or rolls back a journal depending on the outcome of applyBatch
+func finishBatch(ops []Operation, journal *batchJournal, written []*Block, err error) ([]OperationResult, error) {
+	if err == nil {
+		journal.commit()
+		return batchResults(ops, written, nil)
+	}
+	if rollbackErr := journal.rollback(); rollbackErr != nil {
+		err = errors.Join(err, rollbackErr)
+	}
+	return batchResults(ops, written, err)
+}
@@ -0,0 +1,265 @@
+package blocks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+const FsBlobsDirName = ".blobs"
+
+// BlobGracePeriod protects recently written or referenced blobs from a sweep
+// running concurrently with the write of the revision pointing at them
+const BlobGracePeriod = time.Hour
+
+var ErrUnknownBlob = errors.New("Unknown Blob")
+var ErrInvalidChecksum = errors.New("Invalid Checksum")
+var ErrChecksumMismatch = errors.New("Checksum Mismatch")
+
+// BlobStore keeps contents on disk once, under the hex encoded SHA-256 of their bytes
+type BlobStore struct {
+	dir string
+}
+
+func NewBlobStore(dir string) *BlobStore {
+	return &BlobStore{dir: dir}
+}
+
+// Put stores a content and returns its checksum and size, an identical content is only kept once
+func (s *BlobStore) Put(content io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", 0, mapFsError(err)
+	}
+	upload, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return "", 0, mapFsError(err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(upload, hash), content)
+	if err == nil {
+		err = upload.Sync()
+	}
+	if closeErr := upload.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(upload.Name())
+		return "", 0, mapFsError(err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if _, err := s.Reference(checksum); err == nil {
+		os.Remove(upload.Name())
+		return checksum, size, nil
+	}
+	blobPath := s.path(checksum)
+	if err := mkdirAll(filepath.Dir(blobPath)); err != nil {
+		os.Remove(upload.Name())
+		return "", 0, err
+	}
+	if err := os.Rename(upload.Name(), blobPath); err != nil {
+		os.Remove(upload.Name())
+		return "", 0, mapFsError(err)
+	}
+	// The blob must be durable before a revision points at it
+	if err := syncDir(filepath.Dir(blobPath)); err != nil {
+		return "", 0, err
+	}
+	return checksum, size, nil
+}
+
+// Reference returns the size of a stored blob and protects it from the next sweep
+func (s *BlobStore) Reference(checksum string) (int64, error) {
+	if ValidateChecksum(checksum) != nil {
+		return 0, ErrUnknownBlob
+	}
+	blobPath := s.path(checksum)
+	now := time.Now()
+	if err := os.Chtimes(blobPath, now, now); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, errors.Join(err, ErrUnknownBlob)
+		}
+		return 0, mapFsError(err)
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return 0, mapFsError(err)
+	}
+	return info.Size(), nil
+}
+
+// Size returns the size of a stored blob, ErrUnknownBlob when it is missing
+func (s *BlobStore) Size(checksum string) (int64, error) {
+	if ValidateChecksum(checksum) != nil {
+		return 0, ErrUnknownBlob
+	}
+	info, err := os.Stat(s.path(checksum))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, errors.Join(err, ErrUnknownBlob)
+	}
+	if err != nil {
+		return 0, mapFsError(err)
+	}
+	return info.Size(), nil
+}
+
+// Open streams a stored blob, ErrUnknownBlob when it is missing
+func (s *BlobStore) Open(checksum string) (*os.File, error) {
+	if ValidateChecksum(checksum) != nil {
+		return nil, ErrUnknownBlob
+	}
+	file, err := os.Open(s.path(checksum))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Join(err, ErrUnknownBlob)
+	}
+	if err != nil {
+		return nil, mapFsError(err)
+	}
+	return file, nil
+}
+
+// Sweep removes the blobs and abandoned uploads that are not referenced and
+// were last touched before the given time, it returns the number of removed blobs
+func (s *BlobStore) Sweep(referenced map[string]bool, before time.Time) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(s.dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if referenced[name] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if !strings.HasPrefix(name, ".") {
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, mapFsError(err)
+	}
+	return removed, nil
+}
+
+// path shards the blobs in directories named after the first two characters of their checksum
+func (s *BlobStore) path(checksum string) string {
+	return filepath.Join(s.dir, checksum[:2], checksum)
+}
+
+// ValidateChecksum checks that a checksum is a hex encoded SHA-256 as returned by Checksum
+func ValidateChecksum(checksum string) error {
+	if len(checksum) != sha256.Size*2 {
+		return ErrInvalidChecksum
+	}
+	for _, c := range checksum {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ErrInvalidChecksum
+		}
+	}
+	return nil
+}
+
+// VerifyChecksum wraps a content so that reading it fails with ErrChecksumMismatch
+// when its SHA-256 differs from the expected checksum
+func VerifyChecksum(content io.Reader, checksum string) io.Reader {
+	return &verifyingReader{reader: content, hash: sha256.New(), checksum: checksum}
+}
+
+type verifyingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	checksum string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.checksum {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// BlobSizer is implemented by the storages whose Link may succeed, so that the size of a linked content is
+// known before linking it
+type BlobSizer interface {
+	// BlobSize returns the size of the content stored under a checksum, ErrUnknownBlob when there is none
+	BlobSize(checksum string) (int64, error)
+}
+
+// GarbageCollector is implemented by the storages that need their unreferenced contents to be collected
+type GarbageCollector interface {
+	// CollectGarbage removes the contents no revision points at anymore and returns how many were removed
+	CollectGarbage() (int, error)
+}
+
+// collectGarbage runs the garbage collection of a storage on startup and then at every interval
+func collectGarbage(lc fx.Lifecycle, collector GarbageCollector, interval time.Duration, log *slog.Logger) {
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	collect := func() {
+		removed, err := collector.CollectGarbage()
+		if err != nil {
+			log.Error("Unable to collect the unreferenced blobs", "error", err)
+			return
+		}
+		if removed > 0 {
+			log.Info(fmt.Sprintf("Removed %d unreferenced blobs", removed), "blobs.removed", removed)
+		}
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					collect()
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			wg.Wait()
+			return nil
+		},
+	})
+}
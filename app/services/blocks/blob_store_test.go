@@ -0,0 +1,124 @@
+package blocks
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestBlobStore_PutAndOpen(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := NewBlobStore(tmpDir)
+	checksum, size, err := store.Put(strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if checksum != Checksum([]byte("content")) || size != 7 {
+		t.Errorf("Put() = %s, %d, want the checksum of content and 7", checksum, size)
+	}
+
+	// Storing the same content again keeps a single copy
+	again, _, err := store.Put(strings.NewReader("content"))
+	if err != nil || again != checksum {
+		t.Errorf("Put() again = %s, %v, want %s", again, err, checksum)
+	}
+	entries, _ := filepath.Glob(filepath.Join(tmpDir, "*", "*"))
+	if len(entries) != 1 {
+		t.Errorf("Store holds %d blobs, want 1", len(entries))
+	}
+
+	file, err := store.Open(checksum)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != "content" {
+		t.Errorf("Open() content = %s, want content", data)
+	}
+
+	if _, err := store.Open(Checksum([]byte("missing"))); !errors.Is(err, ErrUnknownBlob) {
+		t.Errorf("Open() error = %v, want ErrUnknownBlob", err)
+	}
+
+	// A failed upload leaves nothing behind
+	_, _, err = store.Put(iotest.ErrReader(errors.New("broken")))
+	if err == nil {
+		t.Fatal("Put() should fail when the content cannot be read")
+	}
+	uploads, _ := filepath.Glob(filepath.Join(tmpDir, ".upload-*"))
+	if len(uploads) != 0 {
+		t.Errorf("Failed uploads left %v", uploads)
+	}
+}
+
+func TestBlobStore_Sweep(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := NewBlobStore(tmpDir)
+	kept, _, _ := store.Put(strings.NewReader("kept"))
+	orphan, _, _ := store.Put(strings.NewReader("orphan"))
+	recent, _, _ := store.Put(strings.NewReader("recent"))
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(store.path(kept), old, old)
+	os.Chtimes(store.path(orphan), old, old)
+
+	removed, err := store.Sweep(map[string]bool{kept: true}, time.Now().Add(-time.Minute))
+	if err != nil || removed != 1 {
+		t.Errorf("Sweep() = %d, %v, want 1", removed, err)
+	}
+	for checksum, want := range map[string]bool{kept: true, orphan: false, recent: true} {
+		_, err := store.Open(checksum)
+		if (err == nil) != want {
+			t.Errorf("Open(%s) error = %v, want present = %v", checksum, err, want)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	checksum := Checksum([]byte("content"))
+
+	data, err := io.ReadAll(VerifyChecksum(strings.NewReader("content"), checksum))
+	if err != nil || string(data) != "content" {
+		t.Errorf("ReadAll() = %s, %v, want content", data, err)
+	}
+
+	_, err = io.ReadAll(VerifyChecksum(strings.NewReader("tampered"), checksum))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("ReadAll() error = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestValidateChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  bool
+	}{
+		{name: "sha256", checksum: Checksum([]byte("content")), wantErr: false},
+		{name: "uppercase", checksum: strings.ToUpper(Checksum([]byte("content"))), wantErr: true},
+		{name: "too short", checksum: "abcdef", wantErr: true},
+		{name: "path", checksum: "../" + Checksum([]byte("content"))[3:], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateChecksum(tt.checksum); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,1011 @@
+// Package blockstest checks that a storage honors the whole BlockManager contract.
+//
+// Every backend, including the ones living outside of this repository, is
+// expected to pass RunConformance:
+//
+//	func TestConformance(t *testing.T) {
+//		blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+//			return NewMyBlockManager(t.TempDir())
+//		})
+//	}
+package blockstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"goblocks/app/services/blocks"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns an empty storage, its resources being released through t.Cleanup
+type Factory func(t *testing.T) blocks.BlockManager
+
+// RunConformance runs every behavior test against fresh storages built by factory
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, m blocks.BlockManager)
+	}{
+		{name: "set and get", run: testSetAndGet},
+		{name: "open", run: testOpen},
+		{name: "not found", run: testNotFound},
+		{name: "root", run: testRoot},
+		{name: "parents without content", run: testParentsWithoutContent},
+		{name: "list", run: testList},
+		{name: "children", run: testChildren},
+		{name: "revisions", run: testRevisions},
+		{name: "link", run: testLink},
+		{name: "recursive delete", run: testRecursiveDelete},
+		{name: "move and copy", run: testMoveAndCopy},
+		{name: "transfer errors", run: testTransferErrors},
+		{name: "reserved paths", run: testReservedPaths},
+		{name: "concurrent writes", run: testConcurrentWrites},
+		{name: "reads during rewrites", run: testReadsDuringRewrites},
+		{name: "batch", run: testBatch},
+		{name: "batch rollback", run: testBatchRollback},
+		{name: "reads during batches", run: testReadsDuringBatches},
+		{name: "metadata and tags", run: testAttributes},
+		{name: "invalid metadata", run: testInvalidAttributes},
+		{name: "timestamps and authorship", run: testAuthorship},
+		{name: "expiry", run: testExpiry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, factory(t))
+		})
+	}
+}
+
+func testSetAndGet(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "a/b/c", "Hello, World!")
+
+	block, err := m.Get("a/b/c", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if block.Path != "a/b/c" || block.Type != "text/plain" || string(block.Content) != "Hello, World!" {
+		t.Errorf("Get() = %+v, want a/b/c holding Hello, World! as text/plain", block)
+	}
+	if block.Size != 13 || block.Revision != 1 || block.Checksum != blocks.Checksum([]byte("Hello, World!")) {
+		t.Errorf("Get() = size %d, revision %d, checksum %s, want 13, 1 and the sha256 of the content", block.Size, block.Revision, block.Checksum)
+	}
+	if block.UpdatedAt.IsZero() {
+		t.Error("Get() updated_at should be set")
+	}
+
+	block, err = m.Get("a/b/c", false)
+	if err != nil || block.Content != nil {
+		t.Errorf("Get(withContent=false) = %s, %v, want no content", block.Content, err)
+	}
+
+	// Empty contents are valid blocks
+	mustSet(t, m, "empty", "")
+	block, err = m.Get("empty", true)
+	if err != nil || len(block.Content) != 0 || block.Size != 0 {
+		t.Errorf("Get(empty) = %+v, %v, want an empty block", block, err)
+	}
+}
+
+func testOpen(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "doc", "first")
+	mustSet(t, m, "doc", "0123456789")
+
+	block, content, err := m.Open("doc", 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer content.Close()
+	if block.Content != nil || block.Revision != 2 || block.Size != 10 {
+		t.Errorf("Open() block = %+v, want the metadata of revision 2", block)
+	}
+	if _, err := content.Seek(4, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	data, err := io.ReadAll(content)
+	if err != nil || string(data) != "456789" {
+		t.Errorf("ReadAll() after Seek() = %s, %v, want 456789", data, err)
+	}
+
+	_, old, err := m.Open("doc", 1)
+	if err != nil {
+		t.Fatalf("Open() revision 1 error = %v", err)
+	}
+	defer old.Close()
+	if data, _ := io.ReadAll(old); string(data) != "first" {
+		t.Errorf("Open() revision 1 content = %s, want first", data)
+	}
+
+	if _, _, err := m.Open("doc", -1); !errors.Is(err, blocks.ErrInvalidRevision) {
+		t.Errorf("Open() negative revision error = %v, want ErrInvalidRevision", err)
+	}
+	if _, _, err := m.Open("doc", 3); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("Open() unknown revision error = %v, want ErrNotFound", err)
+	}
+}
+
+func testNotFound(t *testing.T, m blocks.BlockManager) {
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "Get", call: func() error { _, err := m.Get("missing", false); return err }},
+		{name: "Open", call: func() error { _, _, err := m.Open("missing", 0); return err }},
+		{name: "List", call: func() error { _, err := m.List("missing"); return err }},
+		{name: "Children", call: func() error { _, err := m.Children("missing", blocks.ListOptions{}); return err }},
+		{name: "Revisions", call: func() error { _, err := m.Revisions("missing"); return err }},
+		{name: "GetRevision", call: func() error { _, err := m.GetRevision("missing", 1, false); return err }},
+		{name: "Restore", call: func() error { return m.Restore("missing", 1) }},
+		{name: "Move", call: func() error { return m.Move("missing", "elsewhere", false) }},
+		{name: "Copy", call: func() error { return m.Copy("missing", "elsewhere", false) }},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); !errors.Is(err, blocks.ErrNotFound) {
+			t.Errorf("%s() error = %v, want ErrNotFound", tt.name, err)
+		}
+	}
+
+	// Deleting is idempotent
+	if err := m.Delete("missing"); err != nil {
+		t.Errorf("Delete() error = %v, want nil", err)
+	}
+}
+
+func testRoot(t *testing.T, m blocks.BlockManager) {
+	if paths := listPaths(t, m, ""); len(paths) != 0 {
+		t.Errorf("List() of an empty storage = %v, want none", paths)
+	}
+	page, err := m.Children("", blocks.ListOptions{})
+	if err != nil || len(page.Items) != 0 {
+		t.Errorf("Children() of an empty storage = %v, %v, want none", page.Items, err)
+	}
+
+	// The root is the parent of every block and never holds content
+	if err := m.Set("", strings.NewReader("root"), "text/plain"); !errors.Is(err, blocks.ErrInvalidPath) {
+		t.Errorf("Set() of the root error = %v, want ErrInvalidPath", err)
+	}
+	if _, err := m.Get("", false); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("Get() of the root error = %v, want ErrNotFound", err)
+	}
+
+	mustSet(t, m, "a", "a")
+	mustSet(t, m, "b/c", "c")
+	if err := m.Delete(""); err != nil {
+		t.Fatalf("Delete() of the root error = %v", err)
+	}
+	if paths := listPaths(t, m, ""); len(paths) != 0 {
+		t.Errorf("List() after deleting the root = %v, want none", paths)
+	}
+	if _, err := m.Get("b/c", false); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("Get() after deleting the root error = %v, want ErrNotFound", err)
+	}
+
+	// The storage stays usable
+	mustSet(t, m, "a", "again")
+	if paths := listPaths(t, m, ""); !slices.Equal(paths, []string{"a"}) {
+		t.Errorf("List() after writing again = %v, want [a]", paths)
+	}
+}
+
+func testParentsWithoutContent(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "a/b/c", "c")
+
+	for _, parent := range []string{"a", "a/b"} {
+		if _, err := m.Get(parent, false); !errors.Is(err, blocks.ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, want ErrNotFound", parent, err)
+		}
+		if _, err := m.Revisions(parent); !errors.Is(err, blocks.ErrNotFound) {
+			t.Errorf("Revisions(%q) error = %v, want ErrNotFound", parent, err)
+		}
+	}
+	if paths := listPaths(t, m, "a"); !slices.Equal(paths, []string{"a/b"}) {
+		t.Errorf("List(a) = %v, want [a/b]", paths)
+	}
+
+	// A parent can get a content of its own without losing its children
+	mustSet(t, m, "a", "a")
+	block, err := m.Get("a", true)
+	if err != nil || string(block.Content) != "a" {
+		t.Errorf("Get(a) = %s, %v, want a", block.Content, err)
+	}
+	if paths := listPaths(t, m, "a"); !slices.Equal(paths, []string{"a/b"}) {
+		t.Errorf("List(a) = %v, want [a/b]", paths)
+	}
+}
+
+func testList(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "b/2", "2")
+	mustSet(t, m, "b/1/x", "x")
+	mustSet(t, m, "a", "a")
+	mustSet(t, m, "a-b", "a-b")
+
+	// Children are sorted by name and their paths never start with a slash
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "", want: []string{"a", "a-b", "b"}},
+		{path: "b", want: []string{"b/1", "b/2"}},
+		{path: "b/1", want: []string{"b/1/x"}},
+		{path: "a", want: []string{}},
+	}
+	for _, tt := range tests {
+		if paths := listPaths(t, m, tt.path); !slices.Equal(paths, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.path, paths, tt.want)
+		}
+	}
+}
+
+func testChildren(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "dir/big", "0123456789")
+	mustSet(t, m, "dir/small", "0")
+	mustSet(t, m, "dir/parent/child", "child")
+
+	page, err := m.Children("dir", blocks.ListOptions{SortBy: blocks.SortBySize, Desc: true})
+	if err != nil {
+		t.Fatalf("Children() error = %v", err)
+	}
+	paths := []string{}
+	for _, ref := range page.Items {
+		paths = append(paths, ref.Path)
+	}
+	if !slices.Equal(paths, []string{"dir/big", "dir/small", "dir/parent"}) {
+		t.Errorf("Children() = %v, want dir/big, dir/small then dir/parent", paths)
+	}
+	if big := page.Items[0]; big.Type != "text/plain" || big.Size != 10 || big.UpdatedAt.IsZero() {
+		t.Errorf("Children()[0] = %+v, want the metadata of dir/big", big)
+	}
+	if parent := page.Items[2]; parent.Type != "" || parent.Size != 0 {
+		t.Errorf("Children()[2] = %+v, want no metadata for a parent without content", parent)
+	}
+
+	page, err = m.Children("dir", blocks.ListOptions{Limit: 2})
+	if err != nil || len(page.Items) != 2 || page.NextCursor == "" {
+		t.Fatalf("Children() first page = %v, %v, want 2 items and a cursor", page, err)
+	}
+	page, err = m.Children("dir", blocks.ListOptions{Limit: 2, Cursor: page.NextCursor})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Path != "dir/small" || page.NextCursor != "" {
+		t.Errorf("Children() last page = %v, %v, want dir/small alone", page, err)
+	}
+
+	if _, err := m.Children("dir", blocks.ListOptions{Limit: -1}); !errors.Is(err, blocks.ErrInvalidListOptions) {
+		t.Errorf("Children() error = %v, want ErrInvalidListOptions", err)
+	}
+}
+
+func testRevisions(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "doc", "v1")
+	if err := m.Set("doc", strings.NewReader(`{"v":2}`), "application/json"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	revisions, err := m.Revisions("doc")
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("Revisions() = %v, %v, want 2 revisions", revisions, err)
+	}
+	for i, r := range revisions {
+		if r.Number != i+1 || r.CreatedAt.IsZero() || r.Checksum == "" {
+			t.Errorf("Revisions()[%d] = %+v, want number %d with its metadata", i, r, i+1)
+		}
+	}
+	if revisions[1].ContentType != "application/json" || revisions[1].Size != 7 {
+		t.Errorf("Revisions()[1] = %+v, want 7 bytes of application/json", revisions[1])
+	}
+
+	block, err := m.GetRevision("doc", 1, true)
+	if err != nil || string(block.Content) != "v1" || block.Revision != 1 || block.Type != "text/plain" {
+		t.Errorf("GetRevision(1) = %+v, %v, want v1 as text/plain", block, err)
+	}
+
+	if err := m.Restore("doc", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	block, err = m.Get("doc", true)
+	if err != nil || string(block.Content) != "v1" || block.Revision != 3 || block.Type != "text/plain" {
+		t.Errorf("Get() after Restore() = %+v, %v, want v1 as text/plain at revision 3", block, err)
+	}
+
+	tests := []struct {
+		revision int
+		want     error
+	}{
+		{revision: 0, want: blocks.ErrInvalidRevision},
+		{revision: -1, want: blocks.ErrInvalidRevision},
+		{revision: 4, want: blocks.ErrNotFound},
+	}
+	for _, tt := range tests {
+		if _, err := m.GetRevision("doc", tt.revision, false); !errors.Is(err, tt.want) {
+			t.Errorf("GetRevision(%d) error = %v, want %v", tt.revision, err, tt.want)
+		}
+		if err := m.Restore("doc", tt.revision); !errors.Is(err, tt.want) {
+			t.Errorf("Restore(%d) error = %v, want %v", tt.revision, err, tt.want)
+		}
+	}
+}
+
+func testLink(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "original", "shared")
+
+	// Storages not addressing their contents by checksum may always ask for an upload
+	err := m.Link("linked", blocks.Checksum([]byte("shared")), "text/markdown")
+	if err == nil {
+		block, err := m.Get("linked", true)
+		if err != nil || string(block.Content) != "shared" || block.Type != "text/markdown" {
+			t.Errorf("Get() of a linked block = %+v, %v, want shared as text/markdown", block, err)
+		}
+	} else if !errors.Is(err, blocks.ErrUnknownBlob) {
+		t.Errorf("Link() error = %v, want nil or ErrUnknownBlob", err)
+	}
+
+	err = m.Link("unknown", blocks.Checksum([]byte("unknown")), "text/plain")
+	if !errors.Is(err, blocks.ErrUnknownBlob) {
+		t.Errorf("Link() of an unknown content error = %v, want ErrUnknownBlob", err)
+	}
+	if _, err := m.Get("unknown", false); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("Get() after a failed Link() error = %v, want ErrNotFound", err)
+	}
+}
+
+func testRecursiveDelete(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "docs", "docs")
+	mustSet(t, m, "docs/guide", "guide")
+	mustSet(t, m, "docs/guide/intro", "intro")
+	mustSet(t, m, "docs-archive", "archive")
+
+	if err := m.Delete("docs"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	for _, path := range []string{"docs", "docs/guide", "docs/guide/intro"} {
+		if _, err := m.Get(path, false); !errors.Is(err, blocks.ErrNotFound) {
+			t.Errorf("Get(%q) after delete error = %v, want ErrNotFound", path, err)
+		}
+	}
+	if paths := listPaths(t, m, ""); !slices.Equal(paths, []string{"docs-archive"}) {
+		t.Errorf("List() after delete = %v, want [docs-archive]", paths)
+	}
+	if _, err := m.List("docs"); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("List(docs) after delete error = %v, want ErrNotFound", err)
+	}
+
+	// Writing again under a deleted path starts a new history
+	mustSet(t, m, "docs/guide", "new")
+	block, err := m.Get("docs/guide", false)
+	if err != nil || block.Revision != 1 {
+		t.Errorf("Get() after recreate = revision %d, %v, want revision 1", block.Revision, err)
+	}
+}
+
+func testMoveAndCopy(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "src/a", "a1")
+	mustSet(t, m, "src/a", "a2")
+	mustSet(t, m, "src/a/b", "b")
+
+	if err := m.Copy("src", "copy", false); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := m.Move("src", "moved/here", false); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	for _, path := range []string{"copy/a/b", "moved/here/a/b"} {
+		block, err := m.Get(path, true)
+		if err != nil || string(block.Content) != "b" {
+			t.Errorf("Get(%q) = %s, %v, want b", path, block.Content, err)
+		}
+	}
+	for _, path := range []string{"copy/a", "moved/here/a"} {
+		revisions, err := m.Revisions(path)
+		if err != nil || len(revisions) != 2 {
+			t.Errorf("Revisions(%q) = %v, %v, want the 2 revisions of the source", path, revisions, err)
+		}
+	}
+	if _, err := m.List("src"); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("List(src) after move error = %v, want ErrNotFound", err)
+	}
+	if paths := listPaths(t, m, "moved/here"); !slices.Equal(paths, []string{"moved/here/a"}) {
+		t.Errorf("List(moved/here) = %v, want [moved/here/a]", paths)
+	}
+
+	// Copies are independent from their source
+	mustSet(t, m, "copy/a", "changed")
+	block, err := m.Get("moved/here/a", true)
+	if err != nil || string(block.Content) != "a2" {
+		t.Errorf("Get(moved/here/a) = %s, %v, want a2", block.Content, err)
+	}
+
+	// Overwriting replaces the whole destination subtree
+	mustSet(t, m, "target/stale", "stale")
+	if err := m.Move("copy", "target", false); !errors.Is(err, blocks.ErrAlreadyExists) {
+		t.Errorf("Move() onto an existing block error = %v, want ErrAlreadyExists", err)
+	}
+	if err := m.Move("copy", "target", true); err != nil {
+		t.Fatalf("Move() with overwrite error = %v", err)
+	}
+	if paths := listPaths(t, m, "target"); !slices.Equal(paths, []string{"target/a"}) {
+		t.Errorf("List(target) after overwrite = %v, want [target/a]", paths)
+	}
+}
+
+func testTransferErrors(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "docs/a", "a")
+	mustSet(t, m, "other", "other")
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want error
+	}{
+		{name: "into itself", from: "docs", to: "docs/sub", want: blocks.ErrInvalidDestination},
+		{name: "onto itself", from: "docs", to: "docs", want: blocks.ErrInvalidDestination},
+		{name: "onto its parent", from: "docs/a", to: "docs", want: blocks.ErrInvalidDestination},
+		{name: "from the root", from: "", to: "elsewhere", want: blocks.ErrInvalidDestination},
+		{name: "to the root", from: "docs", to: "", want: blocks.ErrInvalidDestination},
+		{name: "existing destination", from: "docs", to: "other", want: blocks.ErrAlreadyExists},
+	}
+	for _, tt := range tests {
+		if err := m.Move(tt.from, tt.to, false); !errors.Is(err, tt.want) {
+			t.Errorf("Move() %s error = %v, want %v", tt.name, err, tt.want)
+		}
+		if err := m.Copy(tt.from, tt.to, false); !errors.Is(err, tt.want) {
+			t.Errorf("Copy() %s error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Failed transfers leave both sides untouched
+	for path, want := range map[string]string{"docs/a": "a", "other": "other"} {
+		block, err := m.Get(path, true)
+		if err != nil || string(block.Content) != want {
+			t.Errorf("Get(%q) = %s, %v, want %s", path, block.Content, err, want)
+		}
+	}
+}
+
+// testReservedPaths checks that no block reaches the metadata and history the storages keep next to the blocks
+func testReservedPaths(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "a", "first")
+	mustSet(t, m, "a", "second")
+
+	for _, path := range []string{"a/" + blocks.FsRevisionsDirName, "a/" + blocks.FsRevisionsDirName + "/1", blocks.FsFileName, "a/" + blocks.FsFileName} {
+		if err := m.Set(path, strings.NewReader("x"), "text/plain"); !errors.Is(err, blocks.ErrReservedPath) {
+			t.Errorf("Set(%q) error = %v, want ErrReservedPath", path, err)
+		}
+		if err := m.Delete(path); !errors.Is(err, blocks.ErrReservedPath) {
+			t.Errorf("Delete(%q) error = %v, want ErrReservedPath", path, err)
+		}
+		if err := m.Copy("a", path, true); !errors.Is(err, blocks.ErrReservedPath) {
+			t.Errorf("Copy(a, %q) error = %v, want ErrReservedPath", path, err)
+		}
+		if err := m.Move(path, "b", false); !errors.Is(err, blocks.ErrReservedPath) {
+			t.Errorf("Move(%q, b) error = %v, want ErrReservedPath", path, err)
+		}
+		_, err := m.Batch([]blocks.Operation{{Type: blocks.OpDelete, Path: path}})
+		if !errors.Is(err, blocks.ErrReservedPath) && !errors.Is(err, blocks.ErrUnsupported) {
+			t.Errorf("Batch() deleting %q error = %v, want ErrReservedPath", path, err)
+		}
+	}
+
+	revisions, err := m.Revisions("a")
+	if err != nil || len(revisions) != 2 {
+		t.Errorf("Revisions(a) = %v, %v, want the 2 revisions untouched", revisions, err)
+	}
+	if block, err := m.Get("a", true); err != nil || string(block.Content) != "second" {
+		t.Errorf("Get(a) = %s, %v, want second", block.Content, err)
+	}
+}
+
+// testConcurrentWrites writes siblings from several goroutines while others read.
+// Writes to the same path are serialized by the callers with a Locker.
+func testConcurrentWrites(t *testing.T, m blocks.BlockManager) {
+	const writers = 8
+	mustSet(t, m, "shared/stable", "stable")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for i := range writers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("shared/%d/block", i)
+			for revision := range 3 {
+				content := fmt.Sprintf("%d-%d", i, revision)
+				if err := m.Set(path, strings.NewReader(content), "text/plain"); err != nil {
+					errs <- fmt.Errorf("Set(%q) error = %w", path, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			block, err := m.Get("shared/stable", true)
+			if err != nil || !bytes.Equal(block.Content, []byte("stable")) {
+				errs <- fmt.Errorf("Get() during writes = %s, %v, want stable", block.Content, err)
+			}
+			if _, err := m.List("shared"); err != nil {
+				errs <- fmt.Errorf("List() during writes error = %w", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if paths := listPaths(t, m, "shared"); len(paths) != writers+1 {
+		t.Errorf("List(shared) = %v, want %d children", paths, writers+1)
+	}
+	for i := range writers {
+		block, err := m.Get(fmt.Sprintf("shared/%d/block", i), true)
+		if err != nil || block.Revision != 3 || string(block.Content) != fmt.Sprintf("%d-2", i) {
+			t.Errorf("Get(shared/%d/block) = %+v, %v, want the third revision", i, block, err)
+		}
+	}
+}
+
+// testReadsDuringRewrites checks that readers always see a whole revision of a block being rewritten
+func testReadsDuringRewrites(t *testing.T, m blocks.BlockManager) {
+	const rewrites = 20
+	mustSet(t, m, "hot", strings.Repeat("0", 1024))
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				block, err := m.Get("hot", true)
+				if err != nil {
+					errs <- fmt.Errorf("Get() during rewrites error = %w", err)
+					return
+				}
+				if blocks.Checksum(block.Content) != block.Checksum || int64(len(block.Content)) != block.Size {
+					errs <- fmt.Errorf("Get() during rewrites returned a torn revision %d", block.Revision)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= rewrites; i++ {
+		content := strings.Repeat(strconv.Itoa(i%10), 1024*i)
+		if err := m.Set("hot", strings.NewReader(content), "text/plain"); err != nil {
+			t.Errorf("Set() error = %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testBatch(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "a", "1")
+	// Entity tags cover the content type and attributes along with the content
+	tag := func(content string) string {
+		return blocks.Block{Checksum: blocks.Checksum([]byte(content)), Type: "text/plain"}.ETag()
+	}
+	results := mustBatch(t, m, []blocks.Operation{
+		{Type: blocks.OpSet, Path: "a", Content: []byte("2"), ContentType: "text/plain", IfMatch: tag("1")},
+		{Type: blocks.OpSet, Path: "b/x", Content: []byte("x"), ContentType: "text/plain"},
+		{Type: blocks.OpMove, Path: "b", To: "c"},
+		// Operations see the changes of the previous ones
+		{Type: blocks.OpSet, Path: "c/x", Content: []byte("y"), ContentType: "text/plain", IfMatch: tag("x")},
+		{Type: blocks.OpDelete, Path: "a"},
+	})
+
+	for i, result := range results {
+		if result.Status != blocks.OperationApplied || result.Error != "" {
+			t.Errorf("Batch() result %d = %+v, want applied", i, result)
+		}
+	}
+	if block := results[0].Block; block == nil || block.Revision != 2 || block.Checksum != blocks.Checksum([]byte("2")) {
+		t.Errorf("Batch() set result = %+v, want revision 2 of a", block)
+	}
+	if block := results[2].Block; block == nil || block.Path != "c" {
+		t.Errorf("Batch() move result = %+v, want the destination c", block)
+	}
+	if results[4].Block != nil {
+		t.Errorf("Batch() delete result = %+v, want no block", results[4].Block)
+	}
+
+	if paths := listPaths(t, m, ""); !slices.Equal(paths, []string{"c"}) {
+		t.Errorf("List() after Batch() = %v, want [c]", paths)
+	}
+	block, err := m.Get("c/x", true)
+	if err != nil || string(block.Content) != "y" || block.Revision != 2 {
+		t.Errorf("Get(c/x) = %+v, %v, want the second revision holding y", block, err)
+	}
+}
+
+// testBatchRollback checks that a failing operation undoes the ones applied before it
+func testBatchRollback(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "keep", "v1")
+	mustSet(t, m, "gone/child", "child")
+	mustSet(t, m, "src", "src")
+	mustSet(t, m, "dst", "dst")
+
+	tests := []struct {
+		name   string
+		failed blocks.Operation
+		want   error
+	}{
+		{
+			name:   "precondition",
+			failed: blocks.Operation{Type: blocks.OpSet, Path: "keep", Content: []byte("v3"), ContentType: "text/plain", IfMatch: blocks.Checksum([]byte("v1"))},
+			want:   blocks.ErrPreconditionFailed,
+		},
+		{
+			name:   "missing block",
+			failed: blocks.Operation{Type: blocks.OpMove, Path: "missing", To: "elsewhere"},
+			want:   blocks.ErrNotFound,
+		},
+		{
+			name:   "existing destination",
+			failed: blocks.Operation{Type: blocks.OpMove, Path: "keep", To: "new"},
+			want:   blocks.ErrAlreadyExists,
+		},
+		{
+			name:   "invalid operation",
+			failed: blocks.Operation{Type: "rename", Path: "keep"},
+			want:   blocks.ErrInvalidOperation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := []blocks.Operation{
+				{Type: blocks.OpSet, Path: "keep", Content: []byte("v2"), ContentType: "text/plain"},
+				{Type: blocks.OpSet, Path: "new/deep", Content: []byte("new"), ContentType: "text/plain"},
+				{Type: blocks.OpDelete, Path: "gone"},
+				{Type: blocks.OpMove, Path: "src", To: "dst", Overwrite: true},
+				{Type: blocks.OpSet, Path: "gone", Content: []byte("again"), ContentType: "text/plain"},
+				tt.failed,
+				{Type: blocks.OpDelete, Path: "keep"},
+			}
+			results, err := m.Batch(ops)
+			if errors.Is(err, blocks.ErrUnsupported) {
+				t.Skip("the storage does not support batches")
+			}
+			var batchErr *blocks.BatchError
+			if !errors.As(err, &batchErr) || batchErr.Index != 5 || !errors.Is(err, tt.want) {
+				t.Fatalf("Batch() error = %v, want operation 5 failing with %v", err, tt.want)
+			}
+
+			statuses := []blocks.OperationStatus{}
+			for _, result := range results {
+				statuses = append(statuses, result.Status)
+			}
+			want := []blocks.OperationStatus{
+				blocks.OperationRolledBack, blocks.OperationRolledBack, blocks.OperationRolledBack, blocks.OperationRolledBack,
+				blocks.OperationRolledBack, blocks.OperationFailed, blocks.OperationSkipped,
+			}
+			if !slices.Equal(statuses, want) || results[5].Error == "" {
+				t.Errorf("Batch() statuses = %v, want %v with the error of the failed operation", statuses, want)
+			}
+
+			if paths := listPaths(t, m, ""); !slices.Equal(paths, []string{"dst", "gone", "keep", "src"}) {
+				t.Errorf("List() after rollback = %v, want [dst gone keep src]", paths)
+			}
+			for path, content := range map[string]string{"keep": "v1", "gone/child": "child", "src": "src", "dst": "dst"} {
+				block, err := m.Get(path, true)
+				if err != nil || string(block.Content) != content || block.Revision != 1 {
+					t.Errorf("Get(%s) after rollback = %+v, %v, want the first revision holding %s", path, block, err, content)
+				}
+			}
+			if _, err := m.Get("gone", false); !errors.Is(err, blocks.ErrNotFound) {
+				t.Errorf("Get(gone) after rollback error = %v, want ErrNotFound", err)
+			}
+			revisions, err := m.Revisions("keep")
+			if err != nil || len(revisions) != 1 {
+				t.Errorf("Revisions(keep) after rollback = %v, %v, want a single revision", revisions, err)
+			}
+		})
+	}
+}
+
+// testReadsDuringBatches checks that readers never see a batch half applied
+func testReadsDuringBatches(t *testing.T, m blocks.BlockManager) {
+	mustSet(t, m, "stable", "0")
+	if _, err := m.Batch(nil); errors.Is(err, blocks.ErrUnsupported) {
+		t.Skip("the storage does not support batches")
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// The block only leaves its path in the middle of a batch
+				if _, err := m.Get("stable", true); err != nil {
+					errs <- fmt.Errorf("Get() during batches error = %w", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 20; i++ {
+		mustBatch(t, m, []blocks.Operation{
+			{Type: blocks.OpMove, Path: "stable", To: "moving"},
+			{Type: blocks.OpSet, Path: "moving", Content: []byte(strconv.Itoa(i)), ContentType: "text/plain"},
+			{Type: blocks.OpMove, Path: "moving", To: "stable"},
+		})
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	block, err := m.Get("stable", true)
+	if err != nil || string(block.Content) != "20" || block.Revision != 21 {
+		t.Errorf("Get(stable) = %+v, %v, want revision 21 holding 20", block, err)
+	}
+}
+
+func testAttributes(t *testing.T, m blocks.BlockManager) {
+	err := m.Set("docs/a", strings.NewReader("a1"), "text/plain",
+		blocks.WithMetadata(map[string]string{"Author": "ada"}), blocks.WithTags("draft", "api", "draft"))
+	if err != nil {
+		t.Fatalf("Set() with attributes error = %v", err)
+	}
+	want := blocks.Attributes{Metadata: map[string]string{"author": "ada"}, Tags: []string{"api", "draft"}}
+	block, err := m.Get("docs/a", false)
+	if err != nil || !reflect.DeepEqual(block.Attributes, want) {
+		t.Errorf("Get() attributes = %+v, %v, want %+v", block.Attributes, err, want)
+	}
+
+	// Writing without options carries the attributes over, each option replaces its own
+	mustSet(t, m, "docs/a", "a2")
+	if err := m.Set("docs/a", strings.NewReader("a3"), "text/plain", blocks.WithTags("final")); err != nil {
+		t.Fatalf("Set() with tags error = %v", err)
+	}
+	block, err = m.Get("docs/a", false)
+	if err != nil || block.Metadata["author"] != "ada" || !slices.Equal(block.Tags, []string{"final"}) {
+		t.Errorf("Get() attributes after rewrites = %+v, %v, want author ada tagged final", block.Attributes, err)
+	}
+
+	revisions, err := m.Revisions("docs/a")
+	if err != nil || len(revisions) != 3 || !slices.Equal(revisions[0].Tags, []string{"api", "draft"}) {
+		t.Fatalf("Revisions() = %+v, %v, want the tags of each revision", revisions, err)
+	}
+	if err := m.Restore("docs/a", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	block, err = m.Get("docs/a", false)
+	if err != nil || !reflect.DeepEqual(block.Attributes, want) {
+		t.Errorf("Get() attributes after Restore() = %+v, %v, want %+v", block.Attributes, err, want)
+	}
+
+	if err := m.Copy("docs/a", "docs/b", false); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	block, err = m.Get("docs/b", false)
+	if err != nil || !reflect.DeepEqual(block.Attributes, want) {
+		t.Errorf("Get() attributes of a copy = %+v, %v, want %+v", block.Attributes, err, want)
+	}
+
+	reviewer := "grace"
+	err = blocks.PatchAttributes(m, "docs/b", blocks.AttributesPatch{
+		Metadata: map[string]*string{"author": nil, "Reviewer": &reviewer},
+	})
+	if err != nil {
+		t.Fatalf("PatchAttributes() error = %v", err)
+	}
+	block, err = m.Get("docs/b", true)
+	patched := blocks.Attributes{Metadata: map[string]string{"reviewer": "grace"}, Tags: []string{"api", "draft"}}
+	if err != nil || string(block.Content) != "a1" || block.Revision != 5 || !reflect.DeepEqual(block.Attributes, patched) {
+		t.Errorf("Get() after PatchAttributes() = %+v, %v, want a1 at revision 5 with %+v", block, err, patched)
+	}
+
+	mustSet(t, m, "docs/c", "c")
+	page, err := m.Children("docs", blocks.ListOptions{Tags: []string{"draft", "api"}})
+	if err != nil {
+		t.Fatalf("Children() error = %v", err)
+	}
+	paths := []string{}
+	for _, ref := range page.Items {
+		paths = append(paths, ref.Path)
+	}
+	if !slices.Equal(paths, []string{"docs/a", "docs/b"}) || !slices.Equal(page.Items[0].Tags, []string{"api", "draft"}) {
+		t.Errorf("Children() tagged draft and api = %+v, want docs/a and docs/b with their tags", page.Items)
+	}
+}
+
+func testInvalidAttributes(t *testing.T, m blocks.BlockManager) {
+	tests := []struct {
+		name string
+		opt  blocks.WriteOption
+	}{
+		{name: "invalid key", opt: blocks.WithMetadata(map[string]string{"a b": "c"})},
+		{name: "control character", opt: blocks.WithMetadata(map[string]string{"a": "b\nc"})},
+		{name: "too large", opt: blocks.WithMetadata(map[string]string{"a": strings.Repeat("b", blocks.MaxMetadataSize)})},
+		{name: "empty tag", opt: blocks.WithTags(" ")},
+		{name: "tag with a comma", opt: blocks.WithTags("a,b")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.Set("doc", strings.NewReader("doc"), "text/plain", tt.opt)
+			if !errors.Is(err, blocks.ErrInvalidMetadata) {
+				t.Errorf("Set() error = %v, want ErrInvalidMetadata", err)
+			}
+		})
+	}
+	if _, err := m.Get("doc", false); !errors.Is(err, blocks.ErrNotFound) {
+		t.Errorf("Get() after invalid writes error = %v, want ErrNotFound", err)
+	}
+}
+
+func testAuthorship(t *testing.T, m blocks.BlockManager) {
+	if err := m.Set("doc", strings.NewReader("v1"), "text/plain", blocks.WithAuthor("ada")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	first, err := m.Get("doc", false)
+	if err != nil || first.CreatedAt.IsZero() || !first.CreatedAt.Equal(first.UpdatedAt) || first.UpdatedBy != "ada" {
+		t.Fatalf("Get() = %+v, %v, want a block created and updated by ada at once", first, err)
+	}
+
+	// Every revision has its own author, the creation time is kept
+	mustSet(t, m, "doc", "v2")
+	block, err := m.Get("doc", false)
+	if err != nil || !block.CreatedAt.Equal(first.CreatedAt) || block.UpdatedAt.Before(first.UpdatedAt) || block.UpdatedBy != "" {
+		t.Errorf("Get() after an anonymous write = %+v, %v, want the creation time of %+v without author", block, err, first)
+	}
+	revisions, err := m.Revisions("doc")
+	if err != nil || len(revisions) != 2 || revisions[0].CreatedBy != "ada" || revisions[1].CreatedBy != "" {
+		t.Errorf("Revisions() = %+v, %v, want the first one by ada", revisions, err)
+	}
+	block, err = m.GetRevision("doc", 1, false)
+	if err != nil || block.UpdatedBy != "ada" || !block.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("GetRevision(1) = %+v, %v, want the revision by ada", block, err)
+	}
+
+	if err := m.Restore("doc", 1, blocks.WithAuthor("grace")); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if err := m.Move("doc", "moved", false); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	block, err = m.Get("moved", false)
+	if err != nil || block.UpdatedBy != "grace" || !block.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("Get() after Restore() and Move() = %+v, %v, want grace keeping the creation time", block, err)
+	}
+
+	// A deleted block starts over
+	if err := m.Delete("moved"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	mustSet(t, m, "moved", "new")
+	block, err = m.Get("moved", false)
+	if err != nil || !block.CreatedAt.After(first.CreatedAt) {
+		t.Errorf("Get() of a recreated block = %+v, %v, want a new creation time", block, err)
+	}
+
+	err = m.Set("doc", strings.NewReader("doc"), "text/plain", blocks.WithAuthor("a\nb"))
+	if !errors.Is(err, blocks.ErrInvalidMetadata) {
+		t.Errorf("Set() with an invalid author error = %v, want ErrInvalidMetadata", err)
+	}
+}
+
+func testExpiry(t *testing.T, m blocks.BlockManager) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	if err := m.Set("tmp/doc", strings.NewReader("v1"), "text/plain", blocks.WithExpiry(expiresAt)); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	block, err := m.Get("tmp/doc", false)
+	if err != nil || !block.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Get() = %+v, %v, want a block expiring at %v", block, err, expiresAt)
+	}
+	page, err := m.Children("tmp", blocks.ListOptions{})
+	if err != nil || len(page.Items) != 1 || !page.Items[0].ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Children() = %+v, %v, want tmp/doc expiring at %v", page.Items, err, expiresAt)
+	}
+
+	// Patches keep the expiry, writes without one and restores clear it
+	if err := blocks.PatchAttributes(m, "tmp/doc", blocks.AttributesPatch{Tags: []string{"draft"}}); err != nil {
+		t.Fatalf("PatchAttributes() error = %v", err)
+	}
+	if block, err := m.Get("tmp/doc", false); err != nil || !block.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Get() after PatchAttributes() = %+v, %v, want the expiry kept", block, err)
+	}
+	if err := m.Restore("tmp/doc", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if block, err := m.Get("tmp/doc", false); err != nil || !block.ExpiresAt.IsZero() {
+		t.Errorf("Get() after Restore() = %+v, %v, want no expiry", block, err)
+	}
+	mustSet(t, m, "tmp/doc", "v2")
+	if block, err := m.Get("tmp/doc", false); err != nil || !block.ExpiresAt.IsZero() {
+		t.Errorf("Get() after Set() = %+v, %v, want no expiry", block, err)
+	}
+
+	// Expired blocks are reaped with their subtree, the others are kept
+	past := time.Now().Add(-time.Minute)
+	for _, path := range []string{"tmp/gone", "tmp/doc/gone", "expired"} {
+		if err := m.Set(path, strings.NewReader(path), "text/plain", blocks.WithExpiry(past)); err != nil {
+			t.Fatalf("Set(%q) error = %v", path, err)
+		}
+	}
+	mustSet(t, m, "expired/child", "child")
+	if err := m.Set("tmp/later", strings.NewReader("later"), "text/plain", blocks.WithExpiry(expiresAt)); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	reaped, err := blocks.ReapExpired(m, blocks.NewLocker(), time.Now())
+	if err != nil {
+		t.Fatalf("ReapExpired() error = %v", err)
+	}
+	paths := []string{}
+	for _, ref := range reaped {
+		paths = append(paths, ref.Path)
+	}
+	slices.Sort(paths)
+	if want := []string{"expired", "tmp/doc/gone", "tmp/gone"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("ReapExpired() = %v, want %v", paths, want)
+	}
+	for _, path := range []string{"tmp/gone", "tmp/doc/gone", "expired", "expired/child"} {
+		if _, err := m.Get(path, false); !errors.Is(err, blocks.ErrNotFound) {
+			t.Errorf("Get(%q) after ReapExpired() error = %v, want ErrNotFound", path, err)
+		}
+	}
+	if got := listPaths(t, m, "tmp"); !reflect.DeepEqual(got, []string{"tmp/doc", "tmp/later"}) {
+		t.Errorf("List(tmp) after ReapExpired() = %v, want tmp/doc and tmp/later", got)
+	}
+}
+
+// mustBatch applies a batch, skipping the test on the storages without batches
+func mustBatch(t *testing.T, m blocks.BlockManager, ops []blocks.Operation) []blocks.OperationResult {
+	t.Helper()
+	results, err := m.Batch(ops)
+	if errors.Is(err, blocks.ErrUnsupported) {
+		t.Skip("the storage does not support batches")
+	}
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+	if len(results) != len(ops) {
+		t.Fatalf("Batch() returned %d results, want %d", len(results), len(ops))
+	}
+	return results
+}
+
+func mustSet(t *testing.T, m blocks.BlockManager, path string, content string) {
+	t.Helper()
+	if err := m.Set(path, strings.NewReader(content), "text/plain"); err != nil {
+		t.Fatalf("Set(%q) error = %v", path, err)
+	}
+}
+
+func listPaths(t *testing.T, m blocks.BlockManager, path string) []string {
+	t.Helper()
+	refs, err := m.List(path)
+	if err != nil {
+		t.Fatalf("List(%q) error = %v", path, err)
+	}
+	paths := []string{}
+	for _, ref := range refs {
+		paths = append(paths, ref.Path)
+	}
+	return paths
+}
@@ -0,0 +1,484 @@
+package blocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltBlocksBucket maps the path of a block to the metadata of its current revision
+	boltBlocksBucket = []byte("blocks")
+	// boltTreeBucket holds a "parent\x00name" key for every node of the hierarchy, so children are found with a prefix scan
+	boltTreeBucket = []byte("tree")
+	// boltRevisionsBucket maps "path\x00number" keys to the metadata of a revision
+	boltRevisionsBucket = []byte("revisions")
+	// boltDataBucket maps "path\x00number" keys to the content of a revision
+	boltDataBucket = []byte("data")
+)
+
+// DefaultBoltFileName is the database file used when no storage path is configured
+const DefaultBoltFileName = "goblocks.db"
+
+// boltSeparator splits the path from the rest of a key, paths never contain null bytes
+const boltSeparator = "\x00"
+
+// BoltBlockManager stores every block in a single bbolt file. Every write
+// is a transaction, so a block and its history are never partially updated.
+type BoltBlockManager struct {
+	db *bolt.DB
+}
+
+func NewBoltBlockManager(filePath string) (*BoltBlockManager, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, mapFsError(err)
+	}
+	// The file is locked by its owner, fail instead of waiting forever for another process
+	db, err := bolt.Open(filePath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, mapFsError(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBlocksBucket, boltTreeBucket, boltRevisionsBucket, boltDataBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Join(err, ErrUnknown)
+	}
+
+	return &BoltBlockManager{db: db}, nil
+}
+
+// Close releases the database file
+func (b *BoltBlockManager) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltBlockManager) List(p string) ([]BlockReference, error) {
+	references := []BlockReference{}
+	err := b.view(func(tx *bolt.Tx) error {
+		if !nodeExists(tx, p) {
+			return ErrNotFound
+		}
+		for _, name := range childNames(tx, p) {
+			references = append(references, BlockReference{Path: childPath(p, name)})
+		}
+		return nil
+	})
+	return references, err
+}
+
+func (b *BoltBlockManager) Children(p string, opts ListOptions) (ChildrenPage, error) {
+	refs := []BlockReference{}
+	err := b.view(func(tx *bolt.Tx) error {
+		if !nodeExists(tx, p) {
+			return ErrNotFound
+		}
+		for _, name := range childNames(tx, p) {
+			ref := BlockReference{Path: childPath(p, name)}
+			// Nodes without content of their own are listed without type nor size, like fs directories
+			if fileContent, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(ref.Path)); err == nil {
+				ref.Type = fileContent.ContentType
+				ref.Size = fileContent.Size
+				ref.UpdatedAt = fileContent.CreatedAt
+				ref.Tags = fileContent.Tags
+				ref.ExpiresAt = fileContent.ExpiresAt
+			}
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	return paginate(refs, opts)
+}
+
+func (b *BoltBlockManager) Get(p string, withContent bool) (Block, error) {
+	if withContent {
+		return readBlock(b.Open, p, 0)
+	}
+
+	var block Block
+	err := b.view(func(tx *bolt.Tx) error {
+		fileContent, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(p))
+		block = fileContent.toBlock(p)
+		return err
+	})
+	return block, err
+}
+
+func (b *BoltBlockManager) Open(p string, revision int) (Block, io.ReadSeekCloser, error) {
+	if revision < 0 {
+		return Block{}, nil, ErrInvalidRevision
+	}
+
+	var block Block
+	var content []byte
+	err := b.view(func(tx *bolt.Tx) error {
+		if revision == 0 {
+			current, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(p))
+			if err != nil {
+				return err
+			}
+			revision = current.Revision
+		}
+		fileContent, err := getFileContent(tx.Bucket(boltRevisionsBucket), revisionKey(p, revision))
+		if err != nil {
+			return err
+		}
+		block = fileContent.toBlock(p)
+		// Values are only valid during the transaction
+		content = bytes.Clone(tx.Bucket(boltDataBucket).Get(revisionKey(p, revision)))
+		return nil
+	})
+	if err != nil {
+		return Block{}, nil, err
+	}
+	return block, nopCloser{bytes.NewReader(content)}, nil
+}
+
+// Set buffers the content, values of the database being written at once
+func (b *BoltBlockManager) Set(p string, content io.Reader, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return errors.Join(err, ErrUnknown)
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		return setBlock(tx, p, data, contentType, opts)
+	})
+}
+
+// Link always fails with ErrUnknownBlob, contents are stored per revision and not addressed by their checksum
+func (b *BoltBlockManager) Link(p string, checksum string, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	return ErrUnknownBlob
+}
+
+func (b *BoltBlockManager) Delete(p string) error {
+	if err := validateReserved(p); err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		return deleteSubtree(tx, p)
+	})
+}
+
+func (b *BoltBlockManager) Move(from string, to string, overwrite bool) error {
+	return b.transfer(from, to, overwrite, true)
+}
+
+func (b *BoltBlockManager) Copy(from string, to string, overwrite bool) error {
+	return b.transfer(from, to, overwrite, false)
+}
+
+// transfer copies or moves a subtree in a single transaction, so the destination appears at once
+func (b *BoltBlockManager) transfer(from string, to string, overwrite bool, move bool) error {
+	err := validateTransfer(from, to)
+	if err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		return transferBolt(tx, from, to, overwrite, move)
+	})
+}
+
+// Batch applies the operations in a single transaction, which a failure rolls back
+func (b *BoltBlockManager) Batch(ops []Operation) ([]OperationResult, error) {
+	var written []*Block
+	var batchErr error
+	err := b.update(func(tx *bolt.Tx) error {
+		written, batchErr = applyBatch(ops, func(op Operation) (*Block, error) {
+			block, err := applyBolt(tx, op)
+			return block, mapBoltError(err)
+		})
+		return batchErr
+	})
+	if batchErr != nil {
+		err = batchErr
+	}
+	return batchResults(ops, written, err)
+}
+
+func (b *BoltBlockManager) Revisions(p string) ([]Revision, error) {
+	revisions := []Revision{}
+	err := b.view(func(tx *bolt.Tx) error {
+		if _, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(p)); err != nil {
+			return err
+		}
+		prefix := []byte(p + boltSeparator)
+		c := tx.Bucket(boltRevisionsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			fileContent := FileContent{}
+			if err := json.Unmarshal(v, &fileContent); err != nil {
+				return err
+			}
+			revisions = append(revisions, fileContent.toRevision())
+		}
+		return nil
+	})
+	return revisions, err
+}
+
+func (b *BoltBlockManager) GetRevision(p string, revision int, withContent bool) (Block, error) {
+	if revision <= 0 {
+		return Block{}, ErrInvalidRevision
+	}
+	if withContent {
+		return readBlock(b.Open, p, revision)
+	}
+
+	var block Block
+	err := b.view(func(tx *bolt.Tx) error {
+		fileContent, err := getFileContent(tx.Bucket(boltRevisionsBucket), revisionKey(p, revision))
+		block = fileContent.toBlock(p)
+		return err
+	})
+	return block, err
+}
+
+func (b *BoltBlockManager) Restore(p string, revision int, opts ...WriteOption) error {
+	if revision <= 0 {
+		return ErrInvalidRevision
+	}
+
+	return b.update(func(tx *bolt.Tx) error {
+		fileContent, err := getFileContent(tx.Bucket(boltRevisionsBucket), revisionKey(p, revision))
+		if err != nil {
+			return err
+		}
+		content := bytes.Clone(tx.Bucket(boltDataBucket).Get(revisionKey(p, revision)))
+		return setBlock(tx, p, content, fileContent.ContentType, append([]WriteOption{WithAttributes(fileContent.Attributes)}, opts...))
+	})
+}
+
+func (b *BoltBlockManager) view(fn func(tx *bolt.Tx) error) error {
+	return mapBoltError(b.db.View(fn))
+}
+
+func (b *BoltBlockManager) update(fn func(tx *bolt.Tx) error) error {
+	return mapBoltError(b.db.Update(fn))
+}
+
+// setBlock records a new revision of a block and makes it current
+func setBlock(tx *bolt.Tx, p string, content []byte, contentType string, opts []WriteOption) error {
+	number := 1
+	current, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(p))
+	if err == nil {
+		number = current.Revision + 1
+	}
+	attributes, err := writeAttributes(current.Attributes, opts)
+	if err != nil {
+		return err
+	}
+
+	created := blockCreatedAt(current, func() (FileContent, error) {
+		return getFileContent(tx.Bucket(boltRevisionsBucket), revisionKey(p, 1))
+	})
+
+	revision := newRevision(number, int64(len(content)), Checksum(content), contentType, attributes, writeAuthor(opts))
+	fileContent := newFileContent(revision, created)
+	metadata, err := json.Marshal(fileContent)
+	if err != nil {
+		return err
+	}
+
+	key := revisionKey(p, number)
+	if err := tx.Bucket(boltDataBucket).Put(key, content); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltRevisionsBucket).Put(key, metadata); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltBlocksBucket).Put([]byte(p), metadata); err != nil {
+		return err
+	}
+	return createNodes(tx, p)
+}
+
+// transferBolt copies or moves a subtree, replacing an existing destination when overwrite is set
+func transferBolt(tx *bolt.Tx, from string, to string, overwrite bool, move bool) error {
+	if !nodeExists(tx, from) {
+		return ErrNotFound
+	}
+	if nodeExists(tx, to) {
+		if !overwrite {
+			return ErrAlreadyExists
+		}
+		if err := deleteSubtree(tx, to); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range [][]byte{boltBlocksBucket, boltTreeBucket, boltRevisionsBucket, boltDataBucket} {
+		bucket := tx.Bucket(name)
+		for _, key := range subtreeKeys(bucket, from) {
+			target := append([]byte(to), key[len(from):]...)
+			if err := bucket.Put(target, bytes.Clone(bucket.Get(key))); err != nil {
+				return err
+			}
+			if !move {
+				continue
+			}
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	if move {
+		if err := tx.Bucket(boltTreeBucket).Delete(nodeKey(from)); err != nil {
+			return err
+		}
+	}
+	return createNodes(tx, to)
+}
+
+// applyBolt runs an operation of a batch within its transaction
+func applyBolt(tx *bolt.Tx, op Operation) (*Block, error) {
+	current, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(op.Path))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := checkMatch(op.IfMatch, entityTag(current.Checksum, current.ContentType, current.Attributes), err == nil); err != nil {
+		return nil, err
+	}
+
+	var target string
+	switch op.Type {
+	case OpSet:
+		target = op.Path
+		err = setBlock(tx, op.Path, op.Content, op.ContentType, op.Options)
+	case OpDelete:
+		return nil, deleteSubtree(tx, op.Path)
+	case OpMove:
+		target = op.To
+		err = transferBolt(tx, op.Path, op.To, op.Overwrite, true)
+	default:
+		return nil, ErrInvalidOperation
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block := Block{Path: target}
+	if fileContent, err := getFileContent(tx.Bucket(boltBlocksBucket), []byte(target)); err == nil {
+		block = fileContent.toBlock(target)
+	}
+	return &block, nil
+}
+
+// deleteSubtree removes a block with its history and all its descendants
+func deleteSubtree(tx *bolt.Tx, p string) error {
+	for _, name := range [][]byte{boltBlocksBucket, boltTreeBucket, boltRevisionsBucket, boltDataBucket} {
+		bucket := tx.Bucket(name)
+		for _, key := range subtreeKeys(bucket, p) {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	if p == "" {
+		return nil
+	}
+	return tx.Bucket(boltTreeBucket).Delete(nodeKey(p))
+}
+
+// subtreeKeys returns the keys of a bucket belonging to a path or to one of its descendants
+func subtreeKeys(bucket *bolt.Bucket, p string) [][]byte {
+	keys := [][]byte{}
+	c := bucket.Cursor()
+	prefix := []byte(p)
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		rest := string(k[len(prefix):])
+		if p == "" || rest == "" || strings.HasPrefix(rest, boltSeparator) || strings.HasPrefix(rest, "/") {
+			keys = append(keys, bytes.Clone(k))
+		}
+	}
+	return keys
+}
+
+// createNodes adds a path and its ancestors to the hierarchy
+func createNodes(tx *bolt.Tx, p string) error {
+	tree := tx.Bucket(boltTreeBucket)
+	for ; p != ""; p = parentPath(p) {
+		if err := tree.Put(nodeKey(p), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nodeExists(tx *bolt.Tx, p string) bool {
+	return p == "" || tx.Bucket(boltTreeBucket).Get(nodeKey(p)) != nil
+}
+
+// childNames returns the names of the children of a node, sorted
+func childNames(tx *bolt.Tx, p string) []string {
+	names := []string{}
+	prefix := []byte(p + boltSeparator)
+	c := tx.Bucket(boltTreeBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		names = append(names, string(k[len(prefix):]))
+	}
+	return names
+}
+
+func getFileContent(bucket *bolt.Bucket, key []byte) (FileContent, error) {
+	value := bucket.Get(key)
+	if value == nil {
+		return FileContent{}, ErrNotFound
+	}
+	fileContent := FileContent{}
+	if err := json.Unmarshal(value, &fileContent); err != nil {
+		return FileContent{}, err
+	}
+	return fileContent, nil
+}
+
+// nodeKey returns the key of a path in the tree bucket
+func nodeKey(p string) []byte {
+	return []byte(parentPath(p) + boltSeparator + path.Base(p))
+}
+
+// revisionKey returns the key of a revision, numbers are big endian so revisions are sorted
+func revisionKey(p string, number int) []byte {
+	return binary.BigEndian.AppendUint32([]byte(p+boltSeparator), uint32(number))
+}
+
+func parentPath(p string) string {
+	parent := path.Dir(p)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
+
+func mapBoltError(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrAlreadyExists) || errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrInvalidMetadata) {
+		return err
+	}
+	return errors.Join(err, ErrUnknown)
+}
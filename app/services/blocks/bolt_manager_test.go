@@ -0,0 +1,202 @@
+package blocks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestBoltBlockManager(t *testing.T) (*BoltBlockManager, string) {
+	t.Helper()
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	filePath := filepath.Join(tmpDir, "blocks.db")
+	manager, err := NewBoltBlockManager(filePath)
+	if err != nil {
+		t.Fatalf("NewBoltBlockManager() error = %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+	return manager, filePath
+}
+
+func listPaths(t *testing.T, m BlockManager, path string) []string {
+	t.Helper()
+	refs, err := m.List(path)
+	if err != nil {
+		t.Fatalf("List(%q) error = %v", path, err)
+	}
+	paths := []string{}
+	for _, ref := range refs {
+		paths = append(paths, ref.Path)
+	}
+	return paths
+}
+
+func TestBoltBlockManager_SetAndGet(t *testing.T) {
+	manager, filePath := newTestBoltBlockManager(t)
+
+	err := manager.Set("a/b/c", strings.NewReader("Hello, World!"), "text/plain")
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	block, err := manager.Get("a/b/c", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "Hello, World!" || block.Type != "text/plain" || block.Size != 13 || block.Revision != 1 {
+		t.Errorf("Get() = %+v, want the first revision of Hello, World!", block)
+	}
+
+	if _, err := manager.Get("a/b", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a parent without content error = %v, want ErrNotFound", err)
+	}
+
+	// Everything is persisted in the single file
+	manager.Close()
+	reopened, err := NewBoltBlockManager(filePath)
+	if err != nil {
+		t.Fatalf("NewBoltBlockManager() error = %v", err)
+	}
+	defer reopened.Close()
+	block, err = reopened.Get("a/b/c", true)
+	if err != nil || string(block.Content) != "Hello, World!" {
+		t.Errorf("Get() after reopening = %q, %v, want Hello, World!", block.Content, err)
+	}
+}
+
+func TestBoltBlockManager_List(t *testing.T) {
+	manager, _ := newTestBoltBlockManager(t)
+
+	manager.Set("a", strings.NewReader("a"), "text/plain")
+	manager.Set("a/c", strings.NewReader("c"), "text/plain")
+	manager.Set("a/b/d", strings.NewReader("d"), "text/plain")
+	// A sibling sharing the prefix must not show up under a
+	manager.Set("a-b/e", strings.NewReader("e"), "text/plain")
+
+	if got := listPaths(t, manager, ""); !slices.Equal(got, []string{"a", "a-b"}) {
+		t.Errorf("List(\"\") = %v, want [a a-b]", got)
+	}
+	if got := listPaths(t, manager, "a"); !slices.Equal(got, []string{"a/b", "a/c"}) {
+		t.Errorf("List(a) = %v, want [a/b a/c]", got)
+	}
+	if _, err := manager.List("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("List(missing) error = %v, want ErrNotFound", err)
+	}
+
+	page, err := manager.Children("a", ListOptions{SortBy: SortByName})
+	if err != nil {
+		t.Fatalf("Children() error = %v", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Type != "" || page.Items[1].Type != "text/plain" {
+		t.Errorf("Children() = %+v, want the a/b directory and the a/c block", page.Items)
+	}
+}
+
+func TestBoltBlockManager_Delete(t *testing.T) {
+	manager, _ := newTestBoltBlockManager(t)
+
+	manager.Set("a/b", strings.NewReader("b"), "text/plain")
+	manager.Set("a/b/c", strings.NewReader("c"), "text/plain")
+	manager.Set("a/bc", strings.NewReader("bc"), "text/plain")
+
+	if err := manager.Delete("a/b"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := manager.Get("a/b/c", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a deleted descendant error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Revisions("a/b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revisions() of a deleted block error = %v, want ErrNotFound", err)
+	}
+	if got := listPaths(t, manager, "a"); !slices.Equal(got, []string{"a/bc"}) {
+		t.Errorf("List(a) = %v, want [a/bc]", got)
+	}
+
+	// A recreated block starts a new history
+	manager.Set("a/b", strings.NewReader("new"), "text/plain")
+	if block, _ := manager.Get("a/b", false); block.Revision != 1 {
+		t.Errorf("Revision = %d, want 1", block.Revision)
+	}
+}
+
+func TestBoltBlockManager_Revisions(t *testing.T) {
+	manager, _ := newTestBoltBlockManager(t)
+
+	manager.Set("doc", strings.NewReader("v1"), "text/plain")
+	manager.Set("doc", strings.NewReader("version 2"), "text/markdown")
+
+	revisions, err := manager.Revisions("doc")
+	if err != nil {
+		t.Fatalf("Revisions() error = %v", err)
+	}
+	if len(revisions) != 2 || revisions[0].Number != 1 || revisions[1].ContentType != "text/markdown" {
+		t.Errorf("Revisions() = %+v, want 2 revisions in order", revisions)
+	}
+
+	if err := manager.Restore("doc", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	block, _ := manager.Get("doc", true)
+	if block.Revision != 3 || string(block.Content) != "v1" || block.Type != "text/plain" {
+		t.Errorf("Get() after restore = %+v, want v1 as revision 3", block)
+	}
+
+	old, err := manager.GetRevision("doc", 2, true)
+	if err != nil || string(old.Content) != "version 2" {
+		t.Errorf("GetRevision(2) = %q, %v, want version 2", old.Content, err)
+	}
+	if _, err := manager.GetRevision("doc", 4, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRevision(4) error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.GetRevision("doc", 0, false); !errors.Is(err, ErrInvalidRevision) {
+		t.Errorf("GetRevision(0) error = %v, want ErrInvalidRevision", err)
+	}
+}
+
+func TestBoltBlockManager_MoveAndCopy(t *testing.T) {
+	manager, _ := newTestBoltBlockManager(t)
+
+	manager.Set("docs/draft", strings.NewReader("draft"), "text/plain")
+	manager.Set("docs/draft", strings.NewReader("draft 2"), "text/plain")
+	manager.Set("docs/draft/appendix", strings.NewReader("appendix"), "text/plain")
+	manager.Set("docs/published", strings.NewReader("old"), "text/plain")
+
+	if err := manager.Copy("docs/draft", "docs/copy", false); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := manager.Move("docs/draft", "docs/published", false); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Move() onto an existing block error = %v, want ErrAlreadyExists", err)
+	}
+	if err := manager.Move("docs/draft", "docs/published", true); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+
+	for _, path := range []string{"docs/copy", "docs/published"} {
+		revisions, _ := manager.Revisions(path)
+		if len(revisions) != 2 {
+			t.Errorf("Revisions(%s) = %d, want the 2 revisions of the source", path, len(revisions))
+		}
+		appendix, err := manager.Get(path+"/appendix", true)
+		if err != nil || string(appendix.Content) != "appendix" {
+			t.Errorf("Get(%s/appendix) = %q, %v, want appendix", path, appendix.Content, err)
+		}
+	}
+	if _, err := manager.List("docs/draft"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("List() of the moved source error = %v, want ErrNotFound", err)
+	}
+	if got := listPaths(t, manager, "docs"); !slices.Equal(got, []string{"docs/copy", "docs/published"}) {
+		t.Errorf("List(docs) = %v, want [docs/copy docs/published]", got)
+	}
+	if err := manager.Copy("missing", "elsewhere", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Copy() of a missing block error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,89 @@
+package blocks_test
+
+import (
+	"context"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"goblocks/app/services/blocks/blockstest"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func tempDir(t *testing.T) string {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	return tmpDir
+}
+
+func TestFsBlockManager_Conformance(t *testing.T) {
+	blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+		return blocks.NewFsBlockManager(tempDir(t))
+	})
+}
+
+func TestInMemoryBlockManager_Conformance(t *testing.T) {
+	blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+		return blocks.NewInMemoryBlockManager()
+	})
+}
+
+func TestBoltBlockManager_Conformance(t *testing.T) {
+	blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+		manager, err := blocks.NewBoltBlockManager(filepath.Join(tempDir(t), "blocks.db"))
+		if err != nil {
+			t.Fatalf("NewBoltBlockManager() error = %v", err)
+		}
+		t.Cleanup(func() { manager.Close() })
+		return manager
+	})
+}
+
+func TestSqliteBlockManager_Conformance(t *testing.T) {
+	blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+		manager, err := blocks.NewSqliteBlockManager(filepath.Join(tempDir(t), "blocks.sqlite"))
+		if err != nil {
+			t.Fatalf("NewSqliteBlockManager() error = %v", err)
+		}
+		t.Cleanup(func() { manager.Close() })
+		return manager
+	})
+}
+
+func TestS3BlockManager_Conformance(t *testing.T) {
+	blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+		server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+		t.Cleanup(server.Close)
+
+		client := s3.New(s3.Options{
+			BaseEndpoint: aws.String(server.URL),
+			Region:       "us-east-1",
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+			UsePathStyle: true,
+		})
+		_, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String("goblocks")})
+		if err != nil {
+			t.Fatalf("CreateBucket() error = %v", err)
+		}
+		return blocks.NewS3BlockManager(client, "goblocks", "tenant/")
+	})
+}
+
+// The decorators added by NewBlockManager must not change the behavior of the storage they wrap
+func TestDecoratedBlockManager_Conformance(t *testing.T) {
+	blockstest.RunConformance(t, func(t *testing.T) blocks.BlockManager {
+		bus := blocks.NewEventBus(&config.Config{})
+		t.Cleanup(bus.Close)
+		return blocks.ExpireBlocks(blocks.PublishEvents(blocks.TrackReferences(blocks.EnforceQuotas(blocks.NewInMemoryBlockManager(), blocks.NewUsage(&config.Config{})), blocks.NewReferenceIndex()), bus))
+	})
+}
@@ -0,0 +1,358 @@
+package blocks
+
+import (
+	"errors"
+	"goblocks/app/config"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const EventCreated EventType = "created"
+const EventUpdated EventType = "updated"
+const EventDeleted EventType = "deleted"
+
+// EventReset starts the replay of a subscriber resuming after events the log no longer holds, which it
+// missed. Its id is the one before the oldest event kept.
+const EventReset EventType = "reset"
+
+var ErrEventBusClosed = errors.New("Event Bus Closed")
+
+// subscriberBuffer is the number of events a subscriber may lag behind before being dropped
+const subscriberBuffer = 64
+
+// Event describes a mutation of a block
+type Event struct {
+	ID          uint64    `json:"id"`
+	Type        EventType `json:"type"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size"`
+	Revision    int       `json:"revision,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// EventBus fans block events out to subscribers and keeps the most recent ones
+// in a bounded log so that subscribers can resume after a disconnection
+type EventBus struct {
+	mu          sync.Mutex
+	history     []Event
+	size        int
+	nextID      uint64
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// Subscription receives the events published under a path prefix.
+// Its channel is closed when the subscriber lags too far behind or the bus is closed.
+type Subscription struct {
+	Events <-chan Event
+	events chan Event
+	prefix string
+	bus    *EventBus
+}
+
+func NewEventBus(c *config.Config) *EventBus {
+	size := c.Blocks.Events.History
+	if size <= 0 {
+		size = 1
+	}
+	return &EventBus{
+		size: size,
+		// Ids are seeded from the clock so they keep increasing across restarts
+		nextID:      uint64(time.Now().UnixMicro()),
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish assigns an id to the event, records it and delivers it to the matching subscribers
+func (b *EventBus) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	event.ID = b.nextID
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+
+	for s := range b.subscribers {
+		if !s.matches(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			b.drop(s)
+		}
+	}
+	return event
+}
+
+// Subscribe returns the logged events after lastEventID matching prefix, followed by a subscription to the next ones.
+// The replay starts with an EventReset when events after lastEventID are no longer logged.
+func (b *EventBus) Subscribe(prefix string, lastEventID uint64) ([]Event, *Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil, ErrEventBusClosed
+	}
+
+	events := make(chan Event, subscriberBuffer)
+	s := &Subscription{Events: events, events: events, prefix: prefix, bus: b}
+	b.subscribers[s] = struct{}{}
+
+	replay := []Event{}
+	if lastEventID > 0 {
+		oldest := b.nextID + 1
+		if len(b.history) > 0 {
+			oldest = b.history[0].ID
+		}
+		if lastEventID < oldest-1 {
+			replay = append(replay, Event{ID: oldest - 1, Type: EventReset, Time: time.Now().UTC()})
+		}
+		for _, event := range b.history {
+			if event.ID > lastEventID && s.matches(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+	return replay, s, nil
+}
+
+// Close ends every subscription, used on shutdown so that streaming clients disconnect
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subscribers {
+		b.drop(s)
+	}
+}
+
+func (b *EventBus) drop(s *Subscription) {
+	delete(b.subscribers, s)
+	close(s.events)
+}
+
+// Cancel stops the subscription
+func (s *Subscription) Cancel() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		s.bus.drop(s)
+	}
+}
+
+func (s *Subscription) matches(event Event) bool {
+	return strings.HasPrefix(event.Path, s.prefix)
+}
+
+// eventPublisher publishes an event for every block changed through a BlockManager
+type eventPublisher struct {
+	BlockManager
+	bus *EventBus
+}
+
+// PublishEvents returns a BlockManager publishing the mutations of m on bus
+func PublishEvents(m BlockManager, bus *EventBus) BlockManager {
+	return &eventPublisher{m, bus}
+}
+
+func (p *eventPublisher) Set(path string, content io.Reader, contentType string, opts ...WriteOption) error {
+	_, err := p.BlockManager.Get(path, false)
+	eventType := EventUpdated
+	if errors.Is(err, ErrNotFound) {
+		eventType = EventCreated
+	}
+
+	err = p.BlockManager.Set(path, content, contentType, opts...)
+	if err != nil {
+		return err
+	}
+	p.publish(eventType, path)
+	return nil
+}
+
+func (p *eventPublisher) Link(path string, checksum string, contentType string, opts ...WriteOption) error {
+	_, err := p.BlockManager.Get(path, false)
+	eventType := EventUpdated
+	if errors.Is(err, ErrNotFound) {
+		eventType = EventCreated
+	}
+
+	err = p.BlockManager.Link(path, checksum, contentType, opts...)
+	if err != nil {
+		return err
+	}
+	p.publish(eventType, path)
+	return nil
+}
+
+func (p *eventPublisher) Restore(path string, revision int, opts ...WriteOption) error {
+	err := p.BlockManager.Restore(path, revision, opts...)
+	if err != nil {
+		return err
+	}
+	p.publish(EventUpdated, path)
+	return nil
+}
+
+func (p *eventPublisher) Delete(path string) error {
+	deleted := p.blocks(path)
+	err := p.BlockManager.Delete(path)
+	if err != nil {
+		return err
+	}
+	p.publishAll(EventDeleted, deleted)
+	return nil
+}
+
+func (p *eventPublisher) Move(from string, to string, overwrite bool) error {
+	moved := p.blocks(from)
+	replaced := p.blocks(to)
+	err := p.BlockManager.Move(from, to, overwrite)
+	if err != nil {
+		return err
+	}
+	p.publishAll(EventDeleted, moved)
+	p.publishTransferred(to, replaced)
+	return nil
+}
+
+func (p *eventPublisher) Copy(from string, to string, overwrite bool) error {
+	replaced := p.blocks(to)
+	err := p.BlockManager.Copy(from, to, overwrite)
+	if err != nil {
+		return err
+	}
+	p.publishTransferred(to, replaced)
+	return nil
+}
+
+// Batch publishes the changes of a committed batch by comparing the subtrees it touched
+// before and after it, a rolled back batch publishing nothing
+func (p *eventPublisher) Batch(ops []Operation) ([]OperationResult, error) {
+	paths := []string{}
+	for _, op := range ops {
+		paths = append(paths, op.Path)
+		if op.Type == OpMove {
+			paths = append(paths, op.To)
+		}
+	}
+	before := p.snapshot(paths)
+	results, err := p.BlockManager.Batch(ops)
+	if err != nil {
+		return results, err
+	}
+	after := p.snapshot(paths)
+
+	existing := map[string]Block{}
+	for _, block := range before {
+		existing[block.Path] = block
+	}
+	kept := map[string]bool{}
+	for _, block := range after {
+		kept[block.Path] = true
+	}
+	for _, block := range before {
+		if !kept[block.Path] {
+			p.bus.Publish(newEvent(EventDeleted, block))
+		}
+	}
+	for _, block := range after {
+		previous, ok := existing[block.Path]
+		switch {
+		case !ok:
+			p.bus.Publish(newEvent(EventCreated, block))
+		case previous.Revision != block.Revision || previous.Checksum != block.Checksum || !previous.UpdatedAt.Equal(block.UpdatedAt):
+			p.bus.Publish(newEvent(EventUpdated, block))
+		}
+	}
+	return results, nil
+}
+
+// snapshot returns the blocks with content of several subtrees, each once
+func (p *eventPublisher) snapshot(paths []string) []Block {
+	found := []Block{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		for _, block := range p.blocks(path) {
+			if !seen[block.Path] {
+				seen[block.Path] = true
+				found = append(found, block)
+			}
+		}
+	}
+	return found
+}
+
+// publishTransferred publishes the blocks written to a destination subtree, and the deletion of the replaced ones
+func (p *eventPublisher) publishTransferred(to string, replaced []Block) {
+	written := p.blocks(to)
+	existing := map[string]bool{}
+	for _, block := range replaced {
+		existing[block.Path] = true
+	}
+	for _, block := range written {
+		eventType := EventCreated
+		if existing[block.Path] {
+			eventType = EventUpdated
+			delete(existing, block.Path)
+		}
+		p.bus.Publish(newEvent(eventType, block))
+	}
+	for _, block := range replaced {
+		if existing[block.Path] {
+			p.bus.Publish(newEvent(EventDeleted, block))
+		}
+	}
+}
+
+// blocks returns the blocks with content of a subtree
+func (p *eventPublisher) blocks(path string) []Block {
+	found := []Block{}
+	Walk(p.BlockManager, path, func(path string) error {
+		block, err := p.BlockManager.Get(path, false)
+		if err == nil {
+			found = append(found, block)
+		}
+		return nil
+	})
+	return found
+}
+
+func (p *eventPublisher) publish(eventType EventType, path string) {
+	block, err := p.BlockManager.Get(path, false)
+	if err != nil {
+		block = Block{Path: path}
+	}
+	p.bus.Publish(newEvent(eventType, block))
+}
+
+func (p *eventPublisher) publishAll(eventType EventType, blocks []Block) {
+	for _, block := range blocks {
+		p.bus.Publish(newEvent(eventType, block))
+	}
+}
+
+func newEvent(eventType EventType, block Block) Event {
+	return Event{
+		Type:        eventType,
+		Path:        block.Path,
+		ContentType: block.Type,
+		Size:        block.Size,
+		Revision:    block.Revision,
+	}
+}
@@ -0,0 +1,157 @@
+package blocks
+
+import (
+	"goblocks/app/config"
+	"strings"
+	"testing"
+)
+
+func newTestEventBus(history int) *EventBus {
+	cfg := &config.Config{}
+	cfg.Blocks.Events.History = history
+	return NewEventBus(cfg)
+}
+
+func TestEventBus_SubscribeAndResume(t *testing.T) {
+	bus := newTestEventBus(3)
+
+	_, live, err := bus.Subscribe("docs/", 0)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	first := bus.Publish(Event{Type: EventCreated, Path: "docs/a"})
+	bus.Publish(Event{Type: EventCreated, Path: "images/b"})
+	bus.Publish(Event{Type: EventUpdated, Path: "docs/a"})
+	bus.Publish(Event{Type: EventDeleted, Path: "docs/a"})
+
+	if event := <-live.Events; event.ID != first.ID {
+		t.Errorf("first live event id = %d, want %d", event.ID, first.ID)
+	}
+	if event := <-live.Events; event.Type != EventUpdated {
+		t.Errorf("second live event = %v, want the update of docs/a", event)
+	}
+
+	// The log only keeps the last 3 events, the first one is gone
+	replay, resumed, err := bus.Subscribe("docs/", first.ID-1)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer resumed.Cancel()
+	if len(replay) != 3 || replay[0].Type != EventReset || replay[1].Type != EventUpdated || replay[2].Type != EventDeleted {
+		t.Fatalf("replay = %v, want a reset, then the update and the deletion of docs/a", replay)
+	}
+	if replay[0].ID != first.ID {
+		t.Errorf("reset id = %d, want the one before the oldest event kept %d", replay[0].ID, first.ID)
+	}
+
+	// Resuming within the log replays without reset
+	replay, again, _ := bus.Subscribe("docs/", first.ID)
+	again.Cancel()
+	if len(replay) != 2 || replay[0].Type != EventUpdated {
+		t.Errorf("replay = %v, want the update and the deletion of docs/a", replay)
+	}
+
+	live.Cancel()
+	bus.Close()
+	if _, ok := <-resumed.Events; ok {
+		t.Error("Close() should end the subscriptions")
+	}
+	if _, _, err := bus.Subscribe("", 0); err != ErrEventBusClosed {
+		t.Errorf("Subscribe() after close error = %v, want ErrEventBusClosed", err)
+	}
+}
+
+func TestEventBus_DropsLaggingSubscribers(t *testing.T) {
+	bus := newTestEventBus(10)
+	_, s, _ := bus.Subscribe("", 0)
+
+	for range subscriberBuffer + 1 {
+		bus.Publish(Event{Type: EventCreated, Path: "a"})
+	}
+
+	received := 0
+	for range s.Events {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("received %d events before being dropped, want %d", received, subscriberBuffer)
+	}
+}
+
+func TestPublishEvents(t *testing.T) {
+	bus := newTestEventBus(100)
+	manager := PublishEvents(NewInMemoryBlockManager(), bus)
+	_, s, _ := bus.Subscribe("", 0)
+	defer s.Cancel()
+
+	manager.Set("docs/a", strings.NewReader("v1"), "text/plain")
+	manager.Set("docs/a", strings.NewReader("v22"), "text/plain")
+	manager.Copy("docs/a", "copy/a", false)
+	manager.Move("docs/a", "moved/a", false)
+
+	expected := []struct {
+		eventType EventType
+		path      string
+	}{
+		{EventCreated, "docs/a"},
+		{EventUpdated, "docs/a"},
+		{EventCreated, "copy/a"},
+		{EventDeleted, "docs/a"},
+		{EventCreated, "moved/a"},
+	}
+	for i, want := range expected {
+		event := <-s.Events
+		if event.Type != want.eventType || event.Path != want.path {
+			t.Errorf("event %d = %s %s, want %s %s", i, event.Type, event.Path, want.eventType, want.path)
+		}
+	}
+
+	manager.Set("moved/a", strings.NewReader("v3"), "text/plain")
+	if event := <-s.Events; event.Revision != 3 || event.Size != 2 || event.ContentType != "text/plain" {
+		t.Errorf("update event = %+v, want revision 3 of size 2", event)
+	}
+}
+
+func TestPublishEvents_Batch(t *testing.T) {
+	bus := newTestEventBus(100)
+	manager := PublishEvents(NewInMemoryBlockManager(), bus)
+	manager.Set("docs/a", strings.NewReader("a"), "text/plain")
+	manager.Set("docs/b", strings.NewReader("b"), "text/plain")
+	_, s, _ := bus.Subscribe("", 0)
+	defer s.Cancel()
+
+	// A rolled back batch publishes nothing
+	_, err := manager.Batch([]Operation{
+		{Type: OpDelete, Path: "docs/a"},
+		{Type: OpSet, Path: "docs/b", Content: []byte("b2"), ContentType: "text/plain", IfMatch: "unknown"},
+	})
+	if err == nil {
+		t.Fatal("Batch() error = nil, want the failed precondition")
+	}
+
+	_, err = manager.Batch([]Operation{
+		{Type: OpSet, Path: "docs/b", Content: []byte("b2"), ContentType: "text/plain"},
+		{Type: OpMove, Path: "docs/a", To: "moved/a"},
+		{Type: OpSet, Path: "new", Content: []byte("new"), ContentType: "text/plain"},
+	})
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+
+	expected := []struct {
+		eventType EventType
+		path      string
+	}{
+		{EventDeleted, "docs/a"},
+		{EventUpdated, "docs/b"},
+		{EventCreated, "moved/a"},
+		{EventCreated, "new"},
+	}
+	for i, want := range expected {
+		event := <-s.Events
+		if event.Type != want.eventType || event.Path != want.path {
+			t.Errorf("event %d = %s %s, want %s %s", i, event.Type, event.Path, want.eventType, want.path)
+		}
+	}
+}
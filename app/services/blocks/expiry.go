@@ -0,0 +1,206 @@
+package blocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+var ErrInvalidExpiry = errors.New("Invalid Expiry")
+
+// expiringManager hides the expired blocks of a BlockManager until the reaper deletes them
+type expiringManager struct {
+	BlockManager
+	now func() time.Time
+}
+
+// ExpireBlocks returns a BlockManager on which expired blocks are not found. The children of an
+// expired block stay readable by their path until ReapExpired deletes the whole subtree.
+func ExpireBlocks(m BlockManager) BlockManager {
+	return &expiringManager{m, time.Now}
+}
+
+func (e *expiringManager) Get(path string, withContent bool) (Block, error) {
+	block, err := e.BlockManager.Get(path, withContent)
+	if err == nil && block.Expired(e.now()) {
+		return Block{}, ErrNotFound
+	}
+	return block, err
+}
+
+func (e *expiringManager) Open(path string, revision int) (Block, io.ReadSeekCloser, error) {
+	if err := e.check(path); err != nil {
+		return Block{}, nil, err
+	}
+	return e.BlockManager.Open(path, revision)
+}
+
+func (e *expiringManager) Children(path string, opts ListOptions) (ChildrenPage, error) {
+	if err := e.check(path); err != nil {
+		return ChildrenPage{}, err
+	}
+	page, err := e.BlockManager.Children(path, opts)
+	if err != nil {
+		return page, err
+	}
+	// Pages keep their cursor, so they may hold less than the limit
+	now := e.now()
+	page.Items = slices.DeleteFunc(page.Items, func(ref BlockReference) bool {
+		return expired(ref.ExpiresAt, now)
+	})
+	return page, nil
+}
+
+func (e *expiringManager) Revisions(path string) ([]Revision, error) {
+	if err := e.check(path); err != nil {
+		return nil, err
+	}
+	return e.BlockManager.Revisions(path)
+}
+
+func (e *expiringManager) GetRevision(path string, revision int, withContent bool) (Block, error) {
+	if err := e.check(path); err != nil {
+		return Block{}, err
+	}
+	return e.BlockManager.GetRevision(path, revision, withContent)
+}
+
+func (e *expiringManager) Restore(path string, revision int, opts ...WriteOption) error {
+	if err := e.check(path); err != nil {
+		return err
+	}
+	return e.BlockManager.Restore(path, revision, opts...)
+}
+
+func (e *expiringManager) Move(from string, to string, overwrite bool) error {
+	if err := e.check(from); err != nil {
+		return err
+	}
+	return e.BlockManager.Move(from, to, overwrite)
+}
+
+func (e *expiringManager) Copy(from string, to string, overwrite bool) error {
+	if err := e.check(from); err != nil {
+		return err
+	}
+	return e.BlockManager.Copy(from, to, overwrite)
+}
+
+// check returns ErrNotFound when the current revision of a block expired
+func (e *expiringManager) check(path string) error {
+	block, err := e.BlockManager.Get(path, false)
+	if err == nil && block.Expired(e.now()) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReapExpired deletes the blocks expired at now with their whole subtree and returns them.
+// Every block is locked while it is checked and deleted, so that a rewrite is never deleted.
+func ReapExpired(m BlockManager, locker *Locker, now time.Time) ([]BlockReference, error) {
+	// The reaper sees the blocks ExpireBlocks hides
+	if e, ok := m.(*expiringManager); ok {
+		m = e.BlockManager
+	}
+	reaped := []BlockReference{}
+	err := reap(m, locker, "", now, &reaped)
+	return reaped, err
+}
+
+func reap(m BlockManager, locker *Locker, path string, now time.Time, reaped *[]BlockReference) error {
+	opts := ListOptions{}
+	for {
+		page, err := m.Children(path, opts)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		for _, ref := range page.Items {
+			if !expired(ref.ExpiresAt, now) {
+				if err := reap(m, locker, ref.Path, now, reaped); err != nil {
+					return err
+				}
+				continue
+			}
+			deleted, err := reapBlock(m, locker, ref.Path, now)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				*reaped = append(*reaped, ref)
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// reapBlock deletes a block when it is still expired, holding it so that no write comes in between
+func reapBlock(m BlockManager, locker *Locker, path string, now time.Time) (bool, error) {
+	unlock := locker.Lock(path)
+	defer unlock()
+
+	// The block may have been rewritten since it was listed
+	block, err := m.Get(path, false)
+	if err != nil || !block.Expired(now) {
+		return false, nil
+	}
+	if err := m.Delete(path); err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	return true, nil
+}
+
+// reapExpired deletes the expired blocks on startup and then at every interval
+func reapExpired(lc fx.Lifecycle, m BlockManager, locker *Locker, interval time.Duration, log *slog.Logger) {
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	purge := func() {
+		reaped, err := ReapExpired(m, locker, time.Now())
+		for _, ref := range reaped {
+			log.Info(fmt.Sprintf("Block %s expired", ref.Path), "block.path", ref.Path, "block.expires_at", ref.ExpiresAt)
+		}
+		if err != nil {
+			log.Error("Unable to purge the expired blocks", "error", err)
+		}
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					purge()
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			wg.Wait()
+			return nil
+		},
+	})
+}
@@ -0,0 +1,124 @@
+package blocks
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/fx/fxtest"
+)
+
+func TestExpireBlocks(t *testing.T) {
+	storage := NewInMemoryBlockManager()
+	now := time.Now()
+	storage.Set("docs/tmp", strings.NewReader("tmp"), "text/plain", WithExpiry(now.Add(time.Minute)))
+	storage.Set("docs/tmp/child", strings.NewReader("child"), "text/plain")
+	storage.Set("docs/kept", strings.NewReader("kept"), "text/plain")
+
+	manager := &expiringManager{storage, func() time.Time { return now }}
+	if _, err := manager.Get("docs/tmp", false); err != nil {
+		t.Fatalf("Get() before the expiry error = %v", err)
+	}
+
+	manager.now = func() time.Time { return now.Add(time.Minute) }
+	if _, err := manager.Get("docs/tmp", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+	if _, _, err := manager.Open("docs/tmp", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Revisions("docs/tmp"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revisions() error = %v, want ErrNotFound", err)
+	}
+	if err := manager.Move("docs/tmp", "moved", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Move() error = %v, want ErrNotFound", err)
+	}
+	page, err := manager.Children("docs", ListOptions{})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Path != "docs/kept" {
+		t.Errorf("Children() = %+v, %v, want docs/kept only", page.Items, err)
+	}
+
+	// Children stay readable until the reaper deletes the subtree
+	if _, err := manager.Get("docs/tmp/child", false); err != nil {
+		t.Errorf("Get() of a child error = %v", err)
+	}
+	// Writing an expired block brings it back
+	if err := manager.Set("docs/tmp", strings.NewReader("new"), "text/plain"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if block, err := manager.Get("docs/tmp", true); err != nil || string(block.Content) != "new" {
+		t.Errorf("Get() after Set() = %+v, %v, want the new content", block, err)
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	bus := newTestEventBus(10)
+	defer bus.Close()
+	manager := PublishEvents(NewInMemoryBlockManager(), bus)
+	manager.Set("docs/tmp", strings.NewReader("tmp"), "text/plain", WithExpiry(time.Now().Add(-time.Second)))
+	manager.Set("docs/kept", strings.NewReader("kept"), "text/plain")
+
+	_, s, _ := bus.Subscribe("docs/tmp", 0)
+	defer s.Cancel()
+	output := &bytes.Buffer{}
+	lc := fxtest.NewLifecycle(t)
+	reapExpired(lc, manager, NewLocker(), time.Hour, slog.New(slog.NewTextHandler(output, nil)))
+	lc.RequireStart()
+	lc.RequireStop()
+
+	if _, err := manager.Get("docs/tmp", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of the expired block error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Get("docs/kept", false); err != nil {
+		t.Errorf("Get() of the kept block error = %v", err)
+	}
+	if !strings.Contains(output.String(), "block.path=docs/tmp") {
+		t.Errorf("log = %q, want the expiration of docs/tmp", output.String())
+	}
+	if event := <-s.Events; event.Type != EventDeleted || event.Path != "docs/tmp" {
+		t.Errorf("event = %v, want the deletion of docs/tmp", event)
+	}
+}
+
+// listedManager tells when the children of a path were listed
+type listedManager struct {
+	BlockManager
+	path   string
+	listed chan struct{}
+}
+
+func (l *listedManager) Children(path string, opts ListOptions) (ChildrenPage, error) {
+	page, err := l.BlockManager.Children(path, opts)
+	if path == l.path {
+		l.listed <- struct{}{}
+	}
+	return page, err
+}
+
+func TestReapExpired_Rewrite(t *testing.T) {
+	storage := NewInMemoryBlockManager()
+	storage.Set("docs/tmp", strings.NewReader("tmp"), "text/plain", WithExpiry(time.Now().Add(-time.Second)))
+	manager := &listedManager{storage, "docs", make(chan struct{}, 1)}
+	locker := NewLocker()
+
+	// A writer holds the block while the reaper lists it as expired, then rewrites it for good
+	unlock := locker.Lock("docs/tmp")
+	done := make(chan []BlockReference)
+	go func() {
+		reaped, _ := ReapExpired(manager, locker, time.Now())
+		done <- reaped
+	}()
+	<-manager.listed
+	storage.Set("docs/tmp", strings.NewReader("kept"), "text/plain")
+	unlock()
+
+	if reaped := <-done; len(reaped) != 0 {
+		t.Errorf("ReapExpired() = %v, want nothing once rewritten", reaped)
+	}
+	if block, err := storage.Get("docs/tmp", true); err != nil || string(block.Content) != "kept" {
+		t.Errorf("Get() = %s, %v, want the rewrite", block.Content, err)
+	}
+}
@@ -0,0 +1,339 @@
+package blocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// FsBatchesDirName holds the journal of a running batch, along with the blocks it deleted or replaced until it commits
+const FsBatchesDirName = ".batches"
+
+// FsJournalName is the journal of a batch in its directory, removing it commits the batch
+const FsJournalName = "journal"
+
+// fsBatch applies the operations of a batch in place and journals how to undo them
+type fsBatch struct {
+	manager *FsBlockManager
+	dir     string
+	parked  int
+	journal batchJournal
+	// undos are the changes of the batch, saved in its journal before they are made
+	undos []fsUndo
+	// failed are the changes which could not be undone, left in the journal for the recovery scan
+	failed []fsUndo
+}
+
+// fsUndo undoes a change of a batch, through paths relative to the base directory.
+// Undoing a change that was journaled but not made yet does nothing.
+type fsUndo struct {
+	// Remove is a directory created by the batch
+	Remove string `json:"remove,omitempty"`
+	// Renamed was moved to To, where it is taken back from
+	Renamed string `json:"renamed,omitempty"`
+	To      string `json:"to,omitempty"`
+	// Written is a block written in place: its previous .content, if any, is put back
+	// and the revisions it did not have are removed
+	Written   string `json:"written,omitempty"`
+	Previous  []byte `json:"previous,omitempty"`
+	Existed   bool   `json:"existed,omitempty"`
+	Revisions []int  `json:"revisions,omitempty"`
+}
+
+// Batch holds every other call off while it applies the operations, a failure undoing
+// the applied ones from a journal. Deleted and replaced blocks are renamed to a batch
+// directory, and only removed once the batch commits. The journal is saved in the
+// batch directory before every change, so that the recovery scan can undo a batch
+// interrupted by a crash.
+func (f *FsBlockManager) Batch(ops []Operation) ([]OperationResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gc.RLock()
+	defer f.gc.RUnlock()
+
+	batch := &fsBatch{
+		manager: f,
+		dir:     filepath.Join(f.baseDir, FsBatchesDirName, strconv.FormatInt(time.Now().UnixNano(), 10)),
+	}
+	written, err := applyBatch(ops, batch.apply)
+	return finishBatch(ops, &batch.journal, written, err)
+}
+
+func (b *fsBatch) apply(op Operation) (*Block, error) {
+	f := b.manager
+	current, err := readFileContent(f.getAbsoluteFilePath(op.Path))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := checkMatch(op.IfMatch, entityTag(current.Checksum, current.ContentType, current.Attributes), err == nil); err != nil {
+		return nil, err
+	}
+
+	switch op.Type {
+	case OpSet:
+		if err := b.journalSet(op.Path); err != nil {
+			return nil, err
+		}
+		if err := f.set(op.Path, bytes.NewReader(op.Content), op.ContentType, op.Options); err != nil {
+			return nil, err
+		}
+		return b.written(op.Path), nil
+
+	case OpDelete:
+		absolutePath := f.getAbsolutePath(op.Path)
+		if _, err := os.Stat(absolutePath); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, b.park(absolutePath)
+
+	case OpMove:
+		source := f.getAbsolutePath(op.Path)
+		if _, err := os.Stat(source); err != nil {
+			return nil, mapFsError(err)
+		}
+		destination := f.getAbsolutePath(op.To)
+		_, err := os.Stat(destination)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, mapFsError(err)
+		}
+		if err == nil {
+			if !op.Overwrite {
+				return nil, ErrAlreadyExists
+			}
+			if err := b.park(destination); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.mkdirAll(filepath.Dir(destination)); err != nil {
+			return nil, err
+		}
+		if err := b.rename(source, destination); err != nil {
+			return nil, err
+		}
+		return b.written(op.To), nil
+	}
+	return nil, ErrInvalidOperation
+}
+
+// journalSet records how to undo a write before it happens: the directories it creates are
+// removed, otherwise the previous .content is put back and the new revisions are removed
+func (b *fsBatch) journalSet(path string) error {
+	f := b.manager
+	if created := missingDir(f.getAbsolutePath(path)); created != "" {
+		return b.record(fsUndo{Remove: b.relative(created)})
+	}
+
+	numbers, err := f.revisionNumbers(path)
+	if err != nil {
+		return err
+	}
+	previous, err := os.ReadFile(f.getAbsoluteFilePath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return mapFsError(err)
+	}
+	return b.record(fsUndo{Written: path, Previous: previous, Existed: err == nil, Revisions: numbers})
+}
+
+// park moves a block out of the tree into the batch directory until the batch commits
+func (b *fsBatch) park(absolutePath string) error {
+	b.parked++
+	return b.rename(absolutePath, filepath.Join(b.dir, strconv.Itoa(b.parked)))
+}
+
+// rename moves a directory and journals the reverse rename
+func (b *fsBatch) rename(source string, destination string) error {
+	if err := b.record(fsUndo{Renamed: b.relative(source), To: b.relative(destination)}); err != nil {
+		return err
+	}
+	if err := os.Rename(source, destination); err != nil {
+		return mapFsError(err)
+	}
+	return syncRename(source, destination)
+}
+
+// mkdirAll creates a directory and journals the removal of the ones it created
+func (b *fsBatch) mkdirAll(dir string) error {
+	created := missingDir(dir)
+	if created == "" {
+		return nil
+	}
+	if err := b.record(fsUndo{Remove: b.relative(created)}); err != nil {
+		return err
+	}
+	return mkdirAll(dir)
+}
+
+// record saves how to undo a change in the journal of the batch, before the change is made.
+// The first change creates the batch directory, removed along with the journal once the
+// batch commits or every change was undone.
+func (b *fsBatch) record(undo fsUndo) error {
+	if len(b.undos) == 0 {
+		if err := mkdirAll(b.dir); err != nil {
+			return err
+		}
+		b.journal.onCommit(func() {
+			commitJournal(b.dir)
+		})
+		// Runs last, the journal is only removed once every change was undone
+		b.journal.onRollback(func() error {
+			if len(b.failed) > 0 {
+				return writeJournal(b.dir, b.failed)
+			}
+			return removeDir(b.dir)
+		})
+	}
+	b.undos = append(b.undos, undo)
+	if err := writeJournal(b.dir, b.undos); err != nil {
+		b.undos = b.undos[:len(b.undos)-1]
+		return err
+	}
+	b.journal.onRollback(func() error {
+		err := undo.apply(b.manager)
+		if err != nil {
+			// Changes are undone most recent first, the journal keeps them in the order they were made
+			b.failed = slices.Insert(b.failed, 0, undo)
+		}
+		return err
+	})
+	return nil
+}
+
+func (b *fsBatch) relative(absolutePath string) string {
+	relative, _ := filepath.Rel(b.manager.baseDir, absolutePath)
+	return relative
+}
+
+// apply undoes a change, doing nothing when it was not made
+func (u fsUndo) apply(f *FsBlockManager) error {
+	switch {
+	case u.Remove != "":
+		return removeDir(filepath.Join(f.baseDir, u.Remove))
+
+	case u.Renamed != "":
+		source := filepath.Join(f.baseDir, u.Renamed)
+		destination := filepath.Join(f.baseDir, u.To)
+		if _, err := os.Stat(destination); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err := os.Rename(destination, source); err != nil {
+			return mapFsError(err)
+		}
+		return syncRename(destination, source)
+
+	case u.Written != "":
+		// The .content goes back first so that it always has a matching revision
+		contentPath := f.getAbsoluteFilePath(u.Written)
+		if u.Existed {
+			if err := writeFileAtomic(contentPath, u.Previous); err != nil {
+				return err
+			}
+		} else if err := os.Remove(contentPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return mapFsError(err)
+		}
+		written, err := f.revisionNumbers(u.Written)
+		if err != nil {
+			return err
+		}
+		for _, number := range written {
+			if slices.Contains(u.Revisions, number) {
+				continue
+			}
+			if err := os.Remove(f.getAbsoluteRevisionFilePath(u.Written, number)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return mapFsError(err)
+			}
+		}
+	}
+	return nil
+}
+
+func writeJournal(dir string, undos []fsUndo) error {
+	data, err := json.Marshal(undos)
+	if err != nil {
+		return errors.Join(err, ErrUnknown)
+	}
+	return writeFileAtomic(filepath.Join(dir, FsJournalName), data)
+}
+
+// commitJournal removes the journal of a batch, which commits it, then the blocks it parked
+func commitJournal(dir string) {
+	if err := os.Remove(filepath.Join(dir, FsJournalName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if syncDir(dir) == nil {
+		removeDir(dir)
+	}
+}
+
+// recoverBatches undoes the batches interrupted by a crash, most recent change first,
+// and removes the blocks parked by the ones which committed
+func (f *FsBlockManager) recoverBatches() error {
+	batches := filepath.Join(f.baseDir, FsBatchesDirName)
+	entries, err := os.ReadDir(batches)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return mapFsError(err)
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(batches, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, FsJournalName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return mapFsError(err)
+		}
+		if err == nil {
+			var undos []fsUndo
+			if err := json.Unmarshal(data, &undos); err != nil {
+				return errors.Join(fmt.Errorf("journal of batch %s: %w", entry.Name(), err), ErrUnknown)
+			}
+			for _, undo := range slices.Backward(undos) {
+				if err := undo.apply(f); err != nil {
+					return fmt.Errorf("undoing batch %s: %w", entry.Name(), err)
+				}
+			}
+		}
+		if err := removeDir(dir); err != nil {
+			return err
+		}
+	}
+	return removeDir(batches)
+}
+
+// written describes the block found at a path after an operation, without content when it only has children
+func (b *fsBatch) written(path string) *Block {
+	block := Block{Path: path}
+	if fileContent, err := readFileContent(b.manager.getAbsoluteFilePath(path)); err == nil {
+		block = fileContent.toBlock(path)
+	}
+	return &block
+}
+
+// missingDir returns the shallowest directory missing along a path, empty when it exists
+func missingDir(dir string) string {
+	missing := ""
+	for current := dir; ; current = filepath.Dir(current) {
+		if _, err := os.Stat(current); err == nil || filepath.Dir(current) == current {
+			break
+		}
+		missing = current
+	}
+	return missing
+}
+
+// removeDir removes a directory with its content and makes the removal durable
+func removeDir(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return mapFsError(err)
+	}
+	err := syncDir(filepath.Dir(dir))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -1,114 +1,293 @@
 package blocks
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	FsFileName = ".content"
+	FsFileName         = ".content"
+	FsRevisionsDirName = ".revisions"
+	FsDataExtension    = ".data"
+	// FsTempPrefix names the files being written, left behind only by a crash
+	FsTempPrefix = ".tmp-"
 )
 
+// FsBlockManager stores every block in a directory holding its metadata and
+// revisions, contents are kept once in a content-addressed blob store shared
+// by all the blocks.
 type FsBlockManager struct {
 	baseDir string
+	blobs   *BlobStore
+	// mu is shared by every call and held exclusively by Batch, so that readers never see a batch half applied
+	mu sync.RWMutex
+	// gc is shared by the calls renaming blocks and held exclusively while CollectGarbage marks the
+	// referenced blobs, so that no revision is moved out of the way of its walk
+	gc sync.RWMutex
 }
 
 func NewFsBlockManager(baseDir string) *FsBlockManager {
-	return &FsBlockManager{baseDir: baseDir}
+	return &FsBlockManager{
+		baseDir: baseDir,
+		blobs:   NewBlobStore(filepath.Join(baseDir, FsBlobsDirName)),
+	}
 }
 
 func (f *FsBlockManager) Get(path string, withContent bool) (Block, error) {
-	file, err := os.Open(f.getAbsoluteFilePath(path))
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return Block{}, errors.Join(err, ErrNotFound)
-		}
-		if errors.Is(err, os.ErrPermission) {
-			return Block{}, errors.Join(err, ErrForbidden)
-		}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.get(path, withContent)
+}
 
-		return Block{}, errors.Join(err, ErrUnknown)
+func (f *FsBlockManager) get(path string, withContent bool) (Block, error) {
+	if withContent {
+		return readBlock(f.open, path, 0)
 	}
-	defer file.Close()
-	stat, err := file.Stat()
+
+	fileContent, err := readFileContent(f.getAbsoluteFilePath(path))
 	if err != nil {
-		return Block{}, errors.Join(err, ErrUnknown)
+		return Block{}, err
+	}
+
+	return fileContent.toBlock(path), nil
+}
+
+func (f *FsBlockManager) Open(path string, revision int) (Block, io.ReadSeekCloser, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.open(path, revision)
+}
+
+func (f *FsBlockManager) open(path string, revision int) (Block, io.ReadSeekCloser, error) {
+	if revision < 0 {
+		return Block{}, nil, ErrInvalidRevision
+	}
+
+	var fileContent FileContent
+	var err error
+	if revision > 0 {
+		fileContent, err = f.readRevision(path, revision)
+	} else {
+		fileContent, err = readFileContent(f.getAbsoluteFilePath(path))
 	}
-	content := make([]byte, stat.Size())
-	_, err = file.Read(content)
 	if err != nil {
-		if errors.Is(err, os.ErrPermission) {
-			return Block{}, errors.Join(err, ErrForbidden)
-		}
-		return Block{}, errors.Join(err, ErrUnknown)
+		return Block{}, nil, err
 	}
 
-	var fileContent = FileContent{}
-	err = json.Unmarshal(content, &fileContent)
+	// Blocks written before sidecar data files embed their content in the metadata
+	if fileContent.Revision == 0 || fileContent.Content != nil {
+		return fileContent.toBlock(path), nopCloser{bytes.NewReader(fileContent.Content)}, nil
+	}
+
+	data, err := f.blobs.Open(fileContent.Checksum)
+	if errors.Is(err, ErrUnknownBlob) {
+		// Blocks written before the blob store keep their content in a sidecar data file
+		data, err = os.Open(f.getAbsoluteRevisionDataPath(path, fileContent.Revision))
+	}
 	if err != nil {
-		return Block{}, errors.Join(err, ErrUnknown)
+		return Block{}, nil, mapFsError(err)
 	}
+	return fileContent.toBlock(path), data, nil
+}
+
+func (f *FsBlockManager) Set(path string, content io.Reader, contentType string, opts ...WriteOption) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.set(path, content, contentType, opts)
+}
 
-	block := Block{
-		Path: path,
-		Type: fileContent.ContentType,
-		Size: fileContent.Size,
+func (f *FsBlockManager) set(path string, content io.Reader, contentType string, opts []WriteOption) error {
+	if err := validateBlockPath(path); err != nil {
+		return err
 	}
-	if withContent {
-		block.Content = fileContent.Content
+	next, err := f.next(path, opts)
+	if err != nil {
+		return err
+	}
+	checksum, size, err := f.blobs.Put(content)
+	if err != nil {
+		return err
 	}
+	return f.record(path, size, checksum, contentType, next)
+}
+
+func (f *FsBlockManager) Link(path string, checksum string, contentType string, opts ...WriteOption) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 
-	return block, nil
+	return f.link(path, checksum, contentType, opts)
 }
 
-func (f *FsBlockManager) Set(path string, content []byte, contentType string) error {
-	//refFormat := "::ref(/a/b/c)"
-	err := os.MkdirAll(f.getAbsolutePath(path), 0755)
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		if errors.Is(err, os.ErrPermission) {
-			return errors.Join(err, ErrForbidden)
-		}
-		return errors.Join(err, ErrUnknown)
+func (f *FsBlockManager) BlobSize(checksum string) (int64, error) {
+	return f.blobs.Size(checksum)
+}
+
+func (f *FsBlockManager) link(path string, checksum string, contentType string, opts []WriteOption) error {
+	if err := validateBlockPath(path); err != nil {
+		return err
 	}
-	augmentedContent := FileContent{
-		Content:     content,
-		ContentType: contentType,
-		Size:        int64(len(content)),
+	next, err := f.next(path, opts)
+	if err != nil {
+		return err
 	}
+	size, err := f.blobs.Reference(checksum)
+	if err != nil {
+		return err
+	}
+	return f.record(path, size, checksum, contentType, next)
+}
 
-	jsonContent, err := json.Marshal(augmentedContent)
+// next returns the attributes, author and creation time of the next revision of a block, an
+// unreadable current revision having nothing to carry over
+func (f *FsBlockManager) next(path string, opts []WriteOption) (FileContent, error) {
+	current, _ := readFileContent(f.getAbsoluteFilePath(path))
+	attributes, err := writeAttributes(current.Attributes, opts)
 	if err != nil {
-		return errors.Join(err, ErrUnknown)
+		return FileContent{}, err
 	}
-	err = os.WriteFile(f.getAbsoluteFilePath(path), jsonContent, 0644)
+	created := blockCreatedAt(current, func() (FileContent, error) {
+		return readFileContent(f.getAbsoluteRevisionFilePath(path, 1))
+	})
+	return FileContent{CreatedBy: writeAuthor(opts), BlockCreatedAt: created, Attributes: attributes}, nil
+}
+
+// record writes a new revision of a block pointing at a stored blob
+func (f *FsBlockManager) record(path string, size int64, checksum string, contentType string, next FileContent) error {
+	err := mkdirAll(f.getAbsoluteRevisionsPath(path))
 	if err != nil {
-		if errors.Is(err, os.ErrPermission) {
-			return errors.Join(err, ErrForbidden)
+		return err
+	}
+
+	revisions, err := f.revisionNumbers(path)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		migrated, err := f.migrateLegacy(path)
+		if err != nil {
+			return err
+		}
+		if migrated {
+			revisions = []int{1}
 		}
-		return errors.Join(err, ErrUnknown)
+	}
+	number := 1
+	if len(revisions) > 0 {
+		number = revisions[len(revisions)-1] + 1
 	}
 
-	return nil
+	revision := newRevision(number, size, checksum, contentType, next.Attributes, next.CreatedBy)
+	augmentedContent := newFileContent(revision, next.BlockCreatedAt)
+
+	// The revision is written first so the current content always has a matching history entry
+	err = writeFileContent(f.getAbsoluteRevisionFilePath(path, number), augmentedContent)
+	if err != nil {
+		return err
+	}
+
+	return writeFileContent(f.getAbsoluteFilePath(path), augmentedContent)
 }
 
 func (f *FsBlockManager) Delete(path string) error {
-	err := os.RemoveAll(f.getAbsolutePath(path))
+	if err := validateReserved(path); err != nil {
+		return err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	absolutePath := f.getAbsolutePath(path)
+	err := os.RemoveAll(absolutePath)
 	if err != nil {
 		if errors.Is(err, os.ErrPermission) {
 			return errors.Join(err, ErrForbidden)
 		}
 		return errors.Join(err, ErrUnknown)
 	}
-	return nil
+	err = syncDir(filepath.Dir(absolutePath))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (f *FsBlockManager) Move(from string, to string, overwrite bool) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.gc.RLock()
+	defer f.gc.RUnlock()
+
+	err := validateTransfer(from, to)
+	if err != nil {
+		return err
+	}
+	source := f.getAbsolutePath(from)
+	if _, err := os.Stat(source); err != nil {
+		return mapFsError(err)
+	}
+
+	return replaceDir(source, f.getAbsolutePath(to), overwrite)
+}
 
+func (f *FsBlockManager) Copy(from string, to string, overwrite bool) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.gc.RLock()
+	defer f.gc.RUnlock()
+
+	err := validateTransfer(from, to)
+	if err != nil {
+		return err
+	}
+	source := f.getAbsolutePath(from)
+	if _, err := os.Stat(source); err != nil {
+		return mapFsError(err)
+	}
+
+	// The copy is staged in a hidden sibling so the destination appears at once
+	destination := f.getAbsolutePath(to)
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return mapFsError(err)
+	}
+	staging := hiddenSibling(destination, "copy")
+	err = copyDir(source, staging)
+	if err == nil {
+		err = replaceDir(staging, destination, overwrite)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+	}
+	return err
 }
 
 func (f *FsBlockManager) List(path string) ([]BlockReference, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.list(path)
+}
+
+func (f *FsBlockManager) list(path string) ([]BlockReference, error) {
 	entries, err := os.ReadDir(f.getAbsolutePath(path))
 	if err != nil {
+		// The base directory is only created by the first write
+		if path == "" && errors.Is(err, os.ErrNotExist) {
+			return []BlockReference{}, nil
+		}
 		if errors.Is(err, os.ErrPermission) {
 			return nil, errors.Join(err, ErrForbidden)
 		}
@@ -127,21 +306,505 @@ func (f *FsBlockManager) List(path string) ([]BlockReference, error) {
 			continue
 		}
 
-		references = append(references, BlockReference{Path: path + "/" + e.Name()})
+		references = append(references, BlockReference{Path: childPath(path, e.Name())})
 
 	}
 	return references, nil
 }
 
+func (f *FsBlockManager) Children(path string, opts ListOptions) (ChildrenPage, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	opts, err := opts.Validate()
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	refs, err := f.list(path)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+
+	// Sorting by name without filtering only needs the metadata of the returned page
+	if opts.SortBy == SortByName && len(opts.Tags) == 0 {
+		page, err := paginate(refs, opts)
+		if err != nil {
+			return ChildrenPage{}, err
+		}
+		f.describe(page.Items)
+		return page, nil
+	}
+
+	f.describe(refs)
+	return paginate(refs, opts)
+}
+
+// describe fills the type, size, modification time, tags and expiry of references, directories without content stay empty
+func (f *FsBlockManager) describe(refs []BlockReference) {
+	for i := range refs {
+		fileContent, err := readFileContent(f.getAbsoluteFilePath(refs[i].Path))
+		if err != nil {
+			continue
+		}
+		refs[i].Type = fileContent.ContentType
+		refs[i].Size = fileContent.Size
+		refs[i].UpdatedAt = fileContent.CreatedAt
+		refs[i].Tags = fileContent.Tags
+		refs[i].ExpiresAt = fileContent.ExpiresAt
+	}
+}
+
+func (f *FsBlockManager) Revisions(path string) ([]Revision, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if _, err := os.Stat(f.getAbsoluteFilePath(path)); err != nil {
+		return nil, mapFsError(err)
+	}
+	numbers, err := f.revisionNumbers(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(numbers) == 0 {
+		numbers = []int{1}
+	}
+
+	revisions := []Revision{}
+	for _, number := range numbers {
+		fileContent, err := f.readRevision(path, number)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, fileContent.toRevision())
+	}
+	return revisions, nil
+}
+
+func (f *FsBlockManager) GetRevision(path string, revision int, withContent bool) (Block, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.getRevision(path, revision, withContent)
+}
+
+func (f *FsBlockManager) getRevision(path string, revision int, withContent bool) (Block, error) {
+	if revision <= 0 {
+		return Block{}, ErrInvalidRevision
+	}
+	if withContent {
+		return readBlock(f.open, path, revision)
+	}
+
+	fileContent, err := f.readRevision(path, revision)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return fileContent.toBlock(path), nil
+}
+
+// readRevision reads the metadata of a revision. Blocks written before revisions were recorded have
+// none, their current content standing for their first revision.
+func (f *FsBlockManager) readRevision(path string, revision int) (FileContent, error) {
+	fileContent, err := readFileContent(f.getAbsoluteRevisionFilePath(path, revision))
+	if revision == 1 && errors.Is(err, ErrNotFound) {
+		if current, currentErr := readFileContent(f.getAbsoluteFilePath(path)); currentErr == nil && current.Revision == 0 {
+			return current, nil
+		}
+	}
+	return fileContent, err
+}
+
+// migrateLegacy records the current content of a block written before revisions were recorded as its
+// first revision, so that it stays in the history once the block is written again
+func (f *FsBlockManager) migrateLegacy(path string) (bool, error) {
+	current, err := readFileContent(f.getAbsoluteFilePath(path))
+	if err != nil || current.Revision != 0 {
+		return false, nil
+	}
+	checksum, size, err := f.blobs.Put(bytes.NewReader(current.Content))
+	if err != nil {
+		return false, err
+	}
+	current.Content = nil
+	current.Revision = 1
+	current.Checksum = checksum
+	current.Size = size
+	return true, writeFileContent(f.getAbsoluteRevisionFilePath(path, 1), current)
+}
+
+func (f *FsBlockManager) Restore(path string, revision int, opts ...WriteOption) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if revision <= 0 {
+		return ErrInvalidRevision
+	}
+	block, err := f.getRevision(path, revision, false)
+	if err != nil {
+		return err
+	}
+	opts = append([]WriteOption{WithAttributes(block.Attributes)}, opts...)
+	err = f.link(path, block.Checksum, block.Type, opts)
+	if !errors.Is(err, ErrUnknownBlob) {
+		return err
+	}
+
+	// Revisions written before the blob store are copied into it
+	block, content, err := f.open(path, revision)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return f.set(path, content, block.Type, opts)
+}
+
+// CollectGarbage marks the blobs referenced by any revision and sweeps the others. Moves, copies
+// and batches wait for the mark to end, the blobs written or linked meanwhile being recent enough
+// to be spared by the sweep.
+func (f *FsBlockManager) CollectGarbage() (int, error) {
+	before := time.Now().Add(-BlobGracePeriod)
+	referenced, err := f.markReferenced()
+	if err != nil {
+		return 0, err
+	}
+	return f.blobs.Sweep(referenced, before)
+}
+
+// markReferenced returns the checksums of the blobs referenced by any revision
+func (f *FsBlockManager) markReferenced() (map[string]bool, error) {
+	f.gc.Lock()
+	defer f.gc.Unlock()
+
+	referenced := map[string]bool{}
+	blobsDir := filepath.Join(f.baseDir, FsBlobsDirName)
+	err := filepath.WalkDir(f.baseDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Entries only vanish during the walk when blocks are deleted or temporary files renamed,
+			// the blobs of the revisions written meanwhile being spared by the grace period
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if filePath == blobsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Base(filepath.Dir(filePath)) != FsRevisionsDirName {
+			return nil
+		}
+		if _, err := strconv.Atoi(d.Name()); err != nil {
+			return nil
+		}
+		fileContent, err := readFileContent(filePath)
+		if err != nil {
+			// An unreadable revision could reference any blob, sweeping is not safe
+			return err
+		}
+		referenced[fileContent.Checksum] = true
+		return nil
+	})
+	if err != nil {
+		return nil, mapFsError(err)
+	}
+	return referenced, nil
+}
+
+// revisionNumbers returns the recorded revision numbers of a block in ascending order
+func (f *FsBlockManager) revisionNumbers(path string) ([]int, error) {
+	entries, err := os.ReadDir(f.getAbsoluteRevisionsPath(path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []int{}, nil
+		}
+		return nil, mapFsError(err)
+	}
+
+	numbers := []int{}
+	for _, e := range entries {
+		number, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	slices.Sort(numbers)
+	return numbers, nil
+}
+
 func (f *FsBlockManager) getAbsolutePath(path string) string {
 	return filepath.Join(f.baseDir, path)
 }
 func (f *FsBlockManager) getAbsoluteFilePath(path string) string {
 	return filepath.Join(f.baseDir, path, FsFileName)
 }
+func (f *FsBlockManager) getAbsoluteRevisionsPath(path string) string {
+	return filepath.Join(f.baseDir, path, FsRevisionsDirName)
+}
+func (f *FsBlockManager) getAbsoluteRevisionFilePath(path string, revision int) string {
+	return filepath.Join(f.baseDir, path, FsRevisionsDirName, strconv.Itoa(revision))
+}
+func (f *FsBlockManager) getAbsoluteRevisionDataPath(path string, revision int) string {
+	return f.getAbsoluteRevisionFilePath(path, revision) + FsDataExtension
+}
+
+// replaceDir renames source to destination. An existing destination is swapped
+// out first and put back if the rename fails.
+func replaceDir(source string, destination string, overwrite bool) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return mapFsError(err)
+	}
+
+	_, err := os.Stat(destination)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return mapFsError(err)
+	}
+	if err != nil {
+		if err := os.Rename(source, destination); err != nil {
+			return mapFsError(err)
+		}
+		return syncRename(source, destination)
+	}
+
+	if !overwrite {
+		return ErrAlreadyExists
+	}
+	trash := hiddenSibling(destination, "trash")
+	if err := os.Rename(destination, trash); err != nil {
+		return mapFsError(err)
+	}
+	if err := os.Rename(source, destination); err != nil {
+		os.Rename(trash, destination)
+		return mapFsError(err)
+	}
+	if err := syncRename(source, destination); err != nil {
+		return err
+	}
+	os.RemoveAll(trash)
+	return nil
+}
+
+// syncRename makes a directory rename durable by syncing both parents
+func syncRename(source string, destination string) error {
+	if err := syncDir(filepath.Dir(destination)); err != nil {
+		return err
+	}
+	if filepath.Dir(source) == filepath.Dir(destination) {
+		return nil
+	}
+	return syncDir(filepath.Dir(source))
+}
+
+// hiddenSibling returns a unique dot-prefixed path next to path, ignored by List
+func hiddenSibling(path string, kind string) string {
+	name := fmt.Sprintf(".%s.%s-%d", filepath.Base(path), kind, time.Now().UnixNano())
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+func copyDir(source string, destination string) error {
+	return filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relative)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target)
+	})
+}
 
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readFileContent(filePath string) (FileContent, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return FileContent{}, mapFsError(err)
+	}
+
+	var fileContent = FileContent{}
+	err = json.Unmarshal(content, &fileContent)
+	if err != nil {
+		return FileContent{}, errors.Join(err, ErrUnknown)
+	}
+	return fileContent, nil
+}
+
+func writeFileContent(filePath string, fileContent FileContent) error {
+	jsonContent, err := json.Marshal(fileContent)
+	if err != nil {
+		return errors.Join(err, ErrUnknown)
+	}
+	return writeFileAtomic(filePath, jsonContent)
+}
+
+// writeFileAtomic replaces a file so that a crash leaves either its old or its new content:
+// the data is written and synced to a temporary sibling, renamed over the file, then the rename is synced
+func writeFileAtomic(filePath string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), FsTempPrefix+"*")
+	if err != nil {
+		return mapFsError(err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return mapFsError(err)
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// syncDir flushes the entries of a directory, making the files created, renamed or removed in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return mapFsError(err)
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return mapFsError(err)
+	}
+	return nil
+}
+
+// mkdirAll creates a directory and its missing parents, syncing the parents of the created ones
+func mkdirAll(dir string) error {
+	missing := []string{}
+	for current := dir; ; current = filepath.Dir(current) {
+		if _, err := os.Stat(current); err == nil || filepath.Dir(current) == current {
+			break
+		}
+		missing = append(missing, current)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return mapFsError(err)
+	}
+	for _, created := range missing {
+		if err := syncDir(filepath.Dir(created)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapFsError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.Join(err, ErrNotFound)
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return errors.Join(err, ErrForbidden)
+	}
+	return errors.Join(err, ErrUnknown)
+}
+
+// FileContent is the metadata stored in a .content file, the content itself is the blob named after its checksum
 type FileContent struct {
-	Content     []byte `json:"content"`
-	ContentType string `json:"content_type"`
-	Size        int64  `json:"size"`
+	// Content is only set by blocks written before sidecar data files
+	Content     []byte    `json:"content,omitempty"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Revision    int       `json:"revision,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitzero"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	// BlockCreatedAt is the time of the first revision, carried over by the next ones
+	BlockCreatedAt time.Time `json:"block_created_at,omitzero"`
+	// Data names the object holding the content in a bucket, under the revisions of the block
+	Data string `json:"data,omitempty"`
+	Attributes
+}
+
+// newFileContent describes a new revision, created being the time of the first revision of the block or zero for a new block
+func newFileContent(revision Revision, created time.Time) FileContent {
+	if created.IsZero() {
+		created = revision.CreatedAt
+	}
+	return FileContent{
+		ContentType:    revision.ContentType,
+		Size:           revision.Size,
+		Revision:       revision.Number,
+		Checksum:       revision.Checksum,
+		CreatedAt:      revision.CreatedAt,
+		CreatedBy:      revision.CreatedBy,
+		BlockCreatedAt: created,
+		Attributes:     revision.Attributes,
+	}
+}
+
+// blockCreatedAt returns the time the block of a current revision was created, zero when there is no
+// current revision. Blocks written before it was recorded take the time of their first revision.
+func blockCreatedAt(current FileContent, first func() (FileContent, error)) time.Time {
+	if !current.BlockCreatedAt.IsZero() || current.Revision == 0 {
+		return current.BlockCreatedAt
+	}
+	fileContent, err := first()
+	if err != nil {
+		return time.Time{}
+	}
+	return fileContent.CreatedAt
+}
+
+func (fc FileContent) toBlock(path string) Block {
+	return Block{
+		Path:       path,
+		Type:       fc.ContentType,
+		Size:       fc.Size,
+		Revision:   max(fc.Revision, 1),
+		Checksum:   fc.Checksum,
+		CreatedAt:  fc.BlockCreatedAt,
+		UpdatedAt:  fc.CreatedAt,
+		UpdatedBy:  fc.CreatedBy,
+		Attributes: fc.Attributes,
+	}
+}
+
+func (fc FileContent) toRevision() Revision {
+	return Revision{
+		Number:      max(fc.Revision, 1),
+		CreatedAt:   fc.CreatedAt,
+		CreatedBy:   fc.CreatedBy,
+		ContentType: fc.ContentType,
+		Size:        fc.Size,
+		Checksum:    fc.Checksum,
+		Attributes:  fc.Attributes,
+	}
 }
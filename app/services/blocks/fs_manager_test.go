@@ -1,9 +1,16 @@
 package blocks
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestFsBlockManager_SetAndGet(t *testing.T) {
@@ -18,7 +25,7 @@ func TestFsBlockManager_SetAndGet(t *testing.T) {
 
 	// Test Set
 	content := []byte("Hello, World!")
-	err = manager.Set("a/b/c", content, "text/plain")
+	err = manager.Set("a/b/c", bytes.NewReader(content), "text/plain")
 	if err != nil {
 		t.Errorf("Set() error = %v", err)
 	}
@@ -85,9 +92,9 @@ func TestFsBlockManager_List(t *testing.T) {
 	manager := NewFsBlockManager(tmpDir)
 
 	// Create some blocks
-	manager.Set("a/file1", []byte("content1"), "text/plain")
-	manager.Set("a/file2", []byte("content2"), "text/plain")
-	manager.Set("a/b/file3", []byte("content3"), "text/plain")
+	manager.Set("a/file1", strings.NewReader("content1"), "text/plain")
+	manager.Set("a/file2", strings.NewReader("content2"), "text/plain")
+	manager.Set("a/b/file3", strings.NewReader("content3"), "text/plain")
 
 	// List children of "a"
 	refs, err := manager.List("a")
@@ -142,7 +149,7 @@ func TestFsBlockManager_Delete(t *testing.T) {
 	manager := NewFsBlockManager(tmpDir)
 
 	// Create a block
-	manager.Set("test/block", []byte("content"), "text/plain")
+	manager.Set("test/block", strings.NewReader("content"), "text/plain")
 
 	// Verify it exists
 	_, err = manager.Get("test/block", false)
@@ -179,10 +186,10 @@ func TestFsBlockManager_UpdateBlock(t *testing.T) {
 	manager := NewFsBlockManager(tmpDir)
 
 	// Create initial block
-	manager.Set("test", []byte("v1"), "text/plain")
+	manager.Set("test", strings.NewReader("v1"), "text/plain")
 
 	// Update it
-	manager.Set("test", []byte("v2"), "application/json")
+	manager.Set("test", strings.NewReader("v2"), "application/json")
 
 	// Verify update
 	block, err := manager.Get("test", true)
@@ -207,7 +214,7 @@ func TestFsBlockManager_FilePermissions(t *testing.T) {
 	manager := NewFsBlockManager(tmpDir)
 
 	// Create a block
-	manager.Set("test", []byte("content"), "text/plain")
+	manager.Set("test", strings.NewReader("content"), "text/plain")
 
 	// Check file permissions
 	filePath := filepath.Join(tmpDir, "test", FsFileName)
@@ -232,3 +239,498 @@ func isErrorType(err, target error) bool {
 	return err.Error() != "" && target != nil &&
 		(err == target || (len(err.Error()) > 0 && len(target.Error()) > 0))
 }
+
+func TestFsBlockManager_Revisions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+
+	manager.Set("test", strings.NewReader("v1"), "text/plain")
+	manager.Set("test", strings.NewReader("v2"), "application/json")
+
+	revisions, err := manager.Revisions("test")
+	if err != nil {
+		t.Fatalf("Revisions() error = %v", err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Revisions() returned %d items, want 2", len(revisions))
+	}
+	if revisions[0].Number != 1 || revisions[1].Number != 2 {
+		t.Errorf("Revisions() numbers = %d,%d, want 1,2", revisions[0].Number, revisions[1].Number)
+	}
+	if revisions[0].Checksum != Checksum([]byte("v1")) {
+		t.Errorf("Revisions() checksum = %v, want %v", revisions[0].Checksum, Checksum([]byte("v1")))
+	}
+	if revisions[0].CreatedAt.IsZero() {
+		t.Error("Revisions() created_at should be set")
+	}
+
+	block, err := manager.GetRevision("test", 1, true)
+	if err != nil {
+		t.Fatalf("GetRevision() error = %v", err)
+	}
+	if string(block.Content) != "v1" || block.Type != "text/plain" {
+		t.Errorf("GetRevision() = %s (%s), want v1 (text/plain)", block.Content, block.Type)
+	}
+
+	_, err = manager.GetRevision("test", 3, false)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRevision() error = %v, want ErrNotFound", err)
+	}
+
+	// The revisions directory must not show up as a child
+	refs, _ := manager.List("test")
+	if len(refs) != 0 {
+		t.Errorf("List() returned %d items, want 0", len(refs))
+	}
+}
+
+func TestFsBlockManager_Restore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+
+	manager.Set("test", strings.NewReader("v1"), "text/plain")
+	manager.Set("test", strings.NewReader("v2"), "application/json")
+
+	err = manager.Restore("test", 1)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	block, err := manager.Get("test", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "v1" || block.Type != "text/plain" {
+		t.Errorf("Get() = %s (%s), want v1 (text/plain)", block.Content, block.Type)
+	}
+	if block.Revision != 3 {
+		t.Errorf("Get() revision = %d, want 3", block.Revision)
+	}
+}
+
+func TestFsBlockManager_StoresContentOnce(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("images/a", strings.NewReader("Hello, World!"), "text/plain")
+	manager.Set("images/b", strings.NewReader("Hello, World!"), "text/plain")
+
+	// The metadata file must not embed the content anymore
+	metadata, err := os.ReadFile(filepath.Join(tmpDir, "images/a", FsFileName))
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if strings.Contains(string(metadata), `"content":`) {
+		t.Errorf("Metadata should not embed content, got %s", metadata)
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(tmpDir, FsBlobsDirName, "*", "*"))
+	checksum := Checksum([]byte("Hello, World!"))
+	if len(blobs) != 1 || filepath.Base(blobs[0]) != checksum {
+		t.Errorf("Blobs = %v, want a single blob named %s", blobs, checksum)
+	}
+
+	block, content, err := manager.Open("images/b", 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer content.Close()
+
+	data, _ := io.ReadAll(content)
+	if string(data) != "Hello, World!" {
+		t.Errorf("Open() content = %s, want Hello, World!", data)
+	}
+	if block.Size != 13 || block.Checksum != checksum {
+		t.Errorf("Open() block = %+v, want size 13 and matching checksum", block)
+	}
+}
+
+func TestFsBlockManager_Link(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("original", strings.NewReader("shared"), "text/plain")
+
+	err = manager.Link("copy", Checksum([]byte("shared")), "text/markdown")
+	if err != nil {
+		t.Fatalf("Link() error = %v", err)
+	}
+	block, err := manager.Get("copy", true)
+	if err != nil || string(block.Content) != "shared" {
+		t.Errorf("Get() = %s, %v, want shared", block.Content, err)
+	}
+	if block.Type != "text/markdown" || block.Size != 6 || block.Revision != 1 {
+		t.Errorf("Get() block = %+v, want text/markdown, size 6 and revision 1", block)
+	}
+
+	tests := []struct {
+		name     string
+		checksum string
+	}{
+		{name: "unknown content", checksum: Checksum([]byte("unknown"))},
+		{name: "invalid checksum", checksum: "../original"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := manager.Link("other", tt.checksum, "text/plain"); !errors.Is(err, ErrUnknownBlob) {
+				t.Errorf("Link() error = %v, want ErrUnknownBlob", err)
+			}
+		})
+	}
+}
+
+func TestFsBlockManager_CollectGarbage(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("kept", strings.NewReader("v1"), "text/plain")
+	manager.Set("kept", strings.NewReader("v2"), "text/plain")
+	manager.Set("shared", strings.NewReader("v2"), "text/plain")
+	manager.Set("deleted", strings.NewReader("orphan"), "text/plain")
+	manager.Delete("deleted")
+
+	// Blobs are only swept once the grace period is over
+	removed, err := manager.CollectGarbage()
+	if err != nil || removed != 0 {
+		t.Errorf("CollectGarbage() = %d, %v, want 0 within the grace period", removed, err)
+	}
+
+	old := time.Now().Add(-2 * BlobGracePeriod)
+	blobs, _ := filepath.Glob(filepath.Join(tmpDir, FsBlobsDirName, "*", "*"))
+	for _, blob := range blobs {
+		os.Chtimes(blob, old, old)
+	}
+	removed, err = manager.CollectGarbage()
+	if err != nil || removed != 1 {
+		t.Errorf("CollectGarbage() = %d, %v, want 1", removed, err)
+	}
+
+	// Old revisions keep their content
+	block, err := manager.GetRevision("kept", 1, true)
+	if err != nil || string(block.Content) != "v1" {
+		t.Errorf("GetRevision() = %s, %v, want v1", block.Content, err)
+	}
+	if err := manager.Link("restored", Checksum([]byte("orphan")), "text/plain"); !errors.Is(err, ErrUnknownBlob) {
+		t.Errorf("Link() error = %v, want ErrUnknownBlob", err)
+	}
+}
+
+func TestFsBlockManager_CollectGarbageDuringMoves(t *testing.T) {
+	tmpDir := t.TempDir()
+	manager := NewFsBlockManager(tmpDir)
+	for i := range 20 {
+		manager.Set(fmt.Sprintf("docs/%d", i), strings.NewReader(fmt.Sprintf("content %d", i)), "text/plain")
+	}
+	old := time.Now().Add(-2 * BlobGracePeriod)
+	blobs, _ := filepath.Glob(filepath.Join(tmpDir, FsBlobsDirName, "*", "*"))
+	for _, blob := range blobs {
+		os.Chtimes(blob, old, old)
+	}
+
+	// Subtrees renamed while the garbage is collected keep their content
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 50 {
+			from, to := "docs", "archive"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			if err := manager.Move(from, to, false); err != nil {
+				t.Errorf("Move() error = %v", err)
+				return
+			}
+		}
+	}()
+	for range 20 {
+		if _, err := manager.CollectGarbage(); err != nil {
+			t.Fatalf("CollectGarbage() error = %v", err)
+		}
+	}
+	<-done
+
+	for i := range 20 {
+		block, err := manager.Get(fmt.Sprintf("docs/%d", i), true)
+		if err != nil || string(block.Content) != fmt.Sprintf("content %d", i) {
+			t.Errorf("Get(docs/%d) = %q, %v, want its content", i, block.Content, err)
+		}
+	}
+}
+
+func TestFsBlockManager_ReadsLegacySidecarData(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "legacy", FsRevisionsDirName), 0755)
+	legacy := fmt.Sprintf(`{"content_type":"text/plain","size":5,"revision":1,"checksum":"%s"}`, Checksum([]byte("Hello")))
+	os.WriteFile(filepath.Join(tmpDir, "legacy", FsFileName), []byte(legacy), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "legacy", FsRevisionsDirName, "1"), []byte(legacy), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "legacy", FsRevisionsDirName, "1"+FsDataExtension), []byte("Hello"), 0644)
+
+	manager := NewFsBlockManager(tmpDir)
+	block, err := manager.Get("legacy", true)
+	if err != nil || string(block.Content) != "Hello" {
+		t.Errorf("Get() = %s, %v, want Hello", block.Content, err)
+	}
+
+	// Restoring copies the content into the blob store
+	if err := manager.Restore("legacy", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	block, err = manager.Get("legacy", true)
+	if err != nil || string(block.Content) != "Hello" || block.Revision != 2 {
+		t.Errorf("Get() = %s (revision %d), %v, want Hello at revision 2", block.Content, block.Revision, err)
+	}
+}
+
+func TestFsBlockManager_BackfillsCreationTime(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("legacy", strings.NewReader("v1"), "text/plain")
+	manager.Set("legacy", strings.NewReader("v2"), "text/plain")
+
+	// Blocks written before the creation time was recorded take the one of their first revision
+	created := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, filePath := range []string{manager.getAbsoluteRevisionFilePath("legacy", 1), manager.getAbsoluteFilePath("legacy")} {
+		fileContent, _ := readFileContent(filePath)
+		if fileContent.Revision == 1 {
+			fileContent.CreatedAt = created
+		}
+		fileContent.BlockCreatedAt = time.Time{}
+		writeFileContent(filePath, fileContent)
+	}
+
+	manager.Set("legacy", strings.NewReader("v3"), "text/plain")
+	block, err := manager.Get("legacy", false)
+	if err != nil || !block.CreatedAt.Equal(created) {
+		t.Errorf("Get() = %+v, %v, want the creation time of the first revision", block, err)
+	}
+}
+
+func TestFsBlockManager_ReadsLegacyInlineContent(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "legacy"), 0755)
+	legacy := `{"content":"SGVsbG8=","content_type":"text/plain","size":5}`
+	os.WriteFile(filepath.Join(tmpDir, "legacy", FsFileName), []byte(legacy), 0644)
+
+	manager := NewFsBlockManager(tmpDir)
+	block, err := manager.Get("legacy", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "Hello" {
+		t.Errorf("Get() content = %s, want Hello", block.Content)
+	}
+}
+
+func TestFsBlockManager_LegacyInlineRevisions(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tmpDir, "legacy"), 0755)
+	legacy := `{"content":"SGVsbG8=","content_type":"text/plain","size":5}`
+	os.WriteFile(filepath.Join(tmpDir, "legacy", FsFileName), []byte(legacy), 0644)
+	manager := NewFsBlockManager(tmpDir)
+
+	// The content of a block written before revisions were recorded is its first revision
+	revisions, err := manager.Revisions("legacy")
+	if err != nil || len(revisions) != 1 || revisions[0].Number != 1 || revisions[0].Size != 5 {
+		t.Fatalf("Revisions() = %+v, %v, want the current content as revision 1", revisions, err)
+	}
+	block, err := manager.GetRevision("legacy", 1, true)
+	if err != nil || string(block.Content) != "Hello" {
+		t.Fatalf("GetRevision(1) = %q, %v, want Hello", block.Content, err)
+	}
+
+	// and stays in the history once the block is written again
+	if err := manager.Set("legacy", strings.NewReader("World"), "text/plain"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	revisions, err = manager.Revisions("legacy")
+	if err != nil || len(revisions) != 2 || revisions[1].Number != 2 {
+		t.Fatalf("Revisions() after Set() = %+v, %v, want 2 revisions", revisions, err)
+	}
+	block, err = manager.GetRevision("legacy", 1, true)
+	if err != nil || string(block.Content) != "Hello" {
+		t.Errorf("GetRevision(1) after Set() = %q, %v, want Hello", block.Content, err)
+	}
+	block, err = manager.Get("legacy", true)
+	if err != nil || string(block.Content) != "World" || block.Revision != 2 {
+		t.Errorf("Get() = %+v, %v, want World as revision 2", block, err)
+	}
+}
+
+func TestFsBlockManager_FailedUploadKeepsCurrentContent(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("test", strings.NewReader("v1"), "text/plain")
+
+	err = manager.Set("test", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("broken"))), "text/plain")
+	if err == nil {
+		t.Fatal("Set() should fail when the content cannot be read")
+	}
+
+	block, err := manager.Get("test", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "v1" {
+		t.Errorf("Get() content = %s, want v1", block.Content)
+	}
+	revisions, _ := manager.Revisions("test")
+	if len(revisions) != 1 {
+		t.Errorf("Revisions() returned %d items, want 1", len(revisions))
+	}
+}
+
+func TestFsBlockManager_MoveAndCopy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("docs/draft", strings.NewReader("v1"), "text/plain")
+	manager.Set("docs/draft", strings.NewReader("v2"), "text/plain")
+	manager.Set("docs/draft/appendix", strings.NewReader("appendix"), "text/plain")
+	manager.Set("docs/published", strings.NewReader("old"), "text/plain")
+
+	err = manager.Move("docs/draft", "docs/published", false)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Move() error = %v, want ErrAlreadyExists", err)
+	}
+
+	err = manager.Move("docs/draft", "docs/published", true)
+	if err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	if _, err := manager.Get("docs/draft", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() source after move error = %v, want ErrNotFound", err)
+	}
+	block, err := manager.Get("docs/published/appendix", true)
+	if err != nil || string(block.Content) != "appendix" {
+		t.Errorf("Get() moved child = %s, %v, want appendix", block.Content, err)
+	}
+	revisions, _ := manager.Revisions("docs/published")
+	if len(revisions) != 2 {
+		t.Errorf("Revisions() after move returned %d items, want 2", len(revisions))
+	}
+
+	err = manager.Copy("docs/published", "archive/2024/published", false)
+	if err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	block, err = manager.Get("archive/2024/published", true)
+	if err != nil || string(block.Content) != "v2" {
+		t.Errorf("Get() copy = %s, %v, want v2", block.Content, err)
+	}
+	if _, err := manager.Get("docs/published", false); err != nil {
+		t.Errorf("Get() source after copy error = %v", err)
+	}
+
+	// Staging directories must not leak into listings
+	refs, _ := manager.List("archive/2024")
+	if len(refs) != 1 {
+		t.Errorf("List() returned %d items, want 1", len(refs))
+	}
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want error
+	}{
+		{name: "missing source", from: "missing", to: "elsewhere", want: ErrNotFound},
+		{name: "into itself", from: "docs", to: "docs/sub", want: ErrInvalidDestination},
+		{name: "onto its parent", from: "docs/published", to: "docs", want: ErrInvalidDestination},
+		{name: "root", from: "", to: "elsewhere", want: ErrInvalidDestination},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := manager.Move(tt.from, tt.to, true); !errors.Is(err, tt.want) {
+				t.Errorf("Move() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFsBlockManager_BatchParksReplacedBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("old", strings.NewReader("old"), "text/plain")
+	manager.Set("draft", strings.NewReader("draft"), "text/plain")
+
+	_, err = manager.Batch([]Operation{
+		{Type: OpMove, Path: "draft", To: "old", Overwrite: true},
+		{Type: OpSet, Path: "old/child", Content: []byte("child"), ContentType: "text/plain", IfMatch: "unknown"},
+	})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Batch() error = %v, want ErrPreconditionFailed", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, FsBatchesDirName)); err != nil {
+		t.Fatalf("Stat(.batches) error = %v, the batches directory should remain", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, FsBatchesDirName))
+	if len(entries) != 0 {
+		t.Errorf("ReadDir(.batches) after rollback = %v, want the parked blocks put back", entries)
+	}
+
+	_, err = manager.Batch([]Operation{
+		{Type: OpMove, Path: "draft", To: "old", Overwrite: true},
+		{Type: OpDelete, Path: "old"},
+	})
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+	entries, _ = os.ReadDir(filepath.Join(tmpDir, FsBatchesDirName))
+	if len(entries) != 0 {
+		t.Errorf("ReadDir(.batches) after commit = %v, want the parked blocks removed", entries)
+	}
+	if refs, _ := manager.List(""); len(refs) != 0 {
+		t.Errorf("List() after commit = %v, want no block", refs)
+	}
+}
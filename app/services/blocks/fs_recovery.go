@@ -0,0 +1,184 @@
+package blocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const FsQuarantineDirName = ".quarantine"
+
+// CorruptFile is a metadata file moved out of the way by a recovery scan
+type CorruptFile struct {
+	// Path is the block the file belonged to
+	Path string `json:"path"`
+	// File is the location of the file relative to the base directory
+	File string `json:"file"`
+	// Quarantine is where the file was moved, relative to the base directory
+	Quarantine string `json:"quarantine"`
+	Error      string `json:"error"`
+	// Restored is the revision a corrupt .content was rebuilt from, 0 when the block lost its content
+	Restored int `json:"restored,omitempty"`
+}
+
+// Recoverer is implemented by the storages able to repair themselves after a crash
+type Recoverer interface {
+	// Recover scans the storage on startup and returns the corrupt files it found
+	Recover() ([]CorruptFile, error)
+}
+
+// Recover undoes the batches interrupted by a crash, removes the temporary files left by
+// interrupted writes, and moves the unreadable metadata files to a timestamped directory
+// of .quarantine. A corrupt .content is rebuilt from the last readable revision of its
+// block, which is always written first.
+func (f *FsBlockManager) Recover() ([]CorruptFile, error) {
+	// Batches interrupted by a crash are undone first, putting back the blocks they parked
+	if err := f.recoverBatches(); err != nil {
+		return nil, err
+	}
+
+	var contents, revisions, temporaries []string
+	batches := filepath.Join(f.baseDir, FsBatchesDirName)
+	skipped := []string{filepath.Join(f.baseDir, FsBlobsDirName), filepath.Join(f.baseDir, FsQuarantineDirName), batches}
+	err := filepath.WalkDir(f.baseDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if slices.Contains(skipped, filePath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(name, FsTempPrefix):
+			temporaries = append(temporaries, filePath)
+		case name == FsFileName:
+			contents = append(contents, filePath)
+		case filepath.Base(filepath.Dir(filePath)) == FsRevisionsDirName:
+			if _, err := strconv.Atoi(name); err == nil {
+				revisions = append(revisions, filePath)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, mapFsError(err)
+	}
+
+	for _, temporary := range temporaries {
+		os.Remove(temporary)
+	}
+
+	quarantine := filepath.Join(f.baseDir, FsQuarantineDirName, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	corrupt := []CorruptFile{}
+	// Revisions go first so that corrupt .content files are rebuilt from readable ones only
+	for _, filePath := range slices.Concat(revisions, contents) {
+		_, err := readFileContent(filePath)
+		if !isCorrupt(err) {
+			continue
+		}
+		file, err := f.quarantine(filePath, quarantine, err)
+		if err != nil {
+			return corrupt, err
+		}
+		if filepath.Base(filePath) == FsFileName {
+			file.Restored, err = f.rebuildFileContent(file.Path)
+			if err != nil {
+				return corrupt, err
+			}
+		}
+		corrupt = append(corrupt, file)
+	}
+	return corrupt, nil
+}
+
+// quarantine moves a corrupt file below the quarantine directory, keeping its relative location
+func (f *FsBlockManager) quarantine(filePath string, quarantine string, cause error) (CorruptFile, error) {
+	relative, err := filepath.Rel(f.baseDir, filePath)
+	if err != nil {
+		return CorruptFile{}, errors.Join(err, ErrUnknown)
+	}
+	blockDir := filepath.Dir(relative)
+	if filepath.Base(blockDir) == FsRevisionsDirName {
+		blockDir = filepath.Dir(blockDir)
+	}
+	if blockDir == "." {
+		blockDir = ""
+	}
+	file := CorruptFile{
+		Path:       filepath.ToSlash(blockDir),
+		File:       filepath.ToSlash(relative),
+		Quarantine: filepath.ToSlash(filepath.Join(FsQuarantineDirName, filepath.Base(quarantine), relative)),
+		Error:      cause.Error(),
+	}
+
+	target := filepath.Join(quarantine, relative)
+	if err := mkdirAll(filepath.Dir(target)); err != nil {
+		return CorruptFile{}, err
+	}
+	if err := os.Rename(filePath, target); err != nil {
+		return CorruptFile{}, mapFsError(err)
+	}
+	return file, syncDir(filepath.Dir(filePath))
+}
+
+// rebuildFileContent points a block at its last readable revision, returning 0 when it has none
+func (f *FsBlockManager) rebuildFileContent(path string) (int, error) {
+	numbers, err := f.revisionNumbers(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, number := range slices.Backward(numbers) {
+		fileContent, err := readFileContent(f.getAbsoluteRevisionFilePath(path, number))
+		if err != nil {
+			continue
+		}
+		return number, writeFileContent(f.getAbsoluteFilePath(path), fileContent)
+	}
+	return 0, nil
+}
+
+// isCorrupt reports whether a metadata file could be read but not decoded
+func isCorrupt(err error) bool {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	return errors.As(err, &syntaxError) || errors.As(err, &typeError)
+}
+
+// recoverStorage runs the recovery scan of a storage and reports the corrupt files it found
+func recoverStorage(recoverer Recoverer, log *slog.Logger) error {
+	corrupt, err := recoverer.Recover()
+	for _, file := range corrupt {
+		message := fmt.Sprintf("Quarantined corrupt %s of block %q", file.File, file.Path)
+		if file.Restored > 0 {
+			message += fmt.Sprintf(", restored to revision %d", file.Restored)
+		}
+		log.Warn(message,
+			"block.path", file.Path,
+			"recovery.file", file.File,
+			"recovery.quarantine", file.Quarantine,
+			"recovery.restored", file.Restored,
+			"error", file.Error,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("recovery scan: %w", err)
+	}
+	if len(corrupt) > 0 {
+		log.Warn(fmt.Sprintf("Recovery scan quarantined %d corrupt files", len(corrupt)), "recovery.corrupt", len(corrupt))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package blocks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFsBlockManager_Recover(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("healthy", strings.NewReader("healthy"), "text/plain")
+	manager.Set("docs/crashed", strings.NewReader("v1"), "text/plain")
+	manager.Set("docs/crashed", strings.NewReader("v2"), "text/plain")
+	manager.Set("twice", strings.NewReader("v1"), "text/plain")
+	manager.Set("twice", strings.NewReader("v2"), "text/plain")
+
+	// A crash while writing the current metadata truncates it
+	os.WriteFile(filepath.Join(tmpDir, "docs/crashed", FsFileName), []byte(`{"content_type":"te`), 0644)
+	// A crash while writing a revision truncates both files
+	os.WriteFile(filepath.Join(tmpDir, "twice", FsRevisionsDirName, "2"), []byte{}, 0644)
+	os.WriteFile(filepath.Join(tmpDir, "twice", FsFileName), []byte{}, 0644)
+	// Legacy blocks have no revision to be rebuilt from
+	os.MkdirAll(filepath.Join(tmpDir, "legacy"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "legacy", FsFileName), []byte(`{"content":`), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "docs", FsTempPrefix+"123"), []byte("partial"), 0644)
+	// A crash during a batch leaves the blocks it deleted parked, with corrupt files ignored
+	os.MkdirAll(filepath.Join(tmpDir, FsBatchesDirName, "1", "1"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, FsBatchesDirName, "1", "1", FsFileName), []byte(`{`), 0644)
+
+	corrupt, err := manager.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	reported := map[string]CorruptFile{}
+	for _, file := range corrupt {
+		reported[file.File] = file
+	}
+	expected := map[string]struct {
+		path     string
+		restored int
+	}{
+		"docs/crashed/.content": {path: "docs/crashed", restored: 2},
+		"twice/.revisions/2":    {path: "twice", restored: 0},
+		"twice/.content":        {path: "twice", restored: 1},
+		"legacy/.content":       {path: "legacy", restored: 0},
+	}
+	if len(corrupt) != len(expected) {
+		t.Errorf("Recover() returned %d files, want %d: %+v", len(corrupt), len(expected), corrupt)
+	}
+	for file, want := range expected {
+		got, ok := reported[file]
+		if !ok {
+			t.Errorf("Recover() did not report %s", file)
+			continue
+		}
+		if got.Path != want.path || got.Restored != want.restored || got.Error == "" {
+			t.Errorf("Recover() %s = %+v, want block %s restored to %d", file, got, want.path, want.restored)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, got.Quarantine)); err != nil {
+			t.Errorf("Quarantined %s is missing: %v", file, err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		content string
+	}{
+		{path: "healthy", content: "healthy"},
+		{path: "docs/crashed", content: "v2"},
+		{path: "twice", content: "v1"},
+	}
+	for _, tt := range tests {
+		block, err := manager.Get(tt.path, true)
+		if err != nil || string(block.Content) != tt.content {
+			t.Errorf("Get(%s) after recovery = %s, %v, want %s", tt.path, block.Content, err, tt.content)
+		}
+	}
+	if _, err := manager.Get("legacy", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(legacy) after recovery error = %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "docs", FsTempPrefix+"123")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Temporary file should be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, FsBatchesDirName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Interrupted batches should be removed, got %v", err)
+	}
+
+	// The next writes carry on with the history
+	manager.Set("twice", strings.NewReader("v3"), "text/plain")
+	block, _ := manager.Get("twice", false)
+	if block.Revision != 2 {
+		t.Errorf("Get() revision after recovery = %d, want 2", block.Revision)
+	}
+
+	corrupt, err = manager.Recover()
+	if err != nil || len(corrupt) != 0 {
+		t.Errorf("Recover() on a healthy storage = %+v, %v, want nothing", corrupt, err)
+	}
+}
+
+func TestFsBlockManager_RecoverInterruptedBatch(t *testing.T) {
+	tmpDir := t.TempDir()
+	manager := NewFsBlockManager(tmpDir)
+	manager.Set("docs/index", strings.NewReader("index v1"), "text/plain")
+	manager.Set("docs/old", strings.NewReader("old"), "text/plain")
+	manager.Set("draft", strings.NewReader("draft"), "text/plain")
+	manager.Set("published", strings.NewReader("published"), "text/plain")
+
+	// A crash after the batch parked the blocks it deletes and replaces, before it commits
+	batch := &fsBatch{manager: manager, dir: filepath.Join(tmpDir, FsBatchesDirName, "1")}
+	ops := []Operation{
+		{Type: OpSet, Path: "docs/index", Content: []byte("index v2"), ContentType: "text/plain"},
+		{Type: OpDelete, Path: "docs/old"},
+		{Type: OpMove, Path: "draft", To: "published", Overwrite: true},
+		{Type: OpSet, Path: "new/block", Content: []byte("new"), ContentType: "text/plain"},
+	}
+	for _, op := range ops {
+		if _, err := batch.apply(op); err != nil {
+			t.Fatalf("apply(%s %s) error = %v", op.Type, op.Path, err)
+		}
+	}
+
+	recovered := NewFsBlockManager(tmpDir)
+	if _, err := recovered.Recover(); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	tests := []struct {
+		path     string
+		content  string
+		revision int
+	}{
+		{path: "docs/index", content: "index v1", revision: 1},
+		{path: "docs/old", content: "old", revision: 1},
+		{path: "draft", content: "draft", revision: 1},
+		{path: "published", content: "published", revision: 1},
+	}
+	for _, tt := range tests {
+		block, err := recovered.Get(tt.path, true)
+		if err != nil || string(block.Content) != tt.content || block.Revision != tt.revision {
+			t.Errorf("Get(%s) after recovery = %q revision %d, %v, want %q revision %d", tt.path, block.Content, block.Revision, err, tt.content, tt.revision)
+		}
+	}
+	if _, err := recovered.Get("new", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(new) after recovery error = %v, want the directories of the batch removed", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, FsBatchesDirName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Undone batches should be removed, got %v", err)
+	}
+
+	// A batch whose journal is gone had committed, only its parked blocks are left to remove
+	manager.Batch([]Operation{{Type: OpDelete, Path: "docs/old"}})
+	os.MkdirAll(filepath.Join(tmpDir, FsBatchesDirName, "2", "1"), 0755)
+	if _, err := recovered.Recover(); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if _, err := recovered.Get("docs/old", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(docs/old) after a committed batch error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := filepath.Join(tmpDir, FsFileName)
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(filePath, []byte(content)); err != nil {
+			t.Fatalf("writeFileAtomic() error = %v", err)
+		}
+		data, _ := os.ReadFile(filePath)
+		if string(data) != content {
+			t.Errorf("Content = %s, want %s", data, content)
+		}
+	}
+
+	info, _ := os.Stat(filePath)
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("Mode = %v, want 0644", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(tmpDir)
+	if len(entries) != 1 {
+		t.Errorf("Directory holds %d entries, want only the written file", len(entries))
+	}
+
+	err = writeFileAtomic(filepath.Join(tmpDir, "missing", FsFileName), []byte("content"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("writeFileAtomic() in a missing directory error = %v, want ErrNotFound", err)
+	}
+}
@@ -1,77 +1,483 @@
 package blocks
 
 import (
-	"path"
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
+// InMemoryBlockManager keeps blocks in a tree mirroring their paths, so
+// listing a block only visits its children and deleting or moving one
+// detaches its whole subtree at once.
 type InMemoryBlockManager struct {
-	blocks sync.Map
+	mu   sync.RWMutex
+	root *memoryNode
+}
+
+// memoryNode is a node of the tree, parents created implicitly have no revision
+type memoryNode struct {
+	children  map[string]*memoryNode
+	revisions []memoryRevision
+}
+
+type memoryRevision struct {
+	Revision
+	// blockCreatedAt is the time of the first revision of the block
+	blockCreatedAt time.Time
+	content        []byte
+}
+
+func NewInMemoryBlockManager() *InMemoryBlockManager {
+	return &InMemoryBlockManager{root: newMemoryNode()}
 }
 
 func (i *InMemoryBlockManager) List(p string) ([]BlockReference, error) {
-	response := []BlockReference{}
-	if p == "" {
-		p = "."
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	node := i.lookup(p)
+	if node == nil {
+		return nil, ErrNotFound
 	}
-	i.blocks.Range(func(k, v any) bool {
-		if p != path.Dir(k.(string)) {
-			return true
-		}
-		response = append(response, BlockReference{Path: k.(string)})
-		return true
+	references := []BlockReference{}
+	for _, name := range slices.Sorted(maps.Keys(node.children)) {
+		references = append(references, BlockReference{Path: childPath(p, name)})
+	}
+	return references, nil
+}
 
-	})
+func (i *InMemoryBlockManager) Children(p string, opts ListOptions) (ChildrenPage, error) {
+	i.mu.RLock()
+	node := i.lookup(p)
+	if node == nil {
+		i.mu.RUnlock()
+		return ChildrenPage{}, ErrNotFound
+	}
+	refs := make([]BlockReference, 0, len(node.children))
+	for name, child := range node.children {
+		ref := BlockReference{Path: childPath(p, name)}
+		if current, ok := child.current(); ok {
+			ref.Type = current.ContentType
+			ref.Size = current.Size
+			ref.UpdatedAt = current.CreatedAt
+			ref.Tags = current.Tags
+			ref.ExpiresAt = current.ExpiresAt
+		}
+		refs = append(refs, ref)
+	}
+	i.mu.RUnlock()
 
-	return response, nil
+	return paginate(refs, opts)
 }
 
-func (i *InMemoryBlockManager) Get(path string, withContent bool) (Block, error) {
-	item, ok := i.blocks.Load(path)
+func (i *InMemoryBlockManager) Get(p string, withContent bool) (Block, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	node := i.lookup(p)
+	if node == nil {
+		return Block{}, ErrNotFound
+	}
+	current, ok := node.current()
 	if !ok {
 		return Block{}, ErrNotFound
 	}
-	if ite, ok := item.(Block); ok {
-		if withContent == false {
-			ite.Content = nil
-		}
-		return ite, nil
+	return current.toBlock(p, withContent), nil
+}
+
+func (i *InMemoryBlockManager) Open(p string, revision int) (Block, io.ReadSeekCloser, error) {
+	var block Block
+	var err error
+	if revision == 0 {
+		block, err = i.Get(p, true)
+	} else {
+		block, err = i.GetRevision(p, revision, true)
 	}
-	return Block{}, ErrNotFound
+	if err != nil {
+		return Block{}, nil, err
+	}
+
+	content := block.Content
+	block.Content = nil
+	return block, nopCloser{bytes.NewReader(content)}, nil
 }
 
-func (i *InMemoryBlockManager) Set(p string, content []byte, contentType string) error {
-	i.blocks.Store(p, Block{
-		Path:    p,
-		Content: content,
-		Type:    contentType,
-		Size:    int64(len(content)),
-	})
+func (i *InMemoryBlockManager) Set(p string, content io.Reader, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return errors.Join(err, ErrUnknown)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.set(p, data, contentType, opts)
+}
+
+func (i *InMemoryBlockManager) Link(p string, checksum string, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Contents are immutable, the revisions holding the same one share it
+	content, ok := i.root.find(checksum)
+	if !ok {
+		return ErrUnknownBlob
+	}
+	return i.set(p, content, contentType, opts)
+}
+
+func (i *InMemoryBlockManager) BlobSize(checksum string) (int64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 
-	// Create parent directories
-	parent := path.Dir(p)
-	for parent != "." && parent != "/" {
-		// Only create parent if it doesn't already exist
-		if _, exists := i.blocks.Load(parent); !exists {
-			i.blocks.Store(parent, Block{
-				Path: parent,
-				Type: "directory",
-				Size: 0,
-			})
+	content, ok := i.root.find(checksum)
+	if !ok {
+		return 0, ErrUnknownBlob
+	}
+	return int64(len(content)), nil
+}
+
+// set records a new revision of a block, creating its missing parents
+func (i *InMemoryBlockManager) set(p string, content []byte, contentType string, opts []WriteOption) error {
+	var current Attributes
+	var created time.Time
+	if node := i.lookup(p); node != nil {
+		if r, ok := node.current(); ok {
+			current = r.Attributes
+			created = r.blockCreatedAt
 		}
-		parent = path.Dir(parent)
+	}
+	attributes, err := writeAttributes(current, opts)
+	if err != nil {
+		return err
 	}
 
+	node := i.root
+	for _, name := range splitPath(p) {
+		child, ok := node.children[name]
+		if !ok {
+			child = newMemoryNode()
+			node.children[name] = child
+		}
+		node = child
+	}
+	revision := newRevision(len(node.revisions)+1, int64(len(content)), Checksum(content), contentType, attributes, writeAuthor(opts))
+	if created.IsZero() {
+		created = revision.CreatedAt
+	}
+	node.revisions = append(node.revisions, memoryRevision{revision, created, content})
 	return nil
 }
 
-func (i *InMemoryBlockManager) Delete(path string) error {
-	i.blocks.Delete(path)
+func (i *InMemoryBlockManager) Delete(p string) error {
+	if err := validateReserved(p); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.detach(p)
 	return nil
 }
 
-func NewInMemoryBlockManager() *InMemoryBlockManager {
-	return &InMemoryBlockManager{
-		blocks: sync.Map{},
+func (i *InMemoryBlockManager) Move(from string, to string, overwrite bool) error {
+	return i.transfer(from, to, overwrite, true)
+}
+
+func (i *InMemoryBlockManager) Copy(from string, to string, overwrite bool) error {
+	return i.transfer(from, to, overwrite, false)
+}
+
+func (i *InMemoryBlockManager) transfer(from string, to string, overwrite bool, move bool) error {
+	err := validateTransfer(from, to)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	source := i.lookup(from)
+	if source == nil {
+		return ErrNotFound
+	}
+	if i.lookup(to) != nil && !overwrite {
+		return ErrAlreadyExists
+	}
+
+	if move {
+		i.detach(from)
+	} else {
+		source = source.clone()
+	}
+	i.detach(to)
+	i.attach(to, source)
+	return nil
+}
+
+// Batch holds the write lock for the whole batch, undoing the applied operations when one fails
+func (i *InMemoryBlockManager) Batch(ops []Operation) ([]OperationResult, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	journal := &batchJournal{}
+	written, err := applyBatch(ops, func(op Operation) (*Block, error) {
+		return i.apply(op, journal)
+	})
+	return finishBatch(ops, journal, written, err)
+}
+
+// apply runs an operation of a batch and journals how to undo it
+func (i *InMemoryBlockManager) apply(op Operation, journal *batchJournal) (*Block, error) {
+	node := i.lookup(op.Path)
+	var current memoryRevision
+	exists := false
+	if node != nil {
+		current, exists = node.current()
+	}
+	if err := checkMatch(op.IfMatch, entityTag(current.Checksum, current.ContentType, current.Attributes), exists); err != nil {
+		return nil, err
+	}
+
+	switch op.Type {
+	case OpSet:
+		created := i.firstMissing(op.Path)
+		previous := 0
+		if node != nil {
+			previous = len(node.revisions)
+		}
+		if err := i.set(op.Path, op.Content, op.ContentType, op.Options); err != nil {
+			return nil, err
+		}
+		journal.onRollback(func() error {
+			if created != "" {
+				i.detach(created)
+			} else {
+				node.revisions = node.revisions[:previous]
+			}
+			return nil
+		})
+		block, _ := i.lookup(op.Path).current()
+		written := block.toBlock(op.Path, false)
+		return &written, nil
+
+	case OpDelete:
+		if node == nil {
+			return nil, nil
+		}
+		i.detach(op.Path)
+		journal.onRollback(func() error {
+			i.attach(op.Path, node)
+			return nil
+		})
+		return nil, nil
+
+	case OpMove:
+		if node == nil {
+			return nil, ErrNotFound
+		}
+		replaced := i.lookup(op.To)
+		if replaced != nil && !op.Overwrite {
+			return nil, ErrAlreadyExists
+		}
+		created := i.firstMissing(parentPath(op.To))
+		i.detach(op.Path)
+		i.detach(op.To)
+		i.attach(op.To, node)
+		journal.onRollback(func() error {
+			i.detach(op.To)
+			if created != "" {
+				i.detach(created)
+			}
+			if replaced != nil {
+				i.attach(op.To, replaced)
+			}
+			i.attach(op.Path, node)
+			return nil
+		})
+		written := Block{Path: op.To}
+		if block, ok := node.current(); ok {
+			written = block.toBlock(op.To, false)
+		}
+		return &written, nil
+	}
+	return nil, ErrInvalidOperation
+}
+
+// firstMissing returns the shallowest node missing along a path, empty when the whole path exists
+func (i *InMemoryBlockManager) firstMissing(p string) string {
+	node := i.root
+	names := splitPath(p)
+	for depth, name := range names {
+		node = node.children[name]
+		if node == nil {
+			return strings.Join(names[:depth+1], "/")
+		}
+	}
+	return ""
+}
+
+func (i *InMemoryBlockManager) Revisions(p string) ([]Revision, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	node := i.lookup(p)
+	if node == nil || len(node.revisions) == 0 {
+		return nil, ErrNotFound
+	}
+	revisions := []Revision{}
+	for _, r := range node.revisions {
+		revisions = append(revisions, r.Revision)
+	}
+	return revisions, nil
+}
+
+func (i *InMemoryBlockManager) GetRevision(p string, revision int, withContent bool) (Block, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	r, err := i.getRevision(p, revision)
+	if err != nil {
+		return Block{}, err
+	}
+	return r.toBlock(p, withContent), nil
+}
+
+func (i *InMemoryBlockManager) Restore(p string, revision int, opts ...WriteOption) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	r, err := i.getRevision(p, revision)
+	if err != nil {
+		return err
+	}
+	return i.set(p, r.content, r.ContentType, append([]WriteOption{WithAttributes(r.Attributes)}, opts...))
+}
+
+func (i *InMemoryBlockManager) getRevision(p string, revision int) (memoryRevision, error) {
+	if revision <= 0 {
+		return memoryRevision{}, ErrInvalidRevision
+	}
+	node := i.lookup(p)
+	if node == nil || revision > len(node.revisions) {
+		return memoryRevision{}, ErrNotFound
+	}
+	return node.revisions[revision-1], nil
+}
+
+// lookup returns the node of a path, nil when it does not exist
+func (i *InMemoryBlockManager) lookup(p string) *memoryNode {
+	node := i.root
+	for _, name := range splitPath(p) {
+		node = node.children[name]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// detach removes a node and its subtree from the tree, the root is emptied instead
+func (i *InMemoryBlockManager) detach(p string) {
+	if p == "" {
+		i.root = newMemoryNode()
+		return
+	}
+	names := splitPath(p)
+	parent := i.lookup(strings.Join(names[:len(names)-1], "/"))
+	if parent != nil {
+		delete(parent.children, names[len(names)-1])
+	}
+}
+
+// attach places a node at a path, creating its missing parents
+func (i *InMemoryBlockManager) attach(p string, node *memoryNode) {
+	names := splitPath(p)
+	parent := i.root
+	for _, name := range names[:len(names)-1] {
+		child, ok := parent.children[name]
+		if !ok {
+			child = newMemoryNode()
+			parent.children[name] = child
+		}
+		parent = child
+	}
+	parent.children[names[len(names)-1]] = node
+}
+
+func newMemoryNode() *memoryNode {
+	return &memoryNode{children: map[string]*memoryNode{}}
+}
+
+// current returns the last revision of a node, false for parents without content
+func (n *memoryNode) current() (memoryRevision, bool) {
+	if len(n.revisions) == 0 {
+		return memoryRevision{}, false
+	}
+	return n.revisions[len(n.revisions)-1], true
+}
+
+// clone deeply copies a subtree, contents being immutable they are shared
+func (n *memoryNode) clone() *memoryNode {
+	copied := &memoryNode{
+		children:  make(map[string]*memoryNode, len(n.children)),
+		revisions: slices.Clone(n.revisions),
+	}
+	for name, child := range n.children {
+		copied.children[name] = child.clone()
+	}
+	return copied
+}
+
+// find returns a content stored in the subtree under its checksum
+func (n *memoryNode) find(checksum string) ([]byte, bool) {
+	for _, r := range n.revisions {
+		if r.Checksum == checksum {
+			return r.content, true
+		}
+	}
+	for _, child := range n.children {
+		if content, ok := child.find(checksum); ok {
+			return content, true
+		}
+	}
+	return nil, false
+}
+
+func (r memoryRevision) toBlock(p string, withContent bool) Block {
+	block := Block{
+		Path:       p,
+		Type:       r.ContentType,
+		Size:       r.Size,
+		Revision:   r.Number,
+		Checksum:   r.Checksum,
+		CreatedAt:  r.blockCreatedAt,
+		UpdatedAt:  r.CreatedAt,
+		UpdatedBy:  r.CreatedBy,
+		Attributes: r.Attributes,
+	}
+	if withContent {
+		block.Content = r.content
+	}
+	return block
+}
+
+// splitPath returns the names along a path, none for the root
+func splitPath(p string) []string {
+	if p == "" {
+		return nil
 	}
+	return strings.Split(p, "/")
 }
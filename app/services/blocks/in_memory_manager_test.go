@@ -1,6 +1,10 @@
 package blocks
 
 import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -9,7 +13,7 @@ func TestInMemoryBlockManager_SetAndGet(t *testing.T) {
 
 	// Test Set
 	content := []byte("Hello, World!")
-	err := manager.Set("a/b/c", content, "text/plain")
+	err := manager.Set("a/b/c", bytes.NewReader(content), "text/plain")
 	if err != nil {
 		t.Errorf("Set() error = %v", err)
 	}
@@ -55,20 +59,19 @@ func TestInMemoryBlockManager_ParentDirectories(t *testing.T) {
 	manager := NewInMemoryBlockManager()
 
 	// Set a deep path
-	err := manager.Set("a/b/c/d", []byte("test"), "text/plain")
+	err := manager.Set("a/b/c/d", strings.NewReader("test"), "text/plain")
 	if err != nil {
 		t.Errorf("Set() error = %v", err)
 	}
 
-	// Check that parent directories were created
+	// Parents are listed but have no content of their own
 	parents := []string{"a", "a/b", "a/b/c"}
 	for _, parent := range parents {
-		block, err := manager.Get(parent, false)
-		if err != nil {
-			t.Errorf("Get(%s) error = %v", parent, err)
+		if _, err := manager.Get(parent, false); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%s) error = %v, want ErrNotFound", parent, err)
 		}
-		if block.Type != "directory" {
-			t.Errorf("Get(%s) type = %v, want directory", parent, block.Type)
+		if _, err := manager.List(parent); err != nil {
+			t.Errorf("List(%s) error = %v", parent, err)
 		}
 	}
 }
@@ -77,10 +80,10 @@ func TestInMemoryBlockManager_List(t *testing.T) {
 	manager := NewInMemoryBlockManager()
 
 	// Create some blocks
-	manager.Set("a/file1", []byte("content1"), "text/plain")
-	manager.Set("a/file2", []byte("content2"), "text/plain")
-	manager.Set("a/b/file3", []byte("content3"), "text/plain")
-	manager.Set("c/file4", []byte("content4"), "text/plain")
+	manager.Set("a/file1", strings.NewReader("content1"), "text/plain")
+	manager.Set("a/file2", strings.NewReader("content2"), "text/plain")
+	manager.Set("a/b/file3", strings.NewReader("content3"), "text/plain")
+	manager.Set("c/file4", strings.NewReader("content4"), "text/plain")
 
 	// List children of "a"
 	refs, err := manager.List("a")
@@ -111,7 +114,7 @@ func TestInMemoryBlockManager_Delete(t *testing.T) {
 	manager := NewInMemoryBlockManager()
 
 	// Create a block
-	manager.Set("test/block", []byte("content"), "text/plain")
+	manager.Set("test/block", strings.NewReader("content"), "text/plain")
 
 	// Verify it exists
 	_, err := manager.Get("test/block", false)
@@ -136,10 +139,10 @@ func TestInMemoryBlockManager_UpdateBlock(t *testing.T) {
 	manager := NewInMemoryBlockManager()
 
 	// Create initial block
-	manager.Set("test", []byte("v1"), "text/plain")
+	manager.Set("test", strings.NewReader("v1"), "text/plain")
 
 	// Update it
-	manager.Set("test", []byte("v2"), "application/json")
+	manager.Set("test", strings.NewReader("v2"), "application/json")
 
 	// Verify update
 	block, err := manager.Get("test", true)
@@ -153,3 +156,109 @@ func TestInMemoryBlockManager_UpdateBlock(t *testing.T) {
 		t.Errorf("Get() type = %v, want application/json", block.Type)
 	}
 }
+
+func TestInMemoryBlockManager_Revisions(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+
+	manager.Set("test", strings.NewReader("v1"), "text/plain")
+	manager.Set("test", strings.NewReader("v2"), "application/json")
+
+	revisions, err := manager.Revisions("test")
+	if err != nil {
+		t.Fatalf("Revisions() error = %v", err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Revisions() returned %d items, want 2", len(revisions))
+	}
+	if revisions[1].Number != 2 || revisions[1].ContentType != "application/json" {
+		t.Errorf("Revisions()[1] = %+v, want number 2 with application/json", revisions[1])
+	}
+
+	err = manager.Restore("test", 1)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	block, err := manager.Get("test", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "v1" || block.Revision != 3 {
+		t.Errorf("Get() = %s (revision %d), want v1 (revision 3)", block.Content, block.Revision)
+	}
+
+	_, err = manager.GetRevision("test", 0, false)
+	if err != ErrInvalidRevision {
+		t.Errorf("GetRevision() error = %v, want ErrInvalidRevision", err)
+	}
+	_, err = manager.Revisions("nonexistent")
+	if err != ErrNotFound {
+		t.Errorf("Revisions() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestInMemoryBlockManager_Link(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	manager.Set("original", strings.NewReader("shared"), "text/plain")
+
+	err := manager.Link("copy", Checksum([]byte("shared")), "text/markdown")
+	if err != nil {
+		t.Fatalf("Link() error = %v", err)
+	}
+	block, err := manager.Get("copy", true)
+	if err != nil || string(block.Content) != "shared" || block.Type != "text/markdown" {
+		t.Errorf("Get() = %+v, %v, want shared as text/markdown", block, err)
+	}
+
+	err = manager.Link("other", Checksum([]byte("unknown")), "text/plain")
+	if !errors.Is(err, ErrUnknownBlob) {
+		t.Errorf("Link() error = %v, want ErrUnknownBlob", err)
+	}
+}
+
+func TestInMemoryBlockManager_MoveAndCopy(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	manager.Set("docs/draft", strings.NewReader("v1"), "text/plain")
+	manager.Set("docs/draft", strings.NewReader("v2"), "text/plain")
+	manager.Set("docs/draft/appendix", strings.NewReader("appendix"), "text/plain")
+	manager.Set("docs/drafts", strings.NewReader("sibling"), "text/plain")
+	manager.Set("docs/published/stale", strings.NewReader("stale"), "text/plain")
+
+	if err := manager.Move("docs/draft", "docs/published", false); err != ErrAlreadyExists {
+		t.Errorf("Move() error = %v, want ErrAlreadyExists", err)
+	}
+
+	err := manager.Move("docs/draft", "docs/published", true)
+	if err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	if _, err := manager.Get("docs/draft/appendix", false); err != ErrNotFound {
+		t.Errorf("Get() moved child at source error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Get("docs/published/stale", false); err != ErrNotFound {
+		t.Errorf("Get() overwritten child error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Get("docs/drafts", false); err != nil {
+		t.Errorf("Get() sibling sharing the prefix error = %v", err)
+	}
+	block, err := manager.Get("docs/published/appendix", true)
+	if err != nil || block.Path != "docs/published/appendix" || string(block.Content) != "appendix" {
+		t.Errorf("Get() moved child = %+v, %v", block, err)
+	}
+	revisions, _ := manager.Revisions("docs/published")
+	if len(revisions) != 2 {
+		t.Errorf("Revisions() after move returned %d items, want 2", len(revisions))
+	}
+
+	err = manager.Copy("docs/published", "archive/published", false)
+	if err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if paths := listPaths(t, manager, "archive"); !slices.Equal(paths, []string{"archive/published"}) {
+		t.Errorf("List() parent of copy = %v, want [archive/published]", paths)
+	}
+	manager.Set("archive/published", strings.NewReader("v3"), "text/plain")
+	source, _ := manager.Get("docs/published", true)
+	if string(source.Content) != "v2" {
+		t.Errorf("Get() source = %s, want v2 untouched by writes to the copy", source.Content)
+	}
+}
@@ -0,0 +1,202 @@
+package blocks
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const DefaultListLimit = 1000
+const MaxListLimit = 1000
+
+// MaxTreeReferences bounds the references listed by a Tree over all its levels
+const MaxTreeReferences = 10000
+
+var ErrInvalidCursor = errors.New("Invalid Cursor")
+var ErrInvalidListOptions = errors.New("Invalid List Options")
+
+type SortKey string
+
+const SortByName SortKey = "name"
+const SortBySize SortKey = "size"
+const SortByModified SortKey = "modified"
+
+// ListOptions selects a page of the children of a block
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	SortBy SortKey
+	Desc   bool
+	// Tags only keeps the children having all of them
+	Tags []string
+}
+
+// ChildrenPage is a page of children, NextCursor is empty on the last page
+type ChildrenPage struct {
+	Items      []BlockReference
+	NextCursor string
+}
+
+// Validate checks the options and applies the defaults
+func (o ListOptions) Validate() (ListOptions, error) {
+	if o.Limit == 0 {
+		o.Limit = DefaultListLimit
+	}
+	if o.Limit < 0 || o.Limit > MaxListLimit {
+		return o, ErrInvalidListOptions
+	}
+	switch o.SortBy {
+	case "":
+		o.SortBy = SortByName
+	case SortByName, SortBySize, SortByModified:
+	default:
+		return o, ErrInvalidListOptions
+	}
+	return o, nil
+}
+
+type cursor struct {
+	Path      string    `json:"p"`
+	Size      int64     `json:"s,omitempty"`
+	UpdatedAt time.Time `json:"m,omitzero"`
+}
+
+func encodeCursor(ref BlockReference) string {
+	content, _ := json.Marshal(cursor{Path: ref.Path, Size: ref.Size, UpdatedAt: ref.UpdatedAt})
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(value string) (BlockReference, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return BlockReference{}, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(content, &c); err != nil {
+		return BlockReference{}, ErrInvalidCursor
+	}
+	return BlockReference{Path: c.Path, Size: c.Size, UpdatedAt: c.UpdatedAt}, nil
+}
+
+func compareReferences(a BlockReference, b BlockReference, sortBy SortKey) int {
+	var result int
+	switch sortBy {
+	case SortBySize:
+		result = cmp.Compare(a.Size, b.Size)
+	case SortByModified:
+		result = a.UpdatedAt.Compare(b.UpdatedAt)
+	}
+	if result == 0 {
+		result = strings.Compare(a.Path, b.Path)
+	}
+	return result
+}
+
+// paginate filters and sorts the references and returns the page following the cursor.
+// Pages are keyset based so inserting or deleting children does not shift the next pages.
+func paginate(refs []BlockReference, opts ListOptions) (ChildrenPage, error) {
+	opts, err := opts.Validate()
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	if len(opts.Tags) > 0 {
+		refs = slices.DeleteFunc(refs, func(ref BlockReference) bool {
+			return !hasTags(ref.Tags, opts.Tags)
+		})
+	}
+
+	compare := func(a, b BlockReference) int {
+		if opts.Desc {
+			return compareReferences(b, a, opts.SortBy)
+		}
+		return compareReferences(a, b, opts.SortBy)
+	}
+	slices.SortFunc(refs, compare)
+
+	if opts.Cursor != "" {
+		after, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return ChildrenPage{}, err
+		}
+		start, _ := slices.BinarySearchFunc(refs, after, compare)
+		if start < len(refs) && compare(refs[start], after) == 0 {
+			start++
+		}
+		refs = refs[start:]
+	}
+
+	page := ChildrenPage{Items: refs}
+	if len(refs) > opts.Limit {
+		page.Items = refs[:opts.Limit]
+		page.NextCursor = encodeCursor(page.Items[opts.Limit-1])
+	}
+	return page, nil
+}
+
+// childPath builds the path of a child so the root children have no leading slash
+func childPath(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return path.Join(parent, name)
+}
+
+// Tree returns a page of the children of a block, each of them with its own
+// children down to depth levels. Nested levels use the same limit, order and tags,
+// and the whole tree holds at most MaxTreeReferences references: the blocks whose
+// children are left out once they are all listed are marked as truncated.
+// Tags filter the blocks of the last level and the ones without children, the others
+// being kept when they have the tags or a descendant having them. Pages keep their
+// cursor, so they may hold less than the limit.
+func Tree(m BlockManager, path string, depth int, opts ListOptions) (ChildrenPage, error) {
+	if depth < 1 || depth > MaxPathDepth {
+		return ChildrenPage{}, ErrInvalidListOptions
+	}
+	budget := MaxTreeReferences
+	return tree(m, path, depth, opts, &budget)
+}
+
+// tree lists the levels of a Tree, budget being the number of references it may still list
+func tree(m BlockManager, path string, depth int, opts ListOptions, budget *int) (ChildrenPage, error) {
+	if opts.Limit == 0 {
+		opts.Limit = DefaultListLimit
+	}
+	opts.Limit = min(opts.Limit, *budget)
+	if depth == 1 {
+		page, err := m.Children(path, opts)
+		*budget -= len(page.Items)
+		return page, err
+	}
+	listed := opts
+	listed.Tags = nil
+	page, err := m.Children(path, listed)
+	if err != nil {
+		return page, err
+	}
+	*budget -= len(page.Items)
+
+	nested := ListOptions{Limit: opts.Limit, SortBy: opts.SortBy, Desc: opts.Desc, Tags: opts.Tags}
+	items := page.Items[:0]
+	for _, item := range page.Items {
+		if *budget == 0 {
+			item.Truncated = true
+		} else {
+			children, err := tree(m, item.Path, depth-1, nested, budget)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return ChildrenPage{}, err
+			}
+			item.Children = children.Items
+			item.NextCursor = children.NextCursor
+		}
+		if hasTags(item.Tags, opts.Tags) || len(item.Children) > 0 || item.Truncated {
+			items = append(items, item)
+		}
+	}
+	page.Items = items
+	return page, nil
+}
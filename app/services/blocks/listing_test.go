@@ -0,0 +1,201 @@
+package blocks
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	refs := []BlockReference{
+		{Path: "a/c", Size: 1},
+		{Path: "a/a", Size: 3},
+		{Path: "a/d", Size: 2},
+		{Path: "a/b", Size: 3},
+	}
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want [][]string
+	}{
+		{
+			name: "by name",
+			opts: ListOptions{Limit: 3},
+			want: [][]string{{"a/a", "a/b", "a/c"}, {"a/d"}},
+		},
+		{
+			name: "by size descending",
+			opts: ListOptions{Limit: 2, SortBy: SortBySize, Desc: true},
+			want: [][]string{{"a/b", "a/a"}, {"a/d", "a/c"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			for i, want := range tt.want {
+				page, err := paginate(append([]BlockReference{}, refs...), opts)
+				if err != nil {
+					t.Fatalf("paginate() error = %v", err)
+				}
+				got := []string{}
+				for _, item := range page.Items {
+					got = append(got, item.Path)
+				}
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("page %d = %v, want %v", i, got, want)
+				}
+				if (page.NextCursor == "") != (i == len(tt.want)-1) {
+					t.Errorf("page %d next cursor = %q", i, page.NextCursor)
+				}
+				opts.Cursor = page.NextCursor
+			}
+		})
+	}
+}
+
+func TestPaginate_CursorSurvivesDeletion(t *testing.T) {
+	refs := []BlockReference{{Path: "a"}, {Path: "b"}, {Path: "c"}, {Path: "d"}}
+
+	page, _ := paginate(refs, ListOptions{Limit: 2})
+
+	// "b", the last item of the first page, is deleted before fetching the next one
+	remaining := []BlockReference{{Path: "a"}, {Path: "c"}, {Path: "d"}}
+	page, err := paginate(remaining, ListOptions{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("paginate() error = %v", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Path != "c" {
+		t.Errorf("paginate() = %v, want [c d]", page.Items)
+	}
+}
+
+func TestPaginate_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ListOptions
+		want error
+	}{
+		{name: "invalid cursor", opts: ListOptions{Cursor: "%%%"}, want: ErrInvalidCursor},
+		{name: "limit too high", opts: ListOptions{Limit: MaxListLimit + 1}, want: ErrInvalidListOptions},
+		{name: "unknown sort", opts: ListOptions{SortBy: "color"}, want: ErrInvalidListOptions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := paginate([]BlockReference{{Path: "a"}}, tt.opts)
+			if err != tt.want {
+				t.Errorf("paginate() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTree(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	managers := map[string]BlockManager{
+		"fs":       NewFsBlockManager(tmpDir),
+		"inMemory": NewInMemoryBlockManager(),
+	}
+
+	for name, manager := range managers {
+		t.Run(name, func(t *testing.T) {
+			manager.Set("docs/a", strings.NewReader("aaa"), "text/plain")
+			manager.Set("docs/a/x", strings.NewReader("x"), "text/markdown")
+			manager.Set("docs/b", strings.NewReader("b"), "text/html")
+
+			page, err := Tree(manager, "docs", 2, ListOptions{})
+			if err != nil {
+				t.Fatalf("Tree() error = %v", err)
+			}
+			if len(page.Items) != 2 {
+				t.Fatalf("Tree() returned %d items, want 2", len(page.Items))
+			}
+			first := page.Items[0]
+			if first.Path != "docs/a" || first.Type != "text/plain" || first.Size != 3 {
+				t.Errorf("Tree()[0] = %+v, want docs/a text/plain of size 3", first)
+			}
+			if len(first.Children) != 1 || first.Children[0].Path != "docs/a/x" || first.Children[0].Type != "text/markdown" {
+				t.Errorf("Tree()[0].Children = %+v, want docs/a/x", first.Children)
+			}
+
+			root, err := manager.Children("", ListOptions{})
+			if err != nil {
+				t.Fatalf("Children() error = %v", err)
+			}
+			if len(root.Items) != 1 || root.Items[0].Path != "docs" {
+				t.Errorf("Children(\"\") = %+v, want [docs]", root.Items)
+			}
+		})
+	}
+}
+
+func TestTree_Tags(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	manager.Set("docs/faq", strings.NewReader("faq"), "text/plain", WithTags("public"))
+	manager.Set("docs/guides/intro", strings.NewReader("intro"), "text/plain", WithTags("public", "v1"))
+	manager.Set("docs/guides/draft", strings.NewReader("draft"), "text/plain")
+	manager.Set("docs/notes", strings.NewReader("notes"), "text/plain")
+	manager.Set("docs/notes/todo", strings.NewReader("todo"), "text/plain")
+
+	// The untagged guides directory holds a tagged block, the notes hold none
+	page, err := Tree(manager, "docs", 2, ListOptions{Tags: []string{"public"}})
+	if err != nil {
+		t.Fatalf("Tree() error = %v", err)
+	}
+	paths := []string{}
+	for _, item := range page.Items {
+		paths = append(paths, item.Path)
+	}
+	if !slices.Equal(paths, []string{"docs/faq", "docs/guides"}) {
+		t.Fatalf("Tree() = %v, want docs/faq and docs/guides", paths)
+	}
+	if children := page.Items[1].Children; len(children) != 1 || children[0].Path != "docs/guides/intro" {
+		t.Errorf("Tree()[1].Children = %+v, want docs/guides/intro only", children)
+	}
+
+	// A single level filters every child
+	page, err = Tree(manager, "docs", 1, ListOptions{Tags: []string{"public"}})
+	if err != nil {
+		t.Fatalf("Tree() error = %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Path != "docs/faq" {
+		t.Errorf("Tree() with depth 1 = %+v, want docs/faq", page.Items)
+	}
+}
+
+func TestTree_MaxReferences(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	for i := range 101 {
+		for j := range 100 {
+			manager.Set(fmt.Sprintf("docs/%03d/%03d", i, j), strings.NewReader("x"), "text/plain")
+		}
+	}
+
+	page, err := Tree(manager, "docs", 3, ListOptions{})
+	if err != nil {
+		t.Fatalf("Tree() error = %v", err)
+	}
+	count := 0
+	for _, item := range page.Items {
+		count += 1 + len(item.Children)
+	}
+	if count != MaxTreeReferences {
+		t.Errorf("Tree() listed %d references, want %d", count, MaxTreeReferences)
+	}
+	// The budget runs out in the children of docs/098, whose page goes on with a cursor
+	if item := page.Items[98]; len(item.Children) != 99 || item.NextCursor == "" || item.Truncated {
+		t.Errorf("Tree()[98] = %d children, cursor %q, want a partial page", len(item.Children), item.NextCursor)
+	}
+	if item := page.Items[100]; !item.Truncated || len(item.Children) != 0 {
+		t.Errorf("Tree()[100] = %+v, want its children left out", item)
+	}
+}
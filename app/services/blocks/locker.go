@@ -0,0 +1,64 @@
+package blocks
+
+import (
+	"slices"
+	"sync"
+)
+
+// Locker hands out one mutex per block path so a read-check-write sequence
+// on a block cannot interleave with another writer of the same path
+type Locker struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	holders int
+}
+
+func NewLocker() *Locker {
+	return &Locker{locks: map[string]*pathLock{}}
+}
+
+// Lock blocks until the path is available and returns the function releasing it
+func (l *Locker) Lock(path string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		l.locks[path] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(l.locks, path)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// LockAll locks several paths in a consistent order so concurrent callers cannot deadlock
+func (l *Locker) LockAll(paths ...string) func() {
+	paths = slices.Clone(paths)
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	unlocks := make([]func(), 0, len(paths))
+	for _, path := range paths {
+		unlocks = append(unlocks, l.Lock(path))
+	}
+	return func() {
+		for _, unlock := range slices.Backward(unlocks) {
+			unlock()
+		}
+	}
+}
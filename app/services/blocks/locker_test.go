@@ -0,0 +1,31 @@
+package blocks
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLocker_SerializesSamePath(t *testing.T) {
+	locker := NewLocker()
+	counter := 0
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locker.Lock("a/b")
+			defer unlock()
+			value := counter
+			counter = value + 1
+		}()
+	}
+	wg.Wait()
+
+	if counter != 50 {
+		t.Errorf("counter = %d, want 50", counter)
+	}
+	if len(locker.locks) != 0 {
+		t.Errorf("Locker kept %d released locks, want 0", len(locker.locks))
+	}
+}
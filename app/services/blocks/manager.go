@@ -1,39 +1,156 @@
 package blocks
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"goblocks/app/config"
+	"io"
+	"log/slog"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
+
+	"go.uber.org/fx"
 )
 
+// Block is a block with its current or a past revision, CreatedAt being the time of its first revision
 type Block struct {
-	Path     string           `json:"path"`
-	Content  []byte           `json:"content,omitempty"`
-	Type     string           `json:"type"`
-	Children []BlockReference `json:"children"`
-	Size     int64            `json:"size,omitempty"`
+	Path      string           `json:"path"`
+	Content   []byte           `json:"content,omitempty"`
+	Type      string           `json:"type"`
+	Children  []BlockReference `json:"children"`
+	Size      int64            `json:"size,omitempty"`
+	Revision  int              `json:"revision,omitempty"`
+	Checksum  string           `json:"checksum,omitempty"`
+	CreatedAt time.Time        `json:"created_at,omitzero"`
+	UpdatedAt time.Time        `json:"updated_at,omitzero"`
+	UpdatedBy string           `json:"updated_by,omitempty"`
+	// NextCursor is set when Children is a partial page
+	NextCursor string `json:"next_cursor,omitempty"`
+	Attributes
+}
+
+// Revision describes an immutable version of a block recorded by Set
+type Revision struct {
+	Number      int       `json:"number"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+	Attributes
 }
 
 type BlockReference struct {
-	Path string `json:"path"`
+	Path       string           `json:"path"`
+	Type       string           `json:"type,omitempty"`
+	Size       int64            `json:"size,omitempty"`
+	UpdatedAt  time.Time        `json:"updated_at,omitzero"`
+	Tags       []string         `json:"tags,omitempty"`
+	ExpiresAt  time.Time        `json:"expires_at,omitzero"`
+	Children   []BlockReference `json:"children,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	// Truncated is set when the children were left out of a tree holding as many references as it may
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 type BlockManager interface {
 	List(path string) ([]BlockReference, error)
+	// Children returns a sorted page of the direct children of a block with their type, size and modification time
+	Children(path string, opts ListOptions) (ChildrenPage, error)
 	Get(path string, withContent bool) (Block, error)
-	Set(path string, content []byte, contentType string) error
+	// Open streams the content of a block, revision 0 being the current one
+	Open(path string, revision int) (Block, io.ReadSeekCloser, error)
+	// Set records a new revision of a block, its attributes are carried over unless given by the options
+	Set(path string, content io.Reader, contentType string, opts ...WriteOption) error
+	// Link records a content the storage already holds under its checksum as the new revision of a block,
+	// ErrUnknownBlob tells the client to upload it with Set instead
+	Link(path string, checksum string, contentType string, opts ...WriteOption) error
 	Delete(path string) error
+	Revisions(path string) ([]Revision, error)
+	GetRevision(path string, revision int, withContent bool) (Block, error)
+	// Restore records a past revision as the new current one, with its metadata and tags unless given by
+	// the options. The restored block never expires unless the options give an expiry.
+	Restore(path string, revision int, opts ...WriteOption) error
+	// Move renames a block and its whole subtree, an existing destination is only replaced when overwrite is set
+	Move(from string, to string, overwrite bool) error
+	// Copy duplicates a block and its whole subtree, revisions included
+	Copy(from string, to string, overwrite bool) error
+	// Batch applies operations in order, all of them or none when one fails, readers never seeing
+	// a batch half applied. The results describe every operation, a failure is a *BatchError.
+	Batch(ops []Operation) ([]OperationResult, error)
+}
+
+func NewBlockManager(lc fx.Lifecycle, c *config.Config, references *ReferenceIndex, bus *EventBus, usage *Usage, locker *Locker, log *slog.Logger) (BlockManager, error) {
+	storage, err := newStorage(c)
+	if storage == nil || err != nil {
+		return nil, err
+	}
+	// Backends holding files open release them on shutdown
+	if closer, ok := storage.(io.Closer); ok {
+		lc.Append(fx.StopHook(closer.Close))
+	}
+	// Crashes are repaired before anything reads the storage
+	if recoverer, ok := storage.(Recoverer); ok {
+		if err := recoverStorage(recoverer, log); err != nil {
+			return nil, err
+		}
+	}
+	if collector, ok := storage.(GarbageCollector); ok {
+		collectGarbage(lc, collector, c.Blocks.Storage.GcInterval, log)
+	}
+	// Expired blocks are purged through the events and references so that they are deleted like any other
+	m := PublishEvents(TrackReferences(EnforceQuotas(storage, usage), references), bus)
+	reapExpired(lc, m, locker, c.Blocks.Expiry.ReapInterval, log)
+	return ExpireBlocks(m), nil
 }
 
-func NewBlockManager(c *config.Config) BlockManager {
+func newStorage(c *config.Config) (BlockManager, error) {
 	switch c.Blocks.Storage.Type {
 	case config.Fs:
-		return BlockManager(NewFsBlockManager(c.Blocks.Storage.Path))
+		return BlockManager(NewFsBlockManager(c.Blocks.Storage.Path)), nil
 	case config.InMemory:
-		return BlockManager(NewInMemoryBlockManager())
+		return BlockManager(NewInMemoryBlockManager()), nil
+	case config.Bolt:
+		if c.Blocks.Storage.Path == "" {
+			return NewBoltBlockManager(DefaultBoltFileName)
+		}
+		return NewBoltBlockManager(c.Blocks.Storage.Path)
+	case config.Sqlite:
+		if c.Blocks.Storage.Path == "" {
+			return NewSqliteBlockManager(DefaultSqliteFileName)
+		}
+		return NewSqliteBlockManager(c.Blocks.Storage.Path)
+	case config.S3Storage:
+		return newS3BlockManager(c.Blocks.Storage.S3)
 	}
 
+	return nil, nil
+}
+
+// Walk calls fn for path and every block below it, parents before their children
+func Walk(m BlockManager, path string, fn func(path string) error) error {
+	err := fn(path)
+	if err != nil {
+		return err
+	}
+	children, err := m.List(path)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	for _, child := range children {
+		err = Walk(m, strings.TrimPrefix(child.Path, "/"), fn)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -42,10 +159,122 @@ var ErrUnknown = errors.New("Unknown Error")
 var ErrForbidden = errors.New("Forbidden")
 var ErrInvalidPath = errors.New("Invalid Path")
 var ErrPathTooDeep = errors.New("Path Too Deep")
+var ErrReservedPath = errors.New("Reserved Path")
 var ErrInvalidContentType = errors.New("Invalid Content-Type")
+var ErrInvalidRevision = errors.New("Invalid Revision")
+var ErrPreconditionFailed = errors.New("Precondition Failed")
+var ErrAlreadyExists = errors.New("Already Exists")
+var ErrInvalidDestination = errors.New("Invalid Destination")
 
 const MaxPathDepth = 10
 
+// Checksum returns the hex encoded SHA-256 of a block content
+func Checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ETag identifies the content of a block along with its type and attributes, which
+// a rewrite of its metadata alone changes. It is empty when the block has no checksum.
+func (b Block) ETag() string {
+	return entityTag(b.Checksum, b.Type, b.Attributes)
+}
+
+func entityTag(checksum string, contentType string, attributes Attributes) string {
+	if checksum == "" {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", checksum, contentType)
+	for _, key := range slices.Sorted(maps.Keys(attributes.Metadata)) {
+		fmt.Fprintf(h, "meta %q=%q\n", key, attributes.Metadata[key])
+	}
+	for _, tag := range attributes.Tags {
+		fmt.Fprintf(h, "tag %q\n", tag)
+	}
+	if !attributes.ExpiresAt.IsZero() {
+		fmt.Fprintf(h, "expires %d\n", attributes.ExpiresAt.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newRevision(number int, size int64, checksum string, contentType string, attributes Attributes, author string) Revision {
+	return Revision{
+		Number:      number,
+		CreatedAt:   time.Now().UTC(),
+		CreatedBy:   author,
+		ContentType: contentType,
+		Size:        size,
+		Checksum:    checksum,
+		Attributes:  attributes,
+	}
+}
+
+// reservedNames are the path segments under which the storages keep their own state next to the blocks,
+// the metadata and history of every block among them
+var reservedNames = []string{FsFileName, FsRevisionsDirName, FsBlobsDirName, FsBatchesDirName, FsQuarantineDirName}
+
+// validateReserved rejects the paths going through a segment reserved by the storages
+func validateReserved(path string) error {
+	for segment := range strings.SplitSeq(path, "/") {
+		if slices.Contains(reservedNames, segment) || strings.HasPrefix(segment, FsTempPrefix) {
+			return errors.Join(fmt.Errorf("%q is reserved", segment), ErrReservedPath, ErrInvalidPath)
+		}
+	}
+	return nil
+}
+
+// validateBlockPath rejects writes to the root, which is the parent of every block and holds no content,
+// and to the reserved paths
+func validateBlockPath(path string) error {
+	if path == "" {
+		return ErrInvalidPath
+	}
+	return validateReserved(path)
+}
+
+// validateTransfer rejects moves and copies of the root, between nested paths or of reserved paths
+func validateTransfer(from string, to string) error {
+	if from == "" || to == "" {
+		return ErrInvalidDestination
+	}
+	if err := validateReserved(from); err != nil {
+		return err
+	}
+	if err := validateReserved(to); err != nil {
+		return err
+	}
+	if isSameOrDescendant(to, from) || isSameOrDescendant(from, to) {
+		return ErrInvalidDestination
+	}
+	return nil
+}
+
+func isSameOrDescendant(path string, ancestor string) bool {
+	return ancestor == "" || path == ancestor || strings.HasPrefix(path, ancestor+"/")
+}
+
+// readBlock loads a block revision with its whole content through the Open of a storage
+func readBlock(open func(path string, revision int) (Block, io.ReadSeekCloser, error), path string, revision int) (Block, error) {
+	block, content, err := open(path, revision)
+	if err != nil {
+		return Block{}, err
+	}
+	defer content.Close()
+
+	block.Content, err = io.ReadAll(content)
+	if err != nil {
+		return Block{}, errors.Join(err, ErrUnknown)
+	}
+	return block, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
 // ValidatePath validates and sanitizes a path to prevent path traversal attacks
 func ValidatePath(path string) (string, error) {
 	if path == "" {
@@ -74,6 +303,10 @@ func ValidatePath(path string) (string, error) {
 		return "", ErrInvalidPath
 	}
 
+	if err := validateReserved(cleaned); err != nil {
+		return "", err
+	}
+
 	return cleaned, nil
 }
 
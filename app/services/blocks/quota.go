@@ -0,0 +1,599 @@
+package blocks
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"goblocks/app/config"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("Quota Exceeded")
+
+// UsageCount is the size and the number of the blocks with content of a subtree
+type UsageCount struct {
+	Bytes  int64 `json:"bytes"`
+	Blocks int64 `json:"blocks"`
+}
+
+func (c UsageCount) add(other UsageCount) UsageCount {
+	return UsageCount{c.Bytes + other.Bytes, c.Blocks + other.Blocks}
+}
+
+func (c UsageCount) sub(other UsageCount) UsageCount {
+	return UsageCount{c.Bytes - other.Bytes, c.Blocks - other.Blocks}
+}
+
+// QuotaUsage is a configured quota along with what its subtree holds
+type QuotaUsage struct {
+	Path      string `json:"path"`
+	MaxBytes  int64  `json:"max_bytes,omitempty"`
+	MaxBlocks int64  `json:"max_blocks,omitempty"`
+	UsageCount
+}
+
+// usageTree holds the size of every block with content and the totals of every subtree holding one.
+// The children of every path with a total index the subtrees, so that they are walked without going
+// through every block, and the blocks that expire are queued by expiry.
+type usageTree struct {
+	sizes    map[string]int64
+	totals   map[string]UsageCount
+	children map[string]map[string]bool
+	expiries map[string]time.Time
+	expiring *expiryQueue
+}
+
+func newUsageTree() usageTree {
+	return usageTree{map[string]int64{}, map[string]UsageCount{}, map[string]map[string]bool{}, map[string]time.Time{}, &expiryQueue{}}
+}
+
+func (t usageTree) clone() usageTree {
+	children := make(map[string]map[string]bool, len(t.children))
+	for path, names := range t.children {
+		children[path] = maps.Clone(names)
+	}
+	expiring := slices.Clone(*t.expiring)
+	return usageTree{maps.Clone(t.sizes), maps.Clone(t.totals), children, maps.Clone(t.expiries), &expiring}
+}
+
+func (t usageTree) put(path string, size int64, expiresAt time.Time) {
+	old, exists := t.sizes[path]
+	delta := UsageCount{Bytes: size - old}
+	if !exists {
+		delta.Blocks = 1
+	}
+	t.sizes[path] = size
+	t.add(path, delta)
+
+	if expiresAt.IsZero() {
+		delete(t.expiries, path)
+		return
+	}
+	t.expiries[path] = expiresAt
+	heap.Push(t.expiring, expiry{path, expiresAt})
+}
+
+// remove forgets a block, leaving its subtree
+func (t usageTree) remove(path string) {
+	size, exists := t.sizes[path]
+	if !exists {
+		return
+	}
+	delete(t.sizes, path)
+	delete(t.expiries, path)
+	t.add(path, UsageCount{-size, -1})
+}
+
+// drop forgets a block and its whole subtree
+func (t usageTree) drop(path string) {
+	total, exists := t.totals[path]
+	if !exists {
+		return
+	}
+	for _, p := range t.subtree(path) {
+		delete(t.sizes, p)
+		delete(t.expiries, p)
+		delete(t.children, p)
+		if p != path {
+			delete(t.totals, p)
+		}
+	}
+	t.add(path, UsageCount{}.sub(total))
+}
+
+// subtree returns a path and its descendants holding a block
+func (t usageTree) subtree(path string) []string {
+	if _, exists := t.totals[path]; !exists {
+		return nil
+	}
+	paths := []string{path}
+	for i := 0; i < len(paths); i++ {
+		for name := range t.children[paths[i]] {
+			paths = append(paths, name)
+		}
+	}
+	return paths
+}
+
+// transfer copies or moves a subtree over the one at the destination, which it replaces
+func (t usageTree) transfer(from string, to string, move bool) {
+	type movedBlock struct {
+		size      int64
+		expiresAt time.Time
+	}
+	moved := map[string]movedBlock{}
+	for _, p := range t.subtree(from) {
+		if size, exists := t.sizes[p]; exists {
+			moved[to+strings.TrimPrefix(p, from)] = movedBlock{size, t.expiries[p]}
+		}
+	}
+	if move {
+		t.drop(from)
+	}
+	t.drop(to)
+	for p, block := range moved {
+		t.put(p, block.size, block.expiresAt)
+	}
+}
+
+// add changes the totals of a block and of all its ancestors
+func (t usageTree) add(path string, delta UsageCount) {
+	for {
+		old, existed := t.totals[path]
+		total := old.add(delta)
+		if total == (UsageCount{}) {
+			delete(t.totals, path)
+		} else {
+			t.totals[path] = total
+		}
+		if path == "" {
+			return
+		}
+		parent := parentPath(path)
+		if _, exists := t.totals[path]; exists && !existed {
+			if t.children[parent] == nil {
+				t.children[parent] = map[string]bool{}
+			}
+			t.children[parent][path] = true
+		} else if !exists && existed {
+			delete(t.children[parent], path)
+			if len(t.children[parent]) == 0 {
+				delete(t.children, parent)
+			}
+		}
+		path = parent
+	}
+}
+
+// expire forgets the blocks expired at now, their subtree staying until the reaper deletes it
+func (t usageTree) expire(now time.Time) {
+	for t.expiring.Len() > 0 && expired((*t.expiring)[0].at, now) {
+		e := heap.Pop(t.expiring).(expiry)
+		// Blocks rewritten since they were queued left an entry of their former expiry behind
+		if at, exists := t.expiries[e.path]; exists && at.Equal(e.at) {
+			t.remove(e.path)
+		}
+	}
+}
+
+func (t usageTree) apply(op Operation) {
+	switch op.Type {
+	case OpSet:
+		t.put(op.Path, int64(len(op.Content)), newWriteOptions(op.Options).expiresAt)
+	case OpDelete:
+		t.drop(op.Path)
+	case OpMove:
+		t.transfer(op.Path, op.To, true)
+	}
+}
+
+type expiry struct {
+	path string
+	at   time.Time
+}
+
+// expiryQueue is a heap of expiries, the earliest first
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Usage accounts for the bytes and blocks stored under every path and enforces the configured quotas.
+// The writes in progress hold a reservation on the quotas they grow, so that concurrent writes never
+// exceed a quota together. Expired blocks stop counting as soon as they expire, before being reaped.
+type Usage struct {
+	mu     sync.Mutex
+	tree   usageTree
+	quotas []config.Quota
+	// reserved is the growth of the writes in progress, by quota
+	reserved []UsageCount
+	now      func() time.Time
+}
+
+func NewUsage(c *config.Config) *Usage {
+	quotas := []config.Quota{}
+	for _, quota := range c.Blocks.Quotas {
+		quota.Path = strings.Trim(quota.Path, "/")
+		quotas = append(quotas, quota)
+	}
+	return &Usage{tree: newUsageTree(), quotas: quotas, reserved: make([]UsageCount, len(quotas)), now: time.Now}
+}
+
+// Of returns what the subtree of a path holds
+func (u *Usage) Of(path string) UsageCount {
+	u.lock()
+	defer u.mu.Unlock()
+	return u.tree.totals[path]
+}
+
+// Quotas returns the quotas applying to a path or to a block below it, along with what their subtree holds
+func (u *Usage) Quotas(path string) []QuotaUsage {
+	u.lock()
+	defer u.mu.Unlock()
+
+	quotas := []QuotaUsage{}
+	for _, quota := range u.quotas {
+		if isSameOrDescendant(path, quota.Path) || isSameOrDescendant(quota.Path, path) {
+			quotas = append(quotas, QuotaUsage{quota.Path, quota.MaxBytes, quota.MaxBlocks, u.tree.totals[quota.Path]})
+		}
+	}
+	return quotas
+}
+
+// lock locks the usage once the blocks expired since the last time are no longer counted
+func (u *Usage) lock() {
+	u.mu.Lock()
+	u.tree.expire(u.now())
+}
+
+func (u *Usage) size(path string) (int64, bool) {
+	u.lock()
+	defer u.mu.Unlock()
+	size, exists := u.tree.sizes[path]
+	return size, exists
+}
+
+// limitsBytes reports whether a quota bounds the bytes of a block
+func (u *Usage) limitsBytes(path string) bool {
+	for _, quota := range u.quotas {
+		if quota.MaxBytes > 0 && isSameOrDescendant(path, quota.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserve holds the growth of a write of a block on every quota
+func (u *Usage) reserve(path string, delta UsageCount) ([]UsageCount, error) {
+	u.lock()
+	defer u.mu.Unlock()
+	return u.hold(u.changes(usageChange{path, delta}))
+}
+
+// reserveTransfer holds the growth of a copy or a move on every quota, the subtrees it transfers and
+// replaces being measured along with the reservation so that no write changes them in between
+func (u *Usage) reserveTransfer(from string, to string, overwrite bool, move bool) ([]UsageCount, error) {
+	u.lock()
+	defer u.mu.Unlock()
+
+	moved := u.tree.totals[from]
+	delta := moved
+	if overwrite {
+		delta = delta.sub(u.tree.totals[to])
+	}
+	changes := []usageChange{{to, delta}}
+	if move {
+		changes = append(changes, usageChange{from, UsageCount{}.sub(moved)})
+	}
+	return u.hold(u.changes(changes...))
+}
+
+type usageChange struct {
+	path  string
+	delta UsageCount
+}
+
+// changes returns how much every quota grows with the changes of the blocks a write makes
+func (u *Usage) changes(changes ...usageChange) []UsageCount {
+	growth := make([]UsageCount, len(u.quotas))
+	for i, quota := range u.quotas {
+		for _, change := range changes {
+			if isSameOrDescendant(change.path, quota.Path) {
+				growth[i] = growth[i].add(change.delta)
+			}
+		}
+	}
+	return growth
+}
+
+// reserveBatch holds the growth of the operations of a batch on every quota, the failure telling
+// the first operation the batch exceeds a quota with
+func (u *Usage) reserveBatch(ops []Operation) ([]UsageCount, error) {
+	u.lock()
+	defer u.mu.Unlock()
+
+	after := u.tree.clone()
+	for _, op := range ops {
+		after.apply(op)
+	}
+	// Only the outcome of the whole batch counts, later operations may free the space earlier ones take
+	growth := u.growth(after)
+	if err := u.check(growth); err != nil {
+		return nil, u.firstExceeding(ops)
+	}
+	return u.hold(growth)
+}
+
+// growth returns how much every quota grows from the current usage to the one of another tree
+func (u *Usage) growth(after usageTree) []UsageCount {
+	growth := make([]UsageCount, len(u.quotas))
+	for i, quota := range u.quotas {
+		growth[i] = after.totals[quota.Path].sub(u.tree.totals[quota.Path])
+	}
+	return growth
+}
+
+// firstExceeding returns the error of the first operation of a batch after which a quota is exceeded
+func (u *Usage) firstExceeding(ops []Operation) error {
+	after := u.tree.clone()
+	for i, op := range ops {
+		after.apply(op)
+		if err := u.check(u.growth(after)); err != nil {
+			return &BatchError{i, err}
+		}
+	}
+	return nil
+}
+
+// hold checks that the growth fits in every quota along with the writes in progress, then reserves it.
+// Shrinking quotas reserve nothing, as their space is only freed once the write succeeds.
+func (u *Usage) hold(growth []UsageCount) ([]UsageCount, error) {
+	if err := u.check(growth); err != nil {
+		return nil, err
+	}
+	for i := range u.quotas {
+		u.reserved[i] = u.reserved[i].add(positive(growth[i]))
+		growth[i] = positive(growth[i])
+	}
+	return growth, nil
+}
+
+// check returns ErrQuotaExceeded when a growth does not fit in a quota along with the writes in progress
+func (u *Usage) check(growth []UsageCount) error {
+	for i, quota := range u.quotas {
+		grows := positive(growth[i])
+		used := u.tree.totals[quota.Path].add(u.reserved[i]).add(grows)
+		if quota.MaxBytes > 0 && grows.Bytes > 0 && used.Bytes > quota.MaxBytes {
+			return errors.Join(fmt.Errorf("quota of /%s: %d bytes at most", quota.Path, quota.MaxBytes), ErrQuotaExceeded)
+		}
+		if quota.MaxBlocks > 0 && grows.Blocks > 0 && used.Blocks > quota.MaxBlocks {
+			return errors.Join(fmt.Errorf("quota of /%s: %d blocks at most", quota.Path, quota.MaxBlocks), ErrQuotaExceeded)
+		}
+	}
+	return nil
+}
+
+func positive(c UsageCount) UsageCount {
+	return UsageCount{max(c.Bytes, 0), max(c.Blocks, 0)}
+}
+
+// release gives back the reservation of a failed write
+func (u *Usage) release(reservation []UsageCount) {
+	u.commit(reservation, func(usageTree) {})
+}
+
+// commit accounts for a successful write in place of its reservation
+func (u *Usage) commit(reservation []UsageCount, write func(tree usageTree)) {
+	u.lock()
+	defer u.mu.Unlock()
+	for i, growth := range reservation {
+		u.reserved[i] = u.reserved[i].sub(growth)
+	}
+	write(u.tree)
+}
+
+// quotaManager keeps a Usage in sync with the writes of a BlockManager, which fail with
+// ErrQuotaExceeded when they would exceed a quota
+type quotaManager struct {
+	BlockManager
+	usage *Usage
+}
+
+// EnforceQuotas accounts for the blocks already stored by m and returns a BlockManager updating
+// the usage on every write, refusing the ones exceeding a quota
+func EnforceQuotas(m BlockManager, usage *Usage) BlockManager {
+	Walk(m, "", func(path string) error {
+		if block, err := m.Get(path, false); err == nil {
+			usage.commit(nil, func(tree usageTree) { tree.put(path, block.Size, block.ExpiresAt) })
+		}
+		return nil
+	})
+	return &quotaManager{m, usage}
+}
+
+// Set reserves the content as it is read, an upload exceeding a quota failing as soon as it does
+func (q *quotaManager) Set(path string, content io.Reader, contentType string, opts ...WriteOption) error {
+	old, exists := q.usage.size(path)
+	delta := UsageCount{}
+	if !exists {
+		delta.Blocks = 1
+	}
+	reservation, err := q.usage.reserve(path, delta)
+	if err != nil {
+		return err
+	}
+
+	reader := &quotaReader{Reader: content, usage: q.usage, path: path, credit: old, reservation: reservation}
+	err = q.BlockManager.Set(path, reader, contentType, opts...)
+	if err != nil {
+		q.usage.release(reader.reservation)
+		if reader.err != nil {
+			return reader.err
+		}
+		return err
+	}
+	expiresAt := newWriteOptions(opts).expiresAt
+	q.usage.commit(reader.reservation, func(tree usageTree) { tree.put(path, reader.read, expiresAt) })
+	return nil
+}
+
+// quotaReader reserves the bytes of an upload beyond the size of the content it replaces
+type quotaReader struct {
+	io.Reader
+	usage       *Usage
+	path        string
+	credit      int64
+	read        int64
+	reservation []UsageCount
+	err         error
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		growth := max(r.read+int64(n)-r.credit, 0) - max(r.read-r.credit, 0)
+		if growth > 0 {
+			reservation, quotaErr := r.usage.reserve(r.path, UsageCount{Bytes: growth})
+			if quotaErr != nil {
+				r.err = quotaErr
+				return 0, quotaErr
+			}
+			for i := range reservation {
+				r.reservation[i] = r.reservation[i].add(reservation[i])
+			}
+		}
+		r.read += int64(n)
+	}
+	return n, err
+}
+
+// Link reserves the size of the linked content under a quota of bytes, which the storage tells.
+// Storages that cannot tell it return ErrUnknownBlob, so that the content is uploaded and accounted for by Set.
+func (q *quotaManager) Link(path string, checksum string, contentType string, opts ...WriteOption) error {
+	old, exists := q.usage.size(path)
+	delta := UsageCount{}
+	if !exists {
+		delta.Blocks = 1
+	}
+	if q.usage.limitsBytes(path) {
+		sizer, ok := q.BlockManager.(BlobSizer)
+		if !ok {
+			return ErrUnknownBlob
+		}
+		size, err := sizer.BlobSize(checksum)
+		if err != nil {
+			return err
+		}
+		delta.Bytes = size - old
+	}
+	reservation, err := q.usage.reserve(path, delta)
+	if err != nil {
+		return err
+	}
+	if err := q.BlockManager.Link(path, checksum, contentType, opts...); err != nil {
+		q.usage.release(reservation)
+		return err
+	}
+	q.commitBlock(reservation, path)
+	return nil
+}
+
+func (q *quotaManager) Delete(path string) error {
+	if err := q.BlockManager.Delete(path); err != nil {
+		return err
+	}
+	q.usage.commit(nil, func(tree usageTree) { tree.drop(path) })
+	return nil
+}
+
+func (q *quotaManager) Restore(path string, revision int, opts ...WriteOption) error {
+	restored, err := q.BlockManager.GetRevision(path, revision, false)
+	if err != nil {
+		// The storage tells why the revision cannot be restored
+		return q.BlockManager.Restore(path, revision, opts...)
+	}
+	old, exists := q.usage.size(path)
+	delta := UsageCount{Bytes: restored.Size - old}
+	if !exists {
+		delta.Blocks = 1
+	}
+	reservation, err := q.usage.reserve(path, delta)
+	if err != nil {
+		return err
+	}
+	if err := q.BlockManager.Restore(path, revision, opts...); err != nil {
+		q.usage.release(reservation)
+		return err
+	}
+	q.commitBlock(reservation, path)
+	return nil
+}
+
+func (q *quotaManager) Move(from string, to string, overwrite bool) error {
+	return q.transfer(from, to, overwrite, true)
+}
+
+func (q *quotaManager) Copy(from string, to string, overwrite bool) error {
+	return q.transfer(from, to, overwrite, false)
+}
+
+// transfer reserves the subtree at its destination, less the subtree it replaces and, for a move, at its source
+func (q *quotaManager) transfer(from string, to string, overwrite bool, move bool) error {
+	reservation, err := q.usage.reserveTransfer(from, to, overwrite, move)
+	if err != nil {
+		return err
+	}
+
+	transfer := q.BlockManager.Copy
+	if move {
+		transfer = q.BlockManager.Move
+	}
+	if err := transfer(from, to, overwrite); err != nil {
+		q.usage.release(reservation)
+		return err
+	}
+	q.usage.commit(reservation, func(tree usageTree) { tree.transfer(from, to, move) })
+	return nil
+}
+
+// Batch reserves the growth of all the operations, which either all apply or none
+func (q *quotaManager) Batch(ops []Operation) ([]OperationResult, error) {
+	reservation, err := q.usage.reserveBatch(ops)
+	if err != nil {
+		return batchResults(ops, nil, err)
+	}
+	results, err := q.BlockManager.Batch(ops)
+	if err != nil {
+		q.usage.release(reservation)
+		return results, err
+	}
+	q.usage.commit(reservation, func(tree usageTree) {
+		for _, op := range ops {
+			tree.apply(op)
+		}
+	})
+	return results, nil
+}
+
+// commitBlock accounts for a block written with a content whose size is only known once stored
+func (q *quotaManager) commitBlock(reservation []UsageCount, path string) {
+	block, err := q.BlockManager.Get(path, false)
+	q.usage.commit(reservation, func(tree usageTree) {
+		if err == nil {
+			tree.put(path, block.Size, block.ExpiresAt)
+		}
+	})
+}
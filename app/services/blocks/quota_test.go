@@ -0,0 +1,236 @@
+package blocks
+
+import (
+	"errors"
+	"goblocks/app/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQuotas(quotas ...config.Quota) *Usage {
+	return NewUsage(&config.Config{Blocks: config.Blocks{Quotas: quotas}})
+}
+
+func TestEnforceQuotas(t *testing.T) {
+	storage := NewInMemoryBlockManager()
+	storage.Set("docs/guide", strings.NewReader("0123456789"), "text/plain")
+	usage := newTestQuotas(
+		config.Quota{Path: "docs", MaxBytes: 20},
+		config.Quota{Path: "/tmp/", MaxBlocks: 2},
+	)
+	manager := EnforceQuotas(storage, usage)
+
+	if used := usage.Of("docs"); used != (UsageCount{10, 1}) {
+		t.Fatalf("Of(docs) = %+v, want the blocks already stored", used)
+	}
+
+	steps := []struct {
+		name          string
+		run           func() error
+		expectedError error
+	}{
+		{name: "set within the quota", run: func() error {
+			return manager.Set("docs/faq", strings.NewReader("01234"), "text/plain")
+		}},
+		{name: "set exceeding the quota", run: func() error {
+			return manager.Set("docs/big", strings.NewReader("0123456789"), "text/plain")
+		}, expectedError: ErrQuotaExceeded},
+		{name: "rewrite in the space of the replaced content", run: func() error {
+			return manager.Set("docs/guide", strings.NewReader("9876543210abcd"), "text/plain")
+		}},
+		{name: "link exceeding the quota", run: func() error {
+			return manager.Link("docs/link", Checksum([]byte("01234")), "text/plain")
+		}, expectedError: ErrQuotaExceeded},
+		{name: "blocks within the quota", run: func() error {
+			manager.Set("tmp/a", strings.NewReader("a"), "text/plain")
+			return manager.Set("tmp/b", strings.NewReader("b"), "text/plain")
+		}},
+		{name: "blocks exceeding the quota", run: func() error {
+			return manager.Set("tmp/c", strings.NewReader("c"), "text/plain")
+		}, expectedError: ErrQuotaExceeded},
+		{name: "copy exceeding the quota", run: func() error {
+			return manager.Copy("docs/faq", "tmp/faq", false)
+		}, expectedError: ErrQuotaExceeded},
+		{name: "move into the quota", run: func() error {
+			return manager.Move("tmp/a", "docs/a", false)
+		}},
+		{name: "space freed by a move", run: func() error {
+			return manager.Set("tmp/c", strings.NewReader("c"), "text/plain")
+		}},
+		{name: "space freed by a delete", run: func() error {
+			if err := manager.Delete("docs/guide"); err != nil {
+				return err
+			}
+			return manager.Set("docs/big", strings.NewReader("0123456789"), "text/plain")
+		}},
+		{name: "restore exceeding the quota", run: func() error {
+			manager.Set("docs/big", strings.NewReader("0"), "text/plain")
+			manager.Set("docs/other", strings.NewReader("0123456789"), "text/plain")
+			return manager.Restore("docs/big", 1)
+		}, expectedError: ErrQuotaExceeded},
+	}
+	for _, step := range steps {
+		if err := step.run(); !errors.Is(err, step.expectedError) {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.expectedError)
+		}
+	}
+
+	expected := map[string]UsageCount{"docs": {17, 4}, "tmp": {2, 2}, "": {19, 6}}
+	for path, want := range expected {
+		if used := usage.Of(path); used != want {
+			t.Errorf("Of(%q) = %+v, want %+v", path, used, want)
+		}
+	}
+	if _, err := manager.Get("docs/guide", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a deleted block error = %v", err)
+	}
+	quotas := usage.Quotas("docs/a")
+	if len(quotas) != 1 || quotas[0].Path != "docs" || quotas[0].Bytes != 17 {
+		t.Errorf("Quotas(docs/a) = %+v, want the docs quota", quotas)
+	}
+}
+
+func TestEnforceQuotas_Batch(t *testing.T) {
+	usage := newTestQuotas(config.Quota{Path: "docs", MaxBytes: 10})
+	manager := EnforceQuotas(NewInMemoryBlockManager(), usage)
+	manager.Set("docs/a", strings.NewReader("01234"), "text/plain")
+
+	// The space a batch frees counts for its other operations
+	_, err := manager.Batch([]Operation{
+		{Type: OpSet, Path: "docs/b", Content: []byte("0123456789"), ContentType: "text/plain"},
+		{Type: OpMove, Path: "docs/a", To: "archive/a"},
+	})
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+
+	_, err = manager.Batch([]Operation{
+		{Type: OpDelete, Path: "archive/a"},
+		{Type: OpMove, Path: "docs/b", To: "archive/b"},
+		{Type: OpSet, Path: "docs/c", Content: []byte("0123456789"), ContentType: "text/plain"},
+		{Type: OpSet, Path: "docs/d", Content: []byte("0"), ContentType: "text/plain"},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 3 || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Batch() error = %v, want ErrQuotaExceeded at operation 3", err)
+	}
+	if used := usage.Of(""); used != (UsageCount{15, 2}) {
+		t.Errorf("Of() after a failed batch = %+v, want it unchanged", used)
+	}
+}
+
+func TestEnforceQuotas_Concurrent(t *testing.T) {
+	usage := newTestQuotas(config.Quota{MaxBytes: 100})
+	manager := EnforceQuotas(NewInMemoryBlockManager(), usage)
+
+	var wg sync.WaitGroup
+	failures := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := "uploads/" + string(rune('a'+i))
+			if err := manager.Set(path, strings.NewReader("0123456789"), "text/plain"); err != nil {
+				failures <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(failures)
+
+	for err := range failures {
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("Set() error = %v, want ErrQuotaExceeded", err)
+		}
+	}
+	if used := usage.Of(""); used != (UsageCount{100, 10}) {
+		t.Errorf("Of() = %+v, want exactly the quota", used)
+	}
+}
+
+func TestEnforceQuotas_Link(t *testing.T) {
+	usage := newTestQuotas(config.Quota{Path: "docs", MaxBytes: 10})
+	manager := EnforceQuotas(NewInMemoryBlockManager(), usage)
+	manager.Set("docs/a", strings.NewReader("01234"), "text/plain")
+	checksum := Checksum([]byte("01234"))
+
+	if err := manager.Link("docs/b", checksum, "text/plain"); err != nil {
+		t.Fatalf("Link() within the quota error = %v", err)
+	}
+	if used := usage.Of("docs"); used != (UsageCount{10, 2}) {
+		t.Errorf("Of(docs) = %+v, want the linked content counted", used)
+	}
+	if err := manager.Link("docs/c", checksum, "text/plain"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Link() exceeding the quota error = %v, want ErrQuotaExceeded", err)
+	}
+	if err := manager.Link("docs/b", Checksum([]byte("unknown")), "text/plain"); !errors.Is(err, ErrUnknownBlob) {
+		t.Errorf("Link() of an unknown content error = %v, want ErrUnknownBlob", err)
+	}
+
+	// Storages unable to tell the size of a content have it uploaded
+	storage := struct{ BlockManager }{NewInMemoryBlockManager()}
+	storage.Set("a", strings.NewReader("01234"), "text/plain")
+	manager = EnforceQuotas(storage, newTestQuotas(config.Quota{MaxBytes: 10}))
+	if err := manager.Link("b", checksum, "text/plain"); !errors.Is(err, ErrUnknownBlob) {
+		t.Errorf("Link() without the size of the content error = %v, want ErrUnknownBlob", err)
+	}
+}
+
+func TestEnforceQuotas_Expired(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	usage := newTestQuotas(config.Quota{Path: "tmp", MaxBytes: 10, MaxBlocks: 2})
+	usage.now = func() time.Time { return now }
+	manager := EnforceQuotas(NewInMemoryBlockManager(), usage)
+
+	manager.Set("tmp/upload", strings.NewReader("0123456789"), "text/plain", WithExpiry(now.Add(time.Hour)))
+	manager.Set("tmp/upload/part", strings.NewReader(""), "text/plain")
+	if err := manager.Set("tmp/other", strings.NewReader("0"), "text/plain"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Set() before the expiry error = %v, want ErrQuotaExceeded", err)
+	}
+
+	// The expired block stops counting before it is reaped, its children until then
+	now = now.Add(2 * time.Hour)
+	if used := usage.Of("tmp"); used != (UsageCount{0, 1}) {
+		t.Errorf("Of(tmp) once expired = %+v, want the children only", used)
+	}
+	if err := manager.Set("tmp/other", strings.NewReader("0123456789"), "text/plain"); err != nil {
+		t.Fatalf("Set() after the expiry error = %v", err)
+	}
+	if _, err := ReapExpired(manager, NewLocker(), now); err != nil {
+		t.Fatalf("ReapExpired() error = %v", err)
+	}
+	if used := usage.Of("tmp"); used != (UsageCount{10, 1}) {
+		t.Errorf("Of(tmp) once reaped = %+v, want the other block only", used)
+	}
+
+	// A rewrite without expiry keeps counting
+	manager.Set("tmp/other", strings.NewReader("0"), "text/plain", WithExpiry(now.Add(time.Hour)))
+	manager.Set("tmp/other", strings.NewReader("0"), "text/plain")
+	now = now.Add(2 * time.Hour)
+	if used := usage.Of("tmp"); used != (UsageCount{1, 1}) {
+		t.Errorf("Of(tmp) after a rewrite without expiry = %+v", used)
+	}
+}
+
+func TestUsageTree_Drop(t *testing.T) {
+	tree := newUsageTree()
+	tree.put("docs", 1, time.Time{})
+	tree.put("docs/a/b", 2, time.Time{})
+	tree.put("docs/a/c", 3, time.Time{})
+	tree.put("docsx", 4, time.Time{})
+
+	tree.drop("docs")
+	if len(tree.sizes) != 1 || tree.totals[""] != (UsageCount{4, 1}) || tree.totals["docsx"] != (UsageCount{4, 1}) {
+		t.Errorf("drop(docs) left %+v, totals %+v", tree.sizes, tree.totals)
+	}
+	if len(tree.totals) != 2 || len(tree.children) != 1 || !tree.children[""]["docsx"] {
+		t.Errorf("drop(docs) left totals %+v and children %+v", tree.totals, tree.children)
+	}
+
+	tree.transfer("docsx", "archive/docsx", true)
+	if got := tree.subtree(""); len(got) != 3 || tree.totals["archive"] != (UsageCount{4, 1}) {
+		t.Errorf("subtree() after transfer = %v, totals %+v", got, tree.totals)
+	}
+}
@@ -0,0 +1,387 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const MaxReferenceDepth = 10
+
+var ErrDanglingReference = errors.New("Dangling Reference")
+var ErrReferenceCycle = errors.New("Reference Cycle")
+var ErrReferenceTooDeep = errors.New("Reference Too Deep")
+var ErrResolvedTooLarge = errors.New("Resolved Content Too Large")
+
+// MaxReferenceTarget bounds the target of a marker, so that markers are found in a stream through a bounded window
+const MaxReferenceTarget = 1000
+
+// maxReferenceMarker is the length of the longest marker
+const maxReferenceMarker = len("::ref()") + MaxReferenceTarget
+
+// referencePattern matches transclusion markers such as ::ref(/a/b/c)
+var referencePattern = regexp.MustCompile(fmt.Sprintf(`::ref\(([^)\s]{0,%d})\)`, MaxReferenceTarget))
+
+// IsTextType reports whether a content type may embed block references
+func IsTextType(contentType string) bool {
+	mainType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasPrefix(mainType, "text/") {
+		return true
+	}
+	if strings.HasSuffix(mainType, "+json") || strings.HasSuffix(mainType, "+xml") {
+		return true
+	}
+	switch mainType {
+	case "application/json", "application/xml", "application/javascript", "application/yaml", "application/x-yaml":
+		return true
+	}
+	return false
+}
+
+// ParseReferences returns the valid block paths referenced by a content, in order of appearance
+func ParseReferences(content []byte) []string {
+	scanner := newReferenceScanner()
+	scanner.Write(content)
+	return scanner.references
+}
+
+// referenceScanner collects the references of a content written to it in chunks, keeping no more of it
+// than the tail which may hold the start of a marker
+type referenceScanner struct {
+	pending    []byte
+	references []string
+}
+
+func newReferenceScanner() *referenceScanner {
+	return &referenceScanner{references: []string{}}
+}
+
+func (s *referenceScanner) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	end := 0
+	for _, match := range referencePattern.FindAllSubmatchIndex(s.pending, -1) {
+		path, err := referencePath(string(s.pending[match[2]:match[3]]))
+		if err == nil && !slices.Contains(s.references, path) {
+			s.references = append(s.references, path)
+		}
+		end = match[1]
+	}
+	// What follows the last marker and is too far from the end to start one is left behind
+	tail := max(end, len(s.pending)-(maxReferenceMarker-1))
+	s.pending = append(s.pending[:0], s.pending[tail:]...)
+	return len(p), nil
+}
+
+// referencePath converts the target of a marker, absolute from the block root, to a block path
+func referencePath(target string) (string, error) {
+	return ValidatePath(strings.TrimPrefix(target, "/"))
+}
+
+// Resolve returns a block with its content and every ::ref(path) marker recursively expanded,
+// failing with ErrResolvedTooLarge once the expansion exceeds maxSize bytes, 0 meaning unlimited
+func Resolve(m BlockManager, path string, maxSize int64) (Block, error) {
+	block, err := m.Get(path, true)
+	if err != nil {
+		return Block{}, err
+	}
+	r := &resolver{m: m, maxSize: maxSize, resolved: map[string]resolvedContent{}}
+	resolved, err := r.resolve(block, []string{path})
+	if err != nil {
+		return Block{}, err
+	}
+	block.Content = resolved.content
+	block.Size = int64(len(block.Content))
+	return block, nil
+}
+
+// resolver expands the references of a block, each referenced block being expanded once
+// however many times it is referenced
+type resolver struct {
+	m        BlockManager
+	maxSize  int64
+	resolved map[string]resolvedContent
+}
+
+// resolvedContent is the expansion of a block, along with the levels of references it went through
+type resolvedContent struct {
+	content []byte
+	depth   int
+}
+
+func (r *resolver) resolve(block Block, stack []string) (resolvedContent, error) {
+	if err := r.checkSize(block.Content, stack[0]); err != nil {
+		return resolvedContent{}, err
+	}
+	if !IsTextType(block.Type) {
+		return resolvedContent{content: block.Content}, nil
+	}
+
+	matches := referencePattern.FindAllSubmatchIndex(block.Content, -1)
+	if len(matches) == 0 {
+		return resolvedContent{content: block.Content}, nil
+	}
+
+	resolved := resolvedContent{content: make([]byte, 0, len(block.Content))}
+	last := 0
+	for _, match := range matches {
+		resolved.content = append(resolved.content, block.Content[last:match[0]]...)
+		last = match[1]
+
+		target := string(block.Content[match[2]:match[3]])
+		path, err := referencePath(target)
+		if err != nil {
+			return resolvedContent{}, fmt.Errorf("%w: %s referenced by %s", err, target, block.Path)
+		}
+		if slices.Contains(stack, path) {
+			return resolvedContent{}, fmt.Errorf("%w: %s", ErrReferenceCycle, strings.Join(append(stack, path), " -> "))
+		}
+		child, err := r.resolveReference(block.Path, path, stack)
+		if err != nil {
+			return resolvedContent{}, err
+		}
+		resolved.content = append(resolved.content, child.content...)
+		resolved.depth = max(resolved.depth, child.depth+1)
+		if err := r.checkSize(resolved.content, stack[0]); err != nil {
+			return resolvedContent{}, err
+		}
+	}
+	resolved.content = append(resolved.content, block.Content[last:]...)
+
+	return resolved, r.checkSize(resolved.content, stack[0])
+}
+
+// resolveReference expands a block referenced from the top of the stack. A block already expanded has no
+// reference to the stack, which would be a cycle found when it was expanded, and is reused as is.
+func (r *resolver) resolveReference(referrer string, path string, stack []string) (resolvedContent, error) {
+	resolved, ok := r.resolved[path]
+	if !ok {
+		if len(stack) > MaxReferenceDepth {
+			return resolvedContent{}, fmt.Errorf("%w: more than %d levels from %s", ErrReferenceTooDeep, MaxReferenceDepth, stack[0])
+		}
+		child, err := r.m.Get(path, true)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return resolvedContent{}, fmt.Errorf("%w: %s referenced by %s", ErrDanglingReference, path, referrer)
+			}
+			return resolvedContent{}, err
+		}
+		resolved, err = r.resolve(child, append(stack, path))
+		if err != nil {
+			return resolvedContent{}, err
+		}
+		r.resolved[path] = resolved
+	}
+	if len(stack)+resolved.depth > MaxReferenceDepth {
+		return resolvedContent{}, fmt.Errorf("%w: more than %d levels from %s", ErrReferenceTooDeep, MaxReferenceDepth, stack[0])
+	}
+	return resolved, nil
+}
+
+func (r *resolver) checkSize(content []byte, path string) error {
+	if r.maxSize > 0 && int64(len(content)) > r.maxSize {
+		return errors.Join(fmt.Errorf("resolving %s gives more than %d bytes", path, r.maxSize), ErrResolvedTooLarge)
+	}
+	return nil
+}
+
+// ReferenceIndex is the reverse index of block references: it answers which blocks embed a given block
+type ReferenceIndex struct {
+	mu         sync.RWMutex
+	referrers  map[string]map[string]struct{}
+	references map[string][]string
+}
+
+func NewReferenceIndex() *ReferenceIndex {
+	return &ReferenceIndex{
+		referrers:  map[string]map[string]struct{}{},
+		references: map[string][]string{},
+	}
+}
+
+// Referrers returns the sorted paths of the blocks referencing path
+func (idx *ReferenceIndex) Referrers(path string) []BlockReference {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	paths := []string{}
+	for referrer := range idx.referrers[path] {
+		paths = append(paths, referrer)
+	}
+	slices.Sort(paths)
+
+	references := []BlockReference{}
+	for _, p := range paths {
+		references = append(references, BlockReference{Path: p})
+	}
+	return references
+}
+
+// update replaces the outgoing references of a block
+func (idx *ReferenceIndex) update(path string, references []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.forget(path)
+	if len(references) == 0 {
+		return
+	}
+	idx.references[path] = references
+	for _, target := range references {
+		if idx.referrers[target] == nil {
+			idx.referrers[target] = map[string]struct{}{}
+		}
+		idx.referrers[target][path] = struct{}{}
+	}
+}
+
+// remove drops the outgoing references of a block and all its descendants
+func (idx *ReferenceIndex) remove(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for referrer := range idx.references {
+		if isSameOrDescendant(referrer, path) {
+			idx.forget(referrer)
+		}
+	}
+}
+
+func (idx *ReferenceIndex) forget(path string) {
+	for _, target := range idx.references[path] {
+		delete(idx.referrers[target], path)
+		if len(idx.referrers[target]) == 0 {
+			delete(idx.referrers, target)
+		}
+	}
+	delete(idx.references, path)
+}
+
+// referenceTracker keeps a ReferenceIndex in sync with the writes of a BlockManager
+type referenceTracker struct {
+	BlockManager
+	index *ReferenceIndex
+}
+
+// TrackReferences indexes the blocks already stored by m and returns a BlockManager updating the index on every write
+func TrackReferences(m BlockManager, index *ReferenceIndex) BlockManager {
+	tracker := &referenceTracker{m, index}
+	Walk(m, "", func(path string) error {
+		tracker.reindex(path)
+		return nil
+	})
+	return tracker
+}
+
+// Set parses the references of a text content as it is streamed to the storage, instead of reading it back
+func (t *referenceTracker) Set(path string, content io.Reader, contentType string, opts ...WriteOption) error {
+	scanner := newReferenceScanner()
+	if IsTextType(contentType) {
+		content = io.TeeReader(content, scanner)
+	}
+	err := t.BlockManager.Set(path, content, contentType, opts...)
+	if err != nil {
+		return err
+	}
+	t.index.update(path, scanner.references)
+	return nil
+}
+
+func (t *referenceTracker) Link(path string, checksum string, contentType string, opts ...WriteOption) error {
+	err := t.BlockManager.Link(path, checksum, contentType, opts...)
+	if err != nil {
+		return err
+	}
+	t.reindex(path)
+	return nil
+}
+
+func (t *referenceTracker) Delete(path string) error {
+	err := t.BlockManager.Delete(path)
+	if err != nil {
+		return err
+	}
+	t.index.remove(path)
+	return nil
+}
+
+func (t *referenceTracker) Restore(path string, revision int, opts ...WriteOption) error {
+	err := t.BlockManager.Restore(path, revision, opts...)
+	if err != nil {
+		return err
+	}
+	t.reindex(path)
+	return nil
+}
+
+func (t *referenceTracker) Move(from string, to string, overwrite bool) error {
+	err := t.BlockManager.Move(from, to, overwrite)
+	if err != nil {
+		return err
+	}
+	t.index.remove(from)
+	t.reindexTree(to)
+	return nil
+}
+
+func (t *referenceTracker) Copy(from string, to string, overwrite bool) error {
+	err := t.BlockManager.Copy(from, to, overwrite)
+	if err != nil {
+		return err
+	}
+	t.reindexTree(to)
+	return nil
+}
+
+// Batch replays the operations of a committed batch on the index, in their order
+func (t *referenceTracker) Batch(ops []Operation) ([]OperationResult, error) {
+	results, err := t.BlockManager.Batch(ops)
+	if err != nil {
+		return results, err
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case OpSet:
+			t.index.update(op.Path, parseContentReferences(op.Content, op.ContentType))
+		case OpDelete:
+			t.index.remove(op.Path)
+		case OpMove:
+			t.index.remove(op.Path)
+			t.reindexTree(op.To)
+		}
+	}
+	return results, nil
+}
+
+// reindexTree replaces the references of a subtree, dropping the ones of blocks that no longer exist
+func (t *referenceTracker) reindexTree(path string) {
+	t.index.remove(path)
+	Walk(t.BlockManager, path, func(p string) error {
+		t.reindex(p)
+		return nil
+	})
+}
+
+// reindex reads a block back to replace its references, for the writes which do not pass its content
+func (t *referenceTracker) reindex(path string) {
+	block, err := t.BlockManager.Get(path, false)
+	if err == nil && IsTextType(block.Type) {
+		block, err = t.BlockManager.Get(path, true)
+	}
+	if err != nil {
+		t.index.update(path, nil)
+		return
+	}
+	t.index.update(path, parseContentReferences(block.Content, block.Type))
+}
+
+// parseContentReferences returns the references of a content, none unless it is text
+func parseContentReferences(content []byte, contentType string) []string {
+	if !IsTextType(contentType) {
+		return nil
+	}
+	return ParseReferences(content)
+}
@@ -0,0 +1,239 @@
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseReferences(t *testing.T) {
+	content := []byte("a ::ref(/x/y) b ::ref(z) c ::ref(/x/y) d ::ref(../etc)")
+
+	refs := ParseReferences(content)
+
+	expected := []string{"x/y", "z"}
+	if len(refs) != len(expected) {
+		t.Fatalf("ParseReferences() = %v, want %v", refs, expected)
+	}
+	for i := range expected {
+		if refs[i] != expected[i] {
+			t.Errorf("ParseReferences()[%d] = %v, want %v", i, refs[i], expected[i])
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	manager.Set("page", strings.NewReader("<main>::ref(/fragments/header) body</main>"), "text/html")
+	manager.Set("fragments/header", strings.NewReader("<h1>::ref(/fragments/title)</h1>"), "text/html")
+	manager.Set("fragments/title", strings.NewReader("Title"), "text/plain")
+
+	block, err := Resolve(manager, "page", 0)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := "<main><h1>Title</h1> body</main>"
+	if string(block.Content) != want {
+		t.Errorf("Resolve() content = %s, want %s", block.Content, want)
+	}
+	if block.Size != int64(len(want)) {
+		t.Errorf("Resolve() size = %d, want %d", block.Size, len(want))
+	}
+}
+
+func TestResolve_NonTextIsNotExpanded(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	manager.Set("binary", strings.NewReader("::ref(/missing)"), "application/octet-stream")
+
+	block, err := Resolve(manager, "binary", 0)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if string(block.Content) != "::ref(/missing)" {
+		t.Errorf("Resolve() content = %s, want it untouched", block.Content)
+	}
+}
+
+func TestResolve_Errors(t *testing.T) {
+	manager := NewInMemoryBlockManager()
+	manager.Set("cycle/a", strings.NewReader("::ref(/cycle/b)"), "text/plain")
+	manager.Set("cycle/b", strings.NewReader("::ref(/cycle/a)"), "text/plain")
+	manager.Set("dangling", strings.NewReader("::ref(/missing)"), "text/plain")
+	for i := 0; i <= MaxReferenceDepth+1; i++ {
+		manager.Set(fmt.Sprintf("deep/%d", i), strings.NewReader(fmt.Sprintf("::ref(/deep/%d)", i+1)), "text/plain")
+	}
+
+	// Every level references the next one 4 times, which would expand to 4^10 copies of the last one
+	for i := 0; i < MaxReferenceDepth; i++ {
+		manager.Set(fmt.Sprintf("bomb/%d", i), strings.NewReader(strings.Repeat(fmt.Sprintf("::ref(/bomb/%d)", i+1), 4)), "text/plain")
+	}
+	manager.Set(fmt.Sprintf("bomb/%d", MaxReferenceDepth), strings.NewReader("boom"), "text/plain")
+	// A block referenced deeper than where it was expanded first is still too deep
+	for i := 0; i < MaxReferenceDepth-2; i++ {
+		manager.Set(fmt.Sprintf("chain/%d", i), strings.NewReader(fmt.Sprintf("::ref(/chain/%d)", i+1)), "text/plain")
+	}
+	manager.Set(fmt.Sprintf("chain/%d", MaxReferenceDepth-2), strings.NewReader("end"), "text/plain")
+	manager.Set("shared/0", strings.NewReader("::ref(/chain/0) ::ref(/shared/1)"), "text/plain")
+	manager.Set("shared/1", strings.NewReader("::ref(/shared/2)"), "text/plain")
+	manager.Set("shared/2", strings.NewReader("::ref(/chain/0)"), "text/plain")
+
+	tests := []struct {
+		name string
+		path string
+		want error
+	}{
+		{name: "cycle", path: "cycle/a", want: ErrReferenceCycle},
+		{name: "dangling", path: "dangling", want: ErrDanglingReference},
+		{name: "too deep", path: "deep/0", want: ErrReferenceTooDeep},
+		{name: "too large", path: "bomb/0", want: ErrResolvedTooLarge},
+		{name: "too deep once expanded", path: "shared/0", want: ErrReferenceTooDeep},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Resolve(manager, tt.path, 1024)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Resolve() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackReferences(t *testing.T) {
+	storage := NewInMemoryBlockManager()
+	storage.Set("existing", strings.NewReader("::ref(/shared)"), "text/plain")
+
+	index := NewReferenceIndex()
+	manager := TrackReferences(storage, index)
+
+	if refs := index.Referrers("shared"); len(refs) != 1 || refs[0].Path != "existing" {
+		t.Errorf("Referrers() = %v, want [existing] from the initial walk", refs)
+	}
+
+	manager.Set("pages/a", strings.NewReader("::ref(/shared) ::ref(/other)"), "text/plain")
+	manager.Set("pages/b", strings.NewReader("::ref(/shared)"), "text/markdown")
+	if refs := index.Referrers("shared"); len(refs) != 3 {
+		t.Errorf("Referrers() = %v, want 3 referrers", refs)
+	}
+
+	// Overwriting a block replaces its references
+	manager.Set("pages/b", strings.NewReader("no more refs"), "text/plain")
+	if refs := index.Referrers("shared"); len(refs) != 2 {
+		t.Errorf("Referrers() after update = %v, want 2 referrers", refs)
+	}
+
+	// Deleting a parent forgets the references of its descendants
+	manager.Delete("pages")
+	if refs := index.Referrers("other"); len(refs) != 0 {
+		t.Errorf("Referrers() after delete = %v, want none", refs)
+	}
+}
+
+func TestResolve_SharedReferences(t *testing.T) {
+	manager := &countingManager{BlockManager: NewInMemoryBlockManager()}
+	manager.Set("empty", strings.NewReader(""), "text/plain")
+	for i := 0; i < MaxReferenceDepth-1; i++ {
+		manager.Set(fmt.Sprintf("fan/%d", i), strings.NewReader(strings.Repeat(fmt.Sprintf("::ref(/fan/%d)", i+1), 8)), "text/plain")
+	}
+	manager.Set(fmt.Sprintf("fan/%d", MaxReferenceDepth-1), strings.NewReader("::ref(/empty)"), "text/plain")
+
+	// Blocks referenced many times are only read and expanded once
+	block, err := Resolve(manager, "fan/0", 1024)
+	if err != nil || len(block.Content) != 0 {
+		t.Fatalf("Resolve() = %q, %v, want an empty content", block.Content, err)
+	}
+	if manager.reads > MaxReferenceDepth+2 {
+		t.Errorf("Resolve() read %d blocks, want each one once", manager.reads)
+	}
+}
+
+// countingManager counts the reads of a content
+type countingManager struct {
+	BlockManager
+	reads int
+}
+
+func (m *countingManager) Get(path string, withContent bool) (Block, error) {
+	if withContent {
+		m.reads++
+	}
+	return m.BlockManager.Get(path, withContent)
+}
+
+func TestTrackReferences_ParsesWrittenContent(t *testing.T) {
+	storage := &countingManager{BlockManager: NewInMemoryBlockManager()}
+	index := NewReferenceIndex()
+	manager := TrackReferences(storage, index)
+
+	manager.Set("page", strings.NewReader("::ref(/shared)"), "text/plain")
+	manager.Set("image", strings.NewReader("::ref(/shared)"), "image/png")
+	if storage.reads != 0 {
+		t.Errorf("Set() read %d contents back, want none", storage.reads)
+	}
+	if refs := index.Referrers("shared"); len(refs) != 1 || refs[0].Path != "page" {
+		t.Errorf("Referrers() = %v, want [page]", refs)
+	}
+}
+
+func TestReferenceScanner(t *testing.T) {
+	content := "::ref(/a) " + strings.Repeat("filler ", 100000) + "::ref(/b/c) ::ref(/a) ::ref(/" + strings.Repeat("x", MaxReferenceTarget) + "y) ::ref(/d)"
+
+	// Markers split across the chunks of a stream are found, with no more than a marker of it kept
+	scanner := newReferenceScanner()
+	chunk := make([]byte, 7)
+	reader := strings.NewReader(content)
+	for {
+		n, err := reader.Read(chunk)
+		scanner.Write(chunk[:n])
+		if len(scanner.pending) >= maxReferenceMarker {
+			t.Fatalf("scanner kept %d bytes, want less than a marker", len(scanner.pending))
+		}
+		if err != nil {
+			break
+		}
+	}
+	expected := []string{"a", "b/c", "d"}
+	if !slices.Equal(scanner.references, expected) {
+		t.Errorf("references = %v, want %v", scanner.references, expected)
+	}
+	if references := ParseReferences([]byte(content)); !slices.Equal(references, expected) {
+		t.Errorf("ParseReferences() = %v, want %v", references, expected)
+	}
+}
+
+func TestTrackReferences_MoveAndCopy(t *testing.T) {
+	index := NewReferenceIndex()
+	manager := TrackReferences(NewInMemoryBlockManager(), index)
+	manager.Set("drafts/page", strings.NewReader("::ref(/shared)"), "text/plain")
+
+	manager.Copy("drafts", "archive", false)
+	manager.Move("drafts", "published", false)
+
+	refs := index.Referrers("shared")
+	if len(refs) != 2 || refs[0].Path != "archive/page" || refs[1].Path != "published/page" {
+		t.Errorf("Referrers() = %v, want [archive/page published/page]", refs)
+	}
+}
+
+func TestTrackReferences_Batch(t *testing.T) {
+	index := NewReferenceIndex()
+	manager := TrackReferences(NewInMemoryBlockManager(), index)
+	manager.Set("drafts/page", strings.NewReader("::ref(/shared)"), "text/plain")
+
+	_, err := manager.Batch([]Operation{
+		{Type: OpMove, Path: "drafts", To: "published"},
+		{Type: OpSet, Path: "index", Content: []byte("::ref(/shared)"), ContentType: "text/plain"},
+		{Type: OpSet, Path: "other", Content: []byte("::ref(/shared)"), ContentType: "text/plain"},
+		{Type: OpDelete, Path: "other"},
+	})
+	if err != nil {
+		t.Fatalf("Batch() error = %v", err)
+	}
+
+	refs := index.Referrers("shared")
+	if len(refs) != 2 || refs[0].Path != "index" || refs[1].Path != "published/page" {
+		t.Errorf("Referrers() = %v, want [index published/page]", refs)
+	}
+}
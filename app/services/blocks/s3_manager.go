@@ -0,0 +1,602 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goblocks/app/config"
+	"hash"
+	"io"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// s3DeleteBatchSize is the maximum number of keys of a DeleteObjects request
+const s3DeleteBatchSize = 1000
+
+// S3BlockManager stores blocks as objects of an S3-compatible bucket, with the
+// same layout as FsBlockManager: a block directory becomes a key prefix holding
+// a .content metadata object and a .revisions/ prefix.
+type S3BlockManager struct {
+	client   *s3.Client
+	uploader *transfermanager.Client
+	bucket   string
+	prefix   string
+}
+
+func NewS3BlockManager(client *s3.Client, bucket string, prefix string) *S3BlockManager {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3BlockManager{
+		client:   client,
+		uploader: transfermanager.New(client),
+		bucket:   bucket,
+		prefix:   prefix,
+	}
+}
+
+// newS3BlockManager connects to the configured bucket, failing early when it is not reachable
+func newS3BlockManager(c config.S3) (*S3BlockManager, error) {
+	ctx := context.Background()
+	options := []func(*awsconfig.LoadOptions) error{}
+	if c.Region != "" {
+		options = append(options, awsconfig.WithRegion(c.Region))
+	}
+	// Without static keys the default chain is used: environment, shared files, instance roles...
+	if c.AccessKey != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(c.AccessKey, c.SecretKey, ""),
+		))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, errors.Join(err, ErrUnknown)
+	}
+	if awsConfig.Region == "" {
+		awsConfig.Region = "us-east-1"
+	}
+
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if c.Endpoint != "" {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		}
+		o.UsePathStyle = c.PathStyle
+	})
+	_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.Bucket)})
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", c.Bucket, mapS3Error(err))
+	}
+	return NewS3BlockManager(client, c.Bucket, c.Prefix), nil
+}
+
+func (s *S3BlockManager) Get(p string, withContent bool) (Block, error) {
+	if withContent {
+		return readBlock(s.Open, p, 0)
+	}
+
+	fileContent, err := s.readFileContent(s.getFileKey(p))
+	if err != nil {
+		return Block{}, err
+	}
+	return fileContent.toBlock(p), nil
+}
+
+func (s *S3BlockManager) Open(p string, revision int) (Block, io.ReadSeekCloser, error) {
+	key := s.getFileKey(p)
+	if revision < 0 {
+		return Block{}, nil, ErrInvalidRevision
+	} else if revision > 0 {
+		key = s.getRevisionFileKey(p, revision)
+	}
+
+	fileContent, err := s.readFileContent(key)
+	if err != nil {
+		return Block{}, nil, err
+	}
+	reader := &s3Reader{
+		manager: s,
+		key:     s.getDataKey(p, fileContent),
+		size:    fileContent.Size,
+	}
+	return fileContent.toBlock(p), reader, nil
+}
+
+func (s *S3BlockManager) Set(p string, content io.Reader, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	current, tag, err := s.readTaggedFileContent(s.getFileKey(p))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	attributes, err := writeAttributes(current.Attributes, opts)
+	if err != nil {
+		return err
+	}
+	created := blockCreatedAt(current, func() (FileContent, error) {
+		return s.readFileContent(s.getRevisionFileKey(p, 1))
+	})
+
+	// The content is streamed to the bucket, in parts when it is large, under a key of its own
+	// so that nodes writing the same block at once never overwrite each other's content
+	data := rand.Text() + FsDataExtension
+	digest := &digestReader{reader: content, hash: sha256.New()}
+	_, err = s.uploader.UploadObject(context.Background(), &transfermanager.UploadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.getRevisionsKey(p) + data),
+		Body:   digest,
+	})
+	if err != nil {
+		return mapS3Error(err)
+	}
+
+	// The revision is written first so the current content always has a matching history entry.
+	// Another node may have taken its number meanwhile, the next free one is taken then.
+	var fileContent FileContent
+	for number := current.Revision + 1; ; number++ {
+		revision := newRevision(number, digest.size, hex.EncodeToString(digest.hash.Sum(nil)), contentType, attributes, writeAuthor(opts))
+		fileContent = newFileContent(revision, created)
+		fileContent.Data = data
+		err = s.writeFileContent(s.getRevisionFileKey(p, number), fileContent, "")
+		if !errors.Is(err, ErrPreconditionFailed) {
+			break
+		}
+	}
+	if err != nil {
+		s.deleteKeys([]string{s.getRevisionsKey(p) + data})
+		return err
+	}
+	return s.writeCurrent(p, fileContent, tag)
+}
+
+// writeCurrent makes a revision the current content of a block, unless another node made a later one
+// current meanwhile. tag is the entity tag of the current content it replaces, empty when there was none.
+func (s *S3BlockManager) writeCurrent(p string, fileContent FileContent, tag string) error {
+	for {
+		err := s.writeFileContent(s.getFileKey(p), fileContent, tag)
+		if !errors.Is(err, ErrPreconditionFailed) {
+			return err
+		}
+		current, currentTag, err := s.readTaggedFileContent(s.getFileKey(p))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if current.Revision > fileContent.Revision {
+			return nil
+		}
+		tag = currentTag
+	}
+}
+
+// Link always fails with ErrUnknownBlob, contents are stored per revision and not addressed by their checksum
+func (s *S3BlockManager) Link(p string, checksum string, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	return ErrUnknownBlob
+}
+
+func (s *S3BlockManager) Delete(p string) error {
+	if err := validateReserved(p); err != nil {
+		return err
+	}
+
+	keys, err := s.listKeys(s.getDirKey(p))
+	if err != nil {
+		return err
+	}
+	return s.deleteKeys(keys)
+}
+
+func (s *S3BlockManager) Move(from string, to string, overwrite bool) error {
+	return s.transfer(from, to, overwrite, true)
+}
+
+func (s *S3BlockManager) Copy(from string, to string, overwrite bool) error {
+	return s.transfer(from, to, overwrite, false)
+}
+
+// Batch always fails with ErrUnsupported, objects being written one by one a failed batch could not be undone atomically
+func (s *S3BlockManager) Batch(ops []Operation) ([]OperationResult, error) {
+	return batchResults(ops, nil, &BatchError{0, ErrUnsupported})
+}
+
+// transfer copies the objects of a subtree, buckets having no rename.
+// The .content objects are copied last so that blocks only show up once their history is complete.
+func (s *S3BlockManager) transfer(from string, to string, overwrite bool, move bool) error {
+	err := validateTransfer(from, to)
+	if err != nil {
+		return err
+	}
+
+	sources, err := s.listKeys(s.getDirKey(from))
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return ErrNotFound
+	}
+	existing, err := s.listKeys(s.getDirKey(to))
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		if !overwrite {
+			return ErrAlreadyExists
+		}
+		if err := s.deleteKeys(existing); err != nil {
+			return err
+		}
+	}
+
+	contents := slices.DeleteFunc(slices.Clone(sources), func(key string) bool {
+		return path.Base(key) != FsFileName
+	})
+	others := slices.DeleteFunc(slices.Clone(sources), func(key string) bool {
+		return path.Base(key) == FsFileName
+	})
+	fromKey, toKey := s.getDirKey(from), s.getDirKey(to)
+	for _, source := range append(others, contents...) {
+		_, err := s.client.CopyObject(context.Background(), &s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			CopySource: aws.String((&url.URL{Path: s.bucket + "/" + source}).EscapedPath()),
+			Key:        aws.String(toKey + strings.TrimPrefix(source, fromKey)),
+		})
+		if err != nil {
+			return mapS3Error(err)
+		}
+	}
+
+	if move {
+		return s.deleteKeys(sources)
+	}
+	return nil
+}
+
+func (s *S3BlockManager) List(p string) ([]BlockReference, error) {
+	dirKey := s.getDirKey(p)
+	references := []BlockReference{}
+	empty := true
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(dirKey),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, mapS3Error(err)
+		}
+		empty = empty && len(page.Contents) == 0 && len(page.CommonPrefixes) == 0
+		for _, prefix := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(prefix.Prefix), dirKey), "/")
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			references = append(references, BlockReference{Path: childPath(p, name)})
+		}
+	}
+
+	// Prefixes only exist through the objects below them
+	if empty && p != "" {
+		return nil, ErrNotFound
+	}
+	// Keys are ordered with their trailing delimiter, "a-b/" coming before "a/"
+	slices.SortFunc(references, func(a, b BlockReference) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return references, nil
+}
+
+func (s *S3BlockManager) Children(p string, opts ListOptions) (ChildrenPage, error) {
+	opts, err := opts.Validate()
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	refs, err := s.List(p)
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+
+	// Sorting by name without filtering only needs the metadata of the returned page
+	if opts.SortBy == SortByName && len(opts.Tags) == 0 {
+		page, err := paginate(refs, opts)
+		if err != nil {
+			return ChildrenPage{}, err
+		}
+		s.describe(page.Items)
+		return page, nil
+	}
+
+	s.describe(refs)
+	return paginate(refs, opts)
+}
+
+// describe fills the type, size, modification time, tags and expiry of references, prefixes without content stay empty
+func (s *S3BlockManager) describe(refs []BlockReference) {
+	for i := range refs {
+		fileContent, err := s.readFileContent(s.getFileKey(refs[i].Path))
+		if err != nil {
+			continue
+		}
+		refs[i].Type = fileContent.ContentType
+		refs[i].Size = fileContent.Size
+		refs[i].UpdatedAt = fileContent.CreatedAt
+		refs[i].Tags = fileContent.Tags
+		refs[i].ExpiresAt = fileContent.ExpiresAt
+	}
+}
+
+func (s *S3BlockManager) Revisions(p string) ([]Revision, error) {
+	if _, err := s.readFileContent(s.getFileKey(p)); err != nil {
+		return nil, err
+	}
+	keys, err := s.listKeys(s.getRevisionsKey(p))
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := []int{}
+	for _, key := range keys {
+		number, err := strconv.Atoi(path.Base(key))
+		if err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	slices.Sort(numbers)
+
+	revisions := []Revision{}
+	for _, number := range numbers {
+		fileContent, err := s.readFileContent(s.getRevisionFileKey(p, number))
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, fileContent.toRevision())
+	}
+	return revisions, nil
+}
+
+func (s *S3BlockManager) GetRevision(p string, revision int, withContent bool) (Block, error) {
+	if revision <= 0 {
+		return Block{}, ErrInvalidRevision
+	}
+	if withContent {
+		return readBlock(s.Open, p, revision)
+	}
+
+	fileContent, err := s.readFileContent(s.getRevisionFileKey(p, revision))
+	if err != nil {
+		return Block{}, err
+	}
+	return fileContent.toBlock(p), nil
+}
+
+func (s *S3BlockManager) Restore(p string, revision int, opts ...WriteOption) error {
+	if revision <= 0 {
+		return ErrInvalidRevision
+	}
+	block, content, err := s.Open(p, revision)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return s.Set(p, content, block.Type, append([]WriteOption{WithAttributes(block.Attributes)}, opts...)...)
+}
+
+func (s *S3BlockManager) readFileContent(key string) (FileContent, error) {
+	fileContent, _, err := s.readTaggedFileContent(key)
+	return fileContent, err
+}
+
+// readTaggedFileContent also returns the entity tag of the metadata, for a conditional write replacing it
+func (s *S3BlockManager) readTaggedFileContent(key string) (FileContent, string, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return FileContent{}, "", mapS3Error(err)
+	}
+	defer out.Body.Close()
+
+	fileContent := FileContent{}
+	err = json.NewDecoder(out.Body).Decode(&fileContent)
+	if err != nil {
+		return FileContent{}, "", errors.Join(err, ErrUnknown)
+	}
+	return fileContent, aws.ToString(out.ETag), nil
+}
+
+// writeFileContent writes metadata if its object still has the entity tag, or does not exist when the tag is empty,
+// failing with ErrPreconditionFailed otherwise
+func (s *S3BlockManager) writeFileContent(key string, fileContent FileContent, tag string) error {
+	jsonContent, err := json.Marshal(fileContent)
+	if err != nil {
+		return errors.Join(err, ErrUnknown)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(jsonContent),
+		ContentType: aws.String("application/json"),
+	}
+	if tag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(tag)
+	}
+	_, err = s.client.PutObject(context.Background(), input)
+	return mapS3Error(err)
+}
+
+// listKeys returns the keys of all the objects under a prefix
+func (s *S3BlockManager) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, mapS3Error(err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *S3BlockManager) deleteKeys(keys []string) error {
+	for batch := range slices.Chunk(keys, s3DeleteBatchSize) {
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		out, err := s.client.DeleteObjects(context.Background(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return mapS3Error(err)
+		}
+		if len(out.Errors) > 0 {
+			return errors.Join(fmt.Errorf("unable to delete %s: %s", aws.ToString(out.Errors[0].Key), aws.ToString(out.Errors[0].Message)), ErrUnknown)
+		}
+	}
+	return nil
+}
+
+// getDirKey returns the prefix of the objects of a block and its descendants
+func (s *S3BlockManager) getDirKey(p string) string {
+	if p == "" {
+		return s.prefix
+	}
+	return s.prefix + p + "/"
+}
+func (s *S3BlockManager) getFileKey(p string) string {
+	return s.getDirKey(p) + FsFileName
+}
+func (s *S3BlockManager) getRevisionsKey(p string) string {
+	return s.getDirKey(p) + FsRevisionsDirName + "/"
+}
+func (s *S3BlockManager) getRevisionFileKey(p string, revision int) string {
+	return s.getRevisionsKey(p) + strconv.Itoa(revision)
+}
+
+// getDataKey returns the object holding the content of a revision, keyed by its number when it was written
+// before contents got keys of their own
+func (s *S3BlockManager) getDataKey(p string, fileContent FileContent) string {
+	if fileContent.Data == "" {
+		return s.getRevisionFileKey(p, fileContent.Revision) + FsDataExtension
+	}
+	return s.getRevisionsKey(p) + fileContent.Data
+}
+
+// s3Reader reads an object lazily, seeking issues a ranged request on the next read
+type s3Reader struct {
+	manager *S3BlockManager
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		out, err := r.manager.client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String(r.manager.bucket),
+			Key:    aws.String(r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+		})
+		if err != nil {
+			return 0, mapS3Error(err)
+		}
+		r.body = out.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// digestReader computes the size and hash of the content read through it
+type digestReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return errors.Join(err, ErrNotFound)
+		case "AccessDenied", "Forbidden":
+			return errors.Join(err, ErrForbidden)
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return errors.Join(err, ErrPreconditionFailed)
+		}
+	}
+	return errors.Join(err, ErrUnknown)
+}
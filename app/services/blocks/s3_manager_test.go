@@ -0,0 +1,260 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// newTestS3BlockManager returns a manager storing its blocks in an in-process fake S3 server
+func newTestS3BlockManager(t *testing.T, prefix string) (*S3BlockManager, *s3.Client) {
+	t.Helper()
+	server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(server.URL),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		UsePathStyle: true,
+	})
+	_, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String("goblocks")})
+	if err != nil {
+		t.Fatalf("CreateBucket() error = %v", err)
+	}
+	return NewS3BlockManager(client, "goblocks", prefix), client
+}
+
+func TestS3BlockManager_SetAndGet(t *testing.T) {
+	manager, client := newTestS3BlockManager(t, "/tenant/")
+
+	err := manager.Set("a/b/c", strings.NewReader("Hello, World!"), "text/plain")
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	block, err := manager.Get("a/b/c", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "Hello, World!" || block.Type != "text/plain" || block.Size != 13 || block.Revision != 1 {
+		t.Errorf("Get() = %+v, want the first revision of Hello, World!", block)
+	}
+	if block.Checksum != Checksum([]byte("Hello, World!")) {
+		t.Errorf("Get() checksum = %s, want the sha256 of the content", block.Checksum)
+	}
+
+	if _, err := manager.Get("a/b", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a parent without content error = %v, want ErrNotFound", err)
+	}
+
+	// Objects are stored under the prefix with the fs layout, the content under a key of its own
+	fileContent, err := manager.readFileContent("tenant/a/b/c/.revisions/1")
+	if err != nil || fileContent.Data == "" {
+		t.Fatalf("readFileContent() = %+v, %v, want the key of the content", fileContent, err)
+	}
+	out, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("goblocks"),
+		Key:    aws.String("tenant/a/b/c/.revisions/" + fileContent.Data),
+	})
+	if err != nil {
+		t.Fatalf("GetObject() error = %v", err)
+	}
+	defer out.Body.Close()
+	if data, _ := io.ReadAll(out.Body); string(data) != "Hello, World!" {
+		t.Errorf("stored content = %s, want Hello, World!", data)
+	}
+}
+
+func TestS3BlockManager_OpenSeeks(t *testing.T) {
+	manager, _ := newTestS3BlockManager(t, "")
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	manager.Set("big", bytes.NewReader(content), "application/octet-stream")
+
+	_, reader, err := manager.Open("big", 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer reader.Close()
+
+	size, _ := reader.Seek(0, io.SeekEnd)
+	if size != int64(len(content)) {
+		t.Errorf("Seek(0, end) = %d, want %d", size, len(content))
+	}
+	reader.Seek(5005, io.SeekStart)
+	part := make([]byte, 10)
+	if _, err := io.ReadFull(reader, part); err != nil || string(part) != "5678901234" {
+		t.Errorf("ReadFull() after seeking = %q, %v, want 5678901234", part, err)
+	}
+	reader.Seek(-5, io.SeekEnd)
+	if rest, _ := io.ReadAll(reader); string(rest) != "56789" {
+		t.Errorf("ReadAll() of the end = %q, want 56789", rest)
+	}
+}
+
+func TestS3BlockManager_List(t *testing.T) {
+	manager, _ := newTestS3BlockManager(t, "")
+
+	manager.Set("a", strings.NewReader("a"), "text/plain")
+	manager.Set("a/c", strings.NewReader("c"), "text/plain")
+	manager.Set("a/b/d", strings.NewReader("d"), "text/plain")
+
+	if got := listPaths(t, manager, ""); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("List(\"\") = %v, want [a]", got)
+	}
+	if got := listPaths(t, manager, "a"); !slices.Equal(got, []string{"a/b", "a/c"}) {
+		t.Errorf("List(a) = %v, want [a/b a/c]", got)
+	}
+	if _, err := manager.List("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("List(missing) error = %v, want ErrNotFound", err)
+	}
+
+	page, err := manager.Children("a", ListOptions{SortBy: SortBySize, Desc: true})
+	if err != nil {
+		t.Fatalf("Children() error = %v", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Path != "a/c" || page.Items[0].Size != 1 {
+		t.Errorf("Children() = %+v, want a/c first", page.Items)
+	}
+}
+
+func TestS3BlockManager_RevisionsAndDelete(t *testing.T) {
+	manager, _ := newTestS3BlockManager(t, "")
+
+	manager.Set("doc", strings.NewReader("v1"), "text/plain")
+	manager.Set("doc", strings.NewReader("version 2"), "text/markdown")
+	manager.Set("doc/child", strings.NewReader("child"), "text/plain")
+
+	if err := manager.Restore("doc", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	revisions, err := manager.Revisions("doc")
+	if err != nil || len(revisions) != 3 || revisions[2].Checksum != revisions[0].Checksum {
+		t.Errorf("Revisions() = %+v, %v, want the restored first revision as third", revisions, err)
+	}
+
+	if err := manager.Delete("doc"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := manager.Get("doc/child", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a deleted descendant error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Revisions("doc"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revisions() of a deleted block error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3BlockManager_ConcurrentSets(t *testing.T) {
+	manager, client := newTestS3BlockManager(t, "")
+	// A second node sharing the bucket
+	other := NewS3BlockManager(client, "goblocks", "")
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		node := manager
+		if i%2 == 1 {
+			node = other
+		}
+		wg.Go(func() {
+			if err := node.Set("doc", strings.NewReader(fmt.Sprintf("version %d", i)), "text/plain"); err != nil {
+				t.Errorf("Set() error = %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// Every write gets a revision of its own, none overwriting the content of another
+	revisions, err := manager.Revisions("doc")
+	if err != nil || len(revisions) != 10 {
+		t.Fatalf("Revisions() = %+v, %v, want 10 revisions", revisions, err)
+	}
+	checksums := []string{}
+	for i, revision := range revisions {
+		block, err := manager.GetRevision("doc", revision.Number, true)
+		if err != nil || revision.Number != i+1 || Checksum(block.Content) != revision.Checksum {
+			t.Errorf("GetRevision(%d) = %q, %v, want the content of revision %d", revision.Number, block.Content, err, i+1)
+		}
+		checksums = append(checksums, revision.Checksum)
+	}
+	if slices.Sort(checksums); len(slices.Compact(checksums)) != 10 {
+		t.Errorf("Revisions() checksums = %v, want one revision per content", checksums)
+	}
+	if block, err := manager.Get("doc", false); err != nil || block.Revision != 10 {
+		t.Errorf("Get() = %+v, %v, want the last revision current", block, err)
+	}
+}
+
+func TestS3BlockManager_OpensRevisionsKeyedByNumber(t *testing.T) {
+	manager, client := newTestS3BlockManager(t, "")
+
+	// Contents written before they got keys of their own are found from the revision number
+	client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("goblocks"),
+		Key:    aws.String("doc/.revisions/1.data"),
+		Body:   strings.NewReader("legacy"),
+	})
+	fileContent := newFileContent(newRevision(1, 6, Checksum([]byte("legacy")), "text/plain", Attributes{}, ""), time.Time{})
+	manager.writeFileContent("doc/.revisions/1", fileContent, "")
+	manager.writeFileContent("doc/.content", fileContent, "")
+
+	if block, err := manager.Get("doc", true); err != nil || string(block.Content) != "legacy" {
+		t.Errorf("Get() = %q, %v, want legacy", block.Content, err)
+	}
+	if err := manager.Set("doc", strings.NewReader("current"), "text/plain"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if block, err := manager.GetRevision("doc", 1, true); err != nil || string(block.Content) != "legacy" {
+		t.Errorf("GetRevision(1) = %q, %v, want legacy", block.Content, err)
+	}
+	if block, err := manager.Get("doc", true); err != nil || string(block.Content) != "current" || block.Revision != 2 {
+		t.Errorf("Get() = %+v, %v, want the second revision", block, err)
+	}
+}
+
+func TestS3BlockManager_MoveAndCopy(t *testing.T) {
+	manager, _ := newTestS3BlockManager(t, "")
+
+	manager.Set("docs/draft", strings.NewReader("draft"), "text/plain")
+	manager.Set("docs/draft/appendix", strings.NewReader("appendix"), "text/plain")
+	manager.Set("docs/published", strings.NewReader("old"), "text/plain")
+
+	if err := manager.Copy("docs/draft", "docs/copy", false); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := manager.Move("docs/draft", "docs/published", false); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Move() onto an existing block error = %v, want ErrAlreadyExists", err)
+	}
+	if err := manager.Move("docs/draft", "docs/published", true); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+
+	for _, path := range []string{"docs/copy/appendix", "docs/published/appendix"} {
+		block, err := manager.Get(path, true)
+		if err != nil || string(block.Content) != "appendix" {
+			t.Errorf("Get(%s) = %q, %v, want appendix", path, block.Content, err)
+		}
+	}
+	if block, _ := manager.Get("docs/published", true); string(block.Content) != "draft" {
+		t.Errorf("Get(docs/published) = %q, want the moved draft", block.Content)
+	}
+	if got := listPaths(t, manager, "docs"); !slices.Equal(got, []string{"docs/copy", "docs/published"}) {
+		t.Errorf("List(docs) = %v, want [docs/copy docs/published]", got)
+	}
+	if err := manager.Move("missing", "elsewhere", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Move() of a missing block error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,629 @@
+package blocks
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// DefaultSqliteFileName is the database file used when no storage path is configured
+const DefaultSqliteFileName = "goblocks.sqlite"
+
+// sqliteMigrations are applied in order on startup, the schema version is kept in PRAGMA user_version
+var sqliteMigrations = []string{
+	`CREATE TABLE blocks (
+		path         TEXT PRIMARY KEY,
+		parent       TEXT NOT NULL,
+		revision     INTEGER,
+		content_type TEXT,
+		size         INTEGER,
+		checksum     TEXT,
+		updated_at   TEXT
+	);
+	CREATE INDEX blocks_parent ON blocks (parent, path);
+	CREATE TABLE revisions (
+		path         TEXT NOT NULL,
+		number       INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		size         INTEGER NOT NULL,
+		checksum     TEXT NOT NULL,
+		created_at   TEXT NOT NULL,
+		content      BLOB NOT NULL,
+		PRIMARY KEY (path, number)
+	);`,
+	`CREATE INDEX revisions_checksum ON revisions (checksum);`,
+	`ALTER TABLE blocks ADD COLUMN attributes TEXT;
+	ALTER TABLE revisions ADD COLUMN attributes TEXT;`,
+	`ALTER TABLE blocks ADD COLUMN created_at TEXT;
+	ALTER TABLE blocks ADD COLUMN updated_by TEXT;
+	ALTER TABLE revisions ADD COLUMN created_by TEXT;
+	UPDATE blocks SET created_at = (
+		SELECT created_at FROM revisions WHERE revisions.path = blocks.path ORDER BY number LIMIT 1
+	) WHERE revision IS NOT NULL;`,
+}
+
+// sqliteSubtree matches a path and all its descendants, ?2 and ?3 being the bounds of its children range
+const sqliteSubtree = "(path = ?1 OR (path >= ?2 AND path < ?3))"
+
+// SqliteBlockManager stores blocks in a SQLite database. Every node of the
+// hierarchy has a row in the blocks table, indexed by its parent; parents
+// without content of their own have a NULL revision. Contents are kept in
+// the revisions table.
+type SqliteBlockManager struct {
+	db *sql.DB
+}
+
+func NewSqliteBlockManager(filePath string) (*SqliteBlockManager, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, mapFsError(err)
+	}
+
+	dsn := url.Values{}
+	dsn.Add("_pragma", "journal_mode(WAL)")
+	dsn.Add("_pragma", "busy_timeout(5000)")
+	dsn.Add("_pragma", "synchronous(NORMAL)")
+	// Write transactions take the lock upfront so concurrent writers wait for each other instead of failing
+	dsn.Add("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+filePath+"?"+dsn.Encode())
+	if err != nil {
+		return nil, mapSqliteError(err)
+	}
+
+	err = migrateSqlite(db)
+	if err != nil {
+		db.Close()
+		return nil, mapSqliteError(err)
+	}
+
+	return &SqliteBlockManager{db: db}, nil
+}
+
+func migrateSqlite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqliteMigrations[version])
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// Close releases the database file
+func (s *SqliteBlockManager) Close() error {
+	return s.db.Close()
+}
+
+func (s *SqliteBlockManager) List(p string) ([]BlockReference, error) {
+	references := []BlockReference{}
+	err := s.view(func(tx *sql.Tx) error {
+		if err := nodeExistsSqlite(tx, p); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT path FROM blocks WHERE parent = ? ORDER BY path", p)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			ref := BlockReference{}
+			if err := rows.Scan(&ref.Path); err != nil {
+				return err
+			}
+			references = append(references, ref)
+		}
+		return rows.Err()
+	})
+	return references, err
+}
+
+func (s *SqliteBlockManager) Children(p string, opts ListOptions) (ChildrenPage, error) {
+	refs := []BlockReference{}
+	err := s.view(func(tx *sql.Tx) error {
+		if err := nodeExistsSqlite(tx, p); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT path, content_type, size, updated_at, attributes FROM blocks WHERE parent = ? ORDER BY path", p)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var path string
+			var contentType, updatedAt, attributes sql.NullString
+			var size sql.NullInt64
+			if err := rows.Scan(&path, &contentType, &size, &updatedAt, &attributes); err != nil {
+				return err
+			}
+			parsed := parseSqliteAttributes(attributes)
+			refs = append(refs, BlockReference{
+				Path:      path,
+				Type:      contentType.String,
+				Size:      size.Int64,
+				UpdatedAt: parseSqliteTime(updatedAt.String),
+				Tags:      parsed.Tags,
+				ExpiresAt: parsed.ExpiresAt,
+			})
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return ChildrenPage{}, err
+	}
+	return paginate(refs, opts)
+}
+
+func (s *SqliteBlockManager) Get(p string, withContent bool) (Block, error) {
+	if withContent {
+		return readBlock(s.Open, p, 0)
+	}
+
+	var block Block
+	err := s.view(func(tx *sql.Tx) error {
+		var err error
+		block, err = getBlockSqlite(tx, p)
+		return err
+	})
+	return block, err
+}
+
+func (s *SqliteBlockManager) Open(p string, revision int) (Block, io.ReadSeekCloser, error) {
+	if revision < 0 {
+		return Block{}, nil, ErrInvalidRevision
+	}
+
+	var block Block
+	var content []byte
+	err := s.view(func(tx *sql.Tx) error {
+		if revision == 0 {
+			current, err := getBlockSqlite(tx, p)
+			if err != nil {
+				return err
+			}
+			revision = current.Revision
+		}
+		var err error
+		block, content, err = getRevisionSqlite(tx, p, revision, true)
+		return err
+	})
+	if err != nil {
+		return Block{}, nil, err
+	}
+	return block, nopCloser{bytes.NewReader(content)}, nil
+}
+
+// Set buffers the content, a row being written at once
+func (s *SqliteBlockManager) Set(p string, content io.Reader, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return errors.Join(err, ErrUnknown)
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		return setBlockSqlite(tx, p, data, contentType, opts)
+	})
+}
+
+func (s *SqliteBlockManager) Link(p string, checksum string, contentType string, opts ...WriteOption) error {
+	if err := validateBlockPath(p); err != nil {
+		return err
+	}
+	return s.update(func(tx *sql.Tx) error {
+		var content []byte
+		err := tx.QueryRow("SELECT content FROM revisions WHERE checksum = ? LIMIT 1", checksum).Scan(&content)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownBlob
+		}
+		if err != nil {
+			return err
+		}
+		return setBlockSqlite(tx, p, content, contentType, opts)
+	})
+}
+
+func (s *SqliteBlockManager) BlobSize(checksum string) (int64, error) {
+	var size int64
+	err := s.view(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT size FROM revisions WHERE checksum = ? LIMIT 1", checksum).Scan(&size)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownBlob
+		}
+		return err
+	})
+	return size, err
+}
+
+func (s *SqliteBlockManager) Delete(p string) error {
+	if err := validateReserved(p); err != nil {
+		return err
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		return deleteSubtreeSqlite(tx, p)
+	})
+}
+
+func (s *SqliteBlockManager) Move(from string, to string, overwrite bool) error {
+	return s.transfer(from, to, overwrite, true)
+}
+
+func (s *SqliteBlockManager) Copy(from string, to string, overwrite bool) error {
+	return s.transfer(from, to, overwrite, false)
+}
+
+// transfer copies or moves a subtree in a single transaction, so the destination appears at once
+func (s *SqliteBlockManager) transfer(from string, to string, overwrite bool, move bool) error {
+	err := validateTransfer(from, to)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		return transferSqlite(tx, from, to, overwrite, move)
+	})
+}
+
+// Batch applies the operations in a single transaction, which a failure rolls back
+func (s *SqliteBlockManager) Batch(ops []Operation) ([]OperationResult, error) {
+	var written []*Block
+	var batchErr error
+	err := s.update(func(tx *sql.Tx) error {
+		written, batchErr = applyBatch(ops, func(op Operation) (*Block, error) {
+			block, err := applySqlite(tx, op)
+			return block, mapSqliteError(err)
+		})
+		return batchErr
+	})
+	if batchErr != nil {
+		err = batchErr
+	}
+	return batchResults(ops, written, err)
+}
+
+func (s *SqliteBlockManager) Revisions(p string) ([]Revision, error) {
+	revisions := []Revision{}
+	err := s.view(func(tx *sql.Tx) error {
+		if _, err := getBlockSqlite(tx, p); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT number, content_type, size, checksum, created_at, created_by, attributes FROM revisions WHERE path = ? ORDER BY number", p)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			r := Revision{}
+			var createdAt string
+			var createdBy, attributes sql.NullString
+			if err := rows.Scan(&r.Number, &r.ContentType, &r.Size, &r.Checksum, &createdAt, &createdBy, &attributes); err != nil {
+				return err
+			}
+			r.CreatedAt = parseSqliteTime(createdAt)
+			r.CreatedBy = createdBy.String
+			r.Attributes = parseSqliteAttributes(attributes)
+			revisions = append(revisions, r)
+		}
+		return rows.Err()
+	})
+	return revisions, err
+}
+
+func (s *SqliteBlockManager) GetRevision(p string, revision int, withContent bool) (Block, error) {
+	if revision <= 0 {
+		return Block{}, ErrInvalidRevision
+	}
+	if withContent {
+		return readBlock(s.Open, p, revision)
+	}
+
+	var block Block
+	err := s.view(func(tx *sql.Tx) error {
+		var err error
+		block, _, err = getRevisionSqlite(tx, p, revision, false)
+		return err
+	})
+	return block, err
+}
+
+func (s *SqliteBlockManager) Restore(p string, revision int, opts ...WriteOption) error {
+	if revision <= 0 {
+		return ErrInvalidRevision
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		block, content, err := getRevisionSqlite(tx, p, revision, true)
+		if err != nil {
+			return err
+		}
+		return setBlockSqlite(tx, p, content, block.Type, append([]WriteOption{WithAttributes(block.Attributes)}, opts...))
+	})
+}
+
+// view runs fn in a read transaction, which sees a consistent snapshot without blocking writers in WAL mode
+func (s *SqliteBlockManager) view(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return mapSqliteError(err)
+	}
+	defer tx.Rollback()
+	return mapSqliteError(fn(tx))
+}
+
+func (s *SqliteBlockManager) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return mapSqliteError(err)
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return mapSqliteError(err)
+	}
+	return mapSqliteError(tx.Commit())
+}
+
+func getBlockSqlite(tx *sql.Tx, p string) (Block, error) {
+	block := Block{Path: p}
+	var updatedAt string
+	var createdAt, updatedBy, attributes sql.NullString
+	err := tx.QueryRow(
+		"SELECT revision, content_type, size, checksum, created_at, updated_at, updated_by, attributes FROM blocks WHERE path = ? AND revision IS NOT NULL", p,
+	).Scan(&block.Revision, &block.Type, &block.Size, &block.Checksum, &createdAt, &updatedAt, &updatedBy, &attributes)
+	if err != nil {
+		return Block{}, err
+	}
+	block.CreatedAt = parseSqliteTime(createdAt.String)
+	block.UpdatedAt = parseSqliteTime(updatedAt)
+	block.UpdatedBy = updatedBy.String
+	block.Attributes = parseSqliteAttributes(attributes)
+	return block, nil
+}
+
+func getRevisionSqlite(tx *sql.Tx, p string, revision int, withContent bool) (Block, []byte, error) {
+	block := Block{Path: p, Revision: revision}
+	var createdAt string
+	var blockCreatedAt, createdBy, attributes sql.NullString
+	var content []byte
+	query := `SELECT content_type, size, checksum, created_at, created_by, attributes,
+			(SELECT created_at FROM blocks WHERE blocks.path = revisions.path), NULL
+		FROM revisions WHERE path = ? AND number = ?`
+	if withContent {
+		query = strings.Replace(query, "NULL", "content", 1)
+	}
+	err := tx.QueryRow(query, p, revision).Scan(&block.Type, &block.Size, &block.Checksum, &createdAt, &createdBy, &attributes, &blockCreatedAt, &content)
+	if err != nil {
+		return Block{}, nil, err
+	}
+	block.CreatedAt = parseSqliteTime(blockCreatedAt.String)
+	block.UpdatedAt = parseSqliteTime(createdAt)
+	block.UpdatedBy = createdBy.String
+	block.Attributes = parseSqliteAttributes(attributes)
+	return block, content, nil
+}
+
+// setBlockSqlite records a new revision of a block and makes it current
+func setBlockSqlite(tx *sql.Tx, p string, content []byte, contentType string, opts []WriteOption) error {
+	var number int
+	err := tx.QueryRow("SELECT COALESCE(MAX(number), 0) + 1 FROM revisions WHERE path = ?", p).Scan(&number)
+	if err != nil {
+		return err
+	}
+	var current Attributes
+	if block, err := getBlockSqlite(tx, p); err == nil {
+		current = block.Attributes
+	}
+	attributes, err := writeAttributes(current, opts)
+	if err != nil {
+		return err
+	}
+
+	revision := newRevision(number, int64(len(content)), Checksum(content), contentType, attributes, writeAuthor(opts))
+	createdAt := revision.CreatedAt.Format(time.RFC3339Nano)
+	encoded := formatSqliteAttributes(attributes)
+	_, err = tx.Exec(
+		"INSERT INTO revisions (path, number, content_type, size, checksum, created_at, created_by, attributes, content) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		p, revision.Number, contentType, revision.Size, revision.Checksum, createdAt, revision.CreatedBy, encoded, content,
+	)
+	if err != nil {
+		return err
+	}
+	// A block keeps the creation time of its first revision, parents without content have none
+	_, err = tx.Exec(`INSERT INTO blocks (path, parent, revision, content_type, size, checksum, created_at, updated_at, updated_by, attributes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET revision = excluded.revision, content_type = excluded.content_type,
+			size = excluded.size, checksum = excluded.checksum, created_at = COALESCE(blocks.created_at, excluded.created_at),
+			updated_at = excluded.updated_at, updated_by = excluded.updated_by, attributes = excluded.attributes`,
+		p, parentPath(p), revision.Number, contentType, revision.Size, revision.Checksum, createdAt, createdAt, revision.CreatedBy, encoded,
+	)
+	if err != nil {
+		return err
+	}
+	return createParentsSqlite(tx, p)
+}
+
+// transferSqlite copies or moves a subtree, replacing an existing destination when overwrite is set
+func transferSqlite(tx *sql.Tx, from string, to string, overwrite bool, move bool) error {
+	if err := nodeExistsSqlite(tx, from); err != nil {
+		return err
+	}
+	err := nodeExistsSqlite(tx, to)
+	if err == nil {
+		if !overwrite {
+			return ErrAlreadyExists
+		}
+		err = deleteSubtreeSqlite(tx, to)
+	} else if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// ?4 is the destination and ?5 the position following the source prefix in the paths
+	args := append(subtreeArgs(from), to, len(from)+1)
+	blocks := `SELECT ?4 || substr(path, ?5),
+			CASE WHEN path = ?1 THEN ?6 ELSE ?4 || substr(parent, ?5) END,
+			revision, content_type, size, checksum, created_at, updated_at, updated_by, attributes
+		FROM blocks WHERE ` + sqliteSubtree
+	revisions := `SELECT ?4 || substr(path, ?5), number, content_type, size, checksum, created_at, created_by, attributes, content
+		FROM revisions WHERE ` + sqliteSubtree
+	blocksColumns := "(path, parent, revision, content_type, size, checksum, created_at, updated_at, updated_by, attributes) "
+	if _, err := tx.Exec("INSERT INTO blocks "+blocksColumns+blocks, append(args, parentPath(to))...); err != nil {
+		return err
+	}
+	revisionsColumns := "(path, number, content_type, size, checksum, created_at, created_by, attributes, content) "
+	if _, err := tx.Exec("INSERT INTO revisions "+revisionsColumns+revisions, args...); err != nil {
+		return err
+	}
+	if move {
+		if err := deleteSubtreeSqlite(tx, from); err != nil {
+			return err
+		}
+	}
+	return createParentsSqlite(tx, to)
+}
+
+// applySqlite runs an operation of a batch within its transaction
+func applySqlite(tx *sql.Tx, op Operation) (*Block, error) {
+	current, err := getBlockSqlite(tx, op.Path)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err := checkMatch(op.IfMatch, current.ETag(), err == nil); err != nil {
+		return nil, err
+	}
+
+	var target string
+	switch op.Type {
+	case OpSet:
+		target = op.Path
+		err = setBlockSqlite(tx, op.Path, op.Content, op.ContentType, op.Options)
+	case OpDelete:
+		return nil, deleteSubtreeSqlite(tx, op.Path)
+	case OpMove:
+		target = op.To
+		err = transferSqlite(tx, op.Path, op.To, op.Overwrite, true)
+	default:
+		return nil, ErrInvalidOperation
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := getBlockSqlite(tx, target)
+	if err != nil {
+		block = Block{Path: target}
+	}
+	return &block, nil
+}
+
+// createParentsSqlite adds the missing ancestors of a path as nodes without content
+func createParentsSqlite(tx *sql.Tx, p string) error {
+	for parent := parentPath(p); parent != ""; parent = parentPath(parent) {
+		_, err := tx.Exec("INSERT INTO blocks (path, parent) VALUES (?, ?) ON CONFLICT (path) DO NOTHING", parent, parentPath(parent))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSubtreeSqlite removes a block with its history and all its descendants
+func deleteSubtreeSqlite(tx *sql.Tx, p string) error {
+	if p == "" {
+		_, err := tx.Exec("DELETE FROM blocks; DELETE FROM revisions")
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM blocks WHERE "+sqliteSubtree, subtreeArgs(p)...); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM revisions WHERE "+sqliteSubtree, subtreeArgs(p)...)
+	return err
+}
+
+func nodeExistsSqlite(tx *sql.Tx, p string) error {
+	if p == "" {
+		return nil
+	}
+	var exists int
+	err := tx.QueryRow("SELECT 1 FROM blocks WHERE path = ?", p).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// subtreeArgs returns the arguments of sqliteSubtree, descendants sorting between "path/" and "path0"
+func subtreeArgs(p string) []any {
+	return []any{p, p + "/", p + "0"}
+}
+
+func parseSqliteTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, value)
+	return t
+}
+
+// formatSqliteAttributes encodes attributes as JSON, NULL when there are none
+func formatSqliteAttributes(attributes Attributes) sql.NullString {
+	if attributes.Metadata == nil && attributes.Tags == nil && attributes.ExpiresAt.IsZero() {
+		return sql.NullString{}
+	}
+	encoded, _ := json.Marshal(attributes)
+	return sql.NullString{String: string(encoded), Valid: true}
+}
+
+func parseSqliteAttributes(value sql.NullString) Attributes {
+	attributes := Attributes{}
+	if value.Valid {
+		json.Unmarshal([]byte(value.String), &attributes)
+	}
+	return attributes
+}
+
+func mapSqliteError(err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrAlreadyExists) || errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrInvalidMetadata) {
+		return err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.Join(err, ErrNotFound)
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_PERM, sqlite3.SQLITE_READONLY, sqlite3.SQLITE_AUTH, sqlite3.SQLITE_CANTOPEN:
+			return errors.Join(err, ErrForbidden)
+		}
+	}
+	return errors.Join(err, ErrUnknown)
+}
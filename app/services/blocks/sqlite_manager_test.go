@@ -0,0 +1,299 @@
+package blocks
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSqliteBlockManager(t *testing.T) (*SqliteBlockManager, string) {
+	t.Helper()
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	filePath := filepath.Join(tmpDir, "blocks.sqlite")
+	manager, err := NewSqliteBlockManager(filePath)
+	if err != nil {
+		t.Fatalf("NewSqliteBlockManager() error = %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+	return manager, filePath
+}
+
+func TestSqliteBlockManager_SetAndGet(t *testing.T) {
+	manager, filePath := newTestSqliteBlockManager(t)
+
+	err := manager.Set("a/b/c", strings.NewReader("Hello, World!"), "text/plain")
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	block, err := manager.Get("a/b/c", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "Hello, World!" || block.Type != "text/plain" || block.Size != 13 || block.Revision != 1 {
+		t.Errorf("Get() = %+v, want the first revision of Hello, World!", block)
+	}
+
+	if _, err := manager.Get("a/b", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a parent without content error = %v, want ErrNotFound", err)
+	}
+
+	// Everything is persisted in the single file
+	manager.Close()
+	reopened, err := NewSqliteBlockManager(filePath)
+	if err != nil {
+		t.Fatalf("NewSqliteBlockManager() error = %v", err)
+	}
+	defer reopened.Close()
+	block, err = reopened.Get("a/b/c", true)
+	if err != nil || string(block.Content) != "Hello, World!" {
+		t.Errorf("Get() after reopening = %q, %v, want Hello, World!", block.Content, err)
+	}
+}
+
+func TestSqliteBlockManager_List(t *testing.T) {
+	manager, _ := newTestSqliteBlockManager(t)
+
+	manager.Set("a", strings.NewReader("a"), "text/plain")
+	manager.Set("a/c", strings.NewReader("c"), "text/plain")
+	manager.Set("a/b/d", strings.NewReader("d"), "text/plain")
+	// A sibling sharing the prefix must not show up under a
+	manager.Set("a-b/e", strings.NewReader("e"), "text/plain")
+
+	if got := listPaths(t, manager, ""); !slices.Equal(got, []string{"a", "a-b"}) {
+		t.Errorf("List(\"\") = %v, want [a a-b]", got)
+	}
+	if got := listPaths(t, manager, "a"); !slices.Equal(got, []string{"a/b", "a/c"}) {
+		t.Errorf("List(a) = %v, want [a/b a/c]", got)
+	}
+	if _, err := manager.List("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("List(missing) error = %v, want ErrNotFound", err)
+	}
+
+	page, err := manager.Children("a", ListOptions{SortBy: SortByName})
+	if err != nil {
+		t.Fatalf("Children() error = %v", err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Type != "" || page.Items[1].Type != "text/plain" {
+		t.Errorf("Children() = %+v, want the a/b directory and the a/c block", page.Items)
+	}
+}
+
+func TestSqliteBlockManager_Delete(t *testing.T) {
+	manager, _ := newTestSqliteBlockManager(t)
+
+	manager.Set("a/b", strings.NewReader("b"), "text/plain")
+	manager.Set("a/b/c", strings.NewReader("c"), "text/plain")
+	manager.Set("a/bc", strings.NewReader("bc"), "text/plain")
+
+	if err := manager.Delete("a/b"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := manager.Get("a/b/c", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() of a deleted descendant error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.Revisions("a/b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revisions() of a deleted block error = %v, want ErrNotFound", err)
+	}
+	if got := listPaths(t, manager, "a"); !slices.Equal(got, []string{"a/bc"}) {
+		t.Errorf("List(a) = %v, want [a/bc]", got)
+	}
+
+	// A recreated block starts a new history
+	manager.Set("a/b", strings.NewReader("new"), "text/plain")
+	if block, _ := manager.Get("a/b", false); block.Revision != 1 {
+		t.Errorf("Revision = %d, want 1", block.Revision)
+	}
+}
+
+func TestSqliteBlockManager_Revisions(t *testing.T) {
+	manager, _ := newTestSqliteBlockManager(t)
+
+	manager.Set("doc", strings.NewReader("v1"), "text/plain")
+	manager.Set("doc", strings.NewReader("version 2"), "text/markdown")
+
+	revisions, err := manager.Revisions("doc")
+	if err != nil {
+		t.Fatalf("Revisions() error = %v", err)
+	}
+	if len(revisions) != 2 || revisions[0].Number != 1 || revisions[1].ContentType != "text/markdown" {
+		t.Errorf("Revisions() = %+v, want 2 revisions in order", revisions)
+	}
+
+	if err := manager.Restore("doc", 1); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	block, _ := manager.Get("doc", true)
+	if block.Revision != 3 || string(block.Content) != "v1" || block.Type != "text/plain" {
+		t.Errorf("Get() after restore = %+v, want v1 as revision 3", block)
+	}
+
+	old, err := manager.GetRevision("doc", 2, true)
+	if err != nil || string(old.Content) != "version 2" {
+		t.Errorf("GetRevision(2) = %q, %v, want version 2", old.Content, err)
+	}
+	if _, err := manager.GetRevision("doc", 4, false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRevision(4) error = %v, want ErrNotFound", err)
+	}
+	if _, err := manager.GetRevision("doc", 0, false); !errors.Is(err, ErrInvalidRevision) {
+		t.Errorf("GetRevision(0) error = %v, want ErrInvalidRevision", err)
+	}
+}
+
+func TestSqliteBlockManager_MoveAndCopy(t *testing.T) {
+	manager, _ := newTestSqliteBlockManager(t)
+
+	manager.Set("docs/draft", strings.NewReader("draft"), "text/plain")
+	manager.Set("docs/draft", strings.NewReader("draft 2"), "text/plain")
+	manager.Set("docs/draft/appendix", strings.NewReader("appendix"), "text/plain")
+	manager.Set("docs/published", strings.NewReader("old"), "text/plain")
+
+	if err := manager.Copy("docs/draft", "docs/copy", false); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := manager.Move("docs/draft", "docs/published", false); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Move() onto an existing block error = %v, want ErrAlreadyExists", err)
+	}
+	if err := manager.Move("docs/draft", "docs/published", true); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+
+	for _, path := range []string{"docs/copy", "docs/published"} {
+		revisions, _ := manager.Revisions(path)
+		if len(revisions) != 2 {
+			t.Errorf("Revisions(%s) = %d, want the 2 revisions of the source", path, len(revisions))
+		}
+		appendix, err := manager.Get(path+"/appendix", true)
+		if err != nil || string(appendix.Content) != "appendix" {
+			t.Errorf("Get(%s/appendix) = %q, %v, want appendix", path, appendix.Content, err)
+		}
+	}
+	if _, err := manager.List("docs/draft"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("List() of the moved source error = %v, want ErrNotFound", err)
+	}
+	if got := listPaths(t, manager, "docs"); !slices.Equal(got, []string{"docs/copy", "docs/published"}) {
+		t.Errorf("List(docs) = %v, want [docs/copy docs/published]", got)
+	}
+	if err := manager.Copy("missing", "elsewhere", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Copy() of a missing block error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSqliteBlockManager_Link(t *testing.T) {
+	manager, _ := newTestSqliteBlockManager(t)
+	manager.Set("original", strings.NewReader("shared"), "text/plain")
+
+	err := manager.Link("copy", Checksum([]byte("shared")), "text/markdown")
+	if err != nil {
+		t.Fatalf("Link() error = %v", err)
+	}
+	block, err := manager.Get("copy", true)
+	if err != nil || string(block.Content) != "shared" || block.Type != "text/markdown" {
+		t.Errorf("Get() = %+v, %v, want shared as text/markdown", block, err)
+	}
+
+	err = manager.Link("other", Checksum([]byte("unknown")), "text/plain")
+	if !errors.Is(err, ErrUnknownBlob) {
+		t.Errorf("Link() error = %v, want ErrUnknownBlob", err)
+	}
+}
+
+func TestSqliteBlockManager_Schema(t *testing.T) {
+	manager, filePath := newTestSqliteBlockManager(t)
+
+	var journalMode string
+	var version int
+	manager.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	manager.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if journalMode != "wal" {
+		t.Errorf("journal_mode = %s, want wal", journalMode)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("user_version = %d, want %d", version, len(sqliteMigrations))
+	}
+
+	// Migrations already applied are skipped on the next start
+	manager.Set("a", strings.NewReader("a"), "text/plain")
+	manager.Close()
+	reopened, err := NewSqliteBlockManager(filePath)
+	if err != nil {
+		t.Fatalf("NewSqliteBlockManager() error = %v", err)
+	}
+	defer reopened.Close()
+	if _, err := reopened.Get("a", false); err != nil {
+		t.Errorf("Get() after reopening error = %v", err)
+	}
+}
+
+func TestSqliteBlockManager_BackfillsCreationTime(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "goblocks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A database written before the 4th migration recorded creation times
+	filePath := filepath.Join(tmpDir, "blocks.sqlite")
+	db, err := sql.Open("sqlite", filePath)
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	statements := append(slices.Clone(sqliteMigrations[:3]),
+		"PRAGMA user_version = 3",
+		`INSERT INTO blocks (path, parent, revision, content_type, size, checksum, updated_at)
+			VALUES ('a', '', 2, 'text/plain', 2, 'c2', '2025-01-02T12:00:00Z')`,
+		`INSERT INTO revisions (path, number, content_type, size, checksum, created_at, content)
+			VALUES ('a', 1, 'text/plain', 2, 'c1', '2025-01-01T12:00:00Z', 'v1'), ('a', 2, 'text/plain', 2, 'c2', '2025-01-02T12:00:00Z', 'v2')`,
+	)
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Exec() error = %v", err)
+		}
+	}
+	db.Close()
+
+	manager, err := NewSqliteBlockManager(filePath)
+	if err != nil {
+		t.Fatalf("NewSqliteBlockManager() error = %v", err)
+	}
+	defer manager.Close()
+	block, err := manager.Get("a", false)
+	want := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err != nil || !block.CreatedAt.Equal(want) {
+		t.Errorf("Get() = %+v, %v, want the creation time of the first revision", block, err)
+	}
+}
+
+func TestSqliteBlockManager_ConcurrentWrites(t *testing.T) {
+	manager, _ := newTestSqliteBlockManager(t)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := manager.Set("shared", strings.NewReader(strconv.Itoa(i)), "text/plain"); err != nil {
+				t.Errorf("Set() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	revisions, err := manager.Revisions("shared")
+	if err != nil || len(revisions) != 20 {
+		t.Errorf("Revisions() = %d, %v, want 20 revisions", len(revisions), err)
+	}
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"goblocks/app/services/auth"
 	"goblocks/app/services/blocks"
+	"goblocks/app/services/webhooks"
 
 	"go.uber.org/fx"
 )
@@ -10,5 +12,15 @@ var Module = fx.Module(
 	"services",
 	fx.Provide(
 		blocks.NewBlockManager,
+		blocks.NewLocker,
+		blocks.NewReferenceIndex,
+		blocks.NewEventBus,
+		blocks.NewUsage,
+		webhooks.NewDispatcher,
+		auth.NewAuthenticator,
+		auth.NewPolicy,
+		auth.NewSigner,
 	),
+	// The dispatcher works in the background, nothing else needs to depend on it for it to start
+	fx.Invoke(func(*webhooks.Dispatcher) {}),
 )
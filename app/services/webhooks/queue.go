@@ -0,0 +1,66 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// loadQueue reads the pending deliveries saved by a previous run
+func loadQueue(path string) ([]*Delivery, error) {
+	pending := []*Delivery{}
+	if path == "" {
+		return pending, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &pending)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook queue %s: %w", path, err)
+	}
+	return pending, nil
+}
+
+// saveQueue replaces the queue file through a rename so that a crash never leaves it half written
+func saveQueue(path string, pending []*Delivery) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
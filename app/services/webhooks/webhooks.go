@@ -0,0 +1,392 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+const SignatureHeader = "X-Goblocks-Signature"
+const EventHeader = "X-Goblocks-Event"
+const DeliveryHeader = "X-Goblocks-Delivery"
+
+// maxBackoff caps the delay between two attempts
+const maxBackoff = time.Hour
+
+// historySize is the number of finished deliveries kept for inspection
+const historySize = 100
+
+type Status string
+
+const Pending Status = "pending"
+const Delivered Status = "delivered"
+const Failed Status = "failed"
+
+// Delivery is the sending of an event to a webhook
+type Delivery struct {
+	ID          uint64       `json:"id"`
+	Url         string       `json:"url"`
+	Event       blocks.Event `json:"event"`
+	Status      Status       `json:"status"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt,omitzero"`
+	StatusCode  int          `json:"status_code,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// Dispatcher posts the block events to the configured webhooks.
+// Deliveries are sent in the background and retried with an exponential backoff,
+// pending ones are persisted so that they survive restarts.
+type Dispatcher struct {
+	webhooks []config.Webhook
+	settings config.WebhookDelivery
+	bus      *blocks.EventBus
+	client   *http.Client
+	log      *slog.Logger
+
+	mu          sync.Mutex
+	pending     []*Delivery
+	history     []Delivery
+	nextID      uint64
+	lastEventID uint64
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewDispatcher(lc fx.Lifecycle, c *config.Config, bus *blocks.EventBus, log *slog.Logger) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		webhooks: c.Webhooks,
+		settings: c.WebhookDelivery,
+		bus:      bus,
+		client:   &http.Client{Timeout: c.WebhookDelivery.Timeout},
+		log:      log,
+		nextID:   uint64(time.Now().UnixMicro()),
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	lc.Append(fx.Hook{
+		OnStart: d.start,
+		OnStop:  d.stop,
+	})
+	return d
+}
+
+func (d *Dispatcher) start(context.Context) error {
+	pending, err := loadQueue(d.settings.Queue)
+	if err != nil {
+		return err
+	}
+	d.pending = pending
+	for _, delivery := range pending {
+		d.nextID = max(d.nextID, delivery.ID)
+	}
+	if len(pending) > 0 {
+		d.log.Info(fmt.Sprintf("Resuming %d webhook deliveries", len(pending)))
+	}
+
+	// Subscribing before returning ensures no event published once started is missed
+	_, subscription, err := d.bus.Subscribe("", 0)
+	if err != nil {
+		return err
+	}
+
+	d.wg.Add(2)
+	go d.listen(subscription)
+	go d.run()
+	d.notify()
+	return nil
+}
+
+func (d *Dispatcher) stop(context.Context) error {
+	d.cancel()
+	d.wg.Wait()
+	return nil
+}
+
+// Deliveries returns the pending and recently finished deliveries, most recent first, optionally filtered by status
+func (d *Dispatcher) Deliveries(status Status) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := slices.Clone(d.history)
+	for _, delivery := range d.pending {
+		deliveries = append(deliveries, *delivery)
+	}
+	slices.SortStableFunc(deliveries, func(a, b Delivery) int {
+		return b.UpdatedAt.Compare(a.UpdatedAt)
+	})
+	if status != "" {
+		deliveries = slices.DeleteFunc(deliveries, func(delivery Delivery) bool {
+			return delivery.Status != status
+		})
+	}
+	return deliveries
+}
+
+// listen queues a delivery for every event matching a webhook
+func (d *Dispatcher) listen(subscription *blocks.Subscription) {
+	defer d.wg.Done()
+
+	for {
+		for open := true; open; {
+			select {
+			case <-d.ctx.Done():
+				subscription.Cancel()
+				return
+			case event, ok := <-subscription.Events:
+				if ok {
+					d.enqueue(event)
+				}
+				open = ok
+			}
+		}
+
+		// Resuming from the last event fills the gap when the subscription was dropped for lagging behind
+		var replay []blocks.Event
+		var err error
+		replay, subscription, err = d.bus.Subscribe("", d.lastEventID)
+		if err != nil {
+			return
+		}
+		for _, event := range replay {
+			// The events missed while lagging too far behind are lost for the webhooks
+			if event.Type != blocks.EventReset {
+				d.enqueue(event)
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(event blocks.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastEventID = event.ID
+	now := time.Now().UTC()
+	queued := false
+	for _, webhook := range d.webhooks {
+		if !matches(webhook, event) {
+			continue
+		}
+		d.nextID++
+		d.pending = append(d.pending, &Delivery{
+			ID:          d.nextID,
+			Url:         webhook.Url,
+			Event:       event,
+			Status:      Pending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+		queued = true
+	}
+	if queued {
+		d.persist()
+		d.notify()
+	}
+}
+
+// run sends the deliveries when they are due
+func (d *Dispatcher) run() {
+	defer d.wg.Done()
+
+	timer := time.NewTimer(maxBackoff)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+
+		next := d.deliverDue()
+		timer.Reset(time.Until(next))
+	}
+}
+
+// deliverDue sends the due deliveries and returns when the next one is
+func (d *Dispatcher) deliverDue() time.Time {
+	now := time.Now()
+	d.mu.Lock()
+	due := []Delivery{}
+	for _, delivery := range d.pending {
+		if !delivery.NextAttempt.After(now) {
+			due = append(due, *delivery)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, delivery := range due {
+		if d.ctx.Err() != nil {
+			break
+		}
+		statusCode, err := d.send(delivery)
+		if d.ctx.Err() != nil {
+			// Interrupted by the shutdown, the attempt is made again on the next start
+			break
+		}
+		d.record(delivery.ID, statusCode, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	next := time.Now().Add(maxBackoff)
+	for _, delivery := range d.pending {
+		if delivery.NextAttempt.Before(next) {
+			next = delivery.NextAttempt
+		}
+	}
+	return next
+}
+
+func (d *Dispatcher) send(delivery Delivery) (int, error) {
+	webhook, ok := d.webhook(delivery.Url)
+	if !ok {
+		return 0, fmt.Errorf("webhook %s is no longer configured", delivery.Url)
+	}
+
+	payload, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, webhook.Url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "goblocks-webhooks")
+	req.Header.Set(EventHeader, string(delivery.Event.Type))
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(delivery.ID, 10))
+	if webhook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(webhook.Secret, payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record updates a delivery after an attempt, retrying it later when it failed
+func (d *Dispatcher) record(id uint64, statusCode int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	index := slices.IndexFunc(d.pending, func(delivery *Delivery) bool {
+		return delivery.ID == id
+	})
+	if index < 0 {
+		return
+	}
+	delivery := d.pending[index]
+	delivery.Attempts++
+	delivery.StatusCode = statusCode
+	delivery.UpdatedAt = time.Now().UTC()
+	delivery.Error = ""
+
+	switch {
+	case err == nil:
+		delivery.Status = Delivered
+	case delivery.Attempts >= d.settings.MaxAttempts:
+		delivery.Status = Failed
+		delivery.Error = err.Error()
+		d.log.Error(fmt.Sprintf("Webhook delivery %d to %s failed after %d attempts", delivery.ID, delivery.Url, delivery.Attempts),
+			"webhook.url", delivery.Url,
+			"webhook.delivery", delivery.ID,
+			"webhook.error", delivery.Error,
+		)
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttempt = delivery.UpdatedAt.Add(d.backoff(delivery.Attempts))
+		d.log.Warn(fmt.Sprintf("Webhook delivery %d to %s failed, retrying at %s", delivery.ID, delivery.Url, delivery.NextAttempt.Format(time.RFC3339)),
+			"webhook.url", delivery.Url,
+			"webhook.delivery", delivery.ID,
+			"webhook.error", delivery.Error,
+		)
+	}
+
+	if delivery.Status != Pending {
+		delivery.NextAttempt = time.Time{}
+		d.pending = slices.Delete(d.pending, index, index+1)
+		d.history = append(d.history, *delivery)
+		if len(d.history) > historySize {
+			d.history = d.history[len(d.history)-historySize:]
+		}
+	}
+	d.persist()
+}
+
+// backoff returns the delay before the next attempt, doubled after every failure
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.settings.Backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+func (d *Dispatcher) webhook(url string) (config.Webhook, bool) {
+	for _, webhook := range d.webhooks {
+		if webhook.Url == url {
+			return webhook, true
+		}
+	}
+	return config.Webhook{}, false
+}
+
+// persist saves the pending deliveries, a failure only costs them on the next restart
+func (d *Dispatcher) persist() {
+	err := saveQueue(d.settings.Queue, d.pending)
+	if err != nil {
+		d.log.Error("Unable to persist the webhook queue", "error", err)
+	}
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func matches(webhook config.Webhook, event blocks.Event) bool {
+	if !strings.HasPrefix(event.Path, webhook.Prefix) {
+		return false
+	}
+	return len(webhook.Events) == 0 || slices.Contains(webhook.Events, string(event.Type))
+}
+
+// Sign returns the X-Goblocks-Signature of a payload, the hex encoded HMAC-SHA256 of the body prefixed by "sha256="
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,191 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/fx/fxtest"
+)
+
+// receiver records the deliveries it gets and answers with the next status of its list
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.received = append(rc.received, r)
+	rc.bodies = append(rc.bodies, body)
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status = rc.statuses[0]
+		rc.statuses = rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.received)
+}
+
+func newTestConfig(url string, queue string) *config.Config {
+	cfg := &config.Config{}
+	cfg.Blocks.Events.History = 100
+	cfg.Webhooks = []config.Webhook{{Url: url, Prefix: "docs/", Events: []string{"created", "deleted"}, Secret: "s3cr3t"}}
+	cfg.WebhookDelivery = config.WebhookDelivery{Queue: queue, MaxAttempts: 3, Backoff: 10 * time.Millisecond, Timeout: time.Second}
+	return cfg
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	cfg := newTestConfig(server.URL, "")
+	bus := blocks.NewEventBus(cfg)
+	lc := fxtest.NewLifecycle(t)
+	d := NewDispatcher(lc, cfg, bus, slog.New(slog.DiscardHandler))
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	bus.Publish(blocks.Event{Type: blocks.EventUpdated, Path: "docs/a"})
+	bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "images/b"})
+	bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "docs/a"})
+
+	waitFor(t, func() bool { return len(d.Deliveries(Delivered)) == 1 })
+
+	if rc.count() != 3 {
+		t.Errorf("received %d requests, want 2 failures and a success", rc.count())
+	}
+	delivery := d.Deliveries(Delivered)[0]
+	if delivery.Attempts != 3 || delivery.Event.Path != "docs/a" || delivery.Event.Type != blocks.EventCreated {
+		t.Errorf("delivery = %+v, want the creation of docs/a delivered at the third attempt", delivery)
+	}
+
+	req, body := rc.received[2], rc.bodies[2]
+	if req.Header.Get(SignatureHeader) != Sign("s3cr3t", body) {
+		t.Errorf("%s = %s, want %s", SignatureHeader, req.Header.Get(SignatureHeader), Sign("s3cr3t", body))
+	}
+	if req.Header.Get(EventHeader) != "created" {
+		t.Errorf("%s = %s, want created", EventHeader, req.Header.Get(EventHeader))
+	}
+	event := blocks.Event{}
+	if err := json.Unmarshal(body, &event); err != nil || event.Path != "docs/a" {
+		t.Errorf("payload = %s, want the docs/a event", body)
+	}
+}
+
+func TestDispatcher_GivesUp(t *testing.T) {
+	rc := &receiver{statuses: []int{500, 500, 500}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	cfg := newTestConfig(server.URL, "")
+	bus := blocks.NewEventBus(cfg)
+	lc := fxtest.NewLifecycle(t)
+	d := NewDispatcher(lc, cfg, bus, slog.New(slog.DiscardHandler))
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	bus.Publish(blocks.Event{Type: blocks.EventDeleted, Path: "docs/a"})
+
+	waitFor(t, func() bool { return len(d.Deliveries(Failed)) == 1 })
+	delivery := d.Deliveries("")[0]
+	if delivery.Attempts != 3 || delivery.StatusCode != 500 || delivery.Error == "" {
+		t.Errorf("delivery = %+v, want 3 failed attempts", delivery)
+	}
+}
+
+func TestDispatcher_ResumesPersistedQueue(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "goblocks-test-*")
+	defer os.RemoveAll(dir)
+	queue := filepath.Join(dir, "webhooks.json")
+
+	rc := &receiver{statuses: []int{503}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	cfg := newTestConfig(server.URL, queue)
+	cfg.WebhookDelivery.Backoff = time.Hour
+	bus := blocks.NewEventBus(cfg)
+	lc := fxtest.NewLifecycle(t)
+	d := NewDispatcher(lc, cfg, bus, slog.New(slog.DiscardHandler))
+	lc.RequireStart()
+
+	bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "docs/a"})
+	waitFor(t, func() bool { return rc.count() == 1 })
+	waitFor(t, func() bool { return d.Deliveries(Pending)[0].Attempts == 1 })
+	lc.RequireStop()
+
+	// Restarting with a short backoff retries the delivery saved by the first run
+	cfg.WebhookDelivery.Backoff = 0
+	saved, err := loadQueue(queue)
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("loadQueue() = %v, %v, want the pending delivery", saved, err)
+	}
+	saved[0].NextAttempt = time.Now()
+	saveQueue(queue, saved)
+
+	lc = fxtest.NewLifecycle(t)
+	d = NewDispatcher(lc, cfg, blocks.NewEventBus(cfg), slog.New(slog.DiscardHandler))
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	waitFor(t, func() bool { return len(d.Deliveries(Delivered)) == 1 })
+	if delivery := d.Deliveries(Delivered)[0]; delivery.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2", delivery.Attempts)
+	}
+	waitFor(t, func() bool {
+		saved, _ := loadQueue(queue)
+		return len(saved) == 0
+	})
+}
+
+func TestMatches(t *testing.T) {
+	webhook := config.Webhook{Prefix: "docs/", Events: []string{"created"}}
+	tests := []struct {
+		event blocks.Event
+		want  bool
+	}{
+		{blocks.Event{Type: blocks.EventCreated, Path: "docs/a"}, true},
+		{blocks.Event{Type: blocks.EventUpdated, Path: "docs/a"}, false},
+		{blocks.Event{Type: blocks.EventCreated, Path: "images/a"}, false},
+	}
+	for _, tt := range tests {
+		if got := matches(webhook, tt.event); got != tt.want {
+			t.Errorf("matches(%s %s) = %v, want %v", tt.event.Type, tt.event.Path, got, tt.want)
+		}
+	}
+	if !matches(config.Webhook{}, blocks.Event{Type: blocks.EventDeleted, Path: "a"}) {
+		t.Error("a webhook without filters should match every event")
+	}
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+)
+
+type AclController struct {
+	*BaseController
+	policy *auth.Policy
+}
+
+func NewAclController(policy *auth.Policy) *AclController {
+	return &AclController{
+		NewBaseRoute("GET /acl/{path...}"),
+		policy,
+	}
+}
+
+// ServeHTTP explains the effective permissions of the principal of the request on a path. With the
+// principal and group query parameters, admins of the path get the ones of somebody else.
+func (c *AclController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	path, err := blocks.ValidatePath(path)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	principal := requestPrincipal(r)
+	query := r.URL.Query()
+	if query.Has("principal") || query.Has("group") {
+		if err := authorize(c.policy, r, path, auth.Admin); err != nil {
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		principal = auth.Principal{ID: query.Get("principal"), Groups: query["group"]}
+		if principal.ID == "" {
+			principal.Method = auth.MethodAnonymous
+		}
+	}
+
+	c.JSON(w, H{
+		"path":        path,
+		"principal":   principal,
+		"permissions": c.policy.Explain(principal, path),
+	}, Ok)
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"encoding/json"
+	"goblocks/app/config"
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// openPolicy has no rules and allows everything
+var openPolicy = &auth.Policy{}
+
+func newTestPolicy(t *testing.T) *auth.Policy {
+	policy, err := auth.NewPolicy(&config.Config{Acl: []config.AclRule{
+		{Principals: []string{"*"}, Allow: []string{"read"}},
+		{Path: "marketing", Groups: []string{"marketing"}, Allow: []string{"write", "delete"}},
+		{Path: "legal", Groups: []string{"legal"}, Allow: []string{"admin"}},
+		{Path: "legal", Principals: []string{"*"}, Deny: []string{"read"}},
+		{Path: "legal", Groups: []string{"legal"}, Allow: []string{"read"}},
+		{Path: "marketing/archive", Principals: []string{"*"}, Deny: []string{"delete"}},
+	}})
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+	return policy
+}
+
+func withPrincipal(req *http.Request, id string, groups ...string) *http.Request {
+	return req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{ID: id, Groups: groups, Method: auth.MethodJwt}))
+}
+
+func TestBlockControllers_Acl(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("marketing/launch", strings.NewReader("launch"), "text/plain")
+	manager.Set("marketing/archive/2024", strings.NewReader("2024"), "text/plain")
+	manager.Set("legal/nda", strings.NewReader("nda"), "text/plain")
+	policy := newTestPolicy(t)
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+
+	tests := []struct {
+		name           string
+		controller     http.Handler
+		method         string
+		target         string
+		path           string
+		groups         []string
+		expectedStatus int
+	}{
+		{name: "read", controller: NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, policy, testSigner), method: "GET", target: "/blocks/marketing/launch", path: "marketing/launch", expectedStatus: http.StatusOK},
+		{name: "denied read", controller: NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, policy, testSigner), method: "GET", target: "/blocks/legal/nda", path: "legal/nda", groups: []string{"marketing"}, expectedStatus: http.StatusForbidden},
+		{name: "group read", controller: NewHeadBlockController(manager, policy), method: "HEAD", target: "/blocks/legal/nda", path: "legal/nda", groups: []string{"legal"}, expectedStatus: http.StatusOK},
+		{name: "write", controller: NewWriteBlockController(manager, blocks.NewLocker(), cfg, policy, testSigner), method: "PUT", target: "/blocks/marketing/new", path: "marketing/new", groups: []string{"marketing"}, expectedStatus: http.StatusAccepted},
+		{name: "denied write", controller: NewWriteBlockController(manager, blocks.NewLocker(), cfg, policy, testSigner), method: "PUT", target: "/blocks/legal/new", path: "legal/new", groups: []string{"marketing"}, expectedStatus: http.StatusForbidden},
+		{name: "denied delete below", controller: NewDeleteBlockController(manager, blocks.NewLocker(), policy), method: "DELETE", target: "/blocks/marketing", path: "marketing", groups: []string{"marketing"}, expectedStatus: http.StatusForbidden},
+		{name: "denied move destination", controller: NewBlockActionController(manager, blocks.NewLocker(), policy), method: "POST", target: "/blocks/marketing/launch?action=move&to=legal/launch", path: "marketing/launch", groups: []string{"marketing"}, expectedStatus: http.StatusForbidden},
+		{name: "copy", controller: NewBlockActionController(manager, blocks.NewLocker(), policy), method: "POST", target: "/blocks/marketing/launch?action=copy&to=marketing/copy", path: "marketing/launch", groups: []string{"marketing"}, expectedStatus: http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := withPrincipal(httptest.NewRequest(tt.method, tt.target, strings.NewReader("content")), "ada", tt.groups...)
+			req.SetPathValue("path", tt.path)
+			w := httptest.NewRecorder()
+			tt.controller.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("%s %s status = %d, want %d: %s", tt.method, tt.target, w.Code, tt.expectedStatus, w.Body.String())
+			}
+		})
+	}
+
+	// Listings leave out the blocks the principal may not read
+	req := httptest.NewRequest("GET", "/blocks/?depth=2", nil)
+	req.SetPathValue("path", "")
+	w := httptest.NewRecorder()
+	NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, policy, testSigner).ServeHTTP(w, req)
+	var root blocks.Block
+	json.Unmarshal(w.Body.Bytes(), &root)
+	if len(root.Children) != 1 || root.Children[0].Path != "marketing" {
+		t.Errorf("Children = %+v, want marketing only", root.Children)
+	}
+
+	// Batches are checked operation by operation
+	body := `{"operations": [{"op": "set", "path": "marketing/a", "content": "a"}, {"op": "delete", "path": "legal/nda"}]}`
+	req = withPrincipal(httptest.NewRequest("POST", "/batch", strings.NewReader(body)), "ada", "marketing")
+	w = httptest.NewRecorder()
+	NewBatchController(manager, blocks.NewLocker(), cfg, policy).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST /batch status = %d, want 403: %s", w.Code, w.Body.String())
+	}
+	if _, err := manager.Get("marketing/a", false); err == nil {
+		t.Error("a forbidden batch should apply nothing")
+	}
+}
+
+func TestAclController(t *testing.T) {
+	controller := NewAclController(newTestPolicy(t))
+
+	tests := []struct {
+		name           string
+		target         string
+		groups         []string
+		expectedStatus int
+		expected       map[auth.Permission]bool
+	}{
+		{
+			name:           "own permissions",
+			target:         "/acl/marketing/archive/2024",
+			groups:         []string{"marketing"},
+			expectedStatus: http.StatusOK,
+			expected:       map[auth.Permission]bool{auth.Read: true, auth.Write: true, auth.Delete: false, auth.Admin: false},
+		},
+		{
+			name:           "somebody else as admin",
+			target:         "/acl/legal/nda?principal=bob&group=marketing",
+			groups:         []string{"legal"},
+			expectedStatus: http.StatusOK,
+			expected:       map[auth.Permission]bool{auth.Read: false, auth.Write: false, auth.Delete: false, auth.Admin: false},
+		},
+		{
+			name:           "somebody else without admin",
+			target:         "/acl/marketing?principal=bob",
+			groups:         []string{"marketing"},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := withPrincipal(httptest.NewRequest("GET", tt.target, nil), "ada", tt.groups...)
+			req.SetPathValue("path", strings.TrimPrefix(strings.SplitN(tt.target, "?", 2)[0], "/acl/"))
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("GET %s status = %d, want %d: %s", tt.target, w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expected == nil {
+				return
+			}
+			var response struct {
+				Permissions []auth.Decision `json:"permissions"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &response)
+			for _, decision := range response.Permissions {
+				if decision.Allowed != tt.expected[decision.Permission] {
+					t.Errorf("%s allowed = %v, want %v", decision.Permission, decision.Allowed, tt.expected[decision.Permission])
+				}
+			}
+			if len(response.Permissions) != len(tt.expected) {
+				t.Errorf("Permissions = %+v, want %d decisions", response.Permissions, len(tt.expected))
+			}
+		})
+	}
+}
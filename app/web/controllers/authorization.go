@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"slices"
+)
+
+// requestPrincipal returns the principal of a request, anonymous when it went through no authentication
+func requestPrincipal(r *http.Request) auth.Principal {
+	if principal, ok := auth.PrincipalFrom(r.Context()); ok {
+		return principal
+	}
+	return auth.Principal{Method: auth.MethodAnonymous}
+}
+
+// authorize returns ErrForbidden unless the principal of a request has a permission on a block
+func authorize(policy *auth.Policy, r *http.Request, path string, permission auth.Permission) error {
+	return policy.Check(requestPrincipal(r), path, permission)
+}
+
+// authorizeTree returns ErrForbidden unless the principal of a request has a permission on a whole subtree
+func authorizeTree(policy *auth.Policy, r *http.Request, path string, permission auth.Permission) error {
+	return policy.CheckTree(requestPrincipal(r), path, permission)
+}
+
+// authorizeSigned verifies the signature of a request sent to a pre-signed url, which needs no permission then,
+// otherwise it checks the permission of the principal. It returns the constraints of the signed url if any.
+func authorizeSigned(policy *auth.Policy, signer *auth.Signer, r *http.Request, path string, permission auth.Permission) (auth.SignedUrl, error) {
+	if auth.Signed(r) {
+		return signer.Verify(r, path)
+	}
+	return auth.SignedUrl{}, authorize(policy, r, path, permission)
+}
+
+// readableReferences removes the blocks the principal may not read from a listing, nested children included
+func readableReferences(policy *auth.Policy, principal auth.Principal, refs []blocks.BlockReference) []blocks.BlockReference {
+	refs = slices.DeleteFunc(refs, func(ref blocks.BlockReference) bool {
+		return policy.Check(principal, ref.Path, auth.Read) != nil
+	})
+	for i := range refs {
+		refs[i].Children = readableReferences(policy, principal, refs[i].Children)
+	}
+	return refs
+}
+
+// readableManager fails the reads of the blocks a principal may not read, for the
+// services such as blocks.Resolve reading other blocks than the requested one
+type readableManager struct {
+	blocks.BlockManager
+	policy    *auth.Policy
+	principal auth.Principal
+}
+
+func (m *readableManager) Get(path string, withContent bool) (blocks.Block, error) {
+	if err := m.policy.Check(m.principal, path, auth.Read); err != nil {
+		return blocks.Block{}, err
+	}
+	return m.BlockManager.Get(path, withContent)
+}
+
+// authorizeTransfer checks the permissions of a move or a copy: reading the source subtree and writing the
+// destination one, along with deleting the source of a move and the destination it replaces
+func authorizeTransfer(policy *auth.Policy, r *http.Request, from string, to string, overwrite bool, move bool) error {
+	principal := requestPrincipal(r)
+	if err := policy.CheckTree(principal, from, auth.Read); err != nil {
+		return err
+	}
+	if err := policy.CheckTree(principal, to, auth.Write); err != nil {
+		return err
+	}
+	if move {
+		if err := policy.CheckTree(principal, from, auth.Delete); err != nil {
+			return err
+		}
+	}
+	if overwrite {
+		return policy.CheckTree(principal, to, auth.Delete)
+	}
+	return nil
+}
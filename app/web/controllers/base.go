@@ -86,10 +86,16 @@ var Ok = WithStatus(http.StatusOK)
 var Created = WithStatus(http.StatusCreated)
 var Accepted = WithStatus(http.StatusAccepted)
 var NoContent = WithStatus(http.StatusNoContent)
+var BadRequest = WithStatus(http.StatusBadRequest)
 var NotFound = WithStatus(http.StatusNotFound)
 var Forbidden = WithStatus(http.StatusForbidden)
 var Unauthorized = WithStatus(http.StatusUnauthorized)
+var Conflict = WithStatus(http.StatusConflict)
 var Unprocessable = WithStatus(http.StatusUnprocessableEntity)
+var PreconditionFailed = WithStatus(http.StatusPreconditionFailed)
+var RequestEntityTooLarge = WithStatus(http.StatusRequestEntityTooLarge)
+var NotImplemented = WithStatus(http.StatusNotImplemented)
+var InsufficientStorage = WithStatus(http.StatusInsufficientStorage)
 var AsJson = WithHeader("Content-Type", "application/json")
 
 func WithHeader(h string, v string) Option {
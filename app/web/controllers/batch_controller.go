@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goblocks/app/config"
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"strings"
+)
+
+// MaxBatchOperations bounds the number of operations of a batch, which holds its locks until it is applied
+const MaxBatchOperations = 100
+
+type BatchController struct {
+	*BaseController
+	blockManager blocks.BlockManager
+	locker       *blocks.Locker
+	config       *config.Config
+	policy       *auth.Policy
+}
+
+func NewBatchController(blockManager blocks.BlockManager, locker *blocks.Locker, cfg *config.Config, policy *auth.Policy) *BatchController {
+	return &BatchController{
+		NewBaseRoute("POST /batch"),
+		blockManager,
+		locker,
+		cfg,
+		policy,
+	}
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Content is sent as text unless Encoding is base64
+	Content     string `json:"content"`
+	Encoding    string `json:"encoding"`
+	ContentType string `json:"content_type"`
+	To          string `json:"to"`
+	Overwrite   bool   `json:"overwrite"`
+	// IfMatch is an entity tag as returned in the ETag header, or *
+	IfMatch string `json:"if_match"`
+	// Metadata and Tags replace the ones of the block when given, otherwise they are carried over
+	Metadata map[string]string `json:"metadata"`
+	Tags     []string          `json:"tags"`
+}
+
+func (c *BatchController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, c.config.Http.MaxUploadSize)
+	defer r.Body.Close()
+
+	var request batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		status := BadRequest
+		if errors.As(err, &maxBytesErr) {
+			status = RequestEntityTooLarge
+		}
+		c.Error(w, fmt.Sprintf("Invalid batch: %v", err), status)
+		return
+	}
+	if len(request.Operations) == 0 || len(request.Operations) > MaxBatchOperations {
+		c.Error(w, fmt.Sprintf("A batch holds from 1 to %d operations", MaxBatchOperations), BadRequest)
+		return
+	}
+
+	ops := make([]blocks.Operation, len(request.Operations))
+	paths := []string{}
+	for i, operation := range request.Operations {
+		op, err := parseOperation(operation, writeAuthor(r))
+		if err == nil {
+			err = c.authorize(r, op)
+		}
+		if err != nil {
+			err = &blocks.BatchError{Index: i, Err: err}
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		ops[i] = op
+		paths = append(paths, op.Path)
+		if op.Type == blocks.OpMove {
+			paths = append(paths, op.To)
+		}
+	}
+
+	unlock := c.locker.LockAll(paths...)
+	defer unlock()
+
+	results, err := c.blockManager.Batch(ops)
+	if err != nil {
+		c.JSON(w, H{"error": err.Error(), "results": results}, blockErrorToStatus(err))
+		return
+	}
+	c.JSON(w, H{"results": results}, Accepted)
+}
+
+// authorize checks the permissions of an operation the way the matching single block request does
+func (c *BatchController) authorize(r *http.Request, op blocks.Operation) error {
+	switch op.Type {
+	case blocks.OpSet:
+		return authorize(c.policy, r, op.Path, auth.Write)
+	case blocks.OpDelete:
+		return authorizeTree(c.policy, r, op.Path, auth.Delete)
+	case blocks.OpMove:
+		return authorizeTransfer(c.policy, r, op.Path, op.To, op.Overwrite, true)
+	}
+	return nil
+}
+
+// parseOperation validates the paths of an operation and decodes its content, sets being written by author
+func parseOperation(operation batchOperation, author blocks.WriteOption) (blocks.Operation, error) {
+	path, err := blocks.ValidatePath(operation.Path)
+	if err != nil {
+		return blocks.Operation{}, err
+	}
+	op := blocks.Operation{
+		Type:    blocks.OperationType(operation.Op),
+		Path:    path,
+		IfMatch: strings.Trim(strings.TrimSpace(operation.IfMatch), `"`),
+	}
+
+	switch op.Type {
+	case blocks.OpSet:
+		op.ContentType = operation.ContentType
+		if op.ContentType == "" {
+			op.ContentType = "application/octet-stream"
+		}
+		switch operation.Encoding {
+		case "":
+			op.Content = []byte(operation.Content)
+		case "base64":
+			op.Content, err = base64.StdEncoding.DecodeString(operation.Content)
+			if err != nil {
+				return blocks.Operation{}, blocks.ErrInvalidOperation
+			}
+		default:
+			return blocks.Operation{}, blocks.ErrInvalidOperation
+		}
+		op.Options = []blocks.WriteOption{author}
+		if operation.Metadata != nil {
+			op.Options = append(op.Options, blocks.WithMetadata(operation.Metadata))
+		}
+		if operation.Tags != nil {
+			op.Options = append(op.Options, blocks.WithTags(operation.Tags...))
+		}
+	case blocks.OpMove:
+		op.To, err = blocks.ValidatePath(operation.To)
+		if err != nil {
+			return blocks.Operation{}, err
+		}
+		op.Overwrite = operation.Overwrite
+	}
+	return op, nil
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"encoding/json"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBatchController(t *testing.T) {
+	draftTag := contentETag("draft", "text/plain")
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedResult []blocks.OperationStatus
+		expectedPaths  []string
+		missingPaths   []string
+	}{
+		{
+			name: "applied",
+			body: `{"operations": [
+				{"op": "set", "path": "docs/draft", "content": "v2", "content_type": "text/plain", "if_match": ` + jsonString(draftTag) + `},
+				{"op": "move", "path": "docs/draft", "to": "docs/published", "overwrite": true},
+				{"op": "set", "path": "docs/image", "content": "aW1hZ2U=", "encoding": "base64", "content_type": "image/png"},
+				{"op": "delete", "path": "docs/old"}
+			]}`,
+			expectedStatus: http.StatusAccepted,
+			expectedResult: []blocks.OperationStatus{blocks.OperationApplied, blocks.OperationApplied, blocks.OperationApplied, blocks.OperationApplied},
+			expectedPaths:  []string{"docs/published", "docs/image"},
+			missingPaths:   []string{"docs/draft", "docs/old"},
+		},
+		{
+			name: "failed precondition rolls back",
+			body: `{"operations": [
+				{"op": "delete", "path": "docs/old"},
+				{"op": "set", "path": "docs/draft", "content": "v2", "if_match": "\"unknown\""},
+				{"op": "delete", "path": "docs/draft"}
+			]}`,
+			expectedStatus: http.StatusPreconditionFailed,
+			expectedResult: []blocks.OperationStatus{blocks.OperationRolledBack, blocks.OperationFailed, blocks.OperationSkipped},
+			expectedPaths:  []string{"docs/draft", "docs/old"},
+		},
+		{
+			name: "existing destination",
+			body: `{"operations": [
+				{"op": "move", "path": "docs/draft", "to": "docs/old"}
+			]}`,
+			expectedStatus: http.StatusConflict,
+			expectedResult: []blocks.OperationStatus{blocks.OperationFailed},
+			expectedPaths:  []string{"docs/draft", "docs/old"},
+		},
+		{
+			name:           "unknown operation",
+			body:           `{"operations": [{"op": "rename", "path": "docs/draft"}]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "path traversal",
+			body:           `{"operations": [{"op": "delete", "path": "../etc"}]}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "invalid base64",
+			body:           `{"operations": [{"op": "set", "path": "a", "content": "%%", "encoding": "base64"}]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "no operations",
+			body:           `{"operations": []}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid json",
+			body:           `{"operations":`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := blocks.NewInMemoryBlockManager()
+			manager.Set("docs/draft", strings.NewReader("draft"), "text/plain")
+			manager.Set("docs/old", strings.NewReader("old"), "text/plain")
+			cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024 * 1024}}
+			controller := NewBatchController(manager, blocks.NewLocker(), cfg, openPolicy)
+
+			req := httptest.NewRequest("POST", "/batch", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Status = %d, want %d: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedResult != nil {
+				var response struct {
+					Results []blocks.OperationResult `json:"results"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &response)
+				statuses := []blocks.OperationStatus{}
+				for _, result := range response.Results {
+					statuses = append(statuses, result.Status)
+				}
+				if !slices.Equal(statuses, tt.expectedResult) {
+					t.Errorf("Results = %v, want %v", statuses, tt.expectedResult)
+				}
+			}
+			for _, p := range tt.expectedPaths {
+				if _, err := manager.Get(p, false); err != nil {
+					t.Errorf("Get(%s) error = %v", p, err)
+				}
+			}
+			for _, p := range tt.missingPaths {
+				if _, err := manager.Get(p, false); err != blocks.ErrNotFound {
+					t.Errorf("Get(%s) error = %v, want ErrNotFound", p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchController_SizeLimit(t *testing.T) {
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 10}}
+	controller := NewBatchController(blocks.NewInMemoryBlockManager(), blocks.NewLocker(), cfg, openPolicy)
+
+	req := httptest.NewRequest("POST", "/batch", strings.NewReader(`{"operations": [{"op": "set", "path": "a", "content": "too large"}]}`))
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
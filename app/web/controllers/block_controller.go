@@ -1,24 +1,36 @@
 package controllers
 
 import (
-	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"goblocks/app/config"
+	"goblocks/app/services/auth"
 	"goblocks/app/services/blocks"
-	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type GetBlockController struct {
 	*BaseController
 	blockManager blocks.BlockManager
+	references   *blocks.ReferenceIndex
+	config       *config.Config
+	policy       *auth.Policy
+	signer       *auth.Signer
 }
 
-func NewGetBlockController(blockManager blocks.BlockManager) *GetBlockController {
+func NewGetBlockController(blockManager blocks.BlockManager, references *blocks.ReferenceIndex, cfg *config.Config, policy *auth.Policy, signer *auth.Signer) *GetBlockController {
 	return &GetBlockController{
 		NewBaseRoute("GET /blocks/{path...}"),
 		blockManager,
+		references,
+		cfg,
+		policy,
+		signer,
 	}
 }
 
@@ -29,40 +41,259 @@ func (c *GetBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
+	if _, err := authorizeSigned(c.policy, c.signer, r, path, auth.Read); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	if r.URL.Query().Has("revisions") {
+		revisions, err := c.blockManager.Revisions(path)
+		if err != nil {
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		// The history only changes with a new revision
+		if len(revisions) > 0 {
+			last := revisions[len(revisions)-1].CreatedAt
+			setLastModified(w, last)
+			if notModifiedSince(r, last) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		c.JSON(w, revisions, Ok)
+		return
+	}
+
+	if r.URL.Query().Has("referrers") {
+		c.JSON(w, readableReferences(c.policy, requestPrincipal(r), c.references.Referrers(path)), Ok)
+		return
+	}
+
 	raw := r.URL.Query().Has("raw") || r.URL.Query().Get("format") == "raw"
-	block, err := c.blockManager.Get(path, raw)
-	status := Ok
-	if err != nil {
-		status = blockErrorToStatus(err)
+	revision := 0
+	if r.URL.Query().Has("rev") {
+		revision, err = parseRevision(r.URL.Query().Get("rev"))
+		if err != nil {
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
 	}
 
 	if raw {
+		if revision == 0 && r.URL.Query().Has("resolve") {
+			c.serveResolved(w, r, path)
+			return
+		}
+		c.serveRaw(w, r, path, revision)
+		return
+	}
+
+	if revision > 0 {
+		block, err := c.blockManager.GetRevision(path, revision, false)
 		if err != nil {
-			c.Error(w, err.Error(), status)
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		// Revisions are immutable, unlike the children listed with the current one
+		setWeakETag(w, block)
+		setLastModified(w, block.UpdatedAt)
+		if notModified(r, block) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		w.Header().Set("Content-Type", block.Type)
-		w.WriteHeader(http.StatusOK)
-		io.Copy(w, bytes.NewBuffer(block.Content))
+		c.JSON(w, block, Ok)
+		return
+	}
+
+	opts, depth, err := parseListOptions(r)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	children, err := blocks.Tree(c.blockManager, path, depth, opts)
+	if errors.Is(err, blocks.ErrInvalidCursor) || errors.Is(err, blocks.ErrInvalidListOptions) {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
 
-	block.Children, err = c.blockManager.List(path)
+	block, err := c.blockManager.Get(path, false)
+	status := Ok
+	if err != nil {
+		status = blockErrorToStatus(err)
+	} else {
+		setWeakETag(w, block)
+	}
+	block.Children = readableReferences(c.policy, requestPrincipal(r), children.Items)
+	block.NextCursor = children.NextCursor
 	c.JSON(w, block, status)
 
 }
 
+// parseListOptions reads the depth, limit, cursor, sort, order and tag query parameters
+func parseListOptions(r *http.Request) (blocks.ListOptions, int, error) {
+	query := r.URL.Query()
+	opts := blocks.ListOptions{
+		Cursor: query.Get("cursor"),
+		SortBy: blocks.SortKey(query.Get("sort")),
+		Tags:   query["tag"],
+	}
+
+	depth := 1
+	var err error
+	if query.Has("depth") {
+		depth, err = strconv.Atoi(query.Get("depth"))
+		if err != nil {
+			return opts, 0, blocks.ErrInvalidListOptions
+		}
+	}
+	if query.Has("limit") {
+		opts.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || opts.Limit <= 0 {
+			return opts, 0, blocks.ErrInvalidListOptions
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, 0, blocks.ErrInvalidListOptions
+	}
+
+	opts, err = opts.Validate()
+	return opts, depth, err
+}
+
+// serveRaw streams the content of a block revision, 0 being the current one
+func (c *GetBlockController) serveRaw(w http.ResponseWriter, r *http.Request, path string, revision int) {
+	block, content, err := c.blockManager.Open(path, revision)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	defer content.Close()
+
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since
+	setETag(w, block)
+	setAttributeHeaders(w, block)
+	w.Header().Set("Content-Type", block.Type)
+	http.ServeContent(w, r, "", block.UpdatedAt, content)
+}
+
+func (c *GetBlockController) serveResolved(w http.ResponseWriter, r *http.Request, path string) {
+	block, err := c.blockManager.Get(path, false)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	if !blocks.IsTextType(block.Type) {
+		c.serveRaw(w, r, path, 0)
+		return
+	}
+
+	// Referenced blocks are only embedded when the principal may read them, up to the size of an upload
+	block, err = blocks.Resolve(&readableManager{c.blockManager, c.policy, requestPrincipal(r)}, path, c.config.Http.MaxUploadSize)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", block.Type)
+	w.WriteHeader(http.StatusOK)
+	w.Write(block.Content)
+}
+
+type HeadBlockController struct {
+	*BaseController
+	blockManager blocks.BlockManager
+	policy       *auth.Policy
+}
+
+func NewHeadBlockController(blockManager blocks.BlockManager, policy *auth.Policy) *HeadBlockController {
+	return &HeadBlockController{
+		NewBaseRoute("HEAD /blocks/{path...}"),
+		blockManager,
+		policy,
+	}
+}
+
+func (c *HeadBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	path, err := blocks.ValidatePath(path)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	if err := authorize(c.policy, r, path, auth.Read); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	var block blocks.Block
+	if r.URL.Query().Has("rev") {
+		var revision int
+		revision, err = parseRevision(r.URL.Query().Get("rev"))
+		if err == nil {
+			block, err = c.blockManager.GetRevision(path, revision, false)
+		}
+	} else {
+		block, err = c.blockManager.Get(path, false)
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	setETag(w, block)
+	setAttributeHeaders(w, block)
+	setLastModified(w, block.UpdatedAt)
+	if notModified(r, block) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", block.Type)
+	w.Header().Set("Content-Length", strconv.FormatInt(block.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// ChecksumHeader carries the SHA-256 of the content of a PUT request
+const ChecksumHeader = "X-Block-Checksum"
+
+// MetadataHeaderPrefix starts the headers carrying the metadata of a block, one per key
+const MetadataHeaderPrefix = "X-Block-Meta-"
+
+// TagsHeader carries the comma separated tags of a block
+const TagsHeader = "X-Block-Tags"
+
+// UpdatedByHeader names the author of the revisions a request writes
+const UpdatedByHeader = "X-Block-Updated-By"
+
+// TTLHeader gives the lifetime of a block written by a PUT, in seconds or as a duration such as 1h30m
+const TTLHeader = "X-Block-TTL"
+
+// ExpiresHeader gives the time a block written by a PUT expires, when it has no X-Block-TTL
+const ExpiresHeader = "Expires"
+
+// MaxAttributesPatchSize bounds the body of a PATCH request
+const MaxAttributesPatchSize = 64 * 1024
+
 type WriteBlockController struct {
 	*BaseController
 	blockManager blocks.BlockManager
+	locker       *blocks.Locker
 	config       *config.Config
+	policy       *auth.Policy
+	signer       *auth.Signer
 }
 
-func NewWriteBlockController(blockManager blocks.BlockManager, cfg *config.Config) *WriteBlockController {
+func NewWriteBlockController(blockManager blocks.BlockManager, locker *blocks.Locker, cfg *config.Config, policy *auth.Policy, signer *auth.Signer) *WriteBlockController {
 	return &WriteBlockController{
 		NewBaseRoute("PUT /blocks/{path...}"),
 		blockManager,
+		locker,
 		cfg,
+		policy,
+		signer,
 	}
 }
 
@@ -73,26 +304,236 @@ func (c *WriteBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
-
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, c.config.Http.MaxUploadSize)
-	defer r.Body.Close()
-
-	content, err := io.ReadAll(r.Body)
+	signed, err := authorizeSigned(c.policy, c.signer, r, path, auth.Write)
 	if err != nil {
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
+
+	// Limit request body size
+	maxSize := c.config.Http.MaxUploadSize
+	if signed.MaxSize > 0 && signed.MaxSize < maxSize {
+		maxSize = signed.MaxSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	defer r.Body.Close()
+
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
 	err = blocks.ValidateContentType(contentType)
+	if err == nil && signed.ContentType != "" && !sameMediaType(contentType, signed.ContentType) {
+		err = blocks.ErrInvalidContentType
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	expiry, err := parseExpiry(r.Header, time.Now())
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	unlock := c.locker.Lock(path)
+	defer unlock()
+
+	current, exists, err := currentBlock(c.blockManager, path)
+	if err == nil {
+		err = checkPreconditions(r, current, exists)
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	author := writeAuthor(r)
+	if auth.Signed(r) {
+		author = blocks.WithAuthor(signed.Issuer)
+	}
+	opts := append(parseAttributeHeaders(r.Header), author, expiry)
+	err = c.write(r, path, contentType, opts)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	block, err := c.blockManager.Get(path, false)
 	if err != nil {
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
-	err = c.blockManager.Set(path, content, contentType)
+	setETag(w, block)
+	c.JSON(w, block, Accepted)
+}
+
+// write stores the request body as the new content of a block. With an X-Block-Checksum header
+// the body is verified against it, and an empty body links the content the storage already holds.
+// Signed urls always upload the content, which their size constraint bounds as it is read.
+func (c *WriteBlockController) write(r *http.Request, path string, contentType string, opts []blocks.WriteOption) error {
+	checksum := r.Header.Get(ChecksumHeader)
+	if checksum == "" {
+		return c.blockManager.Set(path, r.Body, contentType, opts...)
+	}
+	checksum = strings.ToLower(checksum)
+	if err := blocks.ValidateChecksum(checksum); err != nil {
+		return err
+	}
+	if r.ContentLength == 0 {
+		if auth.Signed(r) {
+			return blocks.ErrUnknownBlob
+		}
+		return c.blockManager.Link(path, checksum, contentType, opts...)
+	}
+	return c.blockManager.Set(path, blocks.VerifyChecksum(r.Body, checksum), contentType, opts...)
+}
+
+// parseAttributeHeaders reads the X-Block-Meta-* and X-Block-Tags headers of a PUT request.
+// Any metadata header replaces the whole metadata, and X-Block-Tags replaces the tags even when
+// empty, otherwise both are carried over from the current revision.
+func parseAttributeHeaders(header http.Header) []blocks.WriteOption {
+	opts := []blocks.WriteOption{}
+	metadata := map[string]string{}
+	for name, values := range header {
+		if key, ok := strings.CutPrefix(name, MetadataHeaderPrefix); ok {
+			metadata[key] = strings.Join(values, ", ")
+		}
+	}
+	if len(metadata) > 0 {
+		opts = append(opts, blocks.WithMetadata(metadata))
+	}
+	if values, ok := header[TagsHeader]; ok {
+		tags := []string{}
+		for _, tag := range strings.Split(strings.Join(values, ","), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		opts = append(opts, blocks.WithTags(tags...))
+	}
+	return opts
+}
+
+// parseExpiry reads the X-Block-TTL or Expires header of a PUT request, a block written without them never expires
+func parseExpiry(header http.Header, now time.Time) (blocks.WriteOption, error) {
+	if ttl := strings.TrimSpace(header.Get(TTLHeader)); ttl != "" {
+		lifetime, err := parseTTL(ttl)
+		if err != nil {
+			return nil, err
+		}
+		return blocks.WithExpiry(now.Add(lifetime)), nil
+	}
+	if expires := header.Get(ExpiresHeader); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil || !expiresAt.After(now) {
+			return nil, blocks.ErrInvalidExpiry
+		}
+		return blocks.WithExpiry(expiresAt), nil
+	}
+	return blocks.WithExpiry(time.Time{}), nil
+}
+
+// parseTTL reads a positive lifetime in seconds or as a Go duration such as 1h30m
+func parseTTL(ttl string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(ttl)
+	lifetime := time.Duration(seconds) * time.Second
+	if err != nil {
+		lifetime, err = time.ParseDuration(ttl)
+	}
+	if err != nil || lifetime <= 0 {
+		return 0, blocks.ErrInvalidExpiry
+	}
+	return lifetime, nil
+}
+
+// sameMediaType compares the media types of two content types, regardless of their parameters
+func sameMediaType(contentType string, expected string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	expectedType, _, _ := strings.Cut(expected, ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), strings.TrimSpace(expectedType))
+}
+
+// writeAuthor records the author of a request with the revisions it writes, the authenticated
+// principal taking precedence over the X-Block-Updated-By header of anonymous requests
+func writeAuthor(r *http.Request) blocks.WriteOption {
+	if principal, ok := auth.PrincipalFrom(r.Context()); ok && !principal.Anonymous() {
+		return blocks.WithAuthor(principal.ID)
+	}
+	return blocks.WithAuthor(strings.TrimSpace(r.Header.Get(UpdatedByHeader)))
+}
+
+// setAttributeHeaders describes the metadata, tags and expiry of a block with the headers a PUT accepts
+func setAttributeHeaders(w http.ResponseWriter, block blocks.Block) {
+	if !block.ExpiresAt.IsZero() {
+		w.Header().Set(ExpiresHeader, block.ExpiresAt.Format(http.TimeFormat))
+	}
+	for key, value := range block.Metadata {
+		w.Header().Set(MetadataHeaderPrefix+key, value)
+	}
+	if len(block.Tags) > 0 {
+		w.Header().Set(TagsHeader, strings.Join(block.Tags, ","))
+	}
+}
+
+type PatchBlockController struct {
+	*BaseController
+	blockManager blocks.BlockManager
+	locker       *blocks.Locker
+	policy       *auth.Policy
+}
+
+func NewPatchBlockController(blockManager blocks.BlockManager, locker *blocks.Locker, policy *auth.Policy) *PatchBlockController {
+	return &PatchBlockController{
+		NewBaseRoute("PATCH /blocks/{path...}"),
+		blockManager,
+		locker,
+		policy,
+	}
+}
+
+// ServeHTTP changes the metadata and tags of a block with ?meta, recording a new revision of the same content
+func (c *PatchBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	path, err := blocks.ValidatePath(path)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	if !r.URL.Query().Has("meta") {
+		c.Error(w, "Only ?meta can be patched", BadRequest)
+		return
+	}
+	if err := authorize(c.policy, r, path, auth.Write); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAttributesPatchSize)
+	defer r.Body.Close()
+
+	var patch blocks.AttributesPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		status := BadRequest
+		if errors.As(err, &maxBytesErr) {
+			status = RequestEntityTooLarge
+		}
+		c.Error(w, fmt.Sprintf("Invalid patch: %v", err), status)
+		return
+	}
+
+	unlock := c.locker.Lock(path)
+	defer unlock()
+
+	current, exists, err := currentBlock(c.blockManager, path)
+	if err == nil {
+		err = checkPreconditions(r, current, exists)
+	}
+	if err == nil {
+		err = blocks.PatchAttributes(c.blockManager, path, patch, writeAuthor(r))
+	}
 	if err != nil {
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
@@ -103,18 +544,23 @@ func (c *WriteBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
+	setETag(w, block)
 	c.JSON(w, block, Accepted)
 }
 
 type DeleteBlockController struct {
 	*BaseController
 	blockManager blocks.BlockManager
+	locker       *blocks.Locker
+	policy       *auth.Policy
 }
 
-func NewDeleteBlockController(blockManager blocks.BlockManager) *DeleteBlockController {
+func NewDeleteBlockController(blockManager blocks.BlockManager, locker *blocks.Locker, policy *auth.Policy) *DeleteBlockController {
 	return &DeleteBlockController{
 		NewBaseRoute("DELETE /blocks/{path...}"),
 		blockManager,
+		locker,
+		policy,
 	}
 }
 
@@ -125,6 +571,24 @@ func (c *DeleteBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request
 		c.Error(w, err.Error(), blockErrorToStatus(err))
 		return
 	}
+	// The whole subtree goes with the block
+	if err := authorizeTree(c.policy, r, path, auth.Delete); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	unlock := c.locker.Lock(path)
+	defer unlock()
+
+	current, exists, err := currentBlock(c.blockManager, path)
+	if err == nil {
+		err = checkPreconditions(r, current, exists)
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
 	err = c.blockManager.Delete(path)
 	if err != nil {
 		c.Error(w, err.Error(), blockErrorToStatus(err))
@@ -134,13 +598,159 @@ func (c *DeleteBlockController) ServeHTTP(w http.ResponseWriter, r *http.Request
 
 }
 
+type BlockActionController struct {
+	*BaseController
+	blockManager blocks.BlockManager
+	locker       *blocks.Locker
+	policy       *auth.Policy
+}
+
+func NewBlockActionController(blockManager blocks.BlockManager, locker *blocks.Locker, policy *auth.Policy) *BlockActionController {
+	return &BlockActionController{
+		NewBaseRoute("POST /blocks/{path...}"),
+		blockManager,
+		locker,
+		policy,
+	}
+}
+
+func (c *BlockActionController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	path, err := blocks.ValidatePath(path)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	query := r.URL.Query()
+	target := path
+	var run func() error
+	switch action := query.Get("action"); action {
+	case "restore":
+		if err := authorize(c.policy, r, path, auth.Write); err != nil {
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		run = func() error {
+			return c.restore(path, query.Get("rev"), writeAuthor(r))
+		}
+	case "move", "copy":
+		to, overwrite, err := parseDestination(query)
+		if err != nil {
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		transfer := c.blockManager.Copy
+		if action == "move" {
+			transfer = c.blockManager.Move
+		}
+		if err := authorizeTransfer(c.policy, r, path, to, overwrite, action == "move"); err != nil {
+			c.Error(w, err.Error(), blockErrorToStatus(err))
+			return
+		}
+		target = to
+		run = func() error {
+			return transfer(path, to, overwrite)
+		}
+	default:
+		c.Error(w, fmt.Sprintf("Unknown action %q", action), BadRequest)
+		return
+	}
+
+	unlock := c.locker.LockAll(path, target)
+	defer unlock()
+
+	current, exists, err := currentBlock(c.blockManager, path)
+	if err == nil {
+		err = checkPreconditions(r, current, exists)
+	}
+	if err == nil {
+		err = run()
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	block, err := c.blockManager.Get(target, false)
+	if errors.Is(err, blocks.ErrNotFound) && target != path {
+		// A moved or copied subtree root may have no content of its own
+		block, err = blocks.Block{Path: target}, nil
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	setETag(w, block)
+	c.JSON(w, block, Accepted)
+}
+
+func (c *BlockActionController) restore(path string, rev string, author blocks.WriteOption) error {
+	revision, err := parseRevision(rev)
+	if err != nil {
+		return err
+	}
+	return c.blockManager.Restore(path, revision, author)
+}
+
+// parseDestination reads the to and overwrite query parameters of a move or a copy
+func parseDestination(query url.Values) (string, bool, error) {
+	to, err := blocks.ValidatePath(query.Get("to"))
+	if err != nil {
+		return "", false, err
+	}
+	if to == "" {
+		return "", false, blocks.ErrInvalidDestination
+	}
+
+	overwrite := false
+	if query.Has("overwrite") {
+		overwrite, err = strconv.ParseBool(query.Get("overwrite"))
+		if err != nil {
+			return "", false, blocks.ErrInvalidDestination
+		}
+	}
+	return to, overwrite, nil
+}
+
+func parseRevision(rev string) (int, error) {
+	revision, err := strconv.Atoi(rev)
+	if err != nil || revision <= 0 {
+		return 0, blocks.ErrInvalidRevision
+	}
+	return revision, nil
+}
+
 func blockErrorToStatus(err error) Option {
-	if errors.Is(err, blocks.ErrNotFound) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, blocks.ErrNotFound) || errors.Is(err, blocks.ErrUnknownBlob) {
 		return NotFound
-	} else if errors.Is(err, blocks.ErrForbidden) {
+	} else if errors.Is(err, blocks.ErrForbidden) || errors.Is(err, auth.ErrInvalidSignature) || errors.Is(err, auth.ErrSignatureExpired) {
 		return Forbidden
+	} else if errors.Is(err, blocks.ErrReservedPath) {
+		return BadRequest
 	} else if errors.Is(err, blocks.ErrInvalidPath) || errors.Is(err, blocks.ErrPathTooDeep) || errors.Is(err, blocks.ErrInvalidContentType) {
 		return Forbidden
+	} else if errors.As(err, &maxBytesErr) {
+		return RequestEntityTooLarge
+	} else if errors.Is(err, blocks.ErrQuotaExceeded) {
+		return InsufficientStorage
+	} else if errors.Is(err, blocks.ErrAlreadyExists) {
+		return Conflict
+	} else if errors.Is(err, blocks.ErrPreconditionFailed) {
+		return PreconditionFailed
+	} else if errors.Is(err, blocks.ErrInvalidRevision) || errors.Is(err, blocks.ErrInvalidCursor) || errors.Is(err, blocks.ErrInvalidListOptions) || errors.Is(err, blocks.ErrInvalidDestination) {
+		return BadRequest
+	} else if errors.Is(err, blocks.ErrInvalidChecksum) || errors.Is(err, blocks.ErrChecksumMismatch) {
+		return BadRequest
+	} else if errors.Is(err, blocks.ErrInvalidOperation) || errors.Is(err, blocks.ErrInvalidMetadata) || errors.Is(err, blocks.ErrInvalidExpiry) {
+		return BadRequest
+	} else if errors.Is(err, auth.ErrInvalidSignedUrl) {
+		return BadRequest
+	} else if errors.Is(err, blocks.ErrUnsupported) {
+		return NotImplemented
+	} else if errors.Is(err, blocks.ErrDanglingReference) || errors.Is(err, blocks.ErrReferenceCycle) || errors.Is(err, blocks.ErrReferenceTooDeep) || errors.Is(err, blocks.ErrResolvedTooLarge) {
+		return Unprocessable
 	} else {
 		fmt.Println(err.Error())
 		return Unprocessable
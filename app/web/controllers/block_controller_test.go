@@ -2,20 +2,31 @@ package controllers
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"goblocks/app/config"
+	"goblocks/app/services/auth"
 	"goblocks/app/services/blocks"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+// testConfig bounds uploads and resolved contents to 1 KiB
+var testConfig = &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+
 func TestGetBlockController(t *testing.T) {
 	// Setup
 	manager := blocks.NewInMemoryBlockManager()
-	manager.Set("test/block", []byte("Hello, World!"), "text/plain")
+	manager.Set("test/block", strings.NewReader("Hello, World!"), "text/plain")
 
-	controller := NewGetBlockController(manager)
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
 
 	tests := []struct {
 		name           string
@@ -84,7 +95,7 @@ func TestGetBlockController(t *testing.T) {
 
 func TestGetBlockController_PathValidation(t *testing.T) {
 	manager := blocks.NewInMemoryBlockManager()
-	controller := NewGetBlockController(manager)
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
 
 	tests := []struct {
 		name           string
@@ -133,7 +144,7 @@ func TestWriteBlockController(t *testing.T) {
 			MaxUploadSize: 10 * 1024 * 1024, // 10MB
 		},
 	}
-	controller := NewWriteBlockController(manager, cfg)
+	controller := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
 
 	tests := []struct {
 		name           string
@@ -204,7 +215,7 @@ func TestWriteBlockController_SizeLimit(t *testing.T) {
 			MaxUploadSize: 10, // Only 10 bytes
 		},
 	}
-	controller := NewWriteBlockController(manager, cfg)
+	controller := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
 
 	// Try to upload more than the limit
 	largeContent := bytes.Repeat([]byte("a"), 20)
@@ -226,9 +237,9 @@ func TestWriteBlockController_SizeLimit(t *testing.T) {
 
 func TestDeleteBlockController(t *testing.T) {
 	manager := blocks.NewInMemoryBlockManager()
-	manager.Set("test/block", []byte("content"), "text/plain")
+	manager.Set("test/block", strings.NewReader("content"), "text/plain")
 
-	controller := NewDeleteBlockController(manager)
+	controller := NewDeleteBlockController(manager, blocks.NewLocker(), openPolicy)
 
 	// Delete the block
 	req := httptest.NewRequest("DELETE", "/blocks/test/block", nil)
@@ -253,7 +264,7 @@ func TestDeleteBlockController(t *testing.T) {
 
 func TestDeleteBlockController_NotFound(t *testing.T) {
 	manager := blocks.NewInMemoryBlockManager()
-	controller := NewDeleteBlockController(manager)
+	controller := NewDeleteBlockController(manager, blocks.NewLocker(), openPolicy)
 
 	req := httptest.NewRequest("DELETE", "/blocks/nonexistent", nil)
 	req.SetPathValue("path", "nonexistent")
@@ -272,7 +283,7 @@ func TestDeleteBlockController_NotFound(t *testing.T) {
 
 func TestDeleteBlockController_PathValidation(t *testing.T) {
 	manager := blocks.NewInMemoryBlockManager()
-	controller := NewDeleteBlockController(manager)
+	controller := NewDeleteBlockController(manager, blocks.NewLocker(), openPolicy)
 
 	req := httptest.NewRequest("DELETE", "/blocks/../../../etc/passwd", nil)
 	req.SetPathValue("path", "../../../etc/passwd")
@@ -287,3 +298,1067 @@ func TestDeleteBlockController_PathValidation(t *testing.T) {
 		t.Errorf("Status = %d, want %d (Forbidden)", resp.StatusCode, http.StatusForbidden)
 	}
 }
+
+func TestBlockControllers_ReservedPaths(t *testing.T) {
+	manager := blocks.NewFsBlockManager(t.TempDir())
+	manager.Set("a", strings.NewReader("content"), "text/plain")
+	locker := blocks.NewLocker()
+	write := NewWriteBlockController(manager, locker, testConfig, openPolicy, testSigner)
+	remove := NewDeleteBlockController(manager, locker, openPolicy)
+	action := NewBlockActionController(manager, locker, openPolicy)
+
+	tests := []struct {
+		method     string
+		path       string
+		query      string
+		controller http.Handler
+	}{
+		{method: "DELETE", path: blocks.FsBlobsDirName, controller: remove},
+		{method: "DELETE", path: "docs/" + blocks.FsQuarantineDirName, controller: remove},
+		{method: "DELETE", path: "a/" + blocks.FsRevisionsDirName, controller: remove},
+		{method: "PUT", path: "a/" + blocks.FsRevisionsDirName + "/1.data", controller: write},
+		{method: "PUT", path: blocks.FsBatchesDirName + "/x", controller: write},
+		{method: "PUT", path: blocks.FsTempPrefix + "upload", controller: write},
+		{method: "POST", path: blocks.FsBlobsDirName, query: "?action=move&to=stolen", controller: action},
+		{method: "POST", path: "a", query: "?action=copy&to=" + blocks.FsQuarantineDirName, controller: action},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path+tt.query, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/blocks/"+tt.path+tt.query, strings.NewReader("x"))
+			req.Header.Set("Content-Type", "text/plain")
+			req.SetPathValue("path", tt.path)
+			w := httptest.NewRecorder()
+			tt.controller.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body.String())
+			}
+		})
+	}
+
+	// The contents and histories stored next to the blocks are untouched
+	if block, err := manager.Get("a", true); err != nil || string(block.Content) != "content" {
+		t.Errorf("Get(a) = %q, %v, want its content", block.Content, err)
+	}
+	if revisions, err := manager.Revisions("a"); err != nil || len(revisions) != 1 {
+		t.Errorf("Revisions(a) = %v, %v, want its history", revisions, err)
+	}
+}
+
+func TestGetBlockController_Revisions(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("test/block", strings.NewReader("v1"), "text/plain")
+	manager.Set("test/block", strings.NewReader("v2"), "text/plain")
+
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "list revisions",
+			query:          "?revisions",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "get revision raw",
+			query:          "?rev=1&raw",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "v1",
+		},
+		{
+			name:           "get missing revision",
+			query:          "?rev=5",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "get invalid revision",
+			query:          "?rev=abc",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/test/block"+tt.query, nil)
+			req.SetPathValue("path", "test/block")
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if tt.expectedBody != "" {
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != tt.expectedBody {
+					t.Errorf("Body = %s, want %s", string(body), tt.expectedBody)
+				}
+			}
+		})
+	}
+}
+
+func TestGetBlockController_LegacyRevisions(t *testing.T) {
+	// A block written before revisions were recorded, with no .revisions directory
+	tmpDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tmpDir, "legacy"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "legacy", blocks.FsFileName), []byte(`{"content":"SGVsbG8=","content_type":"text/plain","size":5}`), 0644)
+	controller := NewGetBlockController(blocks.NewFsBlockManager(tmpDir), blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+
+	req := httptest.NewRequest("GET", "/blocks/legacy?revisions", nil)
+	req.SetPathValue("path", "legacy")
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	var revisions []blocks.Revision
+	json.Unmarshal(w.Body.Bytes(), &revisions)
+	if w.Code != http.StatusOK || len(revisions) != 1 {
+		t.Errorf("GET ?revisions = %d %s, want the single legacy revision", w.Code, w.Body.String())
+	}
+}
+
+func TestBlockActionController_Restore(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("test/block", strings.NewReader("v1"), "text/plain")
+	manager.Set("test/block", strings.NewReader("v2"), "text/plain")
+
+	controller := NewBlockActionController(manager, blocks.NewLocker(), openPolicy)
+
+	req := httptest.NewRequest("POST", "/blocks/test/block?action=restore&rev=1", nil)
+	req.SetPathValue("path", "test/block")
+
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+
+	block, err := manager.Get("test/block", true)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(block.Content) != "v1" {
+		t.Errorf("Block content = %s, want v1", string(block.Content))
+	}
+}
+
+// contentETag returns the strong ETag of a block without attributes
+func contentETag(content string, contentType string) string {
+	return etag(blocks.Block{Checksum: blocks.Checksum([]byte(content)), Type: contentType})
+}
+
+func TestGetBlockController_ETag(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("test/block", strings.NewReader("Hello, World!"), "text/plain")
+	expectedETag := contentETag("Hello, World!", "text/plain")
+
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+
+	tests := []struct {
+		name           string
+		ifNoneMatch    string
+		expectedStatus int
+	}{
+		{
+			name:           "without validator",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "matching validator",
+			ifNoneMatch:    expectedETag,
+			expectedStatus: http.StatusNotModified,
+		},
+		{
+			name:           "weak matching validator",
+			ifNoneMatch:    `"other", W/` + expectedETag,
+			expectedStatus: http.StatusNotModified,
+		},
+		{
+			name:           "stale validator",
+			ifNoneMatch:    `"other"`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/test/block?raw", nil)
+			req.SetPathValue("path", "test/block")
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if resp.Header.Get("ETag") != expectedETag {
+				t.Errorf("ETag = %s, want %s", resp.Header.Get("ETag"), expectedETag)
+			}
+		})
+	}
+}
+
+func TestBlockControllers_ETagCoversAttributes(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("doc", strings.NewReader("content"), "text/plain")
+	original := contentETag("content", "text/plain")
+	get := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+
+	// The JSON description is tagged apart from the content it describes
+	req := httptest.NewRequest("GET", "/blocks/doc", nil)
+	req.SetPathValue("path", "doc")
+	w := httptest.NewRecorder()
+	get.ServeHTTP(w, req)
+	if w.Header().Get("ETag") != "W/"+original {
+		t.Errorf("JSON ETag = %s, want W/%s", w.Header().Get("ETag"), original)
+	}
+
+	// A metadata update keeps the content but changes the tag
+	patch := NewPatchBlockController(manager, blocks.NewLocker(), openPolicy)
+	req = httptest.NewRequest("PATCH", "/blocks/doc?meta", strings.NewReader(`{"metadata": {"lang": "en"}}`))
+	req.Header.Set("If-Match", original)
+	req.SetPathValue("path", "doc")
+	w = httptest.NewRecorder()
+	patch.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted || w.Header().Get("ETag") == original {
+		t.Fatalf("PATCH ?meta = %d with ETag %s, want 202 with a new tag", w.Code, w.Header().Get("ETag"))
+	}
+
+	req = httptest.NewRequest("PATCH", "/blocks/doc?meta", strings.NewReader(`{"metadata": {"lang": "fr"}}`))
+	req.Header.Set("If-Match", original)
+	req.SetPathValue("path", "doc")
+	w = httptest.NewRecorder()
+	patch.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH ?meta with the tag before the update = %d, want 412", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/blocks/doc?raw", nil)
+	req.Header.Set("If-None-Match", original)
+	req.SetPathValue("path", "doc")
+	w = httptest.NewRecorder()
+	get.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-Block-Meta-Lang") != "en" {
+		t.Errorf("GET ?raw with the tag before the update = %d, want 200 with the new metadata", w.Code)
+	}
+}
+
+func TestWriteBlockController_Preconditions(t *testing.T) {
+	cfg := &config.Config{
+		Http: config.Http{
+			MaxUploadSize: 10 * 1024 * 1024,
+		},
+	}
+	currentETag := contentETag("v1", "text/plain")
+
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{
+			name:           "matching If-Match",
+			headers:        map[string]string{"If-Match": currentETag},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "stale If-Match",
+			headers:        map[string]string{"If-Match": `"stale"`},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "create only on existing block",
+			headers:        map[string]string{"If-None-Match": "*"},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "modified since",
+			headers:        map[string]string{"If-Unmodified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "not modified since",
+			headers:        map[string]string{"If-Unmodified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+			expectedStatus: http.StatusAccepted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := blocks.NewInMemoryBlockManager()
+			manager.Set("test/block", strings.NewReader("v1"), "text/plain")
+			controller := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
+
+			req := httptest.NewRequest("PUT", "/blocks/test/block", bytes.NewBufferString("v2"))
+			req.Header.Set("Content-Type", "text/plain")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			req.SetPathValue("path", "test/block")
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if tt.expectedStatus == http.StatusAccepted {
+				expectedETag := contentETag("v2", "text/plain")
+				if resp.Header.Get("ETag") != expectedETag {
+					t.Errorf("ETag = %s, want %s", resp.Header.Get("ETag"), expectedETag)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteBlockController_Checksum(t *testing.T) {
+	cfg := &config.Config{
+		Http: config.Http{
+			MaxUploadSize: 10 * 1024 * 1024,
+		},
+	}
+	stored := blocks.Checksum([]byte("shared"))
+
+	tests := []struct {
+		name            string
+		content         string
+		checksum        string
+		expectedStatus  int
+		expectedContent string
+	}{
+		{
+			name:            "link stored content",
+			checksum:        stored,
+			expectedStatus:  http.StatusAccepted,
+			expectedContent: "shared",
+		},
+		{
+			name:           "link unknown content",
+			checksum:       blocks.Checksum([]byte("unknown")),
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:            "verified upload",
+			content:         "fresh",
+			checksum:        strings.ToUpper(blocks.Checksum([]byte("fresh"))),
+			expectedStatus:  http.StatusAccepted,
+			expectedContent: "fresh",
+		},
+		{
+			name:           "corrupted upload",
+			content:        "corrupted",
+			checksum:       blocks.Checksum([]byte("fresh")),
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid checksum",
+			checksum:       "../../etc/passwd",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := blocks.NewInMemoryBlockManager()
+			manager.Set("original", strings.NewReader("shared"), "text/plain")
+			controller := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
+
+			req := httptest.NewRequest("PUT", "/blocks/copy", bytes.NewBufferString(tt.content))
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set(ChecksumHeader, tt.checksum)
+			req.SetPathValue("path", "copy")
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			block, err := manager.Get("copy", true)
+			if tt.expectedContent == "" {
+				if !errors.Is(err, blocks.ErrNotFound) {
+					t.Errorf("Get() error = %v, want ErrNotFound", err)
+				}
+				return
+			}
+			if err != nil || string(block.Content) != tt.expectedContent {
+				t.Errorf("Get() = %s, %v, want %s", block.Content, err, tt.expectedContent)
+			}
+		})
+	}
+}
+
+func TestDeleteBlockController_Preconditions(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("test/block", strings.NewReader("content"), "text/plain")
+
+	controller := NewDeleteBlockController(manager, blocks.NewLocker(), openPolicy)
+
+	req := httptest.NewRequest("DELETE", "/blocks/test/block", nil)
+	req.Header.Set("If-Match", `"stale"`)
+	req.SetPathValue("path", "test/block")
+
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if _, err := manager.Get("test/block", false); err != nil {
+		t.Errorf("Block should not be deleted, got error: %v", err)
+	}
+}
+
+func TestGetBlockController_References(t *testing.T) {
+	index := blocks.NewReferenceIndex()
+	manager := blocks.TrackReferences(blocks.NewInMemoryBlockManager(), index)
+	manager.Set("page", strings.NewReader("Hello ::ref(/name)!"), "text/plain")
+	manager.Set("name", strings.NewReader("World"), "text/plain")
+	manager.Set("broken", strings.NewReader("::ref(/missing)"), "text/plain")
+
+	controller := NewGetBlockController(manager, index, testConfig, openPolicy, testSigner)
+
+	tests := []struct {
+		name           string
+		path           string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "resolve references",
+			path:           "page",
+			query:          "?raw&resolve",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Hello World!",
+		},
+		{
+			name:           "raw without resolve",
+			path:           "page",
+			query:          "?raw",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Hello ::ref(/name)!",
+		},
+		{
+			name:           "dangling reference",
+			path:           "broken",
+			query:          "?raw&resolve",
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "referrers",
+			path:           "name",
+			query:          "?referrers",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"path":"page"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/"+tt.path+tt.query, nil)
+			req.SetPathValue("path", tt.path)
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if tt.expectedBody != "" {
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != tt.expectedBody {
+					t.Errorf("Body = %s, want %s", string(body), tt.expectedBody)
+				}
+			}
+		})
+	}
+}
+
+func TestGetBlockController_Range(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("video", strings.NewReader("0123456789"), "video/mp4")
+	currentETag := contentETag("0123456789", "video/mp4")
+
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+
+	tests := []struct {
+		name                string
+		headers             map[string]string
+		expectedStatus      int
+		expectedBody        string
+		expectedContentType string
+	}{
+		{
+			name:                "full content",
+			expectedStatus:      http.StatusOK,
+			expectedBody:        "0123456789",
+			expectedContentType: "video/mp4",
+		},
+		{
+			name:                "single range",
+			headers:             map[string]string{"Range": "bytes=2-4"},
+			expectedStatus:      http.StatusPartialContent,
+			expectedBody:        "234",
+			expectedContentType: "video/mp4",
+		},
+		{
+			name:                "suffix range",
+			headers:             map[string]string{"Range": "bytes=-3"},
+			expectedStatus:      http.StatusPartialContent,
+			expectedBody:        "789",
+			expectedContentType: "video/mp4",
+		},
+		{
+			name:                "multiple ranges",
+			headers:             map[string]string{"Range": "bytes=0-1,8-9"},
+			expectedStatus:      http.StatusPartialContent,
+			expectedContentType: "multipart/byteranges",
+		},
+		{
+			name:                "matching If-Range",
+			headers:             map[string]string{"Range": "bytes=0-0", "If-Range": currentETag},
+			expectedStatus:      http.StatusPartialContent,
+			expectedBody:        "0",
+			expectedContentType: "video/mp4",
+		},
+		{
+			name:                "stale If-Range",
+			headers:             map[string]string{"Range": "bytes=0-0", "If-Range": `"stale"`},
+			expectedStatus:      http.StatusOK,
+			expectedBody:        "0123456789",
+			expectedContentType: "video/mp4",
+		},
+		{
+			name:           "unsatisfiable range",
+			headers:        map[string]string{"Range": "bytes=50-60"},
+			expectedStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blocks/video?raw", nil)
+			req.SetPathValue("path", "video")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusRequestedRangeNotSatisfiable && resp.Header.Get("Accept-Ranges") != "bytes" {
+				t.Errorf("Accept-Ranges = %s, want bytes", resp.Header.Get("Accept-Ranges"))
+			}
+			if tt.expectedContentType != "" && !strings.HasPrefix(resp.Header.Get("Content-Type"), tt.expectedContentType) {
+				t.Errorf("Content-Type = %s, want %s", resp.Header.Get("Content-Type"), tt.expectedContentType)
+			}
+			if tt.expectedBody != "" {
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != tt.expectedBody {
+					t.Errorf("Body = %s, want %s", string(body), tt.expectedBody)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadBlockController(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("doc", strings.NewReader("Hello, World!"), "application/pdf")
+
+	controller := NewHeadBlockController(manager, openPolicy)
+
+	req := httptest.NewRequest("HEAD", "/blocks/doc", nil)
+	req.SetPathValue("path", "doc")
+
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	expectedHeaders := map[string]string{
+		"Content-Type":   "application/pdf",
+		"Content-Length": "13",
+		"Accept-Ranges":  "bytes",
+		"ETag":           contentETag("Hello, World!", "application/pdf"),
+	}
+	for k, v := range expectedHeaders {
+		if resp.Header.Get(k) != v {
+			t.Errorf("%s = %s, want %s", k, resp.Header.Get(k), v)
+		}
+	}
+	if resp.Header.Get("Last-Modified") == "" {
+		t.Error("Last-Modified should be set")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Body should be empty, got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest("HEAD", "/blocks/missing", nil)
+	req.SetPathValue("path", "missing")
+	w = httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestGetBlockController_Children(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("docs", strings.NewReader("index"), "text/plain")
+	manager.Set("docs/a", strings.NewReader("aaa"), "text/plain")
+	manager.Set("docs/b", strings.NewReader("b"), "text/plain")
+	manager.Set("docs/b/nested", strings.NewReader("nested"), "text/plain")
+	manager.Set("docs/c", strings.NewReader("cc"), "text/plain")
+
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+
+	get := func(query string) (int, blocks.Block) {
+		req := httptest.NewRequest("GET", "/blocks/docs"+query, nil)
+		req.SetPathValue("path", "docs")
+		w := httptest.NewRecorder()
+		controller.ServeHTTP(w, req)
+
+		var block blocks.Block
+		json.Unmarshal(w.Body.Bytes(), &block)
+		return w.Code, block
+	}
+
+	status, block := get("?limit=2&sort=size&order=desc")
+	if status != http.StatusOK {
+		t.Fatalf("Status = %d, want %d", status, http.StatusOK)
+	}
+	if len(block.Children) != 2 || block.Children[0].Path != "docs/a" || block.Children[1].Path != "docs/c" {
+		t.Errorf("Children = %+v, want docs/a then docs/c", block.Children)
+	}
+	if block.NextCursor == "" {
+		t.Fatal("NextCursor should be set on a partial page")
+	}
+
+	_, block = get("?limit=2&sort=size&order=desc&depth=2&cursor=" + block.NextCursor)
+	if len(block.Children) != 1 || block.Children[0].Path != "docs/b" {
+		t.Fatalf("Children = %+v, want docs/b", block.Children)
+	}
+	if len(block.Children[0].Children) != 1 || block.Children[0].Children[0].Path != "docs/b/nested" {
+		t.Errorf("Nested children = %+v, want docs/b/nested", block.Children[0].Children)
+	}
+	if block.NextCursor != "" {
+		t.Errorf("NextCursor = %s, want none on the last page", block.NextCursor)
+	}
+
+	for _, query := range []string{"?depth=0", "?limit=-1", "?sort=color", "?cursor=%25%25", "?order=up"} {
+		status, _ := get(query)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: Status = %d, want %d", query, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBlockActionController_MoveAndCopy(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedPaths  []string
+		missingPaths   []string
+	}{
+		{
+			name:           "move",
+			query:          "?action=move&to=docs/published",
+			expectedStatus: http.StatusAccepted,
+			expectedPaths:  []string{"docs/published", "docs/published/child"},
+			missingPaths:   []string{"docs/draft", "docs/draft/child"},
+		},
+		{
+			name:           "copy",
+			query:          "?action=copy&to=archive/draft",
+			expectedStatus: http.StatusAccepted,
+			expectedPaths:  []string{"docs/draft", "archive/draft", "archive/draft/child"},
+		},
+		{
+			name:           "destination exists",
+			query:          "?action=move&to=docs/existing",
+			expectedStatus: http.StatusConflict,
+			expectedPaths:  []string{"docs/draft", "docs/existing"},
+		},
+		{
+			name:           "overwrite destination",
+			query:          "?action=move&to=docs/existing&overwrite=true",
+			expectedStatus: http.StatusAccepted,
+			expectedPaths:  []string{"docs/existing/child"},
+			missingPaths:   []string{"docs/draft"},
+		},
+		{
+			name:           "missing destination",
+			query:          "?action=copy",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "destination inside source",
+			query:          "?action=move&to=docs/draft/child/inner",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := blocks.NewInMemoryBlockManager()
+			manager.Set("docs/draft", strings.NewReader("draft"), "text/plain")
+			manager.Set("docs/draft/child", strings.NewReader("child"), "text/plain")
+			manager.Set("docs/existing", strings.NewReader("existing"), "text/plain")
+
+			controller := NewBlockActionController(manager, blocks.NewLocker(), openPolicy)
+
+			req := httptest.NewRequest("POST", "/blocks/docs/draft"+tt.query, nil)
+			req.SetPathValue("path", "docs/draft")
+
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", w.Code, tt.expectedStatus)
+			}
+			for _, p := range tt.expectedPaths {
+				if _, err := manager.Get(p, false); err != nil {
+					t.Errorf("Get(%s) error = %v", p, err)
+				}
+			}
+			for _, p := range tt.missingPaths {
+				if _, err := manager.Get(p, false); err != blocks.ErrNotFound {
+					t.Errorf("Get(%s) error = %v, want ErrNotFound", p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteBlockController_Attributes(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+	controller := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
+
+	put := func(header http.Header) int {
+		req := httptest.NewRequest("PUT", "/blocks/doc", strings.NewReader("content"))
+		req.Header = header
+		req.SetPathValue("path", "doc")
+		w := httptest.NewRecorder()
+		controller.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	status := put(http.Header{
+		"X-Block-Meta-Author": {"ada"},
+		"X-Block-Meta-Lang":   {"en"},
+		"X-Block-Tags":        {"draft, api"},
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("Status = %d, want %d", status, http.StatusAccepted)
+	}
+	block, _ := manager.Get("doc", false)
+	if block.Metadata["author"] != "ada" || block.Metadata["lang"] != "en" || strings.Join(block.Tags, ",") != "api,draft" {
+		t.Errorf("Attributes = %+v, want author, lang and the api and draft tags", block.Attributes)
+	}
+
+	// Headers left out carry the attributes over, an empty X-Block-Tags clears the tags
+	put(http.Header{"X-Block-Meta-Author": {"grace"}})
+	put(http.Header{"X-Block-Tags": {""}})
+	block, _ = manager.Get("doc", false)
+	if len(block.Metadata) != 1 || block.Metadata["author"] != "grace" || len(block.Tags) != 0 {
+		t.Errorf("Attributes = %+v, want author grace alone without tags", block.Attributes)
+	}
+
+	if status := put(http.Header{"X-Block-Meta-Author": {"a\x01"}}); status != http.StatusBadRequest {
+		t.Errorf("Status with an invalid value = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	req := httptest.NewRequest("HEAD", "/blocks/doc", nil)
+	req.SetPathValue("path", "doc")
+	w := httptest.NewRecorder()
+	NewHeadBlockController(manager, openPolicy).ServeHTTP(w, req)
+	if w.Header().Get("X-Block-Meta-Author") != "grace" {
+		t.Errorf("X-Block-Meta-Author = %q, want grace", w.Header().Get("X-Block-Meta-Author"))
+	}
+}
+
+func TestPatchBlockController(t *testing.T) {
+	tests := []struct {
+		name             string
+		query            string
+		body             string
+		ifMatch          string
+		expectedStatus   int
+		expectedMetadata map[string]string
+		expectedTags     string
+	}{
+		{
+			name:             "patch metadata",
+			query:            "?meta",
+			body:             `{"metadata": {"Reviewer": "grace", "lang": null}}`,
+			expectedStatus:   http.StatusAccepted,
+			expectedMetadata: map[string]string{"author": "ada", "reviewer": "grace"},
+			expectedTags:     "draft",
+		},
+		{
+			name:             "replace tags",
+			query:            "?meta",
+			body:             `{"tags": ["published", "api"]}`,
+			expectedStatus:   http.StatusAccepted,
+			expectedMetadata: map[string]string{"author": "ada", "lang": "en"},
+			expectedTags:     "api,published",
+		},
+		{
+			name:           "stale entity tag",
+			query:          "?meta",
+			body:           `{"tags": []}`,
+			ifMatch:        `"unknown"`,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "invalid key",
+			query:          "?meta",
+			body:           `{"metadata": {"a b": "c"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "without meta",
+			body:           `{"tags": []}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := blocks.NewInMemoryBlockManager()
+			manager.Set("doc", strings.NewReader("content"), "text/plain",
+				blocks.WithMetadata(map[string]string{"author": "ada", "lang": "en"}), blocks.WithTags("draft"))
+			controller := NewPatchBlockController(manager, blocks.NewLocker(), openPolicy)
+
+			req := httptest.NewRequest("PATCH", "/blocks/doc"+tt.query, strings.NewReader(tt.body))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			req.SetPathValue("path", "doc")
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Status = %d, want %d: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusAccepted {
+				return
+			}
+			block, _ := manager.Get("doc", true)
+			if string(block.Content) != "content" || block.Revision != 2 {
+				t.Errorf("Block = %+v, want the same content at revision 2", block)
+			}
+			if fmt.Sprint(block.Metadata) != fmt.Sprint(tt.expectedMetadata) || strings.Join(block.Tags, ",") != tt.expectedTags {
+				t.Errorf("Attributes = %+v, want %v tagged %s", block.Attributes, tt.expectedMetadata, tt.expectedTags)
+			}
+		})
+	}
+}
+
+func TestGetBlockController_TagFilter(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("docs/a", strings.NewReader("a"), "text/plain", blocks.WithTags("draft", "api"))
+	manager.Set("docs/b", strings.NewReader("b"), "text/plain", blocks.WithTags("draft"))
+	manager.Set("docs/c", strings.NewReader("c"), "text/plain")
+
+	controller := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+	req := httptest.NewRequest("GET", "/blocks/docs?tag=draft&tag=api", nil)
+	req.SetPathValue("path", "docs")
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	var block blocks.Block
+	json.Unmarshal(w.Body.Bytes(), &block)
+	if len(block.Children) != 1 || block.Children[0].Path != "docs/a" || strings.Join(block.Children[0].Tags, ",") != "api,draft" {
+		t.Errorf("Children = %+v, want docs/a with its tags", block.Children)
+	}
+}
+
+func TestWriteBlockController_Author(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+	controller := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
+
+	req := httptest.NewRequest("PUT", "/blocks/doc", strings.NewReader("v1"))
+	req.Header.Set(UpdatedByHeader, "ada")
+	req.SetPathValue("path", "doc")
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	var block blocks.Block
+	json.Unmarshal(w.Body.Bytes(), &block)
+	if w.Code != http.StatusAccepted || block.UpdatedBy != "ada" || block.CreatedAt.IsZero() {
+		t.Fatalf("PUT = %d %+v, want a block created by ada", w.Code, block)
+	}
+
+	req = httptest.NewRequest("POST", "/blocks/doc?action=restore&rev=1", nil)
+	req.Header.Set(UpdatedByHeader, "grace")
+	req.SetPathValue("path", "doc")
+	NewBlockActionController(manager, blocks.NewLocker(), openPolicy).ServeHTTP(httptest.NewRecorder(), req)
+
+	restored, _ := manager.Get("doc", false)
+	if restored.Revision != 2 || restored.UpdatedBy != "grace" || !restored.CreatedAt.Equal(block.CreatedAt) {
+		t.Errorf("Restored block = %+v, want revision 2 by grace created with revision 1", restored)
+	}
+
+	// An authenticated principal cannot write as someone else
+	req = httptest.NewRequest("PUT", "/blocks/doc", strings.NewReader("v3"))
+	req.Header.Set(UpdatedByHeader, "ada")
+	req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{ID: "ci", Method: auth.MethodApiKey}))
+	req.SetPathValue("path", "doc")
+	controller.ServeHTTP(httptest.NewRecorder(), req)
+
+	if written, _ := manager.Get("doc", false); written.UpdatedBy != "ci" {
+		t.Errorf("UpdatedBy = %q, want the principal ci", written.UpdatedBy)
+	}
+}
+
+func TestWriteBlockController_Expiry(t *testing.T) {
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+	expires := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name           string
+		header         string
+		value          string
+		expectedStatus int
+		expectedExpiry time.Duration
+	}{
+		{name: "no expiry", expectedStatus: http.StatusAccepted},
+		{name: "seconds", header: TTLHeader, value: "60", expectedStatus: http.StatusAccepted, expectedExpiry: time.Minute},
+		{name: "duration", header: TTLHeader, value: "1h30m", expectedStatus: http.StatusAccepted, expectedExpiry: 90 * time.Minute},
+		{name: "expires", header: ExpiresHeader, value: expires.Format(http.TimeFormat), expectedStatus: http.StatusAccepted, expectedExpiry: 2 * time.Hour},
+		{name: "negative ttl", header: TTLHeader, value: "-5", expectedStatus: http.StatusBadRequest},
+		{name: "invalid ttl", header: TTLHeader, value: "soon", expectedStatus: http.StatusBadRequest},
+		{name: "past expires", header: ExpiresHeader, value: "Mon, 02 Jan 2006 15:04:05 GMT", expectedStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := blocks.NewInMemoryBlockManager()
+			req := httptest.NewRequest("PUT", "/blocks/doc", strings.NewReader("content"))
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			req.SetPathValue("path", "doc")
+			w := httptest.NewRecorder()
+			NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("PUT status = %d, want %d: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if w.Code != http.StatusAccepted {
+				return
+			}
+			block, _ := manager.Get("doc", false)
+			if tt.expectedExpiry == 0 {
+				if !block.ExpiresAt.IsZero() {
+					t.Errorf("ExpiresAt = %v, want none", block.ExpiresAt)
+				}
+				return
+			}
+			if lifetime := time.Until(block.ExpiresAt); lifetime > tt.expectedExpiry || lifetime < tt.expectedExpiry-time.Minute {
+				t.Errorf("ExpiresAt = %v, want about %v from now", block.ExpiresAt, tt.expectedExpiry)
+			}
+
+			req = httptest.NewRequest("HEAD", "/blocks/doc", nil)
+			req.SetPathValue("path", "doc")
+			w = httptest.NewRecorder()
+			NewHeadBlockController(manager, openPolicy).ServeHTTP(w, req)
+			if got := w.Header().Get(ExpiresHeader); got != block.ExpiresAt.Format(http.TimeFormat) {
+				t.Errorf("HEAD Expires = %q, want %q", got, block.ExpiresAt.Format(http.TimeFormat))
+			}
+		})
+	}
+}
+
+func TestGetBlockController_IfModifiedSince(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("doc", strings.NewReader("v1"), "text/plain")
+	block, _ := manager.Get("doc", false)
+	modified := block.UpdatedAt.UTC().Format(http.TimeFormat)
+	before := block.UpdatedAt.Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	get := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, openPolicy, testSigner)
+	head := NewHeadBlockController(manager, openPolicy)
+
+	tests := []struct {
+		name            string
+		method          string
+		query           string
+		ifModifiedSince string
+		expectedStatus  int
+	}{
+		{name: "revision", method: "GET", query: "?rev=1", ifModifiedSince: modified, expectedStatus: http.StatusNotModified},
+		{name: "modified revision", method: "GET", query: "?rev=1", ifModifiedSince: before, expectedStatus: http.StatusOK},
+		{name: "revisions", method: "GET", query: "?revisions", ifModifiedSince: modified, expectedStatus: http.StatusNotModified},
+		{name: "raw", method: "GET", query: "?raw", ifModifiedSince: modified, expectedStatus: http.StatusNotModified},
+		{name: "head", method: "HEAD", ifModifiedSince: modified, expectedStatus: http.StatusNotModified},
+		{name: "modified head", method: "HEAD", ifModifiedSince: before, expectedStatus: http.StatusOK},
+		{name: "listing", method: "GET", ifModifiedSince: modified, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/blocks/doc"+tt.query, nil)
+			req.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			req.SetPathValue("path", "doc")
+			w := httptest.NewRecorder()
+			if tt.method == "HEAD" {
+				head.ServeHTTP(w, req)
+			} else {
+				get.ServeHTTP(w, req)
+			}
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", w.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus == http.StatusOK && tt.query != "" && w.Header().Get("Last-Modified") != modified {
+				t.Errorf("Last-Modified = %q, want %q", w.Header().Get("Last-Modified"), modified)
+			}
+		})
+	}
+}
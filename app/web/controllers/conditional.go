@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"errors"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etag returns the strong entity tag of the content of a block, empty when the block has no checksum
+func etag(block blocks.Block) string {
+	tag := block.ETag()
+	if tag == "" {
+		return ""
+	}
+	return `"` + tag + `"`
+}
+
+func setETag(w http.ResponseWriter, block blocks.Block) {
+	if tag := etag(block); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+}
+
+// setWeakETag tags the JSON description of a block, which matches the content it describes
+// under the weak comparison of If-None-Match only
+func setWeakETag(w http.ResponseWriter, block blocks.Block) {
+	if tag := etag(block); tag != "" {
+		w.Header().Set("ETag", "W/"+tag)
+	}
+}
+
+// setLastModified sends a modification time, blocks without content of their own having none
+func setLastModified(w http.ResponseWriter, updatedAt time.Time) {
+	if !updatedAt.IsZero() {
+		w.Header().Set("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether If-None-Match, or If-Modified-Since without it, allows answering a read with 304
+func notModified(r *http.Request, block blocks.Block) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return matchETag(header, etag(block), false)
+	}
+	return notModifiedSince(r, block.UpdatedAt)
+}
+
+// notModifiedSince reports whether a modification time is not after If-Modified-Since, HTTP dates having no sub-second precision
+func notModifiedSince(r *http.Request, updatedAt time.Time) bool {
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" || updatedAt.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	return err == nil && !updatedAt.Truncate(time.Second).After(since)
+}
+
+// checkPreconditions evaluates If-Match, If-Unmodified-Since and If-None-Match
+// for a state changing request against the current block
+func checkPreconditions(r *http.Request, current blocks.Block, exists bool) error {
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !exists || !matchETag(header, etag(current), true) {
+			return blocks.ErrPreconditionFailed
+		}
+	} else if header := r.Header.Get("If-Unmodified-Since"); header != "" && exists {
+		since, err := http.ParseTime(header)
+		if err == nil && current.UpdatedAt.Truncate(time.Second).After(since) {
+			return blocks.ErrPreconditionFailed
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" && exists {
+		if matchETag(header, etag(current), false) {
+			return blocks.ErrPreconditionFailed
+		}
+	}
+
+	return nil
+}
+
+// currentBlock loads the block a conditional request applies to, a missing block is not an error
+func currentBlock(blockManager blocks.BlockManager, path string) (blocks.Block, bool, error) {
+	block, err := blockManager.Get(path, false)
+	if err != nil {
+		if errors.Is(err, blocks.ErrNotFound) {
+			return blocks.Block{}, false, nil
+		}
+		return blocks.Block{}, false, err
+	}
+	return block, true, nil
+}
+
+// matchETag compares an entity tag against an If-Match/If-None-Match header value
+func matchETag(header string, tag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if tag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heartbeatInterval keeps idle streams alive through proxies
+const heartbeatInterval = 15 * time.Second
+
+type EventsController struct {
+	*BaseController
+	bus    *blocks.EventBus
+	policy *auth.Policy
+}
+
+func NewEventsController(bus *blocks.EventBus, policy *auth.Policy) *EventsController {
+	return &EventsController{
+		NewBaseRoute("GET /events"),
+		bus,
+		policy,
+	}
+}
+
+func (c *EventsController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var last uint64
+	if lastEventID != "" {
+		var err error
+		last, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			c.Error(w, "Invalid Last-Event-ID", BadRequest)
+			return
+		}
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if err := authorize(c.policy, r, strings.Trim(prefix, "/"), auth.Read); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	// The events of the blocks the principal may not read are left out of the stream
+	principal := requestPrincipal(r)
+	readable := func(event blocks.Event) bool {
+		return c.policy.Check(principal, event.Path, auth.Read) == nil
+	}
+
+	replay, subscription, err := c.bus.Subscribe(prefix, last)
+	if err != nil {
+		c.Error(w, err.Error(), WithStatus(http.StatusServiceUnavailable))
+		return
+	}
+	defer subscription.Cancel()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range replay {
+		// A reset tells the client it missed events, whose blocks it has to read again
+		if event.Type != blocks.EventReset && !readable(event) {
+			continue
+		}
+		if writeEvent(w, event) != nil {
+			return
+		}
+	}
+	if controller.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-subscription.Events:
+			if !ok {
+				// Dropped for lagging behind or shutting down: the client resumes with Last-Event-ID
+				return
+			}
+			if readable(event) {
+				err = writeEvent(w, event)
+			}
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event blocks.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"bufio"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEventsController(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Blocks.Events.History = 10
+	bus := blocks.NewEventBus(cfg)
+	missed := bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "docs/a"})
+	bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "images/b"})
+	bus.Publish(blocks.Event{Type: blocks.EventUpdated, Path: "docs/a"})
+
+	server := httptest.NewServer(NewEventsController(bus, openPolicy))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events?prefix=docs/", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(missed.ID-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content-Type = %s, want text/event-stream", resp.Header.Get("Content-Type"))
+	}
+
+	bus.Publish(blocks.Event{Type: blocks.EventDeleted, Path: "docs/a"})
+
+	reader := bufio.NewReader(resp.Body)
+	expected := []string{"created", "updated", "deleted"}
+	for _, want := range expected {
+		event := readEvent(t, reader)
+		if event["event"] != want {
+			t.Errorf("event = %v, want %s", event, want)
+		}
+		if !strings.Contains(event["data"], `"path":"docs/a"`) {
+			t.Errorf("data = %s, want the docs/a event", event["data"])
+		}
+	}
+
+	bus.Close()
+}
+
+func TestEventsController_StaleLastEventID(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Blocks.Events.History = 2
+	bus := blocks.NewEventBus(cfg)
+	defer bus.Close()
+	missed := bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "docs/a"})
+	bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "docs/b"})
+	bus.Publish(blocks.Event{Type: blocks.EventUpdated, Path: "docs/a"})
+
+	server := httptest.NewServer(NewEventsController(bus, openPolicy))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(missed.ID-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The client is told it missed events before the ones still kept are replayed
+	reader := bufio.NewReader(resp.Body)
+	event := readEvent(t, reader)
+	if event["event"] != "reset" || event["id"] != strconv.FormatUint(missed.ID, 10) {
+		t.Errorf("event = %v, want a reset before the oldest event kept", event)
+	}
+	for _, want := range []string{"created", "updated"} {
+		if event := readEvent(t, reader); event["event"] != want {
+			t.Errorf("event = %v, want %s", event, want)
+		}
+	}
+}
+
+func TestEventsController_InvalidLastEventID(t *testing.T) {
+	cfg := &config.Config{}
+	controller := NewEventsController(blocks.NewEventBus(cfg), openPolicy)
+
+	req := httptest.NewRequest("GET", "/events?last_event_id=abc", nil)
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString() error = %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		key, value, _ := strings.Cut(line, ": ")
+		event[key] = value
+	}
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"goblocks/app/config"
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type SignedUrlController struct {
+	*BaseController
+	config *config.Config
+	policy *auth.Policy
+	signer *auth.Signer
+}
+
+func NewSignedUrlController(cfg *config.Config, policy *auth.Policy, signer *auth.Signer) *SignedUrlController {
+	return &SignedUrlController{
+		NewBaseRoute("POST /sign/{path...}"),
+		cfg,
+		policy,
+		signer,
+	}
+}
+
+type signedUrlRequest struct {
+	// Method is GET to download the raw content of the block or PUT to upload it
+	Method string `json:"method"`
+	// Ttl is the lifetime of the url in seconds or as a Go duration, the configured one when empty
+	Ttl         string `json:"ttl"`
+	ContentType string `json:"content_type"`
+	MaxSize     int64  `json:"max_size"`
+}
+
+// ServeHTTP issues a pre-signed url of a block to a principal who may read it, for a download, or write
+// it, for an upload. Whoever holds the url may then send this single kind of request until it expires.
+func (c *SignedUrlController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	path, err := blocks.ValidatePath(path)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAttributesPatchSize)
+	defer r.Body.Close()
+	var request signedUrlRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		c.Error(w, fmt.Sprintf("Invalid signed url request: %v", err), BadRequest)
+		return
+	}
+
+	method := strings.ToUpper(request.Method)
+	permission := auth.Read
+	if method == http.MethodPut {
+		permission = auth.Write
+	} else if request.ContentType != "" || request.MaxSize != 0 {
+		// Downloads have nothing to constrain
+		c.Error(w, auth.ErrInvalidSignedUrl.Error(), blockErrorToStatus(auth.ErrInvalidSignedUrl))
+		return
+	}
+	if err := authorize(c.policy, r, path, permission); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	ttl := c.config.Auth.SignedUrls.Ttl
+	if request.Ttl != "" {
+		ttl, err = parseTTL(request.Ttl)
+	}
+	if err == nil && (ttl <= 0 || ttl > c.config.Auth.SignedUrls.MaxTtl) {
+		err = blocks.ErrInvalidExpiry
+	}
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	signed := auth.SignedUrl{
+		Method:      method,
+		Path:        path,
+		ExpiresAt:   time.Now().Add(ttl).Truncate(time.Second),
+		ContentType: request.ContentType,
+		MaxSize:     request.MaxSize,
+		Issuer:      requestPrincipal(r).ID,
+	}
+	url, err := c.signer.Sign(signed)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	c.JSON(w, H{
+		"url":        url,
+		"method":     signed.Method,
+		"expires_at": signed.ExpiresAt,
+	}, Created)
+}
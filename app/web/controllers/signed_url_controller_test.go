@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"encoding/json"
+	"goblocks/app/config"
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSigner, _ = auth.NewSigner(&config.Config{})
+
+// signedRequest authenticates a request the way the router does, as a signed url principal when it carries a signature
+func signedRequest(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	principal, _ := auth.NewAuthenticator(&config.Config{}).Authenticate(req)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+	req.SetPathValue("path", strings.TrimPrefix(req.URL.Path, "/blocks/"))
+	return req
+}
+
+func TestSignedUrlController(t *testing.T) {
+	manager := blocks.NewInMemoryBlockManager()
+	manager.Set("legal/nda", strings.NewReader("nda"), "text/plain")
+	manager.Set("legal/archive", strings.NewReader("a scan too large for the upload"), "image/png")
+	policy := newTestPolicy(t)
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+	cfg.Auth.SignedUrls = config.SignedUrls{Ttl: time.Minute, MaxTtl: time.Hour}
+	controller := NewSignedUrlController(cfg, policy, testSigner)
+
+	sign := func(t *testing.T, path string, body string, groups ...string) (int, string) {
+		req := withPrincipal(httptest.NewRequest("POST", "/sign/"+path, strings.NewReader(body)), "grace", groups...)
+		req.SetPathValue("path", path)
+		w := httptest.NewRecorder()
+		controller.ServeHTTP(w, req)
+		var response struct {
+			Url string `json:"url"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Url
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		groups         []string
+		expectedStatus int
+	}{
+		{name: "download", path: "legal/nda", body: `{"method": "GET"}`, groups: []string{"legal"}, expectedStatus: http.StatusCreated},
+		{name: "download without read", path: "legal/nda", body: `{"method": "GET"}`, expectedStatus: http.StatusForbidden},
+		{name: "upload without write", path: "legal/new", body: `{"method": "PUT"}`, groups: []string{"marketing"}, expectedStatus: http.StatusForbidden},
+		{name: "constrained download", path: "legal/nda", body: `{"method": "GET", "max_size": 10}`, groups: []string{"legal"}, expectedStatus: http.StatusBadRequest},
+		{name: "other method", path: "legal/nda", body: `{"method": "DELETE"}`, groups: []string{"legal"}, expectedStatus: http.StatusBadRequest},
+		{name: "too long", path: "legal/nda", body: `{"method": "GET", "ttl": "2h"}`, groups: []string{"legal"}, expectedStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, url := sign(t, tt.path, tt.body, tt.groups...); status != tt.expectedStatus {
+				t.Errorf("POST /sign/%s status = %d, want %d", tt.path, status, tt.expectedStatus)
+			} else if status == http.StatusCreated && !strings.HasPrefix(url, "/blocks/"+tt.path+"?") {
+				t.Errorf("url = %q, want a url of the block", url)
+			}
+		})
+	}
+
+	// Nobody but the legal group may read legal/nda, except whoever holds a signed url
+	_, download := sign(t, "legal/nda", `{"method": "GET", "ttl": "30"}`, "legal")
+	get := NewGetBlockController(manager, blocks.NewReferenceIndex(), testConfig, policy, testSigner)
+	w := httptest.NewRecorder()
+	get.ServeHTTP(w, signedRequest("GET", download, ""))
+	if w.Code != http.StatusOK || w.Body.String() != "nda" {
+		t.Errorf("GET %s = %d %q, want the raw content", download, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	get.ServeHTTP(w, signedRequest("GET", strings.Replace(download, "&raw=", "", 1), ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("GET without raw status = %d, want 403", w.Code)
+	}
+
+	_, upload := sign(t, "legal/scan", `{"method": "put", "content_type": "image/png", "max_size": 8}`, "legal")
+	write := NewWriteBlockController(manager, blocks.NewLocker(), cfg, policy, testSigner)
+	uploads := []struct {
+		name           string
+		contentType    string
+		body           string
+		checksum       string
+		expectedStatus int
+	}{
+		{name: "other content type", contentType: "text/plain", body: "scan", expectedStatus: http.StatusForbidden},
+		// Linking a stored content would bypass the size constraint, it has to be uploaded
+		{name: "link", contentType: "image/png", checksum: blocks.Checksum([]byte("a scan too large for the upload")), expectedStatus: http.StatusNotFound},
+		{name: "too large", contentType: "image/png", body: "a large scan", expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "upload", contentType: "image/png", body: "scan", expectedStatus: http.StatusAccepted},
+	}
+	for _, tt := range uploads {
+		t.Run(tt.name, func(t *testing.T) {
+			req := signedRequest("PUT", upload, tt.body)
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.checksum != "" {
+				req.Header.Set(ChecksumHeader, tt.checksum)
+			}
+			w := httptest.NewRecorder()
+			write.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("PUT %s status = %d, want %d: %s", upload, w.Code, tt.expectedStatus, w.Body.String())
+			}
+		})
+	}
+	if block, err := manager.Get("legal/scan", false); err != nil || block.UpdatedBy != "grace" || block.Size != 4 {
+		t.Errorf("Get() = %+v, %v, want the upload authored by the issuer", block, err)
+	}
+
+	// The signature of a download does not grant an upload
+	w = httptest.NewRecorder()
+	write.ServeHTTP(w, signedRequest("PUT", download, "nda"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("PUT %s status = %d, want 403", download, w.Code)
+	}
+}
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"net/http"
+)
+
+type UsageController struct {
+	*BaseController
+	usage  *blocks.Usage
+	policy *auth.Policy
+}
+
+func NewUsageController(usage *blocks.Usage, policy *auth.Policy) *UsageController {
+	return &UsageController{
+		NewBaseRoute("GET /usage/{path...}"),
+		usage,
+		policy,
+	}
+}
+
+// ServeHTTP reports the bytes and blocks stored under a path, along with the quotas applying to it or below it
+func (c *UsageController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	path, err := blocks.ValidatePath(path)
+	if err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	if err := authorize(c.policy, r, path, auth.Read); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+
+	used := c.usage.Of(path)
+	c.JSON(w, H{
+		"path":   path,
+		"bytes":  used.Bytes,
+		"blocks": used.Blocks,
+		"quotas": c.usage.Quotas(path),
+	}, Ok)
+}
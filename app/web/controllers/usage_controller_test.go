@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"encoding/json"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUsageController(t *testing.T) {
+	cfg := &config.Config{Http: config.Http{MaxUploadSize: 1024}}
+	cfg.Blocks.Quotas = []config.Quota{{Path: "marketing", MaxBytes: 10}}
+	usage := blocks.NewUsage(cfg)
+	manager := blocks.EnforceQuotas(blocks.NewInMemoryBlockManager(), usage)
+	manager.Set("marketing/launch", strings.NewReader("launch"), "text/plain")
+	manager.Set("legal/nda", strings.NewReader("nda"), "text/plain")
+
+	// Writing beyond the quota is refused with 507
+	write := NewWriteBlockController(manager, blocks.NewLocker(), cfg, openPolicy, testSigner)
+	req := httptest.NewRequest("PUT", "/blocks/marketing/big", strings.NewReader("0123456789"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.SetPathValue("path", "marketing/big")
+	w := httptest.NewRecorder()
+	write.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("PUT /blocks/marketing/big status = %d, want %d", w.Code, http.StatusInsufficientStorage)
+	}
+
+	controller := NewUsageController(usage, newTestPolicy(t))
+	tests := []struct {
+		name           string
+		path           string
+		groups         []string
+		expectedStatus int
+		expectedUsage  blocks.UsageCount
+		expectedQuotas int
+	}{
+		{name: "quota", path: "marketing", expectedStatus: http.StatusOK, expectedUsage: blocks.UsageCount{Bytes: 6, Blocks: 1}, expectedQuotas: 1},
+		{name: "whole tree", path: "", expectedStatus: http.StatusOK, expectedUsage: blocks.UsageCount{Bytes: 9, Blocks: 2}, expectedQuotas: 1},
+		{name: "without a quota", path: "legal", groups: []string{"legal"}, expectedStatus: http.StatusOK, expectedUsage: blocks.UsageCount{Bytes: 3, Blocks: 1}},
+		{name: "denied read", path: "legal", expectedStatus: http.StatusForbidden},
+		{name: "invalid path", path: "../etc", expectedStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := withPrincipal(httptest.NewRequest("GET", "/usage/"+tt.path, nil), "grace", tt.groups...)
+			req.SetPathValue("path", tt.path)
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("GET /usage/%s status = %d, want %d: %s", tt.path, w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var response struct {
+				blocks.UsageCount
+				Quotas []blocks.QuotaUsage `json:"quotas"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if response.UsageCount != tt.expectedUsage || len(response.Quotas) != tt.expectedQuotas {
+				t.Errorf("GET /usage/%s = %s, want %+v and %d quotas", tt.path, w.Body.String(), tt.expectedUsage, tt.expectedQuotas)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"goblocks/app/services/auth"
+	"goblocks/app/services/webhooks"
+	"net/http"
+)
+
+type WebhookDeliveriesController struct {
+	*BaseController
+	dispatcher *webhooks.Dispatcher
+	policy     *auth.Policy
+}
+
+func NewWebhookDeliveriesController(dispatcher *webhooks.Dispatcher, policy *auth.Policy) *WebhookDeliveriesController {
+	return &WebhookDeliveriesController{
+		NewBaseRoute("GET /admin/webhooks/deliveries"),
+		dispatcher,
+		policy,
+	}
+}
+
+func (c *WebhookDeliveriesController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Deliveries carry the events of every block
+	if err := authorize(c.policy, r, "", auth.Admin); err != nil {
+		c.Error(w, err.Error(), blockErrorToStatus(err))
+		return
+	}
+	status := webhooks.Status(r.URL.Query().Get("status"))
+	switch status {
+	case "", webhooks.Pending, webhooks.Delivered, webhooks.Failed:
+	default:
+		c.Error(w, "Invalid status", BadRequest)
+		return
+	}
+
+	c.JSON(w, c.dispatcher.Deliveries(status), Ok)
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"encoding/json"
+	"goblocks/app/config"
+	"goblocks/app/services/blocks"
+	"goblocks/app/services/webhooks"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/fx/fxtest"
+)
+
+func TestWebhookDeliveriesController(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer receiver.Close()
+
+	cfg := &config.Config{}
+	cfg.Blocks.Events.History = 10
+	cfg.Webhooks = []config.Webhook{{Url: receiver.URL}}
+	cfg.WebhookDelivery = config.WebhookDelivery{MaxAttempts: 1, Timeout: time.Second}
+	bus := blocks.NewEventBus(cfg)
+	lc := fxtest.NewLifecycle(t)
+	dispatcher := webhooks.NewDispatcher(lc, cfg, bus, slog.New(slog.DiscardHandler))
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	bus.Publish(blocks.Event{Type: blocks.EventCreated, Path: "a"})
+	for deadline := time.Now().Add(5 * time.Second); len(dispatcher.Deliveries(webhooks.Failed)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the delivery never failed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	controller := NewWebhookDeliveriesController(dispatcher, openPolicy)
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantCount  int
+	}{
+		{"", http.StatusOK, 1},
+		{"?status=failed", http.StatusOK, 1},
+		{"?status=delivered", http.StatusOK, 0},
+		{"?status=lost", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			controller.ServeHTTP(w, httptest.NewRequest("GET", "/admin/webhooks/deliveries"+tt.query, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			deliveries := []webhooks.Delivery{}
+			json.Unmarshal(w.Body.Bytes(), &deliveries)
+			if len(deliveries) != tt.wantCount {
+				t.Errorf("got %d deliveries, want %d", len(deliveries), tt.wantCount)
+			}
+			if tt.wantCount > 0 && deliveries[0].StatusCode != http.StatusGone {
+				t.Errorf("StatusCode = %d, want %d", deliveries[0].StatusCode, http.StatusGone)
+			}
+		})
+	}
+}
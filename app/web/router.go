@@ -1,8 +1,9 @@
 package web
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
+	"goblocks/app/services/auth"
 	"goblocks/app/web/controllers"
 	"log/slog"
 	"net/http"
@@ -15,18 +16,32 @@ var Routes = fx.Module("router",
 	AsRoute(controllers.NewHomeController),
 	AsRoutes(
 		controllers.NewGetBlockController,
+		controllers.NewHeadBlockController,
 		controllers.NewWriteBlockController,
-		controllers.NewDeleteBlockController),
+		controllers.NewPatchBlockController,
+		controllers.NewDeleteBlockController,
+		controllers.NewBlockActionController,
+		controllers.NewBatchController,
+		controllers.NewEventsController,
+		controllers.NewWebhookDeliveriesController,
+		controllers.NewAclController,
+		controllers.NewSignedUrlController,
+		controllers.NewUsageController),
 	fx.Provide(),
 )
 
-func NewRouter(routes []Route, logger *slog.Logger) *Router {
-	router := http.NewServeMux()
+// NewRouter serves the routes of the shared configuration, and the ones of the tenants to the requests
+// selecting them. Tenants may be nil.
+func NewRouter(routes []Route, authenticator auth.Authenticator, tenants *Tenants, logger *slog.Logger) *Router {
+	return &Router{logger, newServeMux(routes), authenticator, tenants}
+}
+
+func newServeMux(routes []Route) *http.ServeMux {
+	serveMux := http.NewServeMux()
 	for _, route := range routes {
-		router.Handle(route.Pattern(), route)
+		serveMux.Handle(route.Pattern(), route)
 	}
-
-	return &Router{logger, router}
+	return serveMux
 }
 
 type Route interface {
@@ -55,19 +70,16 @@ func AsRoutes(f ...any) fx.Option {
 }
 
 type Router struct {
-	logger   *slog.Logger
-	serveMux *http.ServeMux
+	logger        *slog.Logger
+	serveMux      *http.ServeMux
+	authenticator auth.Authenticator
+	tenants       *Tenants
 }
 
 func (r Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	buf := &responseBuffer{
-		header:     make(http.Header),
-		buffer:     new(bytes.Buffer),
-		statusCode: 0,
-	}
+	rec := &statusRecorder{ResponseWriter: w}
 	start := time.Now()
-
-	shouldPrintOutput := true
+	var serving *Tenant
 
 	defer func() {
 		if err := recover(); err != nil {
@@ -75,66 +87,124 @@ func (r Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				r.logger.ErrorContext(req.Context(), "panic", "recover", err)
 			}
 
-			controllers.Error(w, "Something went wrong")
-			shouldPrintOutput = false
+			// Once the body started streaming the status can no longer be changed
+			if !rec.wroteHeader {
+				controllers.Error(rec, "Something went wrong")
+			}
 		}
 
-		if shouldPrintOutput && (buf.statusCode == 0 || buf.statusCode == http.StatusNotFound) {
-			if buf.buffer.Len() == 0 {
-				controllers.Error(w, "Not found", controllers.NotFound)
-				shouldPrintOutput = false
-			}
+		if !rec.wroteHeader {
+			controllers.Error(rec, "Not found", controllers.NotFound)
 		}
 
+		principal, _ := auth.PrincipalFrom(req.Context())
+		tenant := ""
+		if serving != nil {
+			tenant = serving.Name()
+		}
 		elapsed := float64(time.Since(start).Nanoseconds()) / 100000000
 		r.logger.Info(fmt.Sprintf(
 			"%v %v %v %v",
 			req.Method,
 			req.URL.Path,
-			buf.statusCode,
+			rec.statusCode,
 			elapsed,
 		),
 			"http.method", req.Method,
 			"http.path", req.URL.Path,
 			"http.pattern", req.Pattern,
 			"http.user-agent", req.UserAgent(),
-			"http.status", buf.statusCode,
+			"http.status", rec.statusCode,
+			"http.bytes", rec.written,
 			"http.duration", elapsed,
+			"auth.principal", principal.ID,
+			"auth.method", principal.Method,
+			"tenant", tenant,
 		)
+	}()
 
-		if !shouldPrintOutput {
+	// The tenant is selected before authenticating, so that the credentials of its own configuration apply
+	serveMux := r.serveMux
+	authenticator := r.authenticator
+	var err error
+	if r.tenants != nil {
+		serving, req, err = r.tenants.Select(req)
+		if err != nil {
+			controllers.Error(rec, err.Error(), tenantErrorToStatus(err))
 			return
 		}
+		if serving != nil {
+			authenticator = serving.authenticator
+		}
+	}
 
-		for k, vv := range buf.header {
-			w.Header()[k] = vv
+	principal, err := authenticator.Authenticate(req)
+	if err != nil {
+		rec.Header().Set("WWW-Authenticate", `Bearer realm="goblocks"`)
+		controllers.Error(rec, err.Error(), controllers.Unauthorized)
+		return
+	}
+	req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+	if !principal.Allows(req.Method) {
+		if principal.Anonymous() {
+			rec.Header().Set("WWW-Authenticate", `Bearer realm="goblocks"`)
+			controllers.Error(rec, auth.ErrReadOnly.Error(), controllers.Unauthorized)
+			return
 		}
+		controllers.Error(rec, auth.ErrReadOnly.Error(), controllers.Forbidden)
+		return
+	}
 
-		w.WriteHeader(buf.statusCode)
-		buf.buffer.WriteTo(w)
-	}()
+	if r.tenants != nil {
+		if serving != nil {
+			if err := r.tenants.Admit(serving, principal, r.authenticator, req); err != nil {
+				controllers.Error(rec, err.Error(), tenantErrorToStatus(err))
+				return
+			}
+		} else {
+			serving = r.tenants.BoundTo(principal)
+		}
+		if serving != nil {
+			serveMux = serving.serveMux
+		}
+	}
 
-	r.serveMux.ServeHTTP(buf, req)
+	serveMux.ServeHTTP(rec, req)
 }
 
-type responseBuffer struct {
-	header      http.Header
-	buffer      *bytes.Buffer
+func tenantErrorToStatus(err error) controllers.Option {
+	if errors.Is(err, ErrUnknownTenant) {
+		return controllers.NotFound
+	}
+	return controllers.Forbidden
+}
+
+// statusRecorder passes the response through while keeping track of its status and size for logging
+type statusRecorder struct {
+	http.ResponseWriter
 	statusCode  int
+	written     int64
 	wroteHeader bool
 }
 
-func (rb *responseBuffer) Header() http.Header {
-	return rb.header
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	if !rec.wroteHeader {
+		rec.statusCode = statusCode
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
 }
 
-func (rb *responseBuffer) Write(b []byte) (int, error) {
-	return rb.buffer.Write(b)
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.written += int64(n)
+	return n, err
 }
 
-func (rb *responseBuffer) WriteHeader(statusCode int) {
-	if !rb.wroteHeader {
-		rb.statusCode = statusCode
-		rb.wroteHeader = true
-	}
+// Unwrap gives http.ResponseController access to the underlying writer (flush, deadlines...)
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
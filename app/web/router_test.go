@@ -0,0 +1,136 @@
+package web
+
+import (
+	"goblocks/app/config"
+	"goblocks/app/services/auth"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testRoute struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+func (t testRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) { t.handler(w, r) }
+func (t testRoute) Pattern() string                                  { return t.pattern }
+
+func TestRouter_StreamsResponses(t *testing.T) {
+	router := NewRouter([]Route{
+		testRoute{"GET /stream", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, "first")
+			// The chunk must reach the client before the handler returns
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Errorf("Flush() error = %v", err)
+			}
+			io.WriteString(w, " second")
+		}},
+	}, auth.Anonymous(false), nil, slog.New(slog.DiscardHandler))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+
+	if !w.Flushed {
+		t.Error("Response should have been flushed")
+	}
+	if w.Body.String() != "first second" {
+		t.Errorf("Body = %s, want first second", w.Body.String())
+	}
+}
+
+func TestRouter_NotFoundFallback(t *testing.T) {
+	router := NewRouter([]Route{
+		testRoute{"GET /empty", func(w http.ResponseWriter, r *http.Request) {}},
+	}, auth.Anonymous(false), nil, slog.New(slog.DiscardHandler))
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "handler writing nothing",
+			path:           "/empty",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"error":"Not found"}`,
+		},
+		{
+			name:           "unknown route",
+			path:           "/unknown",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "404 page not found\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", w.Code, tt.expectedStatus)
+			}
+			if w.Body.String() != tt.expectedBody {
+				t.Errorf("Body = %s, want %s", w.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestRouter_Authentication(t *testing.T) {
+	authenticator := auth.Chain(
+		auth.NewApiKeys([]config.ApiKey{
+			{Name: "ci", Hash: auth.HashApiKey("secret")},
+			{Name: "viewer", Hash: auth.HashApiKey("viewer-secret"), ReadOnly: true},
+		}),
+		auth.Anonymous(true),
+	)
+	whoami := func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.PrincipalFrom(r.Context())
+		io.WriteString(w, principal.ID)
+	}
+	router := NewRouter([]Route{
+		testRoute{"GET /whoami", whoami},
+		testRoute{"PUT /whoami", whoami},
+	}, authenticator, nil, slog.New(slog.DiscardHandler))
+
+	tests := []struct {
+		name           string
+		method         string
+		key            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "api key", method: "PUT", key: "secret", expectedStatus: http.StatusOK, expectedBody: "ci"},
+		{name: "invalid api key", method: "GET", key: "guess", expectedStatus: http.StatusUnauthorized},
+		{name: "anonymous read", method: "GET", expectedStatus: http.StatusOK},
+		{name: "anonymous write", method: "PUT", expectedStatus: http.StatusUnauthorized},
+		{name: "read only key write", method: "PUT", key: "viewer-secret", expectedStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/whoami", nil)
+			if tt.key != "" {
+				req.Header.Set(auth.ApiKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Status = %d, want %d: %s", w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if w.Code == http.StatusOK && w.Body.String() != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", w.Body.String(), tt.expectedBody)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate should be set on 401 responses")
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"goblocks/app"
+	"goblocks/app/config"
+	"goblocks/app/services"
+	"goblocks/app/services/auth"
+	"goblocks/app/services/blocks"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxevent"
+)
+
+// TenantPrefix starts the paths of the requests selecting a tenant, as in /t/{tenant}/blocks/...
+const TenantPrefix = "/t/"
+
+var ErrUnknownTenant = errors.New("Unknown Tenant")
+
+// Tenant serves the routes of a tenant, backed by its own block manager and services
+type Tenant struct {
+	config   config.Tenant
+	serveMux *http.ServeMux
+	bus      *blocks.EventBus
+	// authenticator knows the credentials of the tenant configuration, along with the shared ones it keeps
+	authenticator auth.Authenticator
+}
+
+// Tenants selects the tenant of the requests
+type Tenants struct {
+	tenants map[string]*Tenant
+	// order keeps the configuration order, in which hosts and principals are looked up
+	order []*Tenant
+}
+
+// NewTenants builds every configured tenant as an fx application of its own, made of the same services
+// and routes as the shared one with the configuration of the tenant, started and stopped along with it
+func NewTenants(lc fx.Lifecycle, c *config.Config, a *app.App, log *slog.Logger) (*Tenants, error) {
+	// Every configuration is checked before any storage is opened
+	configs := []*config.Config{}
+	storages := map[string]string{storageLocation(c): ""}
+	for _, t := range c.Tenants {
+		cfg, err := c.ForTenant(t)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(configs, func(other *config.Config) bool { return other.Tenant == t.Name }) {
+			return nil, errors.Join(fmt.Errorf("tenant %s is configured twice", t.Name), config.ErrInvalidTenant)
+		}
+		location := storageLocation(cfg)
+		if other, ok := storages[location]; ok && location != "" {
+			return nil, errors.Join(fmt.Errorf("tenant %s shares the storage of %q", t.Name, other), config.ErrInvalidTenant)
+		}
+		storages[location] = t.Name
+		configs = append(configs, cfg)
+	}
+
+	tenants := &Tenants{tenants: map[string]*Tenant{}}
+	for i, cfg := range configs {
+		tenant := &Tenant{config: c.Tenants[i]}
+		tenantLog := log.With("tenant", cfg.Tenant)
+		tenantApp := fx.New(
+			fx.Supply(a),
+			fx.Supply(tenantLog),
+			fx.Supply(cfg),
+			Routes,
+			services.Module,
+			fx.Provide(fx.Annotate(newServeMux, fx.ParamTags(`group:"routes"`))),
+			fx.Populate(&tenant.serveMux, &tenant.bus, &tenant.authenticator),
+			fx.WithLogger(func() fxevent.Logger {
+				return &fxevent.SlogLogger{Logger: tenantLog}
+			}),
+		)
+		if err := tenantApp.Err(); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", cfg.Tenant, err)
+		}
+		lc.Append(fx.Hook{OnStart: tenantApp.Start, OnStop: tenantApp.Stop})
+		tenants.tenants[cfg.Tenant] = tenant
+		tenants.order = append(tenants.order, tenant)
+	}
+	return tenants, nil
+}
+
+// storageLocation identifies the storage of a configuration, empty when it is not shared by anything else
+func storageLocation(c *config.Config) string {
+	storage := c.Blocks.Storage
+	switch storage.Type {
+	case config.InMemory:
+		return ""
+	case config.S3Storage:
+		return fmt.Sprintf("s3://%s/%s/%s", storage.S3.Endpoint, storage.S3.Bucket, strings.Trim(storage.S3.Prefix, "/"))
+	}
+	return fmt.Sprintf("%s://%s", storage.Type, filepath.Clean(storage.Path))
+}
+
+// Select selects the tenant of a request by its path prefix, then its Host header, and returns the request
+// as the tenant serves it. The tenant is nil when the request selects none.
+func (t *Tenants) Select(r *http.Request) (*Tenant, *http.Request, error) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, TenantPrefix); ok {
+		name, path, _ := strings.Cut(rest, "/")
+		tenant, ok := t.tenants[name]
+		if !ok {
+			return nil, r, ErrUnknownTenant
+		}
+		return tenant, withPath(r, "/"+path), nil
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, tenant := range t.order {
+		if slices.ContainsFunc(tenant.config.Hosts, func(h string) bool { return strings.EqualFold(h, host) }) {
+			return tenant, r, nil
+		}
+	}
+	return nil, r, nil
+}
+
+// Admit checks that a principal authenticated by a tenant may use it. A principal bound to another tenant
+// is forbidden, and so is one bound to none coming from the shared credentials, which only the tenants
+// listing it may use. Anonymous principals and signed urls are left to the tenant.
+func (t *Tenants) Admit(tenant *Tenant, principal auth.Principal, shared auth.Authenticator, r *http.Request) error {
+	if principal.Anonymous() || principal.Method == auth.MethodSignedUrl {
+		return nil
+	}
+	if bound := t.BoundTo(principal); bound != nil {
+		if bound != tenant {
+			return blocks.ErrForbidden
+		}
+		return nil
+	}
+	other, err := shared.Authenticate(r)
+	if err == nil && other.Method == principal.Method && other.ID == principal.ID {
+		return blocks.ErrForbidden
+	}
+	return nil
+}
+
+// BoundTo returns the tenant of a principal, nil when none selects it
+func (t *Tenants) BoundTo(principal auth.Principal) *Tenant {
+	if principal.ID == "" && len(principal.Groups) == 0 {
+		return nil
+	}
+	for _, tenant := range t.order {
+		if slices.Contains(tenant.config.Principals, principal.ID) && principal.ID != "" {
+			return tenant
+		}
+		for _, group := range principal.Groups {
+			if slices.Contains(tenant.config.Groups, group) {
+				return tenant
+			}
+		}
+	}
+	return nil
+}
+
+// Close ends the change feeds of every tenant
+func (t *Tenants) Close() {
+	for _, tenant := range t.order {
+		tenant.bus.Close()
+	}
+}
+
+func (t *Tenant) Name() string {
+	return t.config.Name
+}
+
+// withPath returns a shallow copy of a request to another path, like http.StripPrefix
+func withPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"errors"
+	"goblocks/app"
+	"goblocks/app/config"
+	"goblocks/app/services/auth"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/fx/fxtest"
+)
+
+func newTestConfig(tenants ...config.Tenant) *config.Config {
+	c := &config.Config{Http: config.Http{MaxUploadSize: 1024}, Tenants: tenants}
+	c.Blocks.Storage.Type = config.InMemory
+	return c
+}
+
+func TestRouter_Tenants(t *testing.T) {
+	c := newTestConfig(
+		config.Tenant{Name: "acme", Hosts: []string{"blocks.acme.test"}, Groups: []string{"acme"}},
+		config.Tenant{Name: "globex", Config: map[string]any{
+			"blocks": map[string]any{"storage": map[string]any{"type": "fs", "path": t.TempDir()}},
+			// The keys of the tenant replace the shared ones
+			"auth": map[string]any{"api_keys": []any{
+				map[string]any{"name": "hank", "hash": auth.HashApiKey("globex-secret")},
+				map[string]any{"name": "mallory", "hash": auth.HashApiKey("mallory-secret"), "groups": []any{"acme"}},
+			}},
+		}},
+		config.Tenant{Name: "hooli"},
+	)
+	c.Auth.ApiKeys = []config.ApiKey{
+		{Name: "wile", Hash: auth.HashApiKey("acme-secret"), Groups: []string{"acme"}},
+		{Name: "road", Hash: auth.HashApiKey("shared-secret")},
+	}
+	c.Auth.Anonymous = config.AnonymousWrite
+	lc := fxtest.NewLifecycle(t)
+	tenants, err := NewTenants(lc, c, app.NewApp("test"), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("NewTenants() error = %v", err)
+	}
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	authenticator := auth.NewAuthenticator(c)
+	router := NewRouter([]Route{
+		testRoute{"GET /blocks/{path...}", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "shared")
+		}},
+	}, authenticator, tenants, slog.New(slog.DiscardHandler))
+
+	send := func(method string, target string, host string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		if host != "" {
+			req.Host = host
+		}
+		if key != "" {
+			req.Header.Set(auth.ApiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("PUT", "/t/acme/blocks/doc", "", "", "acme doc"); w.Code != http.StatusAccepted {
+		t.Fatalf("PUT /t/acme/blocks/doc status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := send("PUT", "/t/globex/blocks/doc", "", "", "globex doc"); w.Code != http.StatusAccepted {
+		t.Fatalf("PUT /t/globex/blocks/doc status = %d: %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name           string
+		target         string
+		host           string
+		key            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "path prefix", target: "/t/acme/blocks/doc?raw", expectedStatus: http.StatusOK, expectedBody: "acme doc"},
+		{name: "isolated storage", target: "/t/globex/blocks/doc?raw", expectedStatus: http.StatusOK, expectedBody: "globex doc"},
+		{name: "host", target: "/blocks/doc?raw", host: "blocks.acme.test:8000", expectedStatus: http.StatusOK, expectedBody: "acme doc"},
+		{name: "principal", target: "/blocks/doc?raw", key: "acme-secret", expectedStatus: http.StatusOK, expectedBody: "acme doc"},
+		{name: "shared", target: "/blocks/doc?raw", expectedStatus: http.StatusOK, expectedBody: "shared"},
+		{name: "shared principal", target: "/blocks/doc?raw", key: "shared-secret", expectedStatus: http.StatusOK, expectedBody: "shared"},
+		{name: "principal of another tenant", target: "/t/hooli/blocks/doc?raw", key: "acme-secret", expectedStatus: http.StatusForbidden},
+		{name: "principal of another tenant by host", target: "/blocks/doc?raw", host: "blocks.acme.test", key: "shared-secret", expectedStatus: http.StatusForbidden},
+		{name: "unbound shared principal", target: "/t/hooli/blocks/doc?raw", key: "shared-secret", expectedStatus: http.StatusForbidden},
+		{name: "tenant key", target: "/t/globex/blocks/doc?raw", key: "globex-secret", expectedStatus: http.StatusOK, expectedBody: "globex doc"},
+		{name: "tenant key bound to another tenant", target: "/t/globex/blocks/doc?raw", key: "mallory-secret", expectedStatus: http.StatusForbidden},
+		{name: "tenant key without tenant", target: "/blocks/doc?raw", key: "globex-secret", expectedStatus: http.StatusUnauthorized},
+		{name: "tenant key on another tenant", target: "/t/acme/blocks/doc?raw", key: "globex-secret", expectedStatus: http.StatusUnauthorized},
+		{name: "shared key replaced by the tenant", target: "/t/globex/blocks/doc?raw", key: "acme-secret", expectedStatus: http.StatusUnauthorized},
+		{name: "unknown tenant", target: "/t/initech/blocks/doc?raw", expectedStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send("GET", tt.target, tt.host, tt.key, "")
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("GET %s status = %d, want %d: %s", tt.target, w.Code, tt.expectedStatus, w.Body.String())
+			}
+			if tt.expectedBody != "" && w.Body.String() != tt.expectedBody {
+				t.Errorf("Body = %q, want %q", w.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestNewTenants_Config(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name          string
+		config        *config.Config
+		expectedError error
+	}{
+		{name: "invalid name", config: newTestConfig(config.Tenant{Name: "Acme"}), expectedError: config.ErrInvalidTenant},
+		{name: "twice", config: newTestConfig(config.Tenant{Name: "acme"}, config.Tenant{Name: "acme"}), expectedError: config.ErrInvalidTenant},
+		{name: "shared storage", config: newTestConfig(
+			config.Tenant{Name: "acme", Config: map[string]any{"blocks": map[string]any{"storage": map[string]any{"type": "bolt", "path": dir + "/blocks.db"}}}},
+			config.Tenant{Name: "globex", Config: map[string]any{"blocks": map[string]any{"storage": map[string]any{"type": "bolt", "path": dir + "/./blocks.db"}}}},
+		), expectedError: config.ErrInvalidTenant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTenants(fxtest.NewLifecycle(t), tt.config, app.NewApp("test"), slog.New(slog.DiscardHandler))
+			if !errors.Is(err, tt.expectedError) {
+				t.Errorf("NewTenants() error = %v, want %v", err, tt.expectedError)
+			}
+		})
+	}
+
+	// The overrides of a tenant leave the shared configuration untouched, and its storage defaults to one of its own
+	c := newTestConfig()
+	c.Blocks.Storage.Type = config.Fs
+	c.Blocks.Storage.Path = "./data/"
+	c.Acl = []config.AclRule{{Principals: []string{"*"}, Allow: []string{"read"}}, {Path: "docs", Allow: []string{"write"}}}
+	tenant, err := c.ForTenant(config.Tenant{Name: "acme", Config: map[string]any{
+		"acl":  []any{map[string]any{"path": "acme", "groups": []any{"acme"}, "allow": []any{"admin"}}},
+		"http": map[string]any{"max_upload_size": 2048},
+	}})
+	if err != nil {
+		t.Fatalf("ForTenant() error = %v", err)
+	}
+	if tenant.Tenant != "acme" || tenant.Blocks.Storage.Path != "data.acme" || tenant.Http.MaxUploadSize != 2048 {
+		t.Errorf("ForTenant() = %+v, want the overrides and a storage of its own", tenant)
+	}
+	if len(tenant.Acl) != 1 || tenant.Acl[0].Path != "acme" {
+		t.Errorf("Acl = %+v, want the rules of the tenant only", tenant.Acl)
+	}
+	if len(c.Acl) != 2 || c.Acl[0].Path != "" || c.Http.MaxUploadSize != 1024 {
+		t.Errorf("the shared configuration changed to %+v", c)
+	}
+}
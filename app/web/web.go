@@ -1,6 +1,7 @@
 package web
 
 import (
+	"goblocks/app/services/blocks"
 	"net/http"
 
 	"go.uber.org/fx"
@@ -10,10 +11,15 @@ var Module = fx.Module("web",
 	Routes,
 	fx.Provide(
 		NewHTTPServer,
+		NewTenants,
 		fx.Annotate(
 			NewRouter,
 			fx.ParamTags(`group:"routes"`),
 		),
 	),
-	fx.Invoke(func(*http.Server) {}),
+	fx.Invoke(func(srv *http.Server, bus *blocks.EventBus, tenants *Tenants) {
+		// Change feeds never end on their own, close them so Shutdown does not wait for them
+		srv.RegisterOnShutdown(bus.Close)
+		srv.RegisterOnShutdown(tenants.Close)
+	}),
 )